@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"myleveldb/comparer"
 	error2 "myleveldb/error"
 	"myleveldb/memdb"
 )
@@ -25,10 +26,18 @@ batch写入的entry格式
 | 1byte	kt |  varint keylen	 |     	   key         |  varint vlen  |        value        |
 /----------/-----------------/---------------------/---------------/---------------------/
 
+非default family的entry, kt的最高位置为1, 并在kt之后写入family id
+
+/----------------/------------------/-----------------/---------/---------------/---------/
+| 1byte 0x80|kt  | varint family id |  varint keylen  |   key   |  varint vlen  |  value  |
+/----------------/------------------/-----------------/---------/---------------/---------/
+
 **/
 
 const (
 	batchHeaderLen = 12
+
+	batchFamilyFlag = 0x80 // kt最高位, 代表entry带有family id
 )
 
 type Batch struct {
@@ -40,6 +49,7 @@ type Batch struct {
 
 // BatchIndex 索引
 type BatchIndex struct {
+	Family   uint32
 	KeyType  keyType
 	KeyPos   int
 	KeyLen   int
@@ -47,26 +57,31 @@ type BatchIndex struct {
 	ValueLen int
 }
 
+func NewBatch() *Batch {
+	return &Batch{data: bytes.NewBuffer(nil)}
+}
+
 func (bi *BatchIndex) key(data []byte) []byte {
-	return data[bi.KeyPos:bi.KeyLen]
+	return data[bi.KeyPos : bi.KeyPos+bi.KeyLen]
 }
 
 func (bi *BatchIndex) value(data []byte) []byte {
-	return data[bi.ValuePos:bi.ValueLen]
+	return data[bi.ValuePos : bi.ValuePos+bi.ValueLen]
 }
 
 func (b *Batch) BatchLen() uint32 {
 	return uint32(len(b.index))
 }
 
-func (b *Batch) appendEntry(keyType keyType, key, value []byte) {
+func (b *Batch) appendEntry(family uint32, keyType keyType, key, value []byte) {
 
-	n := 1 + binary.MaxVarintLen32 + len(key)
+	n := 1 + binary.MaxVarintLen32 + binary.MaxVarintLen32 + len(key)
 	if keyType == keyTypeVal {
 		n += binary.MaxVarintLen32 + len(value)
 	}
 
 	batchIndex := BatchIndex{
+		Family:  family,
 		KeyType: keyType,
 		KeyPos:  0,
 		KeyLen:  len(key),
@@ -79,14 +94,23 @@ func (b *Batch) appendEntry(keyType keyType, key, value []byte) {
 
 	o := len(data)
 
-	// 写入keytype, 并更新最后的下标
-	b.data.WriteByte(byte(keyType))
-	o++
-
 	scratch := b.scratch[:]
 
+	// 写入keytype, 并更新最后的下标, 非default family还需要写入family id
+	var m int
+	if family != defaultColumnFamilyID {
+		b.data.WriteByte(byte(keyType) | batchFamilyFlag)
+		o++
+		m = binary.PutUvarint(scratch, uint64(family))
+		m, _ = b.data.Write(scratch[:m])
+		o += m
+	} else {
+		b.data.WriteByte(byte(keyType))
+		o++
+	}
+
 	// 写入keylen, 并更新最后的下标
-	m := binary.PutUvarint(scratch, uint64(len(key)))
+	m = binary.PutUvarint(scratch, uint64(len(key)))
 	m, _ = b.data.Write(scratch[:m])
 	o += m
 
@@ -98,10 +122,12 @@ func (b *Batch) appendEntry(keyType keyType, key, value []byte) {
 
 	if keyType == keyTypeVal {
 		scratch = b.scratch[:]
-		m = binary.PutVarint(scratch, int64(len(value)))
+		m = binary.PutUvarint(scratch, uint64(len(value)))
+		m, _ = b.data.Write(scratch[:m])
 		o += m
 		batchIndex.ValuePos = o
 		batchIndex.ValueLen = len(value)
+		b.data.Write(value)
 	}
 
 	b.internalLen += len(key) + len(value) + 8 // 更新在memtable占用的bytes大小
@@ -111,11 +137,65 @@ func (b *Batch) appendEntry(keyType keyType, key, value []byte) {
 }
 
 func (b *Batch) Put(key, value []byte) {
-	b.appendEntry(keyTypeVal, key, value)
+	b.appendEntry(defaultColumnFamilyID, keyTypeVal, key, value)
 }
 
 func (b *Batch) Delete(key []byte) {
-	b.appendEntry(keyTypeDel, key, nil)
+	b.appendEntry(defaultColumnFamilyID, keyTypeDel, key, nil)
+}
+
+// PutCF 写入到指定的family, 同一个batch中不同family的写入是原子的
+func (b *Batch) PutCF(cf *ColumnFamily, key, value []byte) {
+	b.appendEntry(cf.id, keyTypeVal, key, value)
+}
+
+// DeleteCF 删除指定family中的key
+func (b *Batch) DeleteCF(cf *ColumnFamily, key []byte) {
+	b.appendEntry(cf.id, keyTypeDel, key, nil)
+}
+
+// 每个family在memdb中需要占用的bytes大小
+func (b *Batch) familyLen() map[uint32]int {
+	need := make(map[uint32]int, 1)
+	for i := range b.index {
+		bi := &b.index[i]
+		need[bi.Family] += bi.KeyLen + bi.ValueLen + 8
+	}
+	return need
+}
+
+// 从后往前查找batch中family的key最后一次的写入, 用于事务读取自己的写入
+func (b *Batch) get(family uint32, cmp comparer.BasicComparer, key []byte) (value []byte, kt keyType, found bool) {
+	data := b.data.Bytes()
+	for i := len(b.index) - 1; i >= 0; i-- {
+		bi := &b.index[i]
+		if bi.Family == family && cmp.Compare(bi.key(data), key) == 0 {
+			return bi.value(data), bi.KeyType, true
+		}
+	}
+	return nil, 0, false
+}
+
+// batch当前的写入位置, 用于事务的savepoint
+type batchMark struct {
+	dataLen     int
+	indexLen    int
+	internalLen int
+}
+
+func (b *Batch) mark() batchMark {
+	return batchMark{
+		dataLen:     b.data.Len(),
+		indexLen:    len(b.index),
+		internalLen: b.internalLen,
+	}
+}
+
+// 丢弃mark之后写入的entry
+func (b *Batch) rollbackTo(m batchMark) {
+	b.data.Truncate(m.dataLen)
+	b.index = b.index[:m.indexLen]
+	b.internalLen = m.internalLen
 }
 
 func (b *Batch) reset() {
@@ -126,25 +206,25 @@ func (b *Batch) reset() {
 
 func writeBatchWithHeader(writer io.Writer, seq uint64, b *Batch) error {
 
-	header := make([]byte, batchHeaderLen)
+	// header和batch必须作为一个完整的chunk写入journal, 否则replay时无法按chunk解析
+	chunk := make([]byte, batchHeaderLen+b.data.Len())
 
-	binary.LittleEndian.PutUint64(header, seq)
-	binary.LittleEndian.PutUint32(header[8:], b.BatchLen())
+	binary.LittleEndian.PutUint64(chunk, seq)
+	binary.LittleEndian.PutUint32(chunk[8:], b.BatchLen())
+	copy(chunk[batchHeaderLen:], b.data.Bytes())
 
-	_, err := writer.Write(header)
-	if err != nil {
-		return err
-	}
-
-	_, err = writer.Write(b.data.Bytes())
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := writer.Write(chunk)
+	return err
 
 }
 
-func decodeBatchToMem(chunk []byte, expectSeq uint64, memDb *memdb.MemDB) (seq uint64, batchLen int, err error) {
+// getMem返回family对应的memdb, 返回nil代表跳过该family的entry
+func decodeBatchToMem(chunk []byte, expectSeq uint64, getMem func(family uint32) *memdb.MemDB) (seq uint64, batchLen int, err error) {
+
+	if len(chunk) < batchHeaderLen {
+		err = fmt.Errorf("batch decode, chunk len less than header")
+		return
+	}
 
 	header := chunk[:batchHeaderLen]
 
@@ -158,7 +238,11 @@ func decodeBatchToMem(chunk []byte, expectSeq uint64, memDb *memdb.MemDB) (seq u
 
 	data := chunk[batchHeaderLen:]
 
-	err = decodeBatch(data, batchLen, func(idx int, key []byte, kt keyType, value []byte) error {
+	err = decodeBatch(data, batchLen, func(idx int, family uint32, key []byte, kt keyType, value []byte) error {
+		memDb := getMem(family)
+		if memDb == nil {
+			return nil
+		}
 		return memDb.Put(makeInternalKey(key, seq+uint64(idx), kt), value)
 	})
 
@@ -166,7 +250,33 @@ func decodeBatchToMem(chunk []byte, expectSeq uint64, memDb *memdb.MemDB) (seq u
 
 }
 
-func decodeBatch(data []byte, batchLen int, f func(idx int, key []byte, kt keyType, value []byte) error) error {
+// 将journal中的一个chunk解析成batch的每一条记录, key和value引用的是chunk的内容
+func decodeBatchEntries(chunk []byte) (seq uint64, entries []Entry, err error) {
+
+	if len(chunk) < batchHeaderLen {
+		err = fmt.Errorf("batch decode, chunk len less than header")
+		return
+	}
+
+	seq = binary.LittleEndian.Uint64(chunk[:8])
+	batchLen := int(binary.LittleEndian.Uint32(chunk[8:batchHeaderLen]))
+
+	entries = make([]Entry, 0, batchLen)
+	err = decodeBatch(chunk[batchHeaderLen:], batchLen, func(idx int, family uint32, key []byte, kt keyType, value []byte) error {
+		entries = append(entries, Entry{
+			Family:  family,
+			Seq:     seq + uint64(idx),
+			Deleted: kt == keyTypeDel,
+			Key:     key,
+			Value:   value,
+		})
+		return nil
+	})
+
+	return
+}
+
+func decodeBatch(data []byte, batchLen int, f func(idx int, family uint32, key []byte, kt keyType, value []byte) error) error {
 
 	pos := 0
 	end := len(data)
@@ -177,44 +287,68 @@ func decodeBatch(data []byte, batchLen int, f func(idx int, key []byte, kt keyTy
 		if pos+1 > end {
 			return fmt.Errorf("decode key type pos out of range")
 		}
-		kt := keyType(data[pos : pos+1][0])
+		kt := keyType(data[pos])
 		pos += 1
 
+		// decode family
+		family := uint32(defaultColumnFamilyID)
+		if kt&batchFamilyFlag != 0 {
+			kt &^= batchFamilyFlag
+			id, n := binary.Uvarint(data[pos:])
+			if n <= 0 {
+				return fmt.Errorf("decode family err")
+			}
+			family = uint32(id)
+			pos += n
+		}
+
+		if kt != keyTypeVal && kt != keyTypeDel {
+			return fmt.Errorf("decode key type invalid, kt=%d", kt)
+		}
+
 		// decode klen
-		kLen, n := binary.Varint(data[pos:])
+		kLen, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return fmt.Errorf("decode key len err")
+		}
 		pos += n
 
 		// decode key
-		if pos+int(kLen) >= end {
+		if pos+int(kLen) > end {
 			return fmt.Errorf("decode key pos out of range")
 		}
 		key := data[pos : pos+int(kLen)]
+		pos += int(kLen)
 
 		if kt == keyTypeDel {
-			err := f(idx, key, kt, nil)
+			err := f(idx, family, key, kt, nil)
 			if err != nil {
 				return err
 			}
 			continue
 		}
 
-		vLen, m := binary.Varint(data[pos:])
+		vLen, m := binary.Uvarint(data[pos:])
+		if m <= 0 {
+			return fmt.Errorf("decode value len err")
+		}
 		pos += m
-		if pos+int(vLen) >= end {
+		if pos+int(vLen) > end {
 			return fmt.Errorf("decode value pos out of range")
 		}
 
 		v := data[pos : pos+int(vLen)]
+		pos += int(vLen)
 
-		err := f(idx, key, kt, v)
+		err := f(idx, family, key, kt, v)
 		if err != nil {
 			return err
 		}
 
 	}
 
-	if idx != batchLen-1 {
-		return fmt.Errorf("batch decode, expectEntryLen=%d, realEntryLen=%d", batchLen, idx+1)
+	if idx != batchLen {
+		return fmt.Errorf("batch decode, expectEntryLen=%d, realEntryLen=%d", batchLen, idx)
 	}
 
 	return nil
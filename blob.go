@@ -0,0 +1,423 @@
+package myleveldb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"myleveldb/collections"
+	error2 "myleveldb/error"
+	"myleveldb/storage"
+	"sort"
+)
+
+/**
+kv分离(blob file)
+
+value的长度大于等于Options.BlobMinValueSize时, memdb落地或者compaction写入sstable的时候, value被写入到blob文件,
+sstable中只保存value在blob文件中的位置(blob index), 对应的key类型为keyTypeBlob,
+compaction只需要重写很小的blob index, 不需要重写value
+
+blob文件由连续的record组成, 只追加不修改
+
+/-----------------/---------/---------------/-----------/-------------------/
+|  varint keylen  |   key   |  varint vlen  |   value   |  crc32(value) 4B  |
+/-----------------/---------/---------------/-----------/-------------------/
+
+blob index
+
+/--------------------/-------------------/-----------------/
+|  varint file num   |  varint offset    |  varint size    |
+/--------------------/-------------------/-----------------/
+
+offset指向value的第一个字节, 读取时连同后面的crc一起读出并校验
+
+垃圾统计
+每个blob文件在manifest中记录blob的总数量和总大小, compaction丢弃blob index时(被覆盖或者删除),
+对应的blob记为垃圾, 垃圾数量等于总数量时, blob文件从version中移除
+
+垃圾回收
+compaction遇到指向垃圾比例达到Options.BlobGCRatio的blob文件的blob index时, 读取value并重新写入到新的blob文件中,
+旧的blob记为垃圾, DB.CollectBlobGarbage对family的所有level做一次compaction, 迁移指定比例以上的blob文件中所有的live value
+
+注: 跟sstable一样, 运行期间不删除文件, 不再被引用的blob文件在下次打开db时删除
+**/
+
+const (
+	blobChecksumLen = 4
+)
+
+// blobIndex value在blob文件中的位置
+type blobIndex struct {
+	num    int64
+	offset uint64
+	size   uint64
+}
+
+func (bi blobIndex) encode() []byte {
+	dst := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(dst, uint64(bi.num))
+	n += binary.PutUvarint(dst[n:], bi.offset)
+	n += binary.PutUvarint(dst[n:], bi.size)
+	return dst[:n]
+}
+
+func decodeBlobIndex(data []byte) (bi blobIndex, err error) {
+	var (
+		pos int
+		x   [3]uint64
+	)
+	for i := range x {
+		v, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return bi, error2.ErrBlobIndexCorrupted
+		}
+		x[i] = v
+		pos += n
+	}
+	if pos != len(data) {
+		return bi, error2.ErrBlobIndexCorrupted
+	}
+	return blobIndex{num: int64(x[0]), offset: x[1], size: x[2]}, nil
+}
+
+// blobFile blob文件的元信息
+type blobFile struct {
+	num          int64
+	count        uint64 // blob的总数量
+	size         uint64 // value的总大小
+	garbageCount uint64 // 已经变成垃圾的blob数量
+	garbageSize  uint64 // 已经变成垃圾的value大小
+}
+
+// 所有的blob都变成了垃圾
+func (bf blobFile) obsolete() bool {
+	return bf.garbageCount >= bf.count
+}
+
+func (bf blobFile) garbageRatio() float64 {
+	if bf.size == 0 {
+		return 0
+	}
+	return float64(bf.garbageSize) / float64(bf.size)
+}
+
+// version引用的blob文件, key是文件号码
+type blobFiles map[int64]blobFile
+
+// 按照文件号码从小到大返回
+func (bfs blobFiles) sorted() []blobFile {
+	files := make([]blobFile, 0, len(bfs))
+	for _, bf := range bfs {
+		files = append(files, bf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].num < files[j].num
+	})
+	return files
+}
+
+// 垃圾比例大于等于ratio的blob文件
+func (bfs blobFiles) selectGC(ratio float64) map[int64]struct{} {
+	var nums map[int64]struct{}
+	for num, bf := range bfs {
+		if bf.garbageRatio() >= ratio {
+			if nums == nil {
+				nums = make(map[int64]struct{})
+			}
+			nums[num] = struct{}{}
+		}
+	}
+	return nums
+}
+
+// blobWriter 在一次memdb落地或者compaction中写入blob文件, 超过Options.BlobFileSize时切换到新的文件
+type blobWriter struct {
+	cf       *ColumnFamily
+	minSize  int
+	fileSize uint64
+
+	fd      storage.FileDesc
+	writer  storage.Writer
+	written int64 // 当前blob文件已经写入的长度
+	file    blobFile
+	files   []blobFile // 已经写完的blob文件
+
+	scratch []byte
+}
+
+// family没有开启kv分离时返回nil, nil的blobWriter不会分离任何value
+func newBlobWriter(cf *ColumnFamily) *blobWriter {
+	minSize := cf.opt.GetBlobMinValueSize()
+	if minSize <= 0 {
+		return nil
+	}
+	return &blobWriter{
+		cf:       cf,
+		minSize:  minSize,
+		fileSize: uint64(cf.opt.GetBlobFileSize()),
+	}
+}
+
+// 将value长度大于等于阈值的记录写入blob文件, 返回写入sstable的ikey和value
+func (bw *blobWriter) separate(ikey internalKey, value []byte) (internalKey, []byte, error) {
+
+	if bw == nil || len(value) < bw.minSize {
+		return ikey, value, nil
+	}
+
+	ukey, seq, kt, err := parseInternalKey(ikey)
+	if err != nil || kt != keyTypeVal {
+		return ikey, value, nil
+	}
+
+	bi, err := bw.add(ukey, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return makeInternalKey(ukey, seq, keyTypeBlob), bi.encode(), nil
+}
+
+func (bw *blobWriter) add(ukey, value []byte) (blobIndex, error) {
+
+	if bw.writer != nil && bw.file.size >= bw.fileSize {
+		if err := bw.closeFile(); err != nil {
+			return blobIndex{}, err
+		}
+	}
+
+	if bw.writer == nil {
+		fd := storage.FileDesc{Type: storage.FileTypeBlob, Num: int(bw.cf.s.allocNextNum())}
+		w, err := bw.cf.s.stor.Create(fd)
+		if err != nil {
+			return blobIndex{}, err
+		}
+		bw.fd, bw.writer = fd, w
+		bw.file = blobFile{num: int64(fd.Num)}
+	}
+
+	n := 2*binary.MaxVarintLen32 + len(ukey) + len(value) + blobChecksumLen
+	if cap(bw.scratch) < n {
+		bw.scratch = make([]byte, n)
+	}
+	buf := bw.scratch[:n]
+
+	m := binary.PutUvarint(buf, uint64(len(ukey)))
+	m += copy(buf[m:], ukey)
+	m += binary.PutUvarint(buf[m:], uint64(len(value)))
+
+	bi := blobIndex{
+		num:    bw.file.num,
+		offset: uint64(bw.written) + uint64(m),
+		size:   uint64(len(value)),
+	}
+
+	m += copy(buf[m:], value)
+	binary.LittleEndian.PutUint32(buf[m:], crc32.ChecksumIEEE(value))
+	m += blobChecksumLen
+
+	if _, err := bw.writer.Write(buf[:m]); err != nil {
+		return blobIndex{}, err
+	}
+
+	bw.file.count++
+	bw.file.size += uint64(len(value))
+	bw.written += int64(m)
+
+	return bi, nil
+}
+
+func (bw *blobWriter) closeFile() error {
+	if err := bw.writer.Sync(); err != nil {
+		return err
+	}
+	if err := bw.writer.Close(); err != nil {
+		return err
+	}
+	bw.files = append(bw.files, bw.file)
+	bw.writer = nil
+	bw.written = 0
+	return nil
+}
+
+// 刷盘并关闭所有写入的blob文件, 并记录到rec中
+func (bw *blobWriter) finish(rec *SessionRecord) error {
+
+	if bw == nil {
+		return nil
+	}
+
+	if bw.writer != nil {
+		if err := bw.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	for _, bf := range bw.files {
+		rec.addBlobFile(bw.cf.id, bf)
+	}
+	bw.files = nil
+	return nil
+}
+
+// 出错时删除所有写入的blob文件
+func (bw *blobWriter) abort() {
+
+	if bw == nil {
+		return
+	}
+
+	if bw.writer != nil {
+		bw.writer.Close()
+		bw.cf.s.stor.Remove(bw.fd)
+		bw.writer = nil
+	}
+
+	for _, bf := range bw.files {
+		bw.cf.s.stor.Remove(storage.FileDesc{Type: storage.FileTypeBlob, Num: int(bf.num)})
+	}
+	bw.files = nil
+}
+
+// blobReader 缓存在file cache中, 从缓存中剔除时关闭文件
+type blobReader struct {
+	reader storage.Reader
+}
+
+func (br *blobReader) UnRef() {
+	br.reader.Close()
+}
+
+// 通过blob index读取blob文件中的value
+func (sstOpt *sstableOperation) readBlob(bi blobIndex) ([]byte, error) {
+
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, uint64(bi.num))
+	ch, err := sstOpt.FileCache.Get(key, func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
+		reader, err := sstOpt.s.stor.Open(storage.FileDesc{Type: storage.FileTypeBlob, Num: int(bi.num)})
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return 1, &blobReader{reader: reader}, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer ch.UnRef()
+
+	buf := make([]byte, bi.size+blobChecksumLen)
+	if _, err = ch.Value().(*blobReader).reader.ReadAt(buf, int64(bi.offset)); err != nil {
+		if err == io.EOF {
+			err = error2.ErrBlobCorrupted
+		}
+		return nil, err
+	}
+
+	value := buf[:bi.size]
+	if crc32.ChecksumIEEE(value) != binary.LittleEndian.Uint32(buf[bi.size:]) {
+		return nil, error2.ErrBlobCorrupted
+	}
+	return value, nil
+}
+
+// 返回sstable中记录真正的value, blob index会从blob文件中读取
+func (cf *ColumnFamily) resolveValue(kt keyType, value []byte) ([]byte, error) {
+
+	if kt != keyTypeBlob {
+		return append([]byte(nil), value...), nil
+	}
+
+	bi, err := decodeBlobIndex(value)
+	if err != nil {
+		return nil, err
+	}
+	return cf.tableOpts.readBlob(bi)
+}
+
+// 扫描整个blob文件, 返回blob的数量以及value的总大小, 遇到不完整的record时停止
+func scanBlobFile(reader io.Reader) (bf blobFile, err error) {
+
+	r := bufio.NewReader(reader)
+	for {
+		kLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return bf, nil
+		}
+		if _, err = r.Discard(int(kLen)); err != nil {
+			return bf, nil
+		}
+		vLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return bf, nil
+		}
+		value := make([]byte, vLen+blobChecksumLen)
+		if _, err = io.ReadFull(r, value); err != nil {
+			return bf, nil
+		}
+		if crc32.ChecksumIEEE(value[:vLen]) != binary.LittleEndian.Uint32(value[vLen:]) {
+			return bf, nil
+		}
+		bf.count++
+		bf.size += vLen
+	}
+}
+
+// 删除不被任何family引用的blob文件, 只在打开db时调用, 此时还不存在读取blob的version
+func (db *DB) removeObsoleteBlobs() error {
+
+	fds, err := db.s.stor.List(storage.FileTypeBlob)
+	if err != nil || len(fds) == 0 {
+		return err
+	}
+
+	live := make(map[int64]struct{})
+	for _, cf := range db.s.listFamilies() {
+		if v := cf.version(); v != nil {
+			for num := range v.blobs {
+				live[num] = struct{}{}
+			}
+			v.unRef()
+		}
+	}
+
+	for _, fd := range fds {
+		if _, ok := live[int64(fd.Num)]; !ok {
+			db.s.stor.Remove(fd)
+		}
+	}
+	return nil
+}
+
+// CollectBlobGarbage 对family的所有level做一次compaction, 将垃圾比例大于等于ratio的blob文件中的live value迁移到新的blob文件,
+// ratio小于等于0时使用Options.BlobGCRatio, 迁移完成后旧的blob文件从version中移除
+func (db *DB) CollectBlobGarbage(cf *ColumnFamily, ratio float64) error {
+
+	if ratio <= 0 {
+		ratio = cf.opt.GetBlobGCRatio()
+	}
+
+	if err := db.flushMemDb(); err != nil {
+		return err
+	}
+
+	v := cf.version()
+	if v == nil {
+		return error2.ErrColumnFamilyDropped
+	}
+	maxLevel := len(v.levels)
+	gc := len(v.blobs.selectGC(ratio)) > 0
+	v.unRef()
+
+	if !gc {
+		return nil
+	}
+
+	for level := 0; level < maxLevel; level++ {
+		if err := db.compTriggerRange(cRange{cf: cf, level: level, gc: true, gcRatio: ratio}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
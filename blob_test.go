@@ -0,0 +1,97 @@
+package myleveldb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blobGarbage(t *testing.T, db *DB) (count, garbage uint64) {
+	t.Helper()
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	for _, bs := range stats.Blobs {
+		count += bs.Count
+		garbage += bs.GarbageCount
+	}
+	return
+}
+
+func TestBlob_GarbageCollection(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 64 << 10, BlobMinValueSize: 512, BlobGCRatio: 0.9}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+
+	// 大value写入blob文件, 小value留在sstable中
+	for i := 0; i < 400; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 1024)))
+	}
+	assert.Nil(t, db.Put([]byte("small"), []byte("inline")))
+	assert.Nil(t, db.CompactRange(nil, nil))
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, stats.Blobs)
+	old := map[int64]bool{}
+	for _, bs := range stats.Blobs {
+		old[bs.Num] = true
+	}
+	count, garbage := blobGarbage(t, db)
+	assert.Equal(t, uint64(400), count)
+	assert.Equal(t, uint64(0), garbage)
+
+	// 覆盖一半的key, compaction丢弃旧的blob index, 旧的blob记为垃圾
+	for i := 0; i < 400; i += 2 {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1, 1024)))
+	}
+	assert.Nil(t, db.CompactRange(nil, nil))
+	_, garbage = blobGarbage(t, db)
+	assert.True(t, garbage > 0)
+
+	// 垃圾比例没有达到BlobGCRatio, compaction不迁移, 旧文件都还在
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	live := 0
+	for _, bs := range stats.Blobs {
+		if old[bs.Num] {
+			live++
+		}
+	}
+	assert.Equal(t, len(old), live)
+
+	// 垃圾比例超过ratio的旧文件中的live value被迁移, 旧文件从version中移除
+	assert.Nil(t, db.CollectBlobGarbage(db.DefaultColumnFamily(), 0.3))
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	for _, bs := range stats.Blobs {
+		assert.False(t, old[bs.Num], "blob file %d not collected", bs.Num)
+	}
+	count, garbage = blobGarbage(t, db)
+	assert.Equal(t, uint64(400), count-garbage)
+
+	check := func(db *DB) {
+		for i := 0; i < 400; i++ {
+			v, err := db.Get(testKey(i))
+			assert.Nil(t, err)
+			if i%2 == 0 {
+				assert.Equal(t, testValue(i+1, 1024), v)
+			} else {
+				assert.Equal(t, testValue(i, 1024), v)
+			}
+		}
+		v, err := db.Get([]byte("small"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("inline"), v)
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+
+	// 重新打开后blob文件的统计以及value不变
+	db = openTestDB(t, dir, opt)
+	check(db)
+	count, garbage = blobGarbage(t, db)
+	assert.Equal(t, uint64(400), count-garbage)
+}
@@ -1,13 +1,46 @@
 package cache
 
-import "myleveldb/collections"
+import (
+	"myleveldb/collections"
+	"sync/atomic"
+)
+
+// Cache 按照namespace区分key的缓存, collections.LRUCache以及collections.ShardedLRUCache都实现了该接口
+type Cache interface {
+	Get(ns uint32, key []byte, sf collections.SetFunc) (*collections.LRUHandle, error)
+	Pin(ns uint32, key []byte, sf collections.SetFunc) (*collections.PinnedHandle, error)
+	Delete(ns uint32, key []byte) (bool, error)
+	EvictNamespace(ns uint32)
+	Stats() collections.CacheStats
+	Close() error
+}
+
+var lastNamespace uint32
+
+// NewNamespace 分配一个进程内唯一的namespace, 多个db共享同一个cache时, 每个db使用不同的namespace
+func NewNamespace() uint32 {
+	return atomic.AddUint32(&lastNamespace, 1)
+}
 
 // NamespaceCache 带有ns的cache
 type NamespaceCache struct {
-	Cache *collections.LRUCache
+	Cache Cache
 	Ns    uint32
+	// 加在key之前, 同一个namespace中区分不同的对象, 例如block cache中sstable的文件号
+	Prefix []byte
 }
 
 func (ns *NamespaceCache) Get(key []byte, sf collections.SetFunc) (*collections.LRUHandle, error) {
+	if len(ns.Prefix) > 0 {
+		key = append(append(make([]byte, 0, len(ns.Prefix)+len(key)), ns.Prefix...), key...)
+	}
 	return ns.Cache.Get(ns.Ns, key, sf)
 }
+
+// Pin 跟Get相同, 返回的handle释放之前节点不会被驱逐
+func (ns *NamespaceCache) Pin(key []byte, sf collections.SetFunc) (*collections.PinnedHandle, error) {
+	if len(ns.Prefix) > 0 {
+		key = append(append(make([]byte, 0, len(ns.Prefix)+len(key)), ns.Prefix...), key...)
+	}
+	return ns.Cache.Pin(ns.Ns, key, sf)
+}
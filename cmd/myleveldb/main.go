@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"myleveldb"
+	"myleveldb/collections"
+	"myleveldb/comparer"
+	error2 "myleveldb/error"
+	"myleveldb/sstable"
+	"os"
+	"strconv"
+)
+
+/**
+myleveldb 命令行工具, 用于在shell中查看和操作数据库
+
+用法: myleveldb [-db path] [-format escape|hex] [-comparer name] <command> [args]
+
+key和value的格式由-format决定, 输入和输出使用同一种格式
+	escape: go的字符串转义格式, 例如 "a\x00b", 输入时可以不带引号
+	hex:    十六进制, 例如 610062
+
+-comparer指定default family的comparer, 必须跟创建db时使用的相同, 否则打开时返回ErrComparerMismatch
+	bytewise(默认), reverse, uint64be, uint64le
+
+command
+	get <key>
+	put <key> <value>
+	delete <key>
+	scan [-from key] [-to key] [-limit n]     遍历[from, to)范围内的key
+	dump-sst <file.ldb>                        输出sstable的footer, index, filter以及所有的记录
+	dump-manifest                              输出CURRENT指向的manifest中的SessionRecord
+	dump-journal <file.log>                    输出journal中的batch以及seq
+	stats                                      输出数据库的统计信息
+	compact [-from key] [-to key]              对[from, to]范围做一次手动compaction
+	checkpoint <dir>                           在dir生成数据库当前状态的副本
+	repair                                     通过sstable和journal重建manifest
+**/
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx *context, args []string) error
+}
+
+type context struct {
+	dbPath   string
+	encoding string // escape或者hex
+	opt      *myleveldb.Options
+}
+
+// -comparer的名称
+var comparers = map[string]comparer.BasicComparer{
+	"bytewise": comparer.DefaultComparer,
+	"reverse":  comparer.ReverseByteComparer,
+	"uint64be": comparer.BigEndianUint64Comparer,
+	"uint64le": comparer.LittleEndianUint64Comparer,
+}
+
+var commands = []command{
+	{"get", "get <key>", runGet},
+	{"put", "put <key> <value>", runPut},
+	{"delete", "delete <key>", runDelete},
+	{"scan", "scan [-from key] [-to key] [-limit n]", runScan},
+	{"dump-sst", "dump-sst <file.ldb>", runDumpSST},
+	{"dump-manifest", "dump-manifest", runDumpManifest},
+	{"dump-journal", "dump-journal <file.log>", runDumpJournal},
+	{"stats", "stats", runStats},
+	{"compact", "compact [-from key] [-to key]", runCompact},
+	{"checkpoint", "checkpoint <dir>", runCheckpoint},
+	{"repair", "repair", runRepair},
+}
+
+func main() {
+
+	ctx := &context{}
+
+	var cmpName string
+	flag.StringVar(&ctx.dbPath, "db", ".", "database directory")
+	flag.StringVar(&ctx.encoding, "format", "escape", "key/value format, escape or hex")
+	flag.StringVar(&cmpName, "comparer", "bytewise", "comparer of the database, bytewise, reverse, uint64be or uint64le")
+	flag.Usage = usage
+	flag.Parse()
+
+	if ctx.encoding != "escape" && ctx.encoding != "hex" {
+		fatal(fmt.Errorf("unknown format %q", ctx.encoding))
+	}
+
+	cmp, ok := comparers[cmpName]
+	if !ok {
+		fatal(fmt.Errorf("unknown comparer %q", cmpName))
+	}
+	ctx.opt = &myleveldb.Options{Cmp: cmp}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			if err := cmd.run(ctx, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: myleveldb [-db path] [-format escape|hex] [-comparer name] <command> [args]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "myleveldb: %v\n", err)
+	os.Exit(1)
+}
+
+// 按照format解析命令行输入的key或者value
+func (ctx *context) parse(s string) ([]byte, error) {
+
+	if ctx.encoding == "hex" {
+		return hex.DecodeString(s)
+	}
+
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(u), nil
+	}
+
+	u, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(u), nil
+}
+
+// 按照format格式化输出的key或者value
+func (ctx *context) format(b []byte) string {
+	if ctx.encoding == "hex" {
+		return hex.EncodeToString(b)
+	}
+	return strconv.Quote(string(b))
+}
+
+func (ctx *context) parseArgs(args []string, n int, usage string) ([][]byte, error) {
+
+	if len(args) != n {
+		return nil, fmt.Errorf("usage: %s", usage)
+	}
+
+	parsed := make([][]byte, n)
+	for i, arg := range args {
+		b, err := ctx.parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %v", arg, err)
+		}
+		parsed[i] = b
+	}
+	return parsed, nil
+}
+
+// 解析-from和-to, 未设置时为nil
+func (ctx *context) parseRange(from, to string) (start, limit []byte, err error) {
+
+	if from != "" {
+		if start, err = ctx.parse(from); err != nil {
+			return
+		}
+	}
+
+	if to != "" {
+		if limit, err = ctx.parse(to); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (ctx *context) withDB(f func(db *myleveldb.DB) error) error {
+
+	db, err := myleveldb.Open(ctx.dbPath, ctx.opt)
+	if err != nil {
+		return err
+	}
+
+	err = f(db)
+
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func runGet(ctx *context, args []string) error {
+
+	parsed, err := ctx.parseArgs(args, 1, "get <key>")
+	if err != nil {
+		return err
+	}
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+		value, err := db.Get(parsed[0])
+		if err == error2.ErrNotFound {
+			return fmt.Errorf("key %s not found", ctx.format(parsed[0]))
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(ctx.format(value))
+		return nil
+	})
+}
+
+func runPut(ctx *context, args []string) error {
+
+	parsed, err := ctx.parseArgs(args, 2, "put <key> <value>")
+	if err != nil {
+		return err
+	}
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+		return db.Put(parsed[0], parsed[1])
+	})
+}
+
+func runDelete(ctx *context, args []string) error {
+
+	parsed, err := ctx.parseArgs(args, 1, "delete <key>")
+	if err != nil {
+		return err
+	}
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+		return db.Delete(parsed[0])
+	})
+}
+
+func runScan(ctx *context, args []string) error {
+
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	from := fs.String("from", "", "start key, inclusive")
+	to := fs.String("to", "", "end key, exclusive")
+	limit := fs.Int("limit", 0, "max number of keys, 0 means no limit")
+	_ = fs.Parse(args)
+
+	start, end, err := ctx.parseRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+
+		iterator := db.NewIterator(&myleveldb.IterOptions{LowerBound: start, UpperBound: end})
+		defer iterator.UnRef()
+
+		for n, ok := 0, iterator.First(); ok; ok = iterator.Next() {
+
+			if *limit > 0 && n >= *limit {
+				break
+			}
+
+			fmt.Printf("%s => %s\n", ctx.format(iterator.Key()), ctx.format(iterator.Value()))
+			n++
+		}
+
+		return nil
+	})
+}
+
+func runDumpSST(ctx *context, args []string) error {
+
+	if len(args) != 1 {
+		return errors.New("usage: dump-sst <file.ldb>")
+	}
+
+	info := func(info *sstable.TableInfo) error {
+		fmt.Printf("footer:\n")
+		fmt.Printf("  metaIndex: offset=%d length=%d\n", info.MetaIndex.Offset, info.MetaIndex.Length)
+		fmt.Printf("  index: offset=%d length=%d\n", info.Index.Offset, info.Index.Length)
+		fmt.Printf("filter:\n")
+		fmt.Printf("  name=%q format=%s offset=%d length=%d baseLg=%d nums=%d prefix=%q\n",
+			info.FilterName, info.FilterFormat, info.Filter.Offset, info.Filter.Length, info.FilterBaseLg, info.FilterNums, info.FilterPrefix)
+		fmt.Printf("index: partitions=%d\n", info.IndexPartitions)
+		for _, idx := range info.Indexes {
+			fmt.Printf("  %s => offset=%d length=%d\n", ctx.format(idx.Key), idx.Block.Offset, idx.Block.Length)
+		}
+		fmt.Printf("entries:\n")
+		return nil
+	}
+
+	return myleveldb.DumpTable(args[0], ctx.opt, info, func(e myleveldb.Entry) error {
+		printEntry(ctx, "  ", e)
+		return nil
+	})
+}
+
+func runDumpManifest(ctx *context, args []string) error {
+
+	var n int
+	return myleveldb.DumpManifest(ctx.dbPath, func(rec *myleveldb.SessionRecord) error {
+		fmt.Printf("--- record %d ---\n", n)
+		fmt.Print(rec.Format(ctx.format))
+		n++
+		return nil
+	})
+}
+
+func runDumpJournal(ctx *context, args []string) error {
+
+	if len(args) != 1 {
+		return errors.New("usage: dump-journal <file.log>")
+	}
+
+	return myleveldb.DumpJournal(args[0], func(seq uint64, entries []myleveldb.Entry) error {
+		fmt.Printf("--- batch seq=%d len=%d ---\n", seq, len(entries))
+		for _, e := range entries {
+			printEntry(ctx, "  ", e)
+		}
+		return nil
+	})
+}
+
+func printEntry(ctx *context, indent string, e myleveldb.Entry) {
+	if e.Deleted {
+		fmt.Printf("%s%s @ %d : del\n", indent, ctx.format(e.Key), e.Seq)
+		return
+	}
+	if e.Blob {
+		fmt.Printf("%s%s @ %d : blob %x\n", indent, ctx.format(e.Key), e.Seq, e.Value)
+		return
+	}
+	fmt.Printf("%s%s @ %d : put %s\n", indent, ctx.format(e.Key), e.Seq, ctx.format(e.Value))
+}
+
+func runStats(ctx *context, args []string) error {
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+
+		stats, err := db.Stats()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("seq: %d\n", stats.Seq)
+		fmt.Printf("journal: %d\n", stats.JournalNum)
+		fmt.Printf("nextFileNum: %d\n", stats.NextFileNum)
+		fmt.Printf("memdb: %d bytes\n", stats.MemDbSize)
+		fmt.Printf("frozen memdb: %d bytes\n", stats.FrozenMemDbSize)
+		for _, level := range stats.Levels {
+			fmt.Printf("level %d: files=%d size=%d\n", level.Level, level.FileCount, level.Size)
+		}
+		for _, blob := range stats.Blobs {
+			fmt.Printf("blob %06d: count=%d size=%d garbage=%d/%d\n",
+				blob.Num, blob.Count, blob.Size, blob.GarbageCount, blob.GarbageSize)
+		}
+		printCacheStats("block cache", stats.BlockCache)
+		printCacheStats("open files cache", stats.OpenFilesCache)
+		return nil
+	})
+}
+
+func printCacheStats(name string, stats collections.CacheStats) {
+	fmt.Printf("%s: size=%d/%d hit=%d miss=%d insert=%d evict=%d\n", name,
+		stats.Size, stats.Capacity, stats.Hits, stats.Misses, stats.Inserts, stats.Evictions)
+}
+
+func runCompact(ctx *context, args []string) error {
+
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	from := fs.String("from", "", "start key, inclusive")
+	to := fs.String("to", "", "end key, inclusive")
+	_ = fs.Parse(args)
+
+	start, limit, err := ctx.parseRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+		return db.CompactRange(start, limit)
+	})
+}
+
+func runCheckpoint(ctx *context, args []string) error {
+
+	if len(args) != 1 {
+		return errors.New("usage: checkpoint <dir>")
+	}
+
+	return ctx.withDB(func(db *myleveldb.DB) error {
+		return db.Checkpoint(args[0])
+	})
+}
+
+func runRepair(ctx *context, args []string) error {
+	return myleveldb.Repair(ctx.dbPath, ctx.opt)
+}
@@ -0,0 +1,82 @@
+package collections
+
+import "container/list"
+
+/**
+缓存的淘汰策略
+
+LRU: 只有一个lru链表, 命中时移动到最新的位置, 一次全表扫描读取的block会把热点block全部挤出缓存
+
+2Q: 防止扫描污染缓存
+	probation(A1in)  第一次加入缓存的节点, 最多占用容量的1/4
+	protected(Am)    在probation中再次被命中, 或者被淘汰后很快又被加入的节点
+	ghost(A1out)     从probation中淘汰的节点, 只记录namespace以及key的hash, 不占用缓存的容量
+
+	            miss                    hit
+	new key ──────────> probation ─────────────> protected <──┐ hit
+	                        │ 淘汰                  │ 淘汰 ────┘
+	                        v                       v
+	      miss, 在ghost中   ghost                  删除
+	   ───────────────────────────────────────> protected
+
+	容量不足时, probation超过自己的容量或者protected为空时淘汰probation中最旧的节点, 否则淘汰protected中最旧的节点,
+	扫描读取的block只会进入probation, 不会影响protected中的热点block
+**/
+
+// CachePolicy 缓存的淘汰策略
+type CachePolicy int
+
+const (
+	CachePolicyLRU CachePolicy = iota // 默认
+	CachePolicy2Q
+)
+
+const (
+	probationRatio = 4 // probation最多占用容量的 1/probationRatio
+	minGhostLen    = 16
+)
+
+// ghost 记录最近从probation中淘汰的key, 先进先出
+type ghost struct {
+	queue *list.List
+	index map[uint64]*list.Element
+}
+
+func newGhost() *ghost {
+	return &ghost{
+		queue: list.New(),
+		index: make(map[uint64]*list.Element),
+	}
+}
+
+func ghostKey(node *bucketNode) uint64 {
+	return uint64(node.namespace)<<32 | uint64(node.hash)
+}
+
+// 加入ghost, 最多保留maxLen个
+func (g *ghost) add(node *bucketNode, maxLen int) {
+	key := ghostKey(node)
+	if _, ok := g.index[key]; ok {
+		return
+	}
+	g.index[key] = g.queue.PushFront(key)
+	if maxLen < minGhostLen {
+		maxLen = minGhostLen
+	}
+	for g.queue.Len() > maxLen {
+		oldest := g.queue.Back()
+		g.queue.Remove(oldest)
+		delete(g.index, oldest.Value.(uint64))
+	}
+}
+
+// 存在时从ghost中删除并返回true
+func (g *ghost) remove(node *bucketNode) bool {
+	key := ghostKey(node)
+	e, ok := g.index[key]
+	if ok {
+		g.queue.Remove(e)
+		delete(g.index, key)
+	}
+	return ok
+}
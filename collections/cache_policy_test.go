@@ -0,0 +1,76 @@
+package collections
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 热点key被访问两次后, 一次扫描读取大量只访问一次的key, 2Q中热点key仍然在缓存中, LRU中全部被淘汰
+func TestCachePolicy_ScanResistant(t *testing.T) {
+
+	hotInCache := func(policy CachePolicy) int {
+
+		cache := NewCache(100, policy)
+		defer cache.Close()
+
+		var released int32
+		get := func(key string) {
+			h, err := cache.Get(1, []byte(key), testSetFunc(1, &released))
+			assert.Nil(t, err)
+			h.UnRef()
+		}
+
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 50; i++ {
+				get(fmt.Sprintf("hot-%d", i))
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			get(fmt.Sprintf("scan-%d", i))
+		}
+
+		n := 0
+		for i := 0; i < 50; i++ {
+			if h, err := cache.Get(1, []byte(fmt.Sprintf("hot-%d", i)), nil); err == nil {
+				h.UnRef()
+				n++
+			}
+		}
+		return n
+	}
+
+	assert.Equal(t, 0, hotInCache(CachePolicyLRU))
+	assert.Equal(t, 50, hotInCache(CachePolicy2Q))
+}
+
+// 从probation中淘汰后很快又被加入的key直接进入protected
+func TestCachePolicy_Ghost(t *testing.T) {
+
+	cache := NewCache(8, CachePolicy2Q)
+	defer cache.Close()
+
+	var released int32
+	get := func(key string) {
+		h, err := cache.Get(1, []byte(key), testSetFunc(1, &released))
+		assert.Nil(t, err)
+		h.UnRef()
+	}
+
+	get("a")
+	for i := 0; i < 10; i++ {
+		get(fmt.Sprintf("scan-%d", i))
+	}
+	_, err := cache.Get(1, []byte("a"), nil)
+	assert.Equal(t, ErrNotFound, err)
+
+	// 再次加入时在ghost中, 进入protected后不会被扫描淘汰
+	get("a")
+	for i := 10; i < 30; i++ {
+		get(fmt.Sprintf("scan-%d", i))
+	}
+	h, err := cache.Get(1, []byte("a"), nil)
+	assert.Nil(t, err)
+	h.UnRef()
+}
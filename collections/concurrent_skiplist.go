@@ -0,0 +1,548 @@
+package collections
+
+import (
+	"math"
+	"math/rand"
+	"myleveldb/comparer"
+	"myleveldb/utils"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/**
+无锁skiplist
+
+所有的node以及kv都分配在arena中, 通过atomic的加法分配内存, node之间用arena中的offset链接,
+offset为0代表nil, 所以arena的第一个字节不使用
+
+arena由多个大小相同的chunk组成, 每个chunk占用2的幂大小的offset空间, offset >> chunkShift 为所在的chunk,
+一次分配不会跨越chunk的末尾, 跨越时丢弃这次分配的空间, 从下一个chunk重新分配, chunk在第一次使用时才分配
+
+	offset    0                 1<<chunkShift       2<<chunkShift
+	          |  chunk0  | 空洞  |   chunk1   | 空洞  |   chunk2 (nil)  ...
+
+node在arena中的结构, 以8字节对齐
+
+/--------------------------/-------------/------------/----------------------------/---------/
+|  value offset<<32 | len  |  key len    |  height    |  next[0] ... next[height-1] |   key   |
+|         8B(atomic)       |     4B      |    4B      |       4B * height(atomic)   |         |
+/--------------------------/-------------/------------/----------------------------/---------/
+
+写入(可以并发)
+1. 从最高层往下找到每一层key应该插入的位置 prev[i] < key <= next[i]
+2. 分配node, 从第0层往上依次通过CAS将prev[i].next[i]从next[i]修改为node,
+   CAS失败说明有别的写入插到了prev[i]之后, 从prev[i]开始重新找这一层的位置再重试
+3. 第0层已经存在相同的key时, 分配新的value并原子地替换node的value
+
+读取不需要任何锁, 只通过atomic读取next以及value, 一个node在第0层链接成功之后就对读取可见,
+上层的链接只是用来加速查找
+
+容量按照写入的kv大小计算(跟LLRBTree相同), node的header以及tower不计算在内, 这样memdb的剩余空间
+跟batch按照kv长度估算的大小一致. kv大小超过capacity时返回ErrCapFull, 已经分配的内存不会回收
+**/
+
+const (
+	cslMaxHeight = 12
+	cslAlign     = 8
+
+	// 一个node最多比kv多出header, tower以及对齐的空间, kv至少8字节(internal key), 所以arena最多是kv大小的11倍左右
+	cslMaxChunks = 16
+
+	cslValueOffset  = 0
+	cslKeyLenOffset = 8
+	cslHeightOffset = 12
+	cslTowerOffset  = 16
+)
+
+// ConcurrentSkipList 基于arena的无锁skiplist, 支持并发写入以及无等待的读取
+type ConcurrentSkipList struct {
+	chunks     [cslMaxChunks][]byte         // 从pool中获取的内存, 释放时归还, 由growMu保护
+	bases      [cslMaxChunks]unsafe.Pointer // chunk中8字节对齐的起始地址, atomic
+	chunkSize  uint64                       // chunk实际的大小
+	chunkShift uint64                       // chunk占用的offset空间为 1<<chunkShift
+	maxChunks  uint64
+	growMu     sync.Mutex
+
+	pos       uint64 // 下一次分配的位置, atomic
+	head      uint32
+	height    int32 // 当前的最大高度, atomic
+	capacity  int
+	size      int64 // 写入的kv大小, atomic
+	allocated int64 // 已经分配的chunk大小, atomic
+	ref       int32
+	released  int32
+	cmp       comparer.BasicComparer
+	pool      *utils.BytePool
+}
+
+// NewConcurrentSkipList 实例化无锁skiplist, capacity为可以写入的kv大小
+func NewConcurrentSkipList(capacity int, cmp comparer.BasicComparer, pool *utils.BytePool) *ConcurrentSkipList {
+
+	// 一个chunk至少可以放下head node以及一条最大的记录
+	chunkSize := uint64(capacity+2*(cslTowerOffset+cslMaxHeight*4)+cslAlign-1) / cslAlign * cslAlign
+	chunkShift := uint64(0)
+	for uint64(1)<<chunkShift < chunkSize {
+		chunkShift++
+	}
+	maxChunks := uint64(cslMaxChunks)
+	if n := (uint64(1) << 32) >> chunkShift; n < maxChunks {
+		maxChunks = n
+	}
+
+	list := &ConcurrentSkipList{
+		chunkSize:  chunkSize,
+		chunkShift: chunkShift,
+		maxChunks:  maxChunks,
+		pos:        cslAlign,
+		height:     1,
+		capacity:   capacity,
+		ref:        1,
+		cmp:        cmp,
+		pool:       pool,
+	}
+
+	list.head, _ = list.allocNode(nil, nil, cslMaxHeight)
+	return list
+}
+
+// 分配n个字节, 返回8字节对齐的offset, 空间不足时返回false
+func (list *ConcurrentSkipList) alloc(n int) (uint32, bool) {
+	size := uint64((n + cslAlign - 1) / cslAlign * cslAlign)
+	if size > list.chunkSize {
+		return 0, false
+	}
+	for {
+		end := atomic.AddUint64(&list.pos, size)
+		start := end - size
+		idx := start >> list.chunkShift
+		if idx >= list.maxChunks {
+			return 0, false
+		}
+		// 超出了chunk的末尾, 将pos移动到下一个chunk的开始再重新分配
+		if end-idx<<list.chunkShift > list.chunkSize {
+			next := (idx + 1) << list.chunkShift
+			for p := atomic.LoadUint64(&list.pos); p < next; p = atomic.LoadUint64(&list.pos) {
+				if atomic.CompareAndSwapUint64(&list.pos, p, next) {
+					break
+				}
+			}
+			continue
+		}
+		if atomic.LoadPointer(&list.bases[idx]) == nil {
+			list.grow(idx)
+		}
+		return uint32(start), true
+	}
+}
+
+func (list *ConcurrentSkipList) grow(idx uint64) {
+	list.growMu.Lock()
+	defer list.growMu.Unlock()
+	if atomic.LoadPointer(&list.bases[idx]) != nil {
+		return
+	}
+	raw := list.pool.Get(int64(list.chunkSize + cslAlign))
+	base := cslAlign - int(uintptr(unsafe.Pointer(&raw[0])))%cslAlign
+	list.chunks[idx] = raw
+	atomic.AddInt64(&list.allocated, int64(cap(raw)))
+	atomic.StorePointer(&list.bases[idx], unsafe.Pointer(&raw[base]))
+}
+
+// offset对应的地址, offset所在的chunk一定已经分配
+func (list *ConcurrentSkipList) ptr(offset uint32) unsafe.Pointer {
+	base := atomic.LoadPointer(&list.bases[uint64(offset)>>list.chunkShift])
+	return unsafe.Pointer(uintptr(base) + uintptr(uint64(offset)&(1<<list.chunkShift-1)))
+}
+
+// offset开始的n个字节
+func (list *ConcurrentSkipList) bytes(offset uint32, n int) []byte {
+	return (*[math.MaxInt32]byte)(list.ptr(offset))[:n:n]
+}
+
+func (list *ConcurrentSkipList) uint32At(offset uint32) uint32 {
+	return *(*uint32)(list.ptr(offset))
+}
+
+func (list *ConcurrentSkipList) allocNode(key, value []byte, height int) (uint32, bool) {
+
+	towerSize := height * 4
+	node, ok := list.alloc(cslTowerOffset + towerSize + len(key) + len(value))
+	if !ok {
+		return 0, false
+	}
+
+	data := list.bytes(node, cslTowerOffset+towerSize+len(key)+len(value))
+	keyPos := cslTowerOffset + towerSize
+	copy(data[keyPos:], key)
+	valuePos := keyPos + len(key)
+	copy(data[valuePos:], value)
+
+	*(*uint32)(list.ptr(node + cslKeyLenOffset)) = uint32(len(key))
+	*(*uint32)(list.ptr(node + cslHeightOffset)) = uint32(height)
+	for i := 0; i < height; i++ {
+		*list.nextPtr(node, i) = 0
+	}
+	atomic.StoreUint64(list.valuePtr(node), uint64(node+uint32(valuePos))<<32|uint64(len(value)))
+	return node, true
+}
+
+func (list *ConcurrentSkipList) valuePtr(node uint32) *uint64 {
+	return (*uint64)(list.ptr(node + cslValueOffset))
+}
+
+func (list *ConcurrentSkipList) nextPtr(node uint32, level int) *uint32 {
+	return (*uint32)(list.ptr(node + cslTowerOffset + uint32(level*4)))
+}
+
+func (list *ConcurrentSkipList) next(node uint32, level int) uint32 {
+	return atomic.LoadUint32(list.nextPtr(node, level))
+}
+
+func (list *ConcurrentSkipList) nodeHeight(node uint32) int {
+	return int(list.uint32At(node + cslHeightOffset))
+}
+
+func (list *ConcurrentSkipList) key(node uint32) []byte {
+	keyLen := int(list.uint32At(node + cslKeyLenOffset))
+	keyPos := node + cslTowerOffset + list.uint32At(node+cslHeightOffset)*4
+	return list.bytes(keyPos, keyLen)
+}
+
+func (list *ConcurrentSkipList) value(node uint32) []byte {
+	v := atomic.LoadUint64(list.valuePtr(node))
+	pos, n := uint32(v>>32), uint32(v)
+	return list.bytes(pos, int(n))
+}
+
+func (list *ConcurrentSkipList) randHeight() int {
+	height := 1
+	for height < cslMaxHeight && rand.Intn(4) == 0 {
+		height++
+	}
+	return height
+}
+
+// 在level层从before开始找到key的位置, 返回prev < key <= next, found代表next的key等于key
+func (list *ConcurrentSkipList) findSplice(key []byte, before uint32, level int) (prev, next uint32, found bool) {
+	prev = before
+	for {
+		next = list.next(prev, level)
+		if next == 0 {
+			return prev, 0, false
+		}
+		c := list.cmp.Compare(list.key(next), key)
+		if c >= 0 {
+			return prev, next, c == 0
+		}
+		prev = next
+	}
+}
+
+// 找到大于等于key的第一个node, 不存在时返回0
+func (list *ConcurrentSkipList) findGE(key []byte) uint32 {
+	prev := list.head
+	for level := int(atomic.LoadInt32(&list.height)) - 1; level >= 0; level-- {
+		var (
+			next  uint32
+			found bool
+		)
+		prev, next, found = list.findSplice(key, prev, level)
+		if found || level == 0 {
+			return next
+		}
+	}
+	return 0
+}
+
+// 找到小于key的最后一个node, key为nil时找到最后一个node, 不存在时返回0
+func (list *ConcurrentSkipList) findLT(key []byte) uint32 {
+	prev := list.head
+	for level := int(atomic.LoadInt32(&list.height)) - 1; level >= 0; level-- {
+		for {
+			next := list.next(prev, level)
+			if next == 0 || (key != nil && list.cmp.Compare(list.key(next), key) >= 0) {
+				break
+			}
+			prev = next
+		}
+	}
+	if prev == list.head {
+		return 0
+	}
+	return prev
+}
+
+// Put 写入记录, 可以并发调用, key已经存在时替换value
+func (list *ConcurrentSkipList) Put(key, value []byte) error {
+
+	if atomic.LoadInt32(&list.released) == 1 {
+		return ErrClosed
+	}
+
+	// 先占用容量, 失败时再归还
+	kvLen := int64(len(key) + len(value))
+	if atomic.AddInt64(&list.size, kvLen) > int64(list.capacity) {
+		atomic.AddInt64(&list.size, -kvLen)
+		return ErrCapFull
+	}
+
+	var prev, next [cslMaxHeight + 1]uint32
+
+	listHeight := int(atomic.LoadInt32(&list.height))
+	prev[listHeight] = list.head
+	for level := listHeight - 1; level >= 0; level-- {
+		var found bool
+		prev[level], next[level], found = list.findSplice(key, prev[level+1], level)
+		if found {
+			return list.replaceValue(next[level], key, value)
+		}
+	}
+
+	height := list.randHeight()
+	node, ok := list.allocNode(key, value, height)
+	if !ok {
+		atomic.AddInt64(&list.size, -kvLen)
+		return ErrCapFull
+	}
+
+	// 提升skiplist的高度, 新增的层从head开始
+	for {
+		h := atomic.LoadInt32(&list.height)
+		if int(h) >= height || atomic.CompareAndSwapInt32(&list.height, h, int32(height)) {
+			break
+		}
+	}
+	for level := listHeight; level < height; level++ {
+		prev[level], next[level], _ = list.findSplice(key, list.head, level)
+	}
+
+	for level := 0; level < height; level++ {
+		for {
+			atomic.StoreUint32(list.nextPtr(node, level), next[level])
+			if atomic.CompareAndSwapUint32(list.nextPtr(prev[level], level), next[level], node) {
+				break
+			}
+
+			// 有别的写入插在了prev之后, 重新找这一层的位置
+			var found bool
+			prev[level], next[level], found = list.findSplice(key, prev[level], level)
+			if found {
+				// 只有第0层会出现, 相同的key被并发写入, 已经分配的node直接丢弃
+				return list.replaceValue(next[level], key, value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// 替换已经存在的node的value, 只有value占用容量, 归还Put时为key占用的容量
+func (list *ConcurrentSkipList) replaceValue(node uint32, key, value []byte) error {
+	pos, ok := list.alloc(len(value))
+	if !ok {
+		atomic.AddInt64(&list.size, -int64(len(key)+len(value)))
+		return ErrCapFull
+	}
+	copy(list.bytes(pos, len(value)), value)
+	atomic.StoreUint64(list.valuePtr(node), uint64(pos)<<32|uint64(len(value)))
+	atomic.AddInt64(&list.size, -int64(len(key)))
+	return nil
+}
+
+// Get 获取key对应的value
+func (list *ConcurrentSkipList) Get(key []byte) ([]byte, error) {
+	node := list.findGE(key)
+	if node == 0 || list.cmp.Compare(list.key(node), key) != 0 {
+		return nil, ErrNotFound
+	}
+	return list.value(node), nil
+}
+
+// Find 获取大于等于key的最小的kv对
+func (list *ConcurrentSkipList) Find(key []byte) (rkey, value []byte, err error) {
+	node := list.findGE(key)
+	if node == 0 {
+		return nil, nil, ErrNotFound
+	}
+	return list.key(node), list.value(node), nil
+}
+
+// Ref 增加引用次数
+func (list *ConcurrentSkipList) Ref() {
+	atomic.AddInt32(&list.ref, 1)
+}
+
+// UnRef 减少引用次数, 为0时arena的所有chunk归还到pool中
+func (list *ConcurrentSkipList) UnRef() {
+	if atomic.AddInt32(&list.ref, -1) == 0 {
+		if atomic.CompareAndSwapInt32(&list.released, 0, 1) {
+			list.growMu.Lock()
+			for i := range list.chunks {
+				if list.chunks[i] != nil {
+					list.pool.Put(list.chunks[i])
+					list.chunks[i] = nil
+					atomic.StorePointer(&list.bases[i], nil)
+				}
+			}
+			atomic.StoreInt64(&list.allocated, 0)
+			list.growMu.Unlock()
+		}
+	}
+}
+
+// Reset 清空所有的记录, 继续使用已经分配的chunk, 调用时不能有并发的读写
+func (list *ConcurrentSkipList) Reset() {
+	list.pos = cslAlign
+	list.height = 1
+	list.size = 0
+	list.head, _ = list.allocNode(nil, nil, cslMaxHeight)
+}
+
+// Cap 获取容量
+func (list *ConcurrentSkipList) Cap() int {
+	return list.capacity
+}
+
+// Len 获取写入的kv大小
+func (list *ConcurrentSkipList) Len() int {
+	return int(atomic.LoadInt64(&list.size))
+}
+
+// Allocated 已经分配的chunk大小, 包括node的header, tower以及对齐的空间, Reset不会释放
+func (list *ConcurrentSkipList) Allocated() int {
+	return int(atomic.LoadInt64(&list.allocated))
+}
+
+// Free 剩余的空间
+func (list *ConcurrentSkipList) Free() (int, error) {
+	if atomic.LoadInt32(&list.released) == 1 {
+		return 0, ErrClosed
+	}
+	free := list.capacity - int(atomic.LoadInt64(&list.size))
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+// ConcurrentSkipListIter 迭代器, 遍历期间可以并发写入, 新写入的记录可能被遍历到
+type ConcurrentSkipListIter struct {
+	utils.BasicReleaser
+	releaser utils.Releaser
+	list     *ConcurrentSkipList
+	node     uint32
+	soi, eoi bool
+}
+
+func NewConcurrentSkipListIter(list *ConcurrentSkipList, releaser utils.Releaser) *ConcurrentSkipListIter {
+	list.Ref()
+	return &ConcurrentSkipListIter{
+		list:     list,
+		releaser: releaser,
+		soi:      true,
+	}
+}
+
+// SetReleaser 设置迭代器释放时需要一并释放的对象
+func (iter *ConcurrentSkipListIter) SetReleaser(releaser utils.Releaser) {
+	iter.releaser = releaser
+}
+
+func (iter *ConcurrentSkipListIter) First() bool {
+	if iter.Released() {
+		return false
+	}
+	iter.soi, iter.eoi = false, false
+	iter.node = iter.list.next(iter.list.head, 0)
+	return iter.valid()
+}
+
+func (iter *ConcurrentSkipListIter) Next() bool {
+	if iter.Released() || iter.eoi {
+		return false
+	}
+	if iter.soi {
+		return iter.First()
+	}
+	iter.node = iter.list.next(iter.node, 0)
+	return iter.valid()
+}
+
+func (iter *ConcurrentSkipListIter) Seek(key []byte) bool {
+	if iter.Released() {
+		return false
+	}
+	iter.soi, iter.eoi = false, false
+	iter.node = iter.list.findGE(key)
+	return iter.valid()
+}
+
+// Last 移动到最后一个node
+func (iter *ConcurrentSkipListIter) Last() bool {
+	if iter.Released() {
+		return false
+	}
+	iter.eoi = false
+	iter.node = iter.list.findLT(nil)
+	return iter.validBackward()
+}
+
+// Prev node中没有指向前一个node的指针, 重新查找小于当前key的最后一个node
+func (iter *ConcurrentSkipListIter) Prev() bool {
+	if iter.Released() || iter.soi {
+		return false
+	}
+	if iter.eoi {
+		return iter.Last()
+	}
+	iter.node = iter.list.findLT(iter.list.key(iter.node))
+	return iter.validBackward()
+}
+
+func (iter *ConcurrentSkipListIter) SeekBefore(key []byte) bool {
+	if iter.Released() {
+		return false
+	}
+	iter.eoi = false
+	iter.node = iter.list.findLT(key)
+	return iter.validBackward()
+}
+
+// 反向遍历越过第一个node之后, Next重新从第一个node开始
+func (iter *ConcurrentSkipListIter) validBackward() bool {
+	iter.soi = iter.node == 0
+	return !iter.soi
+}
+
+func (iter *ConcurrentSkipListIter) valid() bool {
+	if iter.node == 0 {
+		iter.eoi = true
+		return false
+	}
+	return true
+}
+
+func (iter *ConcurrentSkipListIter) Key() []byte {
+	if iter.soi || iter.eoi {
+		return nil
+	}
+	return iter.list.key(iter.node)
+}
+
+func (iter *ConcurrentSkipListIter) Value() []byte {
+	if iter.soi || iter.eoi {
+		return nil
+	}
+	return iter.list.value(iter.node)
+}
+
+func (iter *ConcurrentSkipListIter) UnRef() {
+	if !iter.Released() {
+		if iter.releaser != nil {
+			iter.releaser.UnRef()
+		}
+		iter.list.UnRef()
+		iter.BasicReleaser.UnRef()
+	}
+}
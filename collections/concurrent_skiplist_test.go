@@ -0,0 +1,125 @@
+package collections
+
+import (
+	"fmt"
+	"math/rand"
+	"myleveldb/comparer"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentSkipList_Put(t *testing.T) {
+
+	list := NewConcurrentSkipList(1<<22, comparer.DefaultComparer, pool)
+	defer list.UnRef()
+
+	const (
+		writers = 8
+		n       = 2000
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for idx := 0; idx < n; idx++ {
+				key := []byte(fmt.Sprintf("key-%08d", idx*writers+w))
+				assert.Nil(t, list.Put(key, key))
+			}
+		}(w)
+	}
+
+	// 并发读取
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for idx := 0; idx < n; idx++ {
+			_, _, _ = list.Find([]byte(fmt.Sprintf("key-%08d", idx)))
+		}
+	}()
+	wg.Wait()
+
+	iter := NewConcurrentSkipListIter(list, nil)
+	defer iter.UnRef()
+
+	count := 0
+	for iter.Next() {
+		assert.EqualValues(t, fmt.Sprintf("key-%08d", count), iter.Key())
+		assert.EqualValues(t, iter.Key(), iter.Value())
+		count++
+	}
+	assert.Equal(t, writers*n, count)
+
+	assert.True(t, iter.Seek([]byte("key-00000100")))
+	assert.EqualValues(t, "key-00000100", iter.Key())
+
+	// 相同的key替换value
+	assert.Nil(t, list.Put([]byte("key-00000001"), []byte("new")))
+	value, err := list.Get([]byte("key-00000001"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, "new", value)
+
+	_, err = list.Get([]byte("key-not-exist"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestConcurrentSkipList_CapFull(t *testing.T) {
+
+	list := NewConcurrentSkipList(1<<10, comparer.DefaultComparer, pool)
+	defer list.UnRef()
+
+	var err error
+	for idx := 0; err == nil; idx++ {
+		err = list.Put([]byte(fmt.Sprintf("key-%08d", idx)), make([]byte, 100))
+	}
+	assert.Equal(t, ErrCapFull, err)
+
+	// 分配的arena包括node的header以及tower, 大于写入的kv大小
+	allocated := list.Allocated()
+	assert.True(t, allocated > list.Len())
+
+	list.Reset()
+	assert.Equal(t, 0, list.Len())
+	assert.Equal(t, allocated, list.Allocated())
+	assert.Nil(t, list.Put([]byte("key"), []byte("value")))
+}
+
+func TestConcurrentSkipListIter_Prev(t *testing.T) {
+
+	list := NewConcurrentSkipList(1<<22, comparer.DefaultComparer, pool)
+	defer list.UnRef()
+
+	const n = 500
+	for _, idx := range rand.Perm(n) {
+		key := []byte(fmt.Sprintf("key-%04d", idx*2))
+		assert.Nil(t, list.Put(key, key))
+	}
+
+	iter := NewConcurrentSkipListIter(list, nil)
+	defer iter.UnRef()
+
+	count := 0
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		assert.EqualValues(t, fmt.Sprintf("key-%04d", (n-1-count)*2), iter.Key())
+		assert.EqualValues(t, iter.Key(), iter.Value())
+		count++
+	}
+	assert.Equal(t, n, count)
+
+	// 越过第一个node之后Next从第一个node开始
+	assert.True(t, iter.Next())
+	assert.EqualValues(t, "key-0000", iter.Key())
+
+	assert.True(t, iter.SeekBefore([]byte("key-0501")))
+	assert.EqualValues(t, "key-0500", iter.Key())
+	assert.True(t, iter.SeekBefore([]byte("key-0500")))
+	assert.EqualValues(t, "key-0498", iter.Key())
+	assert.True(t, iter.Next())
+	assert.EqualValues(t, "key-0500", iter.Key())
+	assert.True(t, iter.SeekBefore([]byte("key-9999")))
+	assert.EqualValues(t, "key-0998", iter.Key())
+	assert.False(t, iter.SeekBefore([]byte("key-0000")))
+}
@@ -72,6 +72,7 @@ func (h *Heap) Pop() (i interface{}) {
 	p := h.array[1]
 
 	if h.lastOffset == 1 {
+		h.array = h.array[:1]
 		h.lastOffset--
 		return p
 	}
@@ -84,5 +85,6 @@ func (h *Heap) Pop() (i interface{}) {
 }
 
 func (h *Heap) Clear() {
-	h.array = nil
+	h.array = h.array[:1]
+	h.lastOffset = 0
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"myleveldb/comparer"
 	"myleveldb/utils"
+	"os"
 	"sync"
 	"sync/atomic"
 )
@@ -163,18 +164,16 @@ func (rbTree *LLRBTree) Ref() {
 // UnRef 减少引用次数
 func (rbTree *LLRBTree) UnRef() {
 	if ref := atomic.AddInt32(&rbTree.ref, -1); ref == 0 {
-		fmt.Printf("rbtree close ... \n")
 		rbTree.reset()
 	}
 }
 
+// Reset 清空所有的记录, 继续使用原来的内存
 func (rbTree *LLRBTree) Reset() {
 	rbTree.rw.Lock()
 	defer rbTree.rw.Unlock()
-	rbTree.ref = 0
+	rbTree.root = nil
 	rbTree.pos = 0
-	rbTree.data = rbTree.data[:0]
-	rbTree.pool.Put(rbTree.data)
 	rbTree.size = 0
 }
 
@@ -201,7 +200,7 @@ func (rbTree *LLRBTree) Put(key, value []byte) error {
 	defer rbTree.rw.Unlock()
 
 	kvLen := len(key) + len(value)
-	if rbTree.capacity-kvLen < 0 {
+	if rbTree.capacity-rbTree.pos-kvLen < 0 {
 		return ErrCapFull
 	}
 	rbTree.size += kvLen
@@ -220,7 +219,7 @@ func (rbTree *LLRBTree) Set(key, value []byte) error {
 	defer rbTree.rw.Unlock()
 
 	kvLen := len(key) + len(value)
-	if rbTree.capacity-kvLen < 0 {
+	if rbTree.capacity-rbTree.pos-kvLen < 0 {
 		return ErrCapFull
 	}
 	rbTree.size += kvLen
@@ -475,6 +474,25 @@ func (rbTree *LLRBTree) Get(key []byte) ([]byte, error) {
 	return nil, ErrNotFound
 }
 
+// 找到小于key的最大节点
+func (rbTree *LLRBTree) findLT(key []byte) (*lLRBTReeNode, error) {
+	x := rbTree.root
+	var lt *lLRBTReeNode
+	for x != nil {
+		if rbTree.cmp.Compare(x.key(rbTree.data), key) < 0 {
+			lt = x
+			x = x.right
+		} else {
+			x = x.left
+		}
+	}
+
+	if lt != nil {
+		return lt, nil
+	}
+	return nil, ErrNotFound
+}
+
 //FindGE 获取大于等于key的最小值
 func (rbTree *LLRBTree) findGE(key []byte) (*lLRBTReeNode, error) {
 	x := rbTree.root
@@ -516,6 +534,22 @@ func (rbTree *LLRBTree) FindGE(key []byte) ([]byte, error) {
 	return x.key(rbTree.data), nil
 }
 
+// Find 获取大于等于key的最小的kv对
+func (rbTree *LLRBTree) Find(key []byte) (rkey, value []byte, err error) {
+
+	rbTree.Ref()
+	defer rbTree.UnRef()
+
+	rbTree.rw.RLock()
+	defer rbTree.rw.RUnlock()
+
+	x, err := rbTree.findGE(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return x.key(rbTree.data), x.value(rbTree.data), nil
+}
+
 // Cap 获取当前树的容量
 func (rbTree *LLRBTree) Cap() int {
 	rbTree.rw.RLock()
@@ -530,6 +564,16 @@ func (rbTree *LLRBTree) Len() int {
 	return rbTree.size
 }
 
+// Allocated 实际占用的内存, buffer在创建时按照容量一次分配
+func (rbTree *LLRBTree) Allocated() int {
+	rbTree.rw.RLock()
+	defer rbTree.rw.RUnlock()
+	if rbTree.released {
+		return 0
+	}
+	return cap(rbTree.data)
+}
+
 // Close 关闭rbtree
 func (rbTree *LLRBTree) Close() error {
 	rbTree.rw.Lock()
@@ -542,7 +586,7 @@ func (rbTree *LLRBTree) Close() error {
 	return nil
 }
 
-// DebugIterString just 4 debug
+// DebugIterString just 4 debug, 输出到stderr
 func (rbTree *LLRBTree) DebugIterString() {
 	rbTree.root.debugIter(rbTree.data)
 }
@@ -554,7 +598,7 @@ func (rbTree *LLRBTree) Free() (int, error) {
 		return 0, ErrClosed
 	}
 	defer rbTree.rw.Unlock()
-	return cap(rbTree.data) - len(rbTree.data), nil
+	return rbTree.capacity - rbTree.pos, nil
 }
 
 type iterDir uint8
@@ -590,6 +634,24 @@ func NewLLRBTreeIter(rbTree *LLRBTree, releaser utils.Releaser) *LLRBTreeIter {
 	}
 }
 
+// SetReleaser 设置迭代器释放时需要一并释放的对象
+func (iter *LLRBTreeIter) SetReleaser(releaser utils.Releaser) {
+	iter.Releaser = releaser
+}
+
+// First 将迭代器移动到第一个节点
+func (iter *LLRBTreeIter) First() bool {
+	iter.rbTree.rw.RLock()
+	if iter.released {
+		iter.rbTree.rw.RUnlock()
+		iter.err = ErrIterReleased
+		return false
+	}
+	iter.soi, iter.eoi = true, false
+	iter.rbTree.rw.RUnlock()
+	return iter.Next()
+}
+
 func (iter *LLRBTreeIter) Next() bool {
 
 	iter.rbTree.rw.RLock()
@@ -655,17 +717,124 @@ func (iter *LLRBTreeIter) Seek(key []byte) bool {
 	iter.rbTree.rw.RLock()
 	defer iter.rbTree.rw.RUnlock()
 
-	if iter.eoi {
+	if iter.released {
+		iter.err = ErrIterReleased
+		return false
+	}
+
+	iter.soi, iter.eoi = false, false
+
+	x, err := iter.rbTree.findGE(key)
+	if err != nil {
+		iter.eoi = true
+		if err != ErrNotFound {
+			iter.err = err
+		}
+		return false
+	}
+
+	iter.offset = x
+	return true
+}
+
+// Last 将迭代器移动到最后一个节点
+func (iter *LLRBTreeIter) Last() bool {
+	iter.rbTree.rw.RLock()
+	defer iter.rbTree.rw.RUnlock()
+
+	if iter.released {
+		iter.err = ErrIterReleased
+		return false
+	}
+
+	return iter.last()
+}
+
+func (iter *LLRBTreeIter) last() bool {
+	iter.iterDir = dirBackward
+	iter.soi, iter.eoi = false, false
+	if iter.maxOffset == nil {
+		iter.soi = true
+		return false
+	}
+	iter.offset = iter.maxOffset
+	return true
+}
+
+// Prev 移动到前一个节点, 越过第一个节点之后Next重新从第一个节点开始
+func (iter *LLRBTreeIter) Prev() bool {
+
+	iter.rbTree.rw.RLock()
+	defer iter.rbTree.rw.RUnlock()
+
+	if iter.released {
+		iter.err = ErrIterReleased
 		return false
 	}
 
 	if iter.soi {
-		iter.soi = !iter.soi
+		return false
 	}
 
-	x, err := iter.rbTree.findGE(key)
+	if iter.eoi {
+		return iter.last()
+	}
+
+	iter.iterDir = dirBackward
+
+	node := iter.offset
+
+	if node == iter.minOffset {
+		iter.soi = true
+		return false
+	}
+
+	// 从它左子节点开始找
+	if node.left != nil {
+		iter.offset = node.left.findMax()
+		return true
+	}
+
+	for {
+
+		parent := node.parent
+
+		if parent == nil {
+			iter.soi = true
+			return false
+		}
+
+		if parent.left == node {
+			node = parent
+			continue
+		}
+
+		iter.offset = parent
+		return true
+
+	}
+
+}
+
+// SeekBefore 移动到小于key的最后一个节点
+func (iter *LLRBTreeIter) SeekBefore(key []byte) bool {
+	iter.rbTree.rw.RLock()
+	defer iter.rbTree.rw.RUnlock()
+
+	if iter.released {
+		iter.err = ErrIterReleased
+		return false
+	}
+
+	iter.iterDir = dirBackward
+	iter.soi, iter.eoi = false, false
+
+	x, err := iter.rbTree.findLT(key)
 	if err != nil {
-		iter.err = err
+		iter.soi = true
+		if err != ErrNotFound {
+			iter.err = err
+		}
 		return false
 	}
 
@@ -703,6 +872,6 @@ func (lLRBTReeNode *lLRBTReeNode) debugIter(data []byte) {
 		return
 	}
 	lLRBTReeNode.left.debugIter(data)
-	fmt.Printf("key=%s, value=%s\n", lLRBTReeNode.key(data), lLRBTReeNode.value(data))
+	fmt.Fprintf(os.Stderr, "key=%s, value=%s\n", lLRBTReeNode.key(data), lLRBTReeNode.value(data))
 	lLRBTReeNode.right.debugIter(data)
 }
@@ -178,3 +178,39 @@ func TestLLRBTreeIter_Seek(t *testing.T) {
 	tree.Close()
 
 }
+
+func TestLLRBTreeIter_Prev(t *testing.T) {
+	tree := NewLLRBTree(1<<22, comparer.DefaultComparer, pool)
+	defer tree.Close()
+
+	const n = 500
+	for _, idx := range rand.Perm(n) {
+		key := []byte(fmt.Sprintf("key-%04d", idx*2))
+		assert.Nil(t, tree.Put(key, key))
+	}
+
+	iter := NewLLRBTreeIter(tree, nil)
+	defer iter.UnRef()
+
+	count := 0
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		assert.EqualValues(t, fmt.Sprintf("key-%04d", (n-1-count)*2), iter.Key())
+		assert.EqualValues(t, iter.Key(), iter.Value())
+		count++
+	}
+	assert.Equal(t, n, count)
+
+	// 越过第一个节点之后Next从第一个节点开始
+	assert.True(t, iter.Next())
+	assert.EqualValues(t, "key-0000", iter.Key())
+
+	assert.True(t, iter.SeekBefore([]byte("key-0501")))
+	assert.EqualValues(t, "key-0500", iter.Key())
+	assert.True(t, iter.SeekBefore([]byte("key-0500")))
+	assert.EqualValues(t, "key-0498", iter.Key())
+	assert.True(t, iter.Next())
+	assert.EqualValues(t, "key-0500", iter.Key())
+	assert.True(t, iter.SeekBefore([]byte("key-9999")))
+	assert.EqualValues(t, "key-0998", iter.Key())
+	assert.False(t, iter.SeekBefore([]byte("key-0000")))
+}
@@ -54,6 +54,10 @@ type bucketNode struct {
 	ref       int32
 	cacheData unsafe.Pointer            // cacheData的引用
 	deleter   BucketNodeDeleterCallback // 当元素被剔除的回调函数
+
+	// 加载value完成(成功或者失败)时关闭, 同时get到加载中的节点时需要等待, 否则拿到的value为nil
+	ready   chan struct{}
+	loadErr error
 }
 
 // Size 返回节点的内存大小
@@ -75,7 +79,7 @@ func (bk *bucketNode) Value() interface{} {
 // Unref 减少一次引用次数, 如果变为0了, 则直接回收
 func (bk *bucketNode) unref() {
 	if atomic.AddInt32(&bk.ref, -1) == 0 {
-		bk.lruMap.delete(bk.hash, bk.namespace, bk.key)
+		bk.lruMap.delete(bk)
 	}
 }
 
@@ -205,8 +209,9 @@ func (m *mBucket) allocateBucket(slot uint32) *bucket {
 			}
 		}
 
+		// 发布之后其他goroutine可能马上写入bkt, 需要在发布之前计算长度
+		bucketLen := len(bkt.nodes)
 		if atomic.CompareAndSwapPointer(&m.buckets[slot], nil, unsafe.Pointer(bkt)) {
-			bucketLen := len(bkt.nodes)
 			// 计算一个bucket的overflow
 			if bucketLen > mBucketOverflow {
 				atomic.AddUint32(&m.overflow, uint32(bucketLen-mBucketOverflow))
@@ -234,11 +239,14 @@ func (m *lruMap) get(namespace, hash uint32, key []byte, createOnNotExists bool)
 			continue
 		}
 
+		// 在锁内增加引用, 引用变为0的节点在delete中检查引用之前被找到时不会被删除
 		_, bn := bucket.lookUp(hash, namespace, key)
+		if bn != nil {
+			atomic.AddInt32(&bn.ref, 1)
+		}
 		bucket.rwLock.RUnlock()
 		// 如果不需要判断"不存在也要创建节点的话", 那么不管找不找到节点都返回
 		if bn != nil {
-			atomic.AddInt32(&bn.ref, 1)
 			return false, bn
 		}
 
@@ -248,6 +256,17 @@ func (m *lruMap) get(namespace, hash uint32, key []byte, createOnNotExists bool)
 		}
 
 		bucket.rwLock.Lock()
+		if bucket.frozen {
+			bucket.rwLock.Unlock()
+			continue
+		}
+
+		// 释放读锁之后其他goroutine可能已经加入了同一个key
+		if _, bn = bucket.lookUp(hash, namespace, key); bn != nil {
+			atomic.AddInt32(&bn.ref, 1)
+			bucket.rwLock.Unlock()
+			return false, bn
+		}
 
 		node = &bucketNode{
 			lruMap:    m,
@@ -255,6 +274,7 @@ func (m *lruMap) get(namespace, hash uint32, key []byte, createOnNotExists bool)
 			namespace: namespace,
 			key:       key,
 			ref:       1,
+			ready:     make(chan struct{}),
 		}
 
 		bucket.nodes = append(bucket.nodes, node)
@@ -290,64 +310,67 @@ func (m *lruMap) get(namespace, hash uint32, key []byte, createOnNotExists bool)
 
 }
 
-// 删掉map集合中的一个节点
-func (m *lruMap) delete(namespace, hash uint32, key []byte) {
+// 删掉map集合中引用变为0的节点, 按照节点本身而不是key查找, 同一个key可能已经加入了新的节点,
+// 在删除之前又被get引用的节点不删除
+func (m *lruMap) delete(evicted *bucketNode) {
 
 	for {
 		mb := loadMBucket(&m.mBucket)
-		bucket := mb.loadBucket(hash)
+		bucket := mb.loadBucket(evicted.hash)
 		bucket.rwLock.Lock()
 		if bucket.frozen {
 			bucket.rwLock.Unlock()
 			continue
 		}
 
-		idx, evicted := bucket.lookUp(hash, namespace, key)
+		idx := -1
+		for i, n := range bucket.nodes {
+			if n == evicted {
+				idx = i
+				break
+			}
+		}
 
-		if evicted == nil {
+		if idx == -1 || atomic.LoadInt32(&evicted.ref) > 0 {
 			bucket.rwLock.Unlock()
 			return
 		}
 
-		if bytes.Compare(evicted.key, key) == 0 && evicted.hash == hash {
-
-			bucket.nodes = append(bucket.nodes[:idx], bucket.nodes[idx+1:]...)
-			bucket.rwLock.Unlock()
-
-			// 如果达到缩容的情况下, 需要判断是不是达到最低限度了
-			if atomic.AddInt32(&m.nodes, -1) < int32(mb.shrinkThreshold) &&
-				mb.shrinkThreshold > mInitBucketSlot*mBucketOverflow {
+		bucket.nodes = append(bucket.nodes[:idx], bucket.nodes[idx+1:]...)
+		bucket.rwLock.Unlock()
 
-				if atomic.CompareAndSwapUint32(&mb.resizeInProgress, 0, 1) {
+		// 如果达到缩容的情况下, 需要判断是不是达到最低限度了
+		if atomic.AddInt32(&m.nodes, -1) < int32(mb.shrinkThreshold) &&
+			mb.shrinkThreshold > mInitBucketSlot*mBucketOverflow {
 
-					resizeSlot := mb.slots >> 1
+			if atomic.CompareAndSwapUint32(&mb.resizeInProgress, 0, 1) {
 
-					resizeMb := &mBucket{
-						shardMask:         resizeSlot - 1,
-						slots:             resizeSlot,
-						growThreshold:     resizeSlot * mBucketOverflow,
-						shrinkThreshold:   resizeSlot * mBucketOverflow >> 1,
-						inProgressMBucket: unsafe.Pointer(mb),
-						buckets:           make([]unsafe.Pointer, resizeSlot),
-					}
+				resizeSlot := mb.slots >> 1
 
-					if atomic.CompareAndSwapPointer(&m.mBucket, unsafe.Pointer(mb), unsafe.Pointer(resizeMb)) {
-						go resizeMb.allocateBuckets()
-					}
+				resizeMb := &mBucket{
+					shardMask:         resizeSlot - 1,
+					slots:             resizeSlot,
+					growThreshold:     resizeSlot * mBucketOverflow,
+					shrinkThreshold:   resizeSlot * mBucketOverflow >> 1,
+					inProgressMBucket: unsafe.Pointer(mb),
+					buckets:           make([]unsafe.Pointer, resizeSlot),
+				}
 
+				if atomic.CompareAndSwapPointer(&m.mBucket, unsafe.Pointer(mb), unsafe.Pointer(resizeMb)) {
+					go resizeMb.allocateBuckets()
 				}
-			}
 
-			if rel, ok := evicted.Value().(utils.Releaser); ok {
-				rel.UnRef()
 			}
+		}
 
-			k, v, deleter := evicted.key, evicted.Value(), evicted.deleter
+		if rel, ok := evicted.Value().(utils.Releaser); ok {
+			rel.UnRef()
+		}
 
-			if deleter != nil {
-				deleter(k, v)
-			}
+		k, v, deleter := evicted.key, evicted.Value(), evicted.deleter
 
+		if deleter != nil {
+			deleter(k, v)
 		}
 
 		return
@@ -414,9 +437,11 @@ func (h *LRUHandle) UnRef() {
 
 // LRUNode lru的节点
 type LRUNode struct {
-	prev   *LRUNode
-	next   *LRUNode
-	handle *LRUHandle
+	prev      *LRUNode
+	next      *LRUNode
+	handle    *LRUHandle
+	probation bool // 2Q策略中是否在probation链表中
+	pins      int  // 被固定的次数, 大于0时不在链表中, 不会被驱逐
 }
 
 // Lru lru双向链表
@@ -425,12 +450,10 @@ type Lru struct {
 }
 
 func newLru() *Lru {
-	recent := LRUNode{}
-	recent.next = &recent
-	recent.prev = &recent
-	return &Lru{
-		recent: recent,
-	}
+	lru := &Lru{}
+	lru.recent.next = &lru.recent
+	lru.recent.prev = &lru.recent
+	return lru
 }
 
 // 将node加入到队列头部
@@ -440,10 +463,10 @@ func (lru *Lru) insert(node *LRUNode) {
 		panic("insert node is recent")
 	}
 
-	recent := lru.recent
+	recent := &lru.recent
 	recentNext := recent.next
 	recent.next = node
-	node.prev = &recent
+	node.prev = recent
 
 	node.next = recentNext
 	recentNext.prev = node
@@ -465,6 +488,27 @@ func (lru *Lru) remove(node *LRUNode) {
 	next.prev = prev
 }
 
+// CacheStats 缓存的统计信息
+type CacheStats struct {
+	Hits      uint64 // 命中的次数
+	Misses    uint64 // 没有命中的次数
+	Inserts   uint64 // 加入缓存的次数
+	Evictions uint64 // 容量不足被驱逐的次数
+	Size      int64  // 当前的容量, 包括固定的节点
+	Pinned    int64  // 固定的节点占用的容量
+	Capacity  int64  // 最大容量
+}
+
+func (stats *CacheStats) add(other CacheStats) {
+	stats.Hits += other.Hits
+	stats.Misses += other.Misses
+	stats.Inserts += other.Inserts
+	stats.Evictions += other.Evictions
+	stats.Size += other.Size
+	stats.Pinned += other.Pinned
+	stats.Capacity += other.Capacity
+}
+
 // LRUCache lrucache的实现
 type LRUCache struct {
 	lruMap      *lruMap // 真正存放数据的map
@@ -474,16 +518,39 @@ type LRUCache struct {
 	mutex       sync.RWMutex
 	closedMutex sync.RWMutex
 	closed      bool
+
+	// 2Q策略, lru作为protected链表
+	policy        CachePolicy
+	probation     *Lru
+	probationSize int64
+	nodes         int // 两个链表中节点的数量, 用于限制ghost的长度
+	ghost         *ghost
+
+	pinnedSize int64 // 固定的节点的容量, 包含在size中
+
+	// 统计, atomic
+	hits      uint64
+	misses    uint64
+	inserts   uint64
+	evictions uint64
 }
 
 func NewLRUCache(capacity int64) *LRUCache {
+	return NewCache(capacity, CachePolicyLRU)
+}
+
+// NewCache 使用指定的淘汰策略新建缓存
+func NewCache(capacity int64, policy CachePolicy) *LRUCache {
 
 	cache := new(LRUCache)
 	cache.capacity = capacity
+	cache.policy = policy
 	cache.lru = newLru()
+	cache.probation = newLru()
+	cache.ghost = newGhost()
 	cache.lruMap = newLruMap()
 	runtime.KeepAlive(cache)
-	runtime.SetFinalizer(cache, cache.Close())
+	runtime.SetFinalizer(cache, (*LRUCache).Close)
 	return cache
 }
 
@@ -493,16 +560,20 @@ type SetFunc func() (int64, Value, BucketNodeDeleterCallback, error)
 // Get 从map中获取, 如果获取不到的话, sf不为空则会把k,v放置到lru的最新节点上, 并把kv放进map中
 // 当从该函数获取LRUHandle时，需要手动进行一次release()函数调用以减少一次引用计数
 func (lruCache *LRUCache) Get(namespace uint32, key []byte, f SetFunc) (*LRUHandle, error) {
+	return lruCache.get(namespace, hash32(key), key, f)
+}
+
+func (lruCache *LRUCache) get(namespace, h uint32, key []byte, f SetFunc) (*LRUHandle, error) {
 	lruCache.closedMutex.RLock()
 	defer lruCache.closedMutex.RUnlock()
 	if lruCache.closed {
 		return nil, ErrCacheClosed
 	}
 
-	h := hash32(key)
 	added, node := lruCache.lruMap.get(namespace, h, key, f != nil)
 
 	if node == nil {
+		atomic.AddUint64(&lruCache.misses, 1)
 		return nil, ErrNotFound
 	}
 
@@ -511,21 +582,49 @@ func (lruCache *LRUCache) Get(namespace uint32, key []byte, f SetFunc) (*LRUHand
 	}
 
 	// 如果不是添加的节点, 那么说明之前该节点已经存在
-	// 需要重新放入到队列中
+	// 需要重新放入到队列中, 节点还在加载中时等待加载完成
 	if !added {
+		<-node.ready
+		if node.loadErr != nil {
+			err := node.loadErr
+			node.unref()
+			if f == nil {
+				err = ErrNotFound
+			}
+			atomic.AddUint64(&lruCache.misses, 1)
+			return nil, err
+		}
+		atomic.AddUint64(&lruCache.hits, 1)
 		lruCache.promote(node)
 		return handle, nil
 	}
 
-	size, value, deleter, err := f()
-	if err != nil {
+	atomic.AddUint64(&lruCache.misses, 1)
+	if err := lruCache.load(node, f); err != nil {
 		node.unref() // 释放掉node
 		return nil, err
 	}
+	atomic.AddUint64(&lruCache.inserts, 1)
+
+	return handle, nil
+
+}
+
+// 加载新加入的节点的value并挂载到lru上, 完成后唤醒等待的get
+func (lruCache *LRUCache) load(node *bucketNode, f SetFunc) (err error) {
+
+	defer func() {
+		node.loadErr = err
+		close(node.ready)
+	}()
+
+	size, value, deleter, err := f()
+	if err != nil {
+		return err
+	}
 
 	if size == 0 || value == nil {
-		node.unref()
-		return nil, ErrInvalidValue
+		return ErrInvalidValue
 	}
 
 	node.value = &bucketNodeValue{
@@ -533,18 +632,15 @@ func (lruCache *LRUCache) Get(namespace uint32, key []byte, f SetFunc) (*LRUHand
 		byteSize: size,
 	}
 	node.deleter = deleter
-	err = lruCache.promote(node)
-	if err != nil {
-		node.unref()
-		return nil, err
-	}
-
-	return handle, nil
-
+	return lruCache.promote(node)
 }
 
 // Delete 从缓存直接删掉
 func (lruCache *LRUCache) Delete(ns uint32, key []byte) (bool, error) {
+	return lruCache.delete(ns, hash32(key), key)
+}
+
+func (lruCache *LRUCache) delete(ns, hash32 uint32, key []byte) (bool, error) {
 
 	lruCache.closedMutex.RLock()
 	defer lruCache.closedMutex.RUnlock()
@@ -552,8 +648,6 @@ func (lruCache *LRUCache) Delete(ns uint32, key []byte) (bool, error) {
 		return false, ErrCacheClosed
 	}
 
-	hash32 := hash32(key)
-
 	for {
 		mBucket := loadMBucket(&lruCache.lruMap.mBucket)
 		bucket := mBucket.loadBucket(hash32)
@@ -570,18 +664,12 @@ func (lruCache *LRUCache) Delete(ns uint32, key []byte) (bool, error) {
 		}
 		bucket.rwLock.Unlock()
 
-		// map自身解除引用
-		node.unref()
-
-		nPtr := node.cacheData
-		if atomic.CompareAndSwapPointer(&node.cacheData, nPtr, nil) {
-			// lru解除引用
-			lruNode := loadLruNode(&nPtr)
-			lruCache.mutex.Lock()
-			lruCache.lru.remove(lruNode)
-			lruCache.size -= node.Size()
-			lruCache.mutex.Unlock()
-			lruNode.handle.UnRef() // 节点解除对node的引用
+		// 从lru中删除, lru解除对node的引用后, 没有被使用的node会从map中删除
+		lruCache.mutex.Lock()
+		lruNode := lruCache.detach(node)
+		lruCache.mutex.Unlock()
+		if lruNode != nil {
+			lruNode.handle.UnRef()
 		}
 
 		return true, nil
@@ -590,6 +678,72 @@ func (lruCache *LRUCache) Delete(ns uint32, key []byte) (bool, error) {
 
 }
 
+// EvictNamespace 删掉namespace中所有在lru中的节点, 正在被使用的节点在使用结束后删除
+func (lruCache *LRUCache) EvictNamespace(ns uint32) {
+
+	lruCache.closedMutex.RLock()
+	defer lruCache.closedMutex.RUnlock()
+	if lruCache.closed {
+		return
+	}
+
+	lruCache.mutex.Lock()
+	removed := make([]*LRUNode, 0)
+	for _, lru := range []*Lru{lruCache.probation, lruCache.lru} {
+		recent := &lru.recent
+		for n := recent.prev; n != recent; {
+			prev := n.prev
+			if node := loadBucketNode(&n.handle.bucketNode); node != nil && node.namespace == ns {
+				lruCache.detach(node)
+				removed = append(removed, n)
+			}
+			n = prev
+		}
+	}
+	lruCache.mutex.Unlock()
+
+	for _, v := range removed {
+		v.handle.UnRef()
+	}
+}
+
+// Stats 获取统计信息
+func (lruCache *LRUCache) Stats() CacheStats {
+	lruCache.mutex.RLock()
+	size, pinned := lruCache.size, lruCache.pinnedSize
+	lruCache.mutex.RUnlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&lruCache.hits),
+		Misses:    atomic.LoadUint64(&lruCache.misses),
+		Inserts:   atomic.LoadUint64(&lruCache.inserts),
+		Evictions: atomic.LoadUint64(&lruCache.evictions),
+		Size:      size,
+		Pinned:    pinned,
+		Capacity:  lruCache.capacity,
+	}
+}
+
+// 将node从lru中摘除, 返回lru中的节点, 需要持有mutex
+func (lruCache *LRUCache) detach(node *bucketNode) *LRUNode {
+	lruNode := loadLruNode(&node.cacheData)
+	if lruNode == nil {
+		return nil
+	}
+	atomic.StorePointer(&node.cacheData, nil)
+	if lruNode.pins > 0 {
+		// 固定的节点不在链表中
+		lruCache.pinnedSize -= node.Size()
+	} else if lruNode.probation {
+		lruCache.probation.remove(lruNode)
+		lruCache.probationSize -= node.Size()
+	} else {
+		lruCache.lru.remove(lruNode)
+	}
+	lruCache.size -= node.Size()
+	lruCache.nodes--
+	return lruNode
+}
+
 // Close 设置关闭方法
 func (lruCache *LRUCache) Close() error {
 
@@ -598,16 +752,18 @@ func (lruCache *LRUCache) Close() error {
 	if !lruCache.closed {
 		lruCache.closed = true
 		lruCache.mutex.Lock()
-		lru := lruCache.lru
-		// 倾倒lru链表
-		recent := lru.recent
-		eldest := recent.prev
+		// 倾倒lru链表, 从后往前遍历
 		removed := make([]*LRUNode, 0)
-		// 从后往前遍历
-		for ; eldest != &recent; eldest = eldest.prev {
-			lru.remove(eldest)
-			// 解除自身对map的引用
-			removed = append(removed, eldest)
+		for _, lru := range []*Lru{lruCache.probation, lruCache.lru} {
+			recent := &lru.recent
+			eldest := recent.prev
+			for eldest != recent {
+				prev := eldest.prev
+				lru.remove(eldest)
+				// 解除自身对map的引用
+				removed = append(removed, eldest)
+				eldest = prev
+			}
 		}
 		lruCache.mutex.Unlock()
 		for _, v := range removed {
@@ -617,22 +773,36 @@ func (lruCache *LRUCache) Close() error {
 	return nil
 }
 
-// promote 将节点挂载到lru上
+// promote 将节点挂载到lru上, 已经在lru中的节点移动到最新的位置
 func (lruCache *LRUCache) promote(node *bucketNode) error {
-	lruNode := (*LRUNode)(atomic.LoadPointer(&node.cacheData))
 	lruCache.mutex.Lock()
 
 	if lruCache.closed {
+		lruCache.mutex.Unlock()
 		return ErrCacheClosed
 	}
 
+	lruNode := loadLruNode(&node.cacheData)
+	if lruNode != nil && lruNode.pins > 0 {
+		// 固定的节点不在链表中, 不需要移动
+		lruCache.mutex.Unlock()
+		return nil
+	}
 	if lruNode != nil {
-		lruCache.lru.remove(lruNode)
+		if lruNode.probation {
+			// probation中再次命中, 移动到protected
+			lruCache.probation.remove(lruNode)
+			lruCache.probationSize -= node.Size()
+			lruNode.probation = false
+		} else {
+			lruCache.lru.remove(lruNode)
+		}
 		lruCache.lru.insert(lruNode)
 		lruCache.mutex.Unlock()
 		return nil
 	}
 
+	// lru持有node的一次引用, 被驱逐时释放
 	node.Ref()
 
 	lruNode = &LRUNode{
@@ -640,30 +810,62 @@ func (lruCache *LRUCache) promote(node *bucketNode) error {
 			bucketNode: unsafe.Pointer(node),
 		},
 	}
+	atomic.StorePointer(&node.cacheData, unsafe.Pointer(lruNode))
 
-	lruCache.lru.insert(lruNode)
+	// 2Q策略中最近被淘汰过的节点直接进入protected, 否则先进入probation
+	if lruCache.policy == CachePolicy2Q && !lruCache.ghost.remove(node) {
+		lruNode.probation = true
+		lruCache.probation.insert(lruNode)
+		lruCache.probationSize += node.Size()
+	} else {
+		lruCache.lru.insert(lruNode)
+	}
 	lruCache.size += node.Size()
+	lruCache.nodes++
+
+	removed := lruCache.evict()
+	lruCache.mutex.Unlock()
+
+	for _, v := range removed {
+		v.handle.UnRef()
+	}
 
+	return nil
+
+}
+
+// 超过容量时驱逐节点直到容量小于capacity, 返回被驱逐的节点, 需要持有mutex, 释放mutex后再解除节点的引用
+func (lruCache *LRUCache) evict() []*LRUNode {
 	if lruCache.size < lruCache.capacity {
-		lruCache.mutex.Unlock()
 		return nil
 	}
-	recent := lruCache.lru.recent
-	eldest := recent.prev
+
 	removed := make([]*LRUNode, 0)
-	for eldest != &recent && lruCache.size >= lruCache.capacity {
-		lruCache.lru.remove(eldest)
-		lruCache.size -= eldest.handle.Size()
+	for lruCache.size >= lruCache.capacity {
+		eldest := lruCache.evictCandidate()
+		if eldest == nil {
+			break
+		}
+		evicted := loadBucketNode(&eldest.handle.bucketNode)
+		if eldest.probation {
+			lruCache.ghost.add(evicted, lruCache.nodes)
+		}
+		lruCache.detach(evicted)
 		removed = append(removed, eldest)
-		eldest = recent.prev
 	}
+	atomic.AddUint64(&lruCache.evictions, uint64(len(removed)))
+	return removed
+}
 
-	lruCache.mutex.Unlock()
-
-	for _, v := range removed {
-		v.handle.UnRef()
+// 下一个被淘汰的节点, 没有节点时返回nil, 需要持有mutex
+func (lruCache *LRUCache) evictCandidate() *LRUNode {
+	probation, protected := &lruCache.probation.recent, &lruCache.lru.recent
+	if probation.prev != probation &&
+		(lruCache.probationSize > lruCache.capacity/probationRatio || protected.prev == protected) {
+		return probation.prev
+	}
+	if protected.prev != protected {
+		return protected.prev
 	}
-
 	return nil
-
 }
@@ -0,0 +1,128 @@
+package collections
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/**
+固定的节点
+
+Pin跟Get一样返回节点的handle, 区别是handle释放之前节点不会被驱逐:
+
+1. 固定的节点从lru/probation链表中摘除, 驱逐只从链表中选择节点, 所以不会被驱逐
+2. 节点的大小仍然计入size, 固定的节点越多, 链表中可以缓存的节点越少,
+   所有节点都被固定时size可以超过capacity
+3. 同一个节点可以被固定多次, 最后一次释放时重新放入protected链表, 超过容量时驱逐其他节点
+4. 固定的节点被Delete或者缓存关闭时从缓存中摘除, handle释放后节点从map中删除
+**/
+
+// PinnedHandle Pin返回的handle, UnRef之后节点重新可以被驱逐
+type PinnedHandle struct {
+	*LRUHandle
+	cache   *LRUCache
+	lruNode *LRUNode
+	once    sync.Once
+}
+
+// UnRef 解除固定, 并减少一次引用次数
+func (h *PinnedHandle) UnRef() {
+	h.once.Do(func() {
+		h.cache.unpin(h.lruNode)
+		h.LRUHandle.UnRef()
+	})
+}
+
+// Pin 跟Get相同, 返回的handle释放之前节点不会被驱逐, 节点的大小仍然计入容量
+func (lruCache *LRUCache) Pin(namespace uint32, key []byte, f SetFunc) (*PinnedHandle, error) {
+	return lruCache.pin(namespace, hash32(key), key, f)
+}
+
+func (lruCache *LRUCache) pin(namespace, h uint32, key []byte, f SetFunc) (*PinnedHandle, error) {
+
+	handle, err := lruCache.get(namespace, h, key, f)
+	if err != nil {
+		return nil, err
+	}
+	node := loadBucketNode(&handle.bucketNode)
+
+	lruCache.mutex.Lock()
+	if lruCache.closed {
+		lruCache.mutex.Unlock()
+		handle.UnRef()
+		return nil, ErrCacheClosed
+	}
+
+	lruNode := loadLruNode(&node.cacheData)
+	if lruNode == nil {
+		// get之后已经被其他节点挤出了lru, 重新挂载
+		node.Ref()
+		lruNode = &LRUNode{
+			handle: &LRUHandle{
+				bucketNode: unsafe.Pointer(node),
+			},
+		}
+		atomic.StorePointer(&node.cacheData, unsafe.Pointer(lruNode))
+		lruCache.size += node.Size()
+		lruCache.nodes++
+	} else if lruNode.pins == 0 {
+		if lruNode.probation {
+			lruCache.probation.remove(lruNode)
+			lruCache.probationSize -= node.Size()
+			lruNode.probation = false
+		} else {
+			lruCache.lru.remove(lruNode)
+		}
+	}
+	if lruNode.pins == 0 {
+		lruCache.pinnedSize += node.Size()
+	}
+	lruNode.pins++
+
+	removed := lruCache.evict()
+	lruCache.mutex.Unlock()
+
+	for _, v := range removed {
+		v.handle.UnRef()
+	}
+
+	return &PinnedHandle{LRUHandle: handle, cache: lruCache, lruNode: lruNode}, nil
+}
+
+// 解除一次固定, 最后一次解除时节点重新放入lru
+func (lruCache *LRUCache) unpin(lruNode *LRUNode) {
+
+	lruCache.mutex.Lock()
+	lruNode.pins--
+	node := loadBucketNode(&lruNode.handle.bucketNode)
+	// 已经被Delete摘除
+	if lruNode.pins > 0 || node == nil || loadLruNode(&node.cacheData) != lruNode {
+		lruCache.mutex.Unlock()
+		return
+	}
+
+	lruCache.pinnedSize -= node.Size()
+	var removed []*LRUNode
+	if lruCache.closed {
+		// 关闭时固定的节点没有被倾倒, 在这里摘除
+		atomic.StorePointer(&node.cacheData, nil)
+		lruCache.size -= node.Size()
+		lruCache.nodes--
+		removed = append(removed, lruNode)
+	} else {
+		lruCache.lru.insert(lruNode)
+		removed = lruCache.evict()
+	}
+	lruCache.mutex.Unlock()
+
+	for _, v := range removed {
+		v.handle.UnRef()
+	}
+}
+
+// Pin 与LRUCache.Pin相同, 在key所在的分片中固定
+func (cache *ShardedLRUCache) Pin(ns uint32, key []byte, f SetFunc) (*PinnedHandle, error) {
+	shard, h := cache.shard(ns, key)
+	return shard.pin(ns, h, key, f)
+}
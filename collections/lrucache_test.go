@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -113,7 +114,9 @@ func Test_lruMap_shrink(t *testing.T) {
 		added, node := lruMap.get(namespace, hash32, keys[idx], false)
 		assert.False(t, added)
 		assert.NotNil(t, node)
-		lruMap.delete(namespace, hash32, keys[idx])
+		// 创建以及查找各持有一次引用, 引用变为0时从map中删除
+		node.unref()
+		node.unref()
 		added, node = lruMap.get(namespace, hash32, keys[idx], false)
 		assert.False(t, added)
 		assert.Nil(t, node)
@@ -122,3 +125,59 @@ func Test_lruMap_shrink(t *testing.T) {
 	t.Logf("lrumap = %#v", lruMap)
 
 }
+
+// 测试固定的节点不会被驱逐, 仍然计入容量
+func TestLRUCache_Pin(t *testing.T) {
+
+	cache := NewLRUCache(100)
+
+	var pinnedReleased, released int32
+	ph, err := cache.Pin(namespace, []byte("pinned"), testSetFunc(30, &pinnedReleased))
+	assert.Nil(t, err)
+
+	for i := 0; i < 20; i++ {
+		h, err := cache.Get(namespace, []byte(fmt.Sprintf("key-%d", i)), testSetFunc(10, &released))
+		assert.Nil(t, err)
+		h.UnRef()
+	}
+
+	stats := cache.Stats()
+	assert.EqualValues(t, 30, stats.Pinned)
+	assert.True(t, stats.Size < stats.Capacity)
+	// 固定的节点占用了30, 链表中最多只能保留6个节点
+	assert.EqualValues(t, 14, atomic.LoadInt32(&released))
+
+	// 命中固定的节点
+	h, err := cache.Get(namespace, []byte("pinned"), nil)
+	assert.Nil(t, err)
+	h.UnRef()
+	assert.EqualValues(t, 0, atomic.LoadInt32(&pinnedReleased))
+
+	// 解除固定后重新可以被驱逐
+	ph.UnRef()
+	ph.UnRef()
+	assert.EqualValues(t, 0, cache.Stats().Pinned)
+	for i := 20; i < 40; i++ {
+		h, err := cache.Get(namespace, []byte(fmt.Sprintf("key-%d", i)), testSetFunc(10, &released))
+		assert.Nil(t, err)
+		h.UnRef()
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&pinnedReleased))
+
+	// 固定期间被删除或者缓存关闭, 释放handle之后从map中删除
+	ph, err = cache.Pin(namespace, []byte("deleted"), testSetFunc(10, &pinnedReleased))
+	assert.Nil(t, err)
+	ok, err := cache.Delete(namespace, []byte("deleted"))
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&pinnedReleased))
+	ph.UnRef()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&pinnedReleased))
+
+	ph, err = cache.Pin(namespace, []byte("closed"), testSetFunc(10, &pinnedReleased))
+	assert.Nil(t, err)
+	cache.Close()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&pinnedReleased))
+	ph.UnRef()
+	assert.EqualValues(t, 3, atomic.LoadInt32(&pinnedReleased))
+}
@@ -0,0 +1,105 @@
+package collections
+
+/**
+分片的lrucache
+
+按照key的hash分成 1<<shardBits 个LRUCache, 每个分片有自己的lru链表以及锁, 容量平均分配到每个分片,
+写满时只在自己的分片中驱逐, 不同分片之间的读写互不影响
+
+分片使用hash的高位, LRUCache内部的lruMap使用hash的低位, 避免同一个分片中的key集中在少数几个bucket
+
+	hash32(key) ^ ns*0x9e3779b1
+	|  shard bits  |            ...            |  bucket mask  |
+**/
+
+const (
+	maxCacheShardBits = 10
+)
+
+// ShardedLRUCache 分片的lrucache
+type ShardedLRUCache struct {
+	shards []*LRUCache
+	shift  uint32
+}
+
+// NewShardedLRUCache 新建分片的lrucache, capacity为所有分片的总容量
+func NewShardedLRUCache(capacity int64, shardBits int) *ShardedLRUCache {
+	return NewShardedCache(capacity, shardBits, CachePolicyLRU)
+}
+
+// NewShardedCache 新建分片的缓存, 每个分片使用policy淘汰
+func NewShardedCache(capacity int64, shardBits int, policy CachePolicy) *ShardedLRUCache {
+
+	if shardBits < 0 {
+		shardBits = 0
+	}
+	if shardBits > maxCacheShardBits {
+		shardBits = maxCacheShardBits
+	}
+
+	n := 1 << shardBits
+	perShard := capacity / int64(n)
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	cache := &ShardedLRUCache{
+		shards: make([]*LRUCache, n),
+		shift:  uint32(32 - shardBits),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = NewCache(perShard, policy)
+	}
+	return cache
+}
+
+func (cache *ShardedLRUCache) shard(ns uint32, key []byte) (*LRUCache, uint32) {
+	h := hash32(key)
+	// shift为32时(只有一个分片)结果为0
+	return cache.shards[(h^ns*0x9e3779b1)>>cache.shift], h
+}
+
+// Get 与LRUCache.Get相同, 在key所在的分片中查找
+func (cache *ShardedLRUCache) Get(ns uint32, key []byte, f SetFunc) (*LRUHandle, error) {
+	shard, h := cache.shard(ns, key)
+	return shard.get(ns, h, key, f)
+}
+
+// Delete 从key所在的分片中删掉
+func (cache *ShardedLRUCache) Delete(ns uint32, key []byte) (bool, error) {
+	shard, h := cache.shard(ns, key)
+	return shard.delete(ns, h, key)
+}
+
+// EvictNamespace 删掉所有分片中namespace的节点
+func (cache *ShardedLRUCache) EvictNamespace(ns uint32) {
+	for _, shard := range cache.shards {
+		shard.EvictNamespace(ns)
+	}
+}
+
+// Stats 所有分片的统计信息之和
+func (cache *ShardedLRUCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, shard := range cache.shards {
+		stats.add(shard.Stats())
+	}
+	return stats
+}
+
+// ShardStats 每个分片的统计信息
+func (cache *ShardedLRUCache) ShardStats() []CacheStats {
+	stats := make([]CacheStats, len(cache.shards))
+	for i, shard := range cache.shards {
+		stats[i] = shard.Stats()
+	}
+	return stats
+}
+
+// Close 关闭所有分片
+func (cache *ShardedLRUCache) Close() error {
+	for _, shard := range cache.shards {
+		shard.Close()
+	}
+	return nil
+}
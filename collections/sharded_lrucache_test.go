@@ -0,0 +1,105 @@
+package collections
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCacheValue struct {
+	released *int32
+}
+
+func (v *testCacheValue) UnRef() {
+	atomic.AddInt32(v.released, 1)
+}
+
+func testSetFunc(size int64, released *int32) SetFunc {
+	return func() (int64, Value, BucketNodeDeleterCallback, error) {
+		return size, &testCacheValue{released: released}, nil, nil
+	}
+}
+
+func TestShardedLRUCache_Stats(t *testing.T) {
+
+	cache := NewShardedLRUCache(1<<10, 2)
+	defer cache.Close()
+
+	var released int32
+	for i := 0; i < 3; i++ {
+		h, err := cache.Get(1, []byte("foo"), testSetFunc(10, &released))
+		assert.Nil(t, err)
+		h.UnRef()
+	}
+
+	_, err := cache.Get(1, []byte("bar"), nil)
+	assert.Equal(t, ErrNotFound, err)
+
+	stats := cache.Stats()
+	assert.EqualValues(t, 2, stats.Hits)
+	assert.EqualValues(t, 2, stats.Misses)
+	assert.EqualValues(t, 1, stats.Inserts)
+	assert.EqualValues(t, 0, stats.Evictions)
+	// 多次命中不会重复计算容量
+	assert.EqualValues(t, 10, stats.Size)
+	assert.EqualValues(t, 1<<10, stats.Capacity)
+	assert.Len(t, cache.ShardStats(), 4)
+}
+
+func TestShardedLRUCache_Evict(t *testing.T) {
+
+	cache := NewShardedLRUCache(4*100, 2)
+
+	var released int32
+	for i := 0; i < 1000; i++ {
+		h, err := cache.Get(1, []byte(fmt.Sprintf("key-%d", i)), testSetFunc(10, &released))
+		assert.Nil(t, err)
+		h.UnRef()
+	}
+
+	stats := cache.Stats()
+	assert.EqualValues(t, 1000, stats.Inserts)
+	assert.EqualValues(t, stats.Evictions, atomic.LoadInt32(&released))
+	for _, shard := range cache.ShardStats() {
+		assert.True(t, shard.Size < shard.Capacity)
+	}
+
+	cache.Close()
+	assert.EqualValues(t, 1000, atomic.LoadInt32(&released))
+}
+
+func TestShardedLRUCache_Namespace(t *testing.T) {
+
+	cache := NewShardedLRUCache(1<<20, 4)
+	defer cache.Close()
+
+	var released1, released2 int32
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		h, err := cache.Get(1, key, testSetFunc(1, &released1))
+		assert.Nil(t, err)
+		h.UnRef()
+		h, err = cache.Get(2, key, testSetFunc(1, &released2))
+		assert.Nil(t, err)
+		h.UnRef()
+	}
+
+	// 正在使用的节点在使用结束后才释放
+	inUse, err := cache.Get(1, []byte("key-0"), nil)
+	assert.Nil(t, err)
+
+	cache.EvictNamespace(1)
+	assert.EqualValues(t, 99, atomic.LoadInt32(&released1))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&released2))
+	inUse.UnRef()
+	assert.EqualValues(t, 100, atomic.LoadInt32(&released1))
+
+	_, err = cache.Get(1, []byte("key-1"), nil)
+	assert.Equal(t, ErrNotFound, err)
+	h, err := cache.Get(2, []byte("key-1"), nil)
+	assert.Nil(t, err)
+	h.UnRef()
+	assert.EqualValues(t, 100, cache.Stats().Size)
+}
@@ -0,0 +1,302 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"myleveldb/memdb"
+	"sort"
+	"sync/atomic"
+)
+
+/**
+column family
+
+一个db中多个逻辑上独立的keyspace, 每个family有自己的comparer, memdb, version(level)以及选项,
+所有的family共享同一个journal, 同一个manifest以及同一个seq
+
+	            journal(共享)                          manifest(共享)
+	batch [default:a=1, users:b=2, default:c]          addFamily(1, users)
+	   |                     |                         addTable(cf=0, level=0, 5)
+	   v                     v                         addTable(cf=1, level=0, 6)
+	default memdb       users memdb
+	default version     users version
+
+1. batch中的entry通过kt的最高位标记是否带有family id, default family(id为0)的entry跟之前的格式相同,
+   所以一个batch可以原子地写入多个family
+2. memdb的切换对所有family同时进行, 任意一个family的memdb写满时, 所有family的memdb一起冻结并落地,
+   这样journal只需要记录一个journalNum, 落地后就可以被删除
+3. manifest中default family的sstable沿用原来的add/del记录, 其他family使用带有family id的记录,
+   family的创建和删除也作为记录写入manifest
+4. 删除family时直接丢弃它的memdb以及version, journal中残留的该family的entry在replay时会被跳过
+
+family的选项不会持久化, 打开db时通过Options.ColumnFamilies按照名称指定, 没有指定的使用默认选项,
+只有comparer的名称跟随family的创建写入manifest, 打开时跟指定的comparer不一致返回ErrComparerMismatch
+replica不会同步family的创建和删除, 回放primary的batch时遇到不存在的family返回ErrUnknownColumnFamily并停止复制
+**/
+
+const (
+	defaultColumnFamilyID   = 0
+	defaultColumnFamilyName = "default"
+)
+
+// ColumnFamily db中的一个keyspace
+type ColumnFamily struct {
+	id   uint32
+	name string
+	s    *Session
+	opt  *Options
+
+	icmp      *iComparer
+	iFilter   iFilter
+	tableOpts *sstableOperation
+
+	// version相关, 受session.vmu保护
+	stVersion   *Version
+	compactPtrs []internalKey // 每一个level被compact的最大值
+
+	// memdb相关, 受db.memMu保护
+	memDb       *memdb.MemDB
+	frozenMemDb *memdb.MemDB
+
+	dropped uint32
+}
+
+func (s *Session) newColumnFamily(id uint32, name string, opt *Options) *ColumnFamily {
+	cf := &ColumnFamily{
+		id:      id,
+		name:    name,
+		s:       s,
+		opt:     opt,
+		icmp:    &iComparer{opt.GetCompare()},
+		iFilter: newIFilter(opt),
+	}
+	cf.tableOpts = s.tableOpts.withFamily(cf)
+	return cf
+}
+
+func (cf *ColumnFamily) ID() uint32 {
+	return cf.id
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+func (cf *ColumnFamily) isDropped() bool {
+	return atomic.LoadUint32(&cf.dropped) == 1
+}
+
+// 获取当前的version, family已经被删除时返回nil, 使用完后需要调用unRef
+func (cf *ColumnFamily) version() *Version {
+	cf.s.vmu.Lock()
+	defer cf.s.vmu.Unlock()
+	if cf.stVersion == nil {
+		return nil
+	}
+	cf.stVersion.incRef()
+	return cf.stVersion
+}
+
+func (cf *ColumnFamily) setVersion(sessionRecord *SessionRecord, newVer *Version) {
+	cf.s.vmu.Lock()
+	defer cf.s.vmu.Unlock()
+	newVer.incRef()
+
+	if cf.stVersion != nil {
+		if sessionRecord != nil {
+			cf.stVersion.delta(sessionRecord)
+		}
+		cf.stVersion.unRef()
+	}
+	cf.stVersion = newVer
+}
+
+// 没有任何sstable的version, 只用于VersionStaging的base, 不会被引用
+func (cf *ColumnFamily) emptyVersion() *Version {
+	return &Version{session: cf.s, cf: cf}
+}
+
+func (cf *ColumnFamily) tLen(n int) int {
+	v := cf.version()
+	if v == nil {
+		return 0
+	}
+	defer v.unRef()
+	return v.tLen(n)
+}
+
+func (cf *ColumnFamily) getCompactPtr(level int) internalKey {
+	if level >= len(cf.compactPtrs) {
+		return nil
+	}
+	return cf.compactPtrs[level]
+}
+
+func (s *Session) getFamily(id uint32) *ColumnFamily {
+	s.cfMu.RLock()
+	defer s.cfMu.RUnlock()
+	return s.families[id]
+}
+
+func (s *Session) getFamilyByName(name string) *ColumnFamily {
+	s.cfMu.RLock()
+	defer s.cfMu.RUnlock()
+	for _, cf := range s.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// 按照id从小到大返回所有的family
+func (s *Session) listFamilies() []*ColumnFamily {
+	s.cfMu.RLock()
+	defer s.cfMu.RUnlock()
+	families := make([]*ColumnFamily, 0, len(s.families))
+	for _, cf := range s.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+	return families
+}
+
+func (s *Session) allocFamilyID() uint32 {
+	return atomic.AddUint32(&s.maxFamilyID, 1)
+}
+
+func (s *Session) markFamilyID(id uint32) {
+	if id > s.maxFamilyID {
+		s.maxFamilyID = id
+	}
+}
+
+// 将family的创建写入manifest, 成功后family才可见
+func (s *Session) addFamily(cf *ColumnFamily) error {
+
+	rec := &SessionRecord{}
+	rec.addColumnFamily(cf.id, cf.name, cf.icmp.Name())
+	rec.setMaxColumnFamily(atomic.LoadUint32(&s.maxFamilyID))
+
+	if err := s.commit(rec); err != nil {
+		return err
+	}
+
+	cf.setVersion(nil, s.newFamilyVersion(cf))
+
+	s.cfMu.Lock()
+	s.families[cf.id] = cf
+	s.cfMu.Unlock()
+	return nil
+}
+
+// 将family的删除写入manifest, 并释放family当前的version
+func (s *Session) dropFamily(cf *ColumnFamily) error {
+
+	rec := &SessionRecord{}
+	rec.dropColumnFamily(cf.id)
+
+	if err := s.commit(rec); err != nil {
+		return err
+	}
+
+	s.cfMu.Lock()
+	delete(s.families, cf.id)
+	s.cfMu.Unlock()
+
+	atomic.StoreUint32(&cf.dropped, 1)
+
+	s.vmu.Lock()
+	if cf.stVersion != nil {
+		cf.stVersion.unRef()
+		cf.stVersion = nil
+	}
+	s.vmu.Unlock()
+	return nil
+}
+
+// DefaultColumnFamily 返回default family, 不指定family的读写都作用在default family上
+func (db *DB) DefaultColumnFamily() *ColumnFamily {
+	return db.s.defaultCf
+}
+
+// ColumnFamily 按照名称查找family, 不存在时返回nil
+func (db *DB) ColumnFamily(name string) *ColumnFamily {
+	return db.s.getFamilyByName(name)
+}
+
+// ColumnFamilies 返回所有的family, 第一个是default family
+func (db *DB) ColumnFamilies() []*ColumnFamily {
+	return db.s.listFamilies()
+}
+
+// CreateColumnFamily 创建一个新的family, opt为nil时使用默认选项
+func (db *DB) CreateColumnFamily(name string, opt *Options) (*ColumnFamily, error) {
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return nil, error2.ErrClosed
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	if db.s.getFamilyByName(name) != nil {
+		return nil, error2.ErrColumnFamilyExists
+	}
+
+	cf := db.s.newColumnFamily(db.s.allocFamilyID(), name, opt)
+
+	// memdb在family可见之前创建好, 写锁保证此时不会发生memdb的切换
+	db.memMu.Lock()
+	cf.memDb = memdb.NewMemDB(cf.opt.GetMemDbType(), cf.opt.GetWriteBuffer(), cf.icmp, db.pool)
+	db.memMu.Unlock()
+
+	if err := db.s.addFamily(cf); err != nil {
+		db.memMu.Lock()
+		cf.memDb.UnRef()
+		cf.memDb = nil
+		db.memMu.Unlock()
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// DropColumnFamily 删除family以及它的所有数据, default family不能被删除
+func (db *DB) DropColumnFamily(cf *ColumnFamily) error {
+
+	if cf.id == defaultColumnFamilyID {
+		return error2.ErrDropDefaultColumnFamily
+	}
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return error2.ErrClosed
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	if cf.isDropped() {
+		return error2.ErrColumnFamilyDropped
+	}
+
+	if err := db.s.dropFamily(cf); err != nil {
+		return err
+	}
+
+	db.memMu.Lock()
+	for _, m := range []**memdb.MemDB{&cf.memDb, &cf.frozenMemDb} {
+		if *m != nil {
+			(*m).UnRef()
+			*m = nil
+		}
+	}
+	db.memMu.Unlock()
+
+	return nil
+}
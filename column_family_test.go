@@ -0,0 +1,105 @@
+package myleveldb
+
+import (
+	"myleveldb/comparer"
+	error2 "myleveldb/error"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnFamily_CreateDropReopen(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 32 << 10}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+
+	users, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("users", nil)
+	assert.Equal(t, error2.ErrColumnFamilyExists, err)
+	assert.Equal(t, error2.ErrDropDefaultColumnFamily, db.DropColumnFamily(db.DefaultColumnFamily()))
+
+	// 同一个key在两个family中互不影响, 写入足够多的数据使两个family都落地到sstable
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+		assert.Nil(t, db.PutCF(users, testKey(i), testValue(i+1, 100)))
+	}
+	assert.Nil(t, db.DeleteCF(users, testKey(0)))
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	users = db.ColumnFamily("users")
+	if !assert.NotNil(t, users) {
+		return
+	}
+	assert.Equal(t, 2, len(db.ColumnFamilies()))
+
+	for i := 0; i < 1000; i++ {
+		v, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 100), v)
+
+		v, err = db.GetCF(users, testKey(i))
+		if i == 0 {
+			assert.Equal(t, error2.ErrNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i+1, 100), v)
+	}
+
+	assert.Nil(t, db.DropColumnFamily(users))
+	assert.Equal(t, error2.ErrColumnFamilyDropped, db.DropColumnFamily(users))
+	assert.Equal(t, error2.ErrColumnFamilyDropped, db.PutCF(users, testKey(1), nil))
+	assert.Nil(t, db.ColumnFamily("users"))
+	assert.Nil(t, db.Close())
+
+	// 删除之后重新打开, family不再存在, 可以用同一个名字重新创建
+	db = openTestDB(t, dir, opt)
+	assert.Nil(t, db.ColumnFamily("users"))
+	users, err = db.CreateColumnFamily("users", nil)
+	assert.Nil(t, err)
+	_, err = db.GetCF(users, testKey(1))
+	assert.Equal(t, error2.ErrNotFound, err)
+	v, err := db.Get(testKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(1, 100), v)
+}
+
+func TestColumnFamily_ComparerMismatch(t *testing.T) {
+
+	dir := t.TempDir()
+	reverse := &Options{Cmp: comparer.ReverseByteComparer}
+
+	db, err := Open(dir, nil)
+	assert.Nil(t, err)
+	users, err := db.CreateColumnFamily("users", reverse)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.PutCF(users, testKey(i), testValue(i, 10)))
+	}
+	dropped, err := db.CreateColumnFamily("dropped", reverse)
+	assert.Nil(t, err)
+	assert.Nil(t, db.DropColumnFamily(dropped))
+	assert.Nil(t, db.Close())
+
+	// 没有指定family的选项时使用默认的comparer, 跟创建时不一致
+	_, err = Open(dir, nil)
+	assert.True(t, error2.IsErrComparerMismatch(err), "%v", err)
+
+	_, err = Open(dir, &Options{ColumnFamilies: map[string]*Options{"users": {Cmp: comparer.DefaultComparer}}})
+	assert.True(t, error2.IsErrComparerMismatch(err), "%v", err)
+
+	// 已经删除的family不检查
+	db = openTestDB(t, dir, &Options{ColumnFamilies: map[string]*Options{"users": reverse}})
+	users = db.ColumnFamily("users")
+	assert.NotNil(t, users)
+
+	it := db.NewIteratorCF(users, nil)
+	defer it.UnRef()
+	assert.True(t, it.First())
+	assert.Equal(t, testKey(99), it.Key())
+}
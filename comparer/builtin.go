@@ -0,0 +1,91 @@
+package comparer
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/**
+内置的比较器
+
+ReverseByteComparer         按照字节的字典序倒序, 遍历时新的key在前, 例如 时间戳 作为key时最新的在前
+BigEndianUint64Comparer     key为8个字节的大端uint64, 按照数值比较
+LittleEndianUint64Comparer  key为8个字节的小端uint64, 按照数值比较
+
+uint64的key长度不是8个字节时不会panic, 也不会只比较前8个字节:
+大端的数值顺序就是字节的字典序, 所以直接按照字节比较; 小端的数值顺序是从最后一个字节往前的字典序,
+所以从后往前按照字节比较. 任意长度的key之间都是全序, 8个字节的key之间就是数值的顺序
+
+多个字段组成的key使用tuple包编码, 编码后的字节按照ByteComparer比较就是按照字段依次比较的顺序
+**/
+
+var (
+	// ReverseByteComparer 按照字节的字典序倒序
+	ReverseByteComparer = &reverseByteComparer{}
+
+	// BigEndianUint64Comparer key为大端编码的uint64
+	BigEndianUint64Comparer = &uint64Comparer{order: binary.BigEndian, name: "myleveldb.BigEndianUint64Comparator"}
+
+	// LittleEndianUint64Comparer key为小端编码的uint64
+	LittleEndianUint64Comparer = &uint64Comparer{order: binary.LittleEndian, name: "myleveldb.LittleEndianUint64Comparator"}
+)
+
+type reverseByteComparer struct{}
+
+func (rc *reverseByteComparer) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func (rc *reverseByteComparer) Name() string {
+	return "myleveldb.ReverseBytewiseComparator"
+}
+
+// Separator 倒序时 a >= x > b, 按字节缩短得到的是更大的key, 所以不缩短
+func (rc *reverseByteComparer) Separator(a, b []byte) []byte {
+	return a
+}
+
+func (rc *reverseByteComparer) Successor(a []byte) []byte {
+	return a
+}
+
+// key应该是8个字节, 缩短后的key不再是合法的uint64, 所以不缩短
+type uint64Comparer struct {
+	order binary.ByteOrder
+	name  string
+}
+
+func (uc *uint64Comparer) Compare(a, b []byte) int {
+	if uc.order == binary.ByteOrder(binary.BigEndian) {
+		return bytes.Compare(a, b)
+	}
+
+	// 小端从最后一个字节往前比较
+	for i, j := len(a)-1, len(b)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func (uc *uint64Comparer) Name() string {
+	return uc.name
+}
+
+func (uc *uint64Comparer) Separator(a, b []byte) []byte {
+	return a
+}
+
+func (uc *uint64Comparer) Successor(a []byte) []byte {
+	return a
+}
@@ -0,0 +1,53 @@
+package comparer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uint64Key(order binary.ByteOrder, v uint64) []byte {
+	b := make([]byte, 8)
+	order.PutUint64(b, v)
+	return b
+}
+
+func TestUint64Comparer_Order(t *testing.T) {
+	for _, c := range []struct {
+		cmp   BasicComparer
+		order binary.ByteOrder
+	}{
+		{BigEndianUint64Comparer, binary.BigEndian},
+		{LittleEndianUint64Comparer, binary.LittleEndian},
+	} {
+		values := []uint64{0, 1, 255, 256, 1 << 32, 1<<64 - 1}
+		for i := 1; i < len(values); i++ {
+			a, b := uint64Key(c.order, values[i-1]), uint64Key(c.order, values[i])
+			assert.Equal(t, -1, c.cmp.Compare(a, b))
+			assert.Equal(t, 1, c.cmp.Compare(b, a))
+			assert.Equal(t, 0, c.cmp.Compare(a, a))
+		}
+	}
+}
+
+func TestUint64Comparer_ShortKey(t *testing.T) {
+	for _, cmp := range []BasicComparer{BigEndianUint64Comparer, LittleEndianUint64Comparer} {
+		assert.NotPanics(t, func() {
+			assert.NotEqual(t, 0, cmp.Compare([]byte("abc"), []byte("abd")))
+			assert.NotEqual(t, 0, cmp.Compare([]byte("abc"), make([]byte, 8)))
+			assert.NotEqual(t, 0, cmp.Compare(nil, []byte("a")))
+			assert.Equal(t, 0, cmp.Compare([]byte("abc"), []byte("abc")))
+		})
+	}
+}
+
+func TestUint64Comparer_LongKey(t *testing.T) {
+	for _, cmp := range []BasicComparer{BigEndianUint64Comparer, LittleEndianUint64Comparer} {
+		// 前8个字节相同的key不能相等
+		a, b := []byte("01234567a"), []byte("01234567b")
+		assert.Equal(t, -1, cmp.Compare(a, b))
+		assert.Equal(t, 1, cmp.Compare(b, a))
+		assert.Equal(t, 0, cmp.Compare(a, []byte("01234567a")))
+	}
+}
@@ -9,13 +9,83 @@ type BasicComparer interface {
 	// 相等时返回 0
 	// 当a元素大于b的时候, 返回1
 	Compare(a, b []byte) int
+
+	// Name 比较器的名称, 创建db时记录在manifest中, 打开db时名称不同会拒绝打开,
+	// 改变了key顺序的比较器需要使用新的名称
+	Name() string
+
+	// Separator 返回一个较短的x, 满足 a <= x < b, 用于缩短sstable index block中的key,
+	// 要求a < b, 不能缩短时返回a, 返回值可能与a共享内存, 调用方不能修改
+	Separator(a, b []byte) []byte
+
+	// Successor 返回一个较短的x, 满足 x >= a, 用于缩短sstable最后一个data block在index block中的key,
+	// 不能缩短时返回a, 返回值可能与a共享内存, 调用方不能修改
+	Successor(a []byte) []byte
 }
 
 // DefaultComparer 默认比较器
 var DefaultComparer = &ByteComparer{}
 
+// ByteComparer 按照字节的字典序比较
 type ByteComparer struct{}
 
 func (bc ByteComparer) Compare(a, b []byte) int {
 	return bytes.Compare(a, b)
 }
+
+func (bc ByteComparer) Name() string {
+	return "myleveldb.BytewiseComparator"
+}
+
+/**
+*   要求是a<b
+*	从左往右, 遍历a, b, 相同的跳过, 找到第一个不同的字节, 如果a[i]+1 < b[i], 那么截断到i并且将a[i]+1
+*	如果a是b的前缀, 或者a[i]+1 >= b[i], 返回a本身
+*	e.g.
+*	abcd abcde -> abcd
+*	abcd abcf  -> abce
+*	abcd abce  -> abcd
+*	0xff 0xfe | 0xff 0xff -> 0xff 0xfe
+**/
+func (bc ByteComparer) Separator(a, b []byte) []byte {
+
+	i, n := 0, len(a)
+	if n > len(b) {
+		n = len(b)
+	}
+	for ; i < n && a[i] == b[i]; i++ {
+
+	}
+
+	if i < n {
+		if c := a[i]; c < 0xff && c+1 < b[i] {
+			dst := make([]byte, i+1)
+			copy(dst, a[:i])
+			dst[i] = c + 1
+			return dst
+		}
+	}
+
+	return a
+}
+
+/**
+*	从左往右遍历a, 找到第一个不是0xff的字节, 截断并且+1
+*	如果a每一位都是0xff, 返回a本身
+*	e.g.
+*	0xff 0xff 0xfe -> 0xff 0xff 0xff
+*	0xf1 0xff -> 0xf2
+*	abc -> b
+**/
+func (bc ByteComparer) Successor(a []byte) []byte {
+
+	for i, c := range a {
+		if c < 0xff {
+			dst := make([]byte, i+1)
+			copy(dst, a[:i])
+			dst[i] = c + 1
+			return dst
+		}
+	}
+	return a
+}
@@ -3,6 +3,7 @@ package myleveldb
 import (
 	"container/list"
 	"myleveldb/collections"
+	error2 "myleveldb/error"
 	"myleveldb/journal"
 	"myleveldb/memdb"
 	"myleveldb/storage"
@@ -24,13 +25,16 @@ type DB struct {
 	journal       *journal.Writer
 	journalWriter storage.Writer
 
-	memMu       sync.Mutex
-	memDb       *memdb.MemDB // 内存数据库
-	frozenMemDb *memdb.MemDB // 只能被读取
+	// 每个family的memdb以及frozenMemDb保存在ColumnFamily中, 受memMu保护
+	memMu sync.Mutex
 	// 冻结manifest相关
 	frozenJournalFd storage.FileDesc
 	frozenSeq       uint64
 
+	// 已经落地但是根据保留策略还没有删除的journal, 按照文件号码从小到大
+	retainMu         sync.Mutex
+	retainedJournals []retainedJournal
+
 	// write相关
 	writeMerge *WriteMerge
 	withBatch  *WithBatch
@@ -39,12 +43,24 @@ type DB struct {
 	snapMu   sync.Mutex
 	snapList *list.List
 
+	// 悲观事务的key锁
+	lockMgr *lockManager
+
 	// compaction相关
 	mcompCmdC  chan cCmd
 	tcompCmdC  chan cCmd
 	tPauseCmdC chan chan<- struct{} // 正在执行compaction的暂停指令
 
 	closeC chan struct{}
+	closeW sync.WaitGroup
+	closed uint32
+
+	// 多个db共享的memdb内存预算, wbmFlushing为1时正在后台切换memdb
+	wbm         *WriteBufferManager
+	wbmFlushing uint32
+
+	// 写入限速
+	wc *writeController
 }
 
 func (db *DB) addSeq(delta uint64) {
@@ -65,24 +81,27 @@ func Open(filepath string, opt *Options) (*DB, error) {
 
 	session, err := newSession(stor, opt)
 	if err != nil {
+		stor.Close()
 		return nil, err
 	}
 
 	// 恢复manifest的信息到session中
 	err = session.recover()
-	if err != nil {
-
-		if err != os.ErrNotExist {
-			return nil, err
-		}
-
+	if err == os.ErrNotExist {
 		err = session.create() // 首次打开不存在manifest文件, 创建一个
-		if err != nil {
-			return nil, err
-		}
 	}
 
-	return openDB(session)
+	var db *DB
+	if err == nil {
+		db, err = openDB(session)
+	}
+
+	// 打开失败时关闭session, 释放文件锁以及manifest
+	if err != nil {
+		session.close()
+		return nil, err
+	}
+	return db, nil
 
 }
 
@@ -97,29 +116,93 @@ func openDB(s *Session) (*DB, error) {
 		mcompCmdC:  make(chan cCmd),
 		tcompCmdC:  make(chan cCmd),
 		tPauseCmdC: make(chan chan<- struct{}),
+		snapList:   list.New(),
+		lockMgr:    newLockManager(s.Options.GetTxnLockStripes()),
+		closeC:     make(chan struct{}),
+		wbm:        s.Options.GetWriteBufferManager(),
+		wc:         newWriteController(s.Options),
 	}
 
 	db.withBatch = &WithBatch{
 		makeRoomForWrite: db.makeRoomForWrite,
 		writeBatch:       db.writeBatchLocked,
+		concurrent:       db.concurrentWritable,
+		writeJournal:     db.writeBatchJournal,
+		putEntry:         db.putBatchEntry,
+		publish:          db.publishBatch,
 	}
 
 	err := db.recoverJournal()
+	if err == nil {
+		err = db.removeObsoleteBlobs()
+	}
 	if err != nil {
+		if db.journalWriter != nil {
+			db.journalWriter.Close()
+		}
 		return nil, err
 	}
 
+	db.reportMemUsage()
+
 	// todo 清理掉不必要的文件
 
+	db.closeW.Add(2)
+
 	// 开启memdb compaction
 	go db.mCompaction()
 
 	// 开启table compaction
 	go db.tCompaction()
 
+	// 定期删除过期的journal
+	if ttl := db.s.Options.GetJournalRetentionTTL(); ttl > 0 {
+		db.closeW.Add(1)
+		go db.journalRetention(ttl)
+	}
+
 	return db, nil
 }
 
+// Close 关闭数据库, 等待正在进行的写入和compaction结束, 再关闭journal, manifest和存储
+func (db *DB) Close() error {
+
+	if !atomic.CompareAndSwapUint32(&db.closed, 0, 1) {
+		return error2.ErrClosed
+	}
+
+	// 拿到写锁, 保证没有正在进行的写入
+	db.writeMerge.writeLock <- struct{}{}
+	close(db.writeMerge.closedC)
+
+	close(db.closeC)
+	db.closeW.Wait()
+
+	db.memMu.Lock()
+	if db.journalWriter != nil {
+		db.journalWriter.Close()
+		db.journalWriter = nil
+		db.journal = nil
+	}
+	for _, cf := range db.s.listFamilies() {
+		if cf.memDb != nil {
+			cf.memDb.UnRef()
+			cf.memDb = nil
+		}
+		if cf.frozenMemDb != nil {
+			cf.frozenMemDb.UnRef()
+			cf.frozenMemDb = nil
+		}
+	}
+	db.memMu.Unlock()
+
+	if db.wbm != nil {
+		db.wbm.remove(db)
+	}
+
+	return db.s.close()
+}
+
 func (db *DB) Put(key, value []byte) error {
 	return db.putRec(key, value, keyTypeVal)
 }
@@ -128,15 +211,46 @@ func (db *DB) Delete(key []byte) error {
 	return db.putRec(key, nil, keyTypeDel)
 }
 
+// Write 原子地写入batch中的所有记录
+func (db *DB) Write(b *Batch) error {
+	return db.writeBatch(b, nil)
+}
+
+// PutCF 写入到指定的family
+func (db *DB) PutCF(cf *ColumnFamily, key, value []byte) error {
+	if cf.id == defaultColumnFamilyID {
+		return db.Put(key, value)
+	}
+	b := NewBatch()
+	b.PutCF(cf, key, value)
+	return db.Write(b)
+}
+
+// DeleteCF 删除指定family中的key
+func (db *DB) DeleteCF(cf *ColumnFamily, key []byte) error {
+	if cf.id == defaultColumnFamilyID {
+		return db.Delete(key)
+	}
+	b := NewBatch()
+	b.DeleteCF(cf, key)
+	return db.Write(b)
+}
+
+// Get 获取key对应的value, key不存在或者已经被删除时返回error2.ErrNotFound
 func (db *DB) Get(key []byte) (value []byte, err error) {
+	return db.GetCF(db.s.defaultCf, key)
+}
+
+// GetCF 获取指定family中key对应的value
+func (db *DB) GetCF(cf *ColumnFamily, key []byte) (value []byte, err error) {
 	snapshot := db.acquireSnapshot()
 	defer db.releaseSnapshot(snapshot)
-	return db.get(key, snapshot.seq)
+	return db.get(cf, key, snapshot.seq)
 }
 
-func (db *DB) get(key []byte, seq uint64) (value []byte, err error) {
-	ikey := makeInternalKey(key, seq, keyTypeVal)
-	memDb, memFrozenDb := db.getMems()
+func (db *DB) get(cf *ColumnFamily, key []byte, seq uint64) (value []byte, err error) {
+	ikey := makeInternalKey(key, seq, keyTypeSeek)
+	memDb, memFrozenDb := db.getMems(cf)
 	defer func() {
 		if memDb != nil {
 			memDb.UnRef()
@@ -152,45 +266,95 @@ func (db *DB) get(key []byte, seq uint64) (value []byte, err error) {
 			continue
 		}
 
-		if ok, v, e := memGet(m, ikey, db.s.icmp); ok {
+		if ok, v, e := memGet(m, ikey, cf.icmp); ok {
 			return append([]byte(nil), v...), e
 		}
 	}
-	v := db.s.version()
+	v := cf.version()
+	if v == nil {
+		return nil, error2.ErrColumnFamilyDropped
+	}
 	defer v.unRef()
 	return v.get(ikey, false)
 }
 
-func (db *DB) getMems() (memDb *memdb.MemDB, memFrozenDb *memdb.MemDB) {
+// 获取key最新一条记录(包括删除)的seq, 不受快照限制, key没有任何记录时found为false
+func (db *DB) latestSeq(cf *ColumnFamily, key []byte) (seq uint64, found bool, err error) {
+	ikey := makeInternalKey(key, maxSeq, keyTypeSeek)
+	memDb, memFrozenDb := db.getMems(cf)
+	defer func() {
+		if memDb != nil {
+			memDb.UnRef()
+		}
+
+		if memFrozenDb != nil {
+			memFrozenDb.UnRef()
+		}
+	}()
+
+	for _, m := range []*memdb.MemDB{memDb, memFrozenDb} {
+		if m == nil {
+			continue
+		}
+
+		rkey, _, ferr := m.Find(ikey)
+		if ferr == collections.ErrNotFound {
+			continue
+		} else if ferr != nil {
+			return 0, false, ferr
+		}
+
+		ukey, rseq, _, kerr := parseInternalKey(rkey)
+		if kerr != nil {
+			return 0, false, kerr
+		}
+		if cf.icmp.uCompare(ukey, key) == 0 {
+			return rseq, true, nil
+		}
+	}
+
+	v := cf.version()
+	if v == nil {
+		return 0, false, error2.ErrColumnFamilyDropped
+	}
+	defer v.unRef()
+	_, seq, found, err = v.find(ikey, true)
+	if found || err == error2.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (db *DB) getMems(cf *ColumnFamily) (memDb *memdb.MemDB, memFrozenDb *memdb.MemDB) {
 
 	db.memMu.Lock()
 	defer db.memMu.Unlock()
 
-	if db.memDb != nil {
-		db.memDb.Ref()
+	if cf.memDb != nil {
+		cf.memDb.Ref()
 	}
 
-	if db.frozenMemDb != nil {
-		db.frozenMemDb.Ref()
+	if cf.frozenMemDb != nil {
+		cf.frozenMemDb.Ref()
 	}
 
-	return db.memDb, db.frozenMemDb
+	return cf.memDb, cf.frozenMemDb
 }
 
 func memGet(mdb *memdb.MemDB, ikey internalKey, icmp *iComparer) (ok bool, value []byte, err error) {
 
-	value, err = mdb.FindGE(ikey)
+	rkey, value, err := mdb.Find(ikey)
 
 	if err == nil {
 
-		ukey, _, kt, kerr := parseInternalKey(ikey)
+		ukey, _, kt, kerr := parseInternalKey(rkey)
 		if kerr != nil {
 			panic(kerr)
 		}
 
 		if icmp.uCompare(ukey, ikey.uKey()) == 0 {
 			if kt == keyTypeDel {
-				return true, nil, collections.ErrNotFound
+				return true, nil, error2.ErrNotFound
 			}
 			return true, value, nil
 		}
@@ -203,21 +367,27 @@ func memGet(mdb *memdb.MemDB, ikey internalKey, icmp *iComparer) (ok bool, value
 
 }
 
+// 任意一个family需要compaction
 func (db *DB) needCompaction() bool {
 
-	v := db.s.version()
-	defer v.unRef()
-
-	return v.cScore > 1 || atomic.LoadPointer(v.cSeek) != nil
+	for _, cf := range db.s.listFamilies() {
+		v := cf.version()
+		if v == nil {
+			continue
+		}
+		need := v.cScore > 1 || (v.cSeek != nil && atomic.LoadPointer(v.cSeek) != nil)
+		v.unRef()
+		if need {
+			return true
+		}
+	}
+	return false
 
 }
 
+// 所有family的level0都低于阈值时才恢复写入
 func (db *DB) resumeWrite() bool {
-	v := db.s.version()
-	defer v.unRef()
-
-	return v.tLen(0) < db.s.Options.GetLevel0TriggerLen()
-
+	return db.refreshWriteStall().condition != WriteStallStopped
 }
 
 func (db *DB) minSeq() uint64 {
@@ -229,3 +399,92 @@ func (db *DB) minSeq() uint64 {
 	}
 	return db.loadSeq()
 }
+
+// LevelStats 每一层sstable的统计
+type LevelStats struct {
+	Level     int
+	FileCount int
+	Size      int64
+}
+
+// DBStats 数据库当前的统计信息, memdb以及level只统计default family
+type DBStats struct {
+	Seq             uint64
+	JournalNum      int
+	NextFileNum     int64
+	MemDbSize       int
+	FrozenMemDbSize int
+	Levels          []LevelStats
+	Blobs           []BlobStats
+
+	// 缓存的统计, 共享的缓存统计的是所有使用该缓存的db
+	BlockCache     collections.CacheStats
+	OpenFilesCache collections.CacheStats
+
+	// 写入限速的当前状态以及累计的等待, 状态统计的是所有family
+	WriteStall WriteStallStats
+}
+
+// BlobStats 每一个blob文件的统计
+type BlobStats struct {
+	Num          int64
+	Count        uint64
+	Size         uint64
+	GarbageCount uint64
+	GarbageSize  uint64
+}
+
+// Stats 获取数据库当前的统计信息
+func (db *DB) Stats() (*DBStats, error) {
+
+	if atomic.LoadUint32(&db.closed) == 1 {
+		return nil, error2.ErrClosed
+	}
+
+	stats := &DBStats{
+		Seq:            db.loadSeq(),
+		NextFileNum:    db.s.loadNextNum(),
+		BlockCache:     db.s.tableOpts.BlockCache.Cache.Stats(),
+		OpenFilesCache: db.s.tableOpts.FileCache.Cache.Stats(),
+	}
+
+	db.refreshWriteStall()
+	stats.WriteStall = db.wc.getStats()
+
+	memDb, memFrozenDb := db.getMems(db.s.defaultCf)
+	if memDb != nil {
+		stats.MemDbSize = memDb.Len()
+		memDb.UnRef()
+	}
+	if memFrozenDb != nil {
+		stats.FrozenMemDbSize = memFrozenDb.Len()
+		memFrozenDb.UnRef()
+	}
+
+	db.memMu.Lock()
+	stats.JournalNum = db.journalFd.Num
+	db.memMu.Unlock()
+
+	v := db.s.defaultCf.version()
+	defer v.unRef()
+
+	for level, tables := range v.levels {
+		stats.Levels = append(stats.Levels, LevelStats{
+			Level:     level,
+			FileCount: len(tables),
+			Size:      tables.size(),
+		})
+	}
+
+	for _, bf := range v.blobs.sorted() {
+		stats.Blobs = append(stats.Blobs, BlobStats{
+			Num:          bf.num,
+			Count:        bf.count,
+			Size:         bf.size,
+			GarbageCount: bf.garbageCount,
+			GarbageSize:  bf.garbageSize,
+		})
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,142 @@
+package myleveldb
+
+import (
+	"io"
+	error2 "myleveldb/error"
+	"myleveldb/journal"
+	"myleveldb/storage"
+	"sync/atomic"
+)
+
+/**
+checkpoint 在指定目录生成一个可以直接打开的数据库副本
+
+1. 拿到写锁, 将所有family的memdb落地到level0, 此时所有的数据都在sstable中, 获取每个family当前的version和seq, 释放写锁
+2. 将这些version引用的所有sstable以及blob文件复制到目标目录, version被引用期间sstable不会被删除
+3. 在目标目录生成一个snapshot的manifest, 并设置CURRENT, 不需要复制journal
+**/
+
+// Checkpoint 在dir目录生成数据库当前状态的副本, dir中不能存在数据库
+func (db *DB) Checkpoint(dir string) error {
+	_, err := db.checkpoint(dir)
+	return err
+}
+
+// 生成副本, 并返回副本对应的seq
+func (db *DB) checkpoint(dir string) (uint64, error) {
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return 0, error2.ErrClosed
+	}
+
+	err := db.flushMemDbLocked()
+	if err != nil {
+		<-db.writeMerge.writeLock
+		return 0, err
+	}
+
+	var vs []*Version
+	for _, cf := range db.s.listFamilies() {
+		if v := cf.version(); v != nil {
+			vs = append(vs, v)
+		}
+	}
+	seq := db.loadSeq()
+	maxFamilyID := atomic.LoadUint32(&db.s.maxFamilyID)
+	<-db.writeMerge.writeLock
+
+	defer func() {
+		for _, v := range vs {
+			v.unRef()
+		}
+	}()
+
+	dst, err := storage.OpenFile(dir, false)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	if _, err := dst.GetMeta(); err == nil {
+		return 0, error2.ErrExists
+	}
+
+	var maxNum int
+	for _, v := range vs {
+		for _, tables := range v.levels {
+			for _, t := range tables {
+				if err = copyFile(db.s.stor, dst, t.fd); err != nil {
+					return 0, err
+				}
+				if t.fd.Num > maxNum {
+					maxNum = t.fd.Num
+				}
+			}
+		}
+		for num := range v.blobs {
+			if err = copyFile(db.s.stor, dst, storage.FileDesc{Type: storage.FileTypeBlob, Num: int(num)}); err != nil {
+				return 0, err
+			}
+			if int(num) > maxNum {
+				maxNum = int(num)
+			}
+		}
+	}
+
+	fd := storage.FileDesc{Type: storage.FileTypeManifest, Num: maxNum + 1}
+
+	rec := &SessionRecord{}
+	rec.setComparer([]byte(db.s.icmp.Name()))
+	rec.setJournalNum(0)
+	rec.setNextFileNum(int64(fd.Num) + 1)
+	rec.setSequenceNum(seq)
+	rec.setMaxColumnFamily(maxFamilyID)
+	for _, v := range vs {
+		if v.cf.id != defaultColumnFamilyID {
+			rec.addColumnFamily(v.cf.id, v.cf.name, v.cf.icmp.Name())
+		}
+		v.fillRecord(rec)
+	}
+
+	writer, err := dst.Create(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer writer.Close()
+
+	if err = writeManifestRecord(journal.NewWriter(writer), rec); err != nil {
+		return 0, err
+	}
+
+	if err = writer.Sync(); err != nil {
+		return 0, err
+	}
+
+	if err = dst.SetMeta(fd); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func copyFile(src, dst storage.Storage, fd storage.FileDesc) error {
+
+	reader, err := src.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := dst.Create(fd)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if _, err = io.Copy(writer, reader); err != nil {
+		return err
+	}
+
+	return writer.Sync()
+}
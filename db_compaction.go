@@ -16,7 +16,39 @@ type cAuto struct {
 }
 
 func (c cAuto) Ack(err error) {
-	c.ack <- err
+	if c.ack != nil {
+		c.ack <- err
+	}
+}
+
+// cRange 对family指定level中跟[min, max]重叠的sstable做一次compaction
+// gc为true时, 迁移垃圾比例大于等于gcRatio的blob文件中的live value
+type cRange struct {
+	ack      chan error
+	cf       *ColumnFamily
+	level    int
+	min, max []byte
+	gc       bool
+	gcRatio  float64
+}
+
+func (c cRange) Ack(err error) {
+	if c.ack != nil {
+		c.ack <- err
+	}
+}
+
+// cIngest 将外部导入的sstable放到合适的level, 跟table compaction串行执行, 避免放置后又被合并结果覆盖
+type cIngest struct {
+	ack    chan error
+	tables tFiles
+	seq    uint64
+}
+
+func (c cIngest) Ack(err error) {
+	if c.ack != nil {
+		c.ack <- err
+	}
 }
 
 func (db *DB) mCompaction() {
@@ -26,6 +58,8 @@ func (db *DB) mCompaction() {
 		ok bool
 	)
 
+	defer db.closeW.Done()
+
 	defer func() {
 
 		if p := recover(); p != nil {
@@ -42,7 +76,7 @@ func (db *DB) mCompaction() {
 	for {
 		select {
 		case cmd := <-db.mcompCmdC:
-			x, ok = cmd.(*cAuto)
+			x, ok = cmd.(cAuto)
 			if ok {
 				x.Ack(db.memCompaction())
 			} else {
@@ -57,18 +91,28 @@ func (db *DB) mCompaction() {
 
 }
 
-// 内存数据库(frozenMemdb)持久化到level0层
+// 内存数据库(所有family的frozenMemdb)持久化到各自family的level0层
 func (db *DB) memCompaction() error {
 
-	frozenMemDb := db.getFrozenMemDb()
-	if frozenMemDb == nil {
+	frozen := db.getFrozenMemDbs()
+	if len(frozen) == 0 {
 		return nil
 	}
 
-	defer frozenMemDb.UnRef()
+	defer func() {
+		for _, f := range frozen {
+			f.mdb.UnRef()
+		}
+	}()
 
-	// 如果immutable memdb 是空的, drop掉
-	if frozenMemDb.Len() == 0 {
+	// 如果immutable memdb 都是空的, drop掉
+	empty := true
+	for _, f := range frozen {
+		if f.mdb.Len() > 0 {
+			empty = false
+		}
+	}
+	if empty {
 		db.dropFrozenMemDb()
 		return nil
 	}
@@ -88,12 +132,17 @@ func (db *DB) memCompaction() error {
 		rec = &SessionRecord{}
 	)
 
-	// 将frozenmemdb 写入到sstable中
-	if err := db.s.flushMemDb(rec, frozenMemDb); err != nil {
-		for _, fd := range rec.atRecords {
-			db.s.stor.Remove(storage.FileDesc{Type: storage.FileTypeSSTable, Num: fd.num})
+	// 将frozenmemdb 写入到sstable中, 所有family的sstable通过同一个record提交
+	for _, f := range frozen {
+		if f.mdb.Len() == 0 {
+			continue
+		}
+		if err := db.s.flushMemDb(rec, f.cf, f.mdb); err != nil {
+			for _, fd := range rec.atRecords {
+				db.s.stor.Remove(storage.FileDesc{Type: storage.FileTypeSSTable, Num: fd.num})
+			}
+			return err
 		}
-		return err
 	}
 
 	// 更新session record, 准备写入到manifest中
@@ -108,10 +157,13 @@ func (db *DB) memCompaction() error {
 	// 将frozenmemdb 删掉
 	db.dropFrozenMemDb()
 
+	// 关闭时table compaction不再回复resumeC
 	if resumeC != nil {
 		select {
 		case <-resumeC:
 			close(resumeC)
+		case <-db.closeC:
+			db.compactionTransactExit()
 		}
 	}
 
@@ -122,18 +174,17 @@ func (db *DB) memCompaction() error {
 
 }
 
-// 将当前memdb 转成frozenMemdb
-func (db *DB) rotateMem(n int, wait bool) (*memdb.MemDB, error) {
+// 将所有family当前的memdb 转成frozenMemdb, need为每个family至少需要的memdb容量
+func (db *DB) rotateMem(need map[uint32]int, wait bool) error {
 
 	// 先让上一次的memCompaction 结束
 	err := db.compTriggerWait(db.mcompCmdC)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	newMemDb, err := db.newMem(n)
-	if err != nil {
-		return nil, err
+	if err = db.newMem(need); err != nil {
+		return err
 	}
 
 	if wait {
@@ -141,20 +192,28 @@ func (db *DB) rotateMem(n int, wait bool) (*memdb.MemDB, error) {
 	} else {
 		_ = db.compTrigger(db.mcompCmdC)
 	}
-	return newMemDb, nil
+	return nil
 }
 
-func (db *DB) getFrozenMemDb() *memdb.MemDB {
+type frozenMem struct {
+	cf  *ColumnFamily
+	mdb *memdb.MemDB
+}
+
+func (db *DB) getFrozenMemDbs() []frozenMem {
 
 	db.memMu.Lock()
 	defer db.memMu.Unlock()
-	if db.frozenMemDb == nil {
-		return nil
-	}
 
-	mdb := db.frozenMemDb
-	mdb.Ref()
-	return mdb
+	var frozen []frozenMem
+	for _, cf := range db.s.listFamilies() {
+		if cf.frozenMemDb == nil {
+			continue
+		}
+		cf.frozenMemDb.Ref()
+		frozen = append(frozen, frozenMem{cf: cf, mdb: cf.frozenMemDb})
+	}
+	return frozen
 }
 
 func (db *DB) compactionTransactExit() {
@@ -163,10 +222,22 @@ func (db *DB) compactionTransactExit() {
 
 func (db *DB) dropFrozenMemDb() {
 	db.memMu.Lock()
-	defer db.memMu.Unlock()
-	db.frozenMemDb.UnRef()
-	db.frozenMemDb = nil
+	for _, cf := range db.s.listFamilies() {
+		if cf.frozenMemDb != nil {
+			cf.frozenMemDb.UnRef()
+			cf.frozenMemDb = nil
+		}
+	}
+	fd := db.frozenJournalFd
 	db.frozenJournalFd = storage.FileDesc{}
+	db.memMu.Unlock()
+
+	// frozenMemdb已经落地, 对应的journal不再需要
+	if !fd.Zero() {
+		db.releaseJournal(fd)
+	}
+
+	db.reportMemUsage()
 }
 
 func (db *DB) tableAutoCompaction() error {
@@ -176,6 +247,16 @@ func (db *DB) tableAutoCompaction() error {
 	return nil
 }
 
+func (db *DB) tableRangeCompaction(cmd cRange) error {
+	if c := db.s.getCompactionRange(cmd.cf, cmd.level, cmd.min, cmd.max); c != nil {
+		if cmd.gc {
+			c.collectBlobGarbage(cmd.gcRatio)
+		}
+		return db.tableCompaction(c)
+	}
+	return nil
+}
+
 func (db *DB) tableCompaction(c *Compaction) error {
 
 	var (
@@ -184,7 +265,6 @@ func (db *DB) tableCompaction(c *Compaction) error {
 		lastSeq      uint64
 		tw           *tWriter
 		sr           SessionRecord
-		dropped      bool
 	)
 
 	defer c.UnRef()
@@ -193,8 +273,8 @@ func (db *DB) tableCompaction(c *Compaction) error {
 	// 那么可以直接将input层放到compaction层
 	if c.trivial() {
 		for _, t0 := range c.levels[0] {
-			sr.addTableFile(c.sourceLevel+1, t0)
-			sr.delTableFile(c.sourceLevel, t0)
+			sr.addTableFile(c.cf.id, c.sourceLevel+1, t0)
+			sr.delTableFile(c.cf.id, c.sourceLevel, t0)
 		}
 		if err := c.s.commit(&sr); err != nil {
 			return err
@@ -204,13 +284,35 @@ func (db *DB) tableCompaction(c *Compaction) error {
 
 	for i, tables := range c.levels {
 		for _, table := range tables {
-			sr.delTableFile(c.sourceLevel+i, table) // 对需要合并的文件全部置为删除
+			sr.delTableFile(c.cf.id, c.sourceLevel+i, table) // 对需要合并的文件全部置为删除
 		}
 	}
 
-	iter := c.newIterator(db.s.tableOpts)
+	iter := c.newIterator(c.cf.tableOpts)
 	defer iter.UnRef()
 
+	// 开启kv分离时较大的value写入新的blob文件, 丢弃或者迁移的blob index记为对应blob文件的垃圾
+	bw := newBlobWriter(c.cf)
+	garbage := make(map[int64]blobFile)
+	committed := false
+	defer func() {
+		if !committed {
+			bw.abort()
+		}
+	}()
+
+	addGarbage := func(value []byte) error {
+		bi, err := decodeBlobIndex(value)
+		if err != nil {
+			return err
+		}
+		g := garbage[bi.num]
+		g.garbageCount++
+		g.garbageSize += bi.size
+		garbage[bi.num] = g
+		return nil
+	}
+
 	seq := db.minSeq() // 获取db当前正在被使用的最小seq(如果存在快照, 那么取快照头部(最老旧)的seq, 不存在则取当前seq)
 
 	for iter.Next() {
@@ -220,25 +322,21 @@ func (db *DB) tableCompaction(c *Compaction) error {
 
 		if err == nil {
 
+			dropped := false
+
 			/*
 				需要判断如果加上当前ukey, 跟gp的重叠过多, 那么需要暂停之前的合并, 并把之前的合并直接写到.ldb文件, 再开一个新的.ldb文件
 			*/
-			if !hashLastUKey || db.s.icmp.uCompare(ukey, lastUKey) != 0 { // ukey首次合并写入
+			if !hashLastUKey || c.cf.icmp.uCompare(ukey, lastUKey) != 0 { // ukey首次合并写入
 				shouldStop := c.shouldStopBefore(iKey)
 
-				if tw == nil {
-					if tw, err = db.s.tableOpts.create(0); err != nil {
-						return err
-					}
-				}
-
-				// 如果要写入的文件跟sstable
-				if shouldStop || tw.tableWriter.BytesLen() >= uint64(db.s.GetTableFileSize()) {
+				// 如果要写入的文件跟gp层重叠过多, 或者文件已经足够大, 那么结束当前文件
+				if tw != nil && (shouldStop || tw.tableWriter.BytesLen() >= uint64(c.cf.opt.GetTableFileSize())) {
 					tf, err := tw.finish()
 					if err != nil {
 						return err
 					}
-					sr.addTableFile(c.sourceLevel+1, *tf)
+					sr.addTableFile(c.cf.id, c.sourceLevel+1, *tf)
 					tw = nil
 					c.restore()
 				}
@@ -268,11 +366,17 @@ func (db *DB) tableCompaction(c *Compaction) error {
 			} else if kType == keyTypeDel && uSeq <= seq && c.isBaseLevelForKey(ukey) {
 				dropped = true
 			}
-			lastSeq = seq
+			lastSeq = uSeq
+
+			if dropped && kType == keyTypeBlob {
+				if err = addGarbage(iter.Value()); err != nil {
+					return err
+				}
+			}
 
 			if !dropped {
 				if tw == nil {
-					if tw, err = db.s.tableOpts.create(0); err != nil {
+					if tw, err = c.cf.tableOpts.create(0); err != nil {
 						return err
 					}
 				}
@@ -283,7 +387,29 @@ func (db *DB) tableCompaction(c *Compaction) error {
 					db.pauseCompaction(pauseCmd)
 				default:
 				}
-				tw.append(iKey, iter.Value())
+				key, value := internalKey(iKey), iter.Value()
+
+				// 迁移blob, 读出value后重新按照普通的value写入
+				if kType == keyTypeBlob {
+					bi, err := decodeBlobIndex(value)
+					if err != nil {
+						return err
+					}
+					if c.shouldRelocate(bi.num) {
+						if value, err = c.cf.tableOpts.readBlob(bi); err != nil {
+							return err
+						}
+						if err = addGarbage(iter.Value()); err != nil {
+							return err
+						}
+						key = makeInternalKey(ukey, uSeq, keyTypeVal)
+					}
+				}
+
+				if key, value, err = bw.separate(key, value); err != nil {
+					return err
+				}
+				tw.append(key, value)
 			}
 		}
 
@@ -293,11 +419,22 @@ func (db *DB) tableCompaction(c *Compaction) error {
 		if tf, err := tw.finish(); err != nil {
 			return err
 		} else {
-			sr.addTableFile(c.sourceLevel+1, *tf)
+			sr.addTableFile(c.cf.id, c.sourceLevel+1, *tf)
 		}
 	}
 
-	return db.s.commit(&sr)
+	if err := bw.finish(&sr); err != nil {
+		return err
+	}
+	for num, g := range garbage {
+		sr.addBlobGarbage(c.cf.id, num, g.garbageCount, g.garbageSize)
+	}
+
+	if err := db.s.commit(&sr); err != nil {
+		return err
+	}
+	committed = true
+	return nil
 }
 
 func (db *DB) pauseCompaction(pauseCmd chan<- struct{}) {
@@ -319,6 +456,8 @@ func (db *DB) tCompaction() {
 		tErr  error
 	)
 
+	defer db.closeW.Done()
+
 	for {
 
 		if db.needCompaction() {
@@ -347,6 +486,7 @@ func (db *DB) tCompaction() {
 			}
 			waitQ = waitQ[:0]
 
+			// 当前不需要compaction, 阻塞等待外部的信号
 			select {
 			case x = <-db.tcompCmdC:
 			case pauseC := <-db.tPauseCmdC:
@@ -354,7 +494,6 @@ func (db *DB) tCompaction() {
 				continue
 			case <-db.closeC:
 				return
-			default:
 			}
 
 		}
@@ -369,6 +508,14 @@ func (db *DB) tCompaction() {
 						waitQ = append(waitQ, cmd)
 					}
 				}
+			case cRange:
+				cmd.Ack(db.tableRangeCompaction(cmd))
+				x = nil
+				continue
+			case cIngest:
+				cmd.Ack(db.ingestTables(cmd.tables, cmd.seq))
+				x = nil
+				continue
 			default:
 				panic("myLeveldb/unsupport cmd type")
 			}
@@ -376,7 +523,72 @@ func (db *DB) tCompaction() {
 		}
 
 		tErr = db.tableAutoCompaction()
+		db.refreshWriteStall()
+
+	}
 
+}
+
+// CompactRange 对default family中[start, limit]范围内的key做一次手动compaction, start或者limit为nil时代表不限制
+// 先将memdb落地到level0, 再从level0开始逐层向下合并
+func (db *DB) CompactRange(start, limit []byte) error {
+	return db.CompactRangeCF(db.s.defaultCf, start, limit)
+}
+
+// CompactRangeCF 对family中[start, limit]范围内的key做一次手动compaction
+func (db *DB) CompactRangeCF(cf *ColumnFamily, start, limit []byte) error {
+
+	if err := db.flushMemDb(); err != nil {
+		return err
+	}
+
+	v := cf.version()
+	if v == nil {
+		return error2.ErrColumnFamilyDropped
+	}
+	maxLevel := len(v.levels)
+	v.unRef()
+
+	for level := 0; level < maxLevel; level++ {
+		if err := db.compTriggerRange(cRange{cf: cf, level: level, min: start, max: limit}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 拿到写锁, 将当前memdb转成frozenMemdb并等待落地到level0
+func (db *DB) flushMemDb() error {
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return error2.ErrClosed
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	return db.flushMemDbLocked()
+}
+
+// 调用前需要拿到写锁
+func (db *DB) flushMemDbLocked() error {
+
+	n := 0
+	for _, cf := range db.s.listFamilies() {
+		memDb, err := db.getEffectiveMemDb(cf)
+		if err != nil {
+			return err
+		}
+		n += memDb.Len()
+		memDb.UnRef()
+	}
+
+	if n == 0 {
+		return nil
 	}
 
+	return db.rotateMem(nil, true)
 }
@@ -0,0 +1,234 @@
+package myleveldb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"myleveldb/journal"
+	"myleveldb/sstable"
+	"myleveldb/storage"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/**
+dump 用于排查问题, 不需要打开db就可以解析db目录下的文件
+
+1. DumpManifest 解析CURRENT指向的manifest, 按顺序回调每一个SessionRecord, 第一个是snapshot, 随后的都是增量
+2. DumpJournal 解析单个journal(.log)文件, 按顺序回调每一个batch
+3. DumpTable 解析单个sstable(.ldb)文件, 先回调sstable的结构信息, 再按顺序回调每一条记录
+**/
+
+// Entry 一条带有seq的记录, Key为ukey
+type Entry struct {
+	Family  uint32 // entry所属的family id
+	Seq     uint64
+	Deleted bool
+	Blob    bool // Value是指向blob文件的blob index, 只会出现在sstable中
+	Key     []byte
+	Value   []byte
+}
+
+// DumpManifest 解析dir中CURRENT指向的manifest
+func DumpManifest(dir string, f func(rec *SessionRecord) error) error {
+
+	stor, err := storage.OpenFile(dir, true)
+	if err != nil {
+		return err
+	}
+	defer stor.Close()
+
+	fd, err := stor.GetMeta()
+	if err != nil {
+		return err
+	}
+
+	reader, err := stor.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	jr := journal.NewReader(reader)
+
+	for {
+
+		chunkReader, err := jr.SeekNextChunk()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rec := &SessionRecord{}
+		if err = rec.decode(bufio.NewReader(chunkReader)); err != nil {
+			return err
+		}
+
+		if err = f(rec); err != nil {
+			return err
+		}
+	}
+
+}
+
+// DumpJournal 解析单个journal文件, seq为batch中第一条记录的seq
+func DumpJournal(path string, f func(seq uint64, entries []Entry) error) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	jr := journal.NewReader(file)
+
+	for {
+
+		chunkReader, err := jr.SeekNextChunk()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		chunk, err := ioutil.ReadAll(chunkReader)
+		if err != nil {
+			return err
+		}
+
+		seq, entries, err := decodeBatchEntries(chunk)
+		if err != nil {
+			return err
+		}
+
+		if err = f(seq, entries); err != nil {
+			return err
+		}
+	}
+
+}
+
+// DumpTable 解析单个sstable文件, info为nil时不解析sstable的结构信息
+func DumpTable(path string, opt *Options, info func(info *sstable.TableInfo) error, f func(e Entry) error) error {
+
+	reader, err := openSSTableFile(path, opt)
+	if err != nil {
+		return err
+	}
+	defer reader.UnRef()
+
+	if info != nil {
+		tInfo, err := reader.Info()
+		if err != nil {
+			return err
+		}
+		if err = info(tInfo); err != nil {
+			return err
+		}
+	}
+
+	iterator := reader.NewIterator()
+	defer iterator.UnRef()
+
+	for iterator.Next() {
+
+		ukey, seq, kt, err := parseInternalKey(iterator.Key())
+		if err != nil {
+			return err
+		}
+
+		if err = f(Entry{
+			Seq:     seq,
+			Deleted: kt == keyTypeDel,
+			Blob:    kt == keyTypeBlob,
+			Key:     ukey,
+			Value:   iterator.Value(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *SessionRecord) String() string {
+	return p.Format(func(ukey []byte) string {
+		return strconv.Quote(string(ukey))
+	})
+}
+
+// Format 按照keyFmt格式化record中的ukey
+func (p *SessionRecord) Format(keyFmt func(ukey []byte) string) string {
+
+	var b strings.Builder
+
+	ikeyFmt := func(ikey internalKey) string {
+		ukey, seq, kt, err := parseInternalKey(ikey)
+		if err != nil {
+			return fmt.Sprintf("<invalid:%x>", []byte(ikey))
+		}
+		return fmt.Sprintf("%s@%d:%d", keyFmt(ukey), seq, kt)
+	}
+
+	if p.hasField(recComparer) {
+		fmt.Fprintf(&b, "comparer: %q\n", p.comparer)
+	}
+
+	if p.hasField(recJournalNum) {
+		fmt.Fprintf(&b, "journalNum: %d\n", p.journalNum)
+	}
+
+	if p.hasField(recNextFileNum) {
+		fmt.Fprintf(&b, "nextFileNum: %d\n", p.nextFileNum)
+	}
+
+	if p.hasField(recSequenceNum) {
+		fmt.Fprintf(&b, "sequenceNum: %d\n", p.sequenceNum)
+	}
+
+	if p.hasField(recMaxColumnFamily) {
+		fmt.Fprintf(&b, "maxColumnFamily: %d\n", p.maxColumnFamily)
+	}
+
+	for _, v := range p.compactPtrs {
+		fmt.Fprintf(&b, "compactPtr: level=%d key=%s\n", v.cLevel, ikeyFmt(v.cKey))
+	}
+
+	for _, v := range p.addedFamilies {
+		fmt.Fprintf(&b, "addColumnFamily: id=%d name=%q comparer=%q\n", v.id, v.name, v.comparer)
+	}
+
+	for _, v := range p.dlRecords {
+		fmt.Fprintf(&b, "delTable: cf=%d level=%d num=%d\n", v.cf, v.level, v.num)
+	}
+
+	for _, v := range p.atRecords {
+		fmt.Fprintf(&b, "addTable: cf=%d level=%d num=%d size=%d min=%s max=%s",
+			v.cf, v.level, v.num, v.size, ikeyFmt(v.min), ikeyFmt(v.max))
+		if v.seq > 0 {
+			fmt.Fprintf(&b, " globalSeq=%d", v.seq)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, v := range p.addedBlobs {
+		fmt.Fprintf(&b, "addBlob: cf=%d num=%d count=%d size=%d\n", v.cf, v.num, v.count, v.size)
+	}
+
+	for _, v := range p.blobGarbage {
+		fmt.Fprintf(&b, "blobGarbage: cf=%d num=%d count=%d size=%d\n", v.cf, v.num, v.count, v.size)
+	}
+
+	for _, id := range p.droppedFamilies {
+		fmt.Fprintf(&b, "dropColumnFamily: id=%d\n", id)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,371 @@
+package myleveldb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	error2 "myleveldb/error"
+	"myleveldb/iter"
+	"myleveldb/sstable"
+	"myleveldb/storage"
+	"os"
+	"sort"
+)
+
+/**
+导入外部sstable(由SSTableFileWriter生成)
+
+1. 校验: 遍历每个文件的所有记录, 确认是seq为0的合法internalKey并且ukey严格递增, 得到每个文件的[umin, umax],
+   导入的文件之间范围不能重叠
+2. 拿到写锁, 先将frozenMemdb以及memdb落地到level0, 这样导入的数据一定比db中已有的数据新,
+   之后也不会有更旧的memdb落地覆盖manifest中的seq
+3. 分配一个全局seq(db.seq+1), 外部文件以新的文件号硬链接到db目录下(不支持时复制文件内容), 记录不会被重写,
+   全局seq记录在manifest的tFile中, 同时原地改写到文件的properties block中, 读取该文件时记录的seq 0被替换为全局seq:
+
+	Find      ukey相同并且全局seq大于查找的seq时, 该ukey对查找不可见, 返回ErrNotFound
+	Seek      同上, 跳过这个ukey
+	Key       返回替换了seq的key
+
+   文件中的ukey唯一并且seq都为0, 替换seq不会改变文件内记录的顺序, compaction之后的文件是普通的sstable.
+   repair从properties block恢复全局seq. 硬链接时外部文件跟db中的文件是同一个文件, 外部文件中的全局seq也会被改写,
+   外部文件再次导入时会重新分配全局seq, 不受影响. 旧版本SSTableFileWriter生成的文件没有properties block,
+   全局seq只记录在manifest中, repair后按照seq 0处理
+4. 交给tCompaction goroutine放置, 跟table compaction串行, 从level0开始往下找到第一个存在重叠的level,
+   放到它的上一层, level0就重叠的话只能放到level0, 都不重叠放到最后一层
+
+		level0      /----/
+		level1                        /------/
+		level2          /-------/                   /-------/
+		导入                               /--/          -> level1跟level2都不重叠, 放到最后一层
+
+		导入                  /--/                        -> level2重叠, 放到level1
+
+   所有文件通过同一个SessionRecord一次commit, 要么全部可见, 要么全部不可见
+5. 更新db.seq, 释放写锁
+**/
+
+type ingestFile struct {
+	path     string
+	min, max internalKey // 文件中的第一个以及最后一个key, seq为0
+}
+
+// IngestExternalFiles 将外部生成的sstable文件导入到db中, 只导入到default family,
+// 外部文件不会被删除, 硬链接导入时properties block中的全局seq会被改写
+func (db *DB) IngestExternalFiles(paths []string) error {
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	files := make([]ingestFile, 0, len(paths))
+	for _, path := range paths {
+		f, err := db.checkExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return db.s.icmp.uCompare(files[i].min.uKey(), files[j].min.uKey()) < 0
+	})
+
+	for i := 1; i < len(files); i++ {
+		if db.s.icmp.uCompare(files[i].min.uKey(), files[i-1].max.uKey()) <= 0 {
+			return error2.ErrIngestOverlap
+		}
+	}
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return error2.ErrClosed
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	// 先等上一个frozenMemdb落地, 再落地当前的memdb
+	if err := db.compTriggerWait(db.mcompCmdC); err != nil {
+		return err
+	}
+	if err := db.flushMemDbLocked(); err != nil {
+		return err
+	}
+
+	seq := db.loadSeq() + 1
+
+	var tables tFiles
+
+	dropTables := func() {
+		for _, t := range tables {
+			db.s.stor.Remove(t.fd)
+		}
+	}
+
+	for _, f := range files {
+		t, err := db.linkExternalFile(f, seq)
+		if err != nil {
+			dropTables()
+			return err
+		}
+		tables = append(tables, *t)
+	}
+
+	if err := db.compTriggerIngest(tables, seq); err != nil {
+		// db已经关闭时不确定是否已经commit, 保留文件
+		if err != error2.ErrClosed {
+			dropTables()
+		}
+		return err
+	}
+
+	db.addSeq(1)
+	return nil
+}
+
+// 校验外部文件, 返回文件中ukey的范围
+func (db *DB) checkExternalFile(path string) (f ingestFile, err error) {
+
+	reader, err := openSSTableFile(path, db.s.Options)
+	if err != nil {
+		return f, err
+	}
+	defer reader.UnRef()
+
+	iterator := reader.NewIterator()
+	defer iterator.UnRef()
+
+	f.path = path
+
+	n := 0
+	for ; iterator.Next(); n++ {
+
+		ukey, seq, kt, err := parseInternalKey(iterator.Key())
+		if err != nil {
+			return f, fmt.Errorf("myleveldb/ingest %s: %v", path, err)
+		}
+
+		if kt != keyTypeVal && kt != keyTypeDel {
+			return f, fmt.Errorf("myleveldb/ingest %s: invalid key type %d", path, kt)
+		}
+
+		// 读取时seq被替换为全局seq, 文件中的seq必须为0
+		if seq != 0 {
+			return f, fmt.Errorf("myleveldb/ingest %s: invalid seq %d", path, seq)
+		}
+
+		if n > 0 && db.s.icmp.uCompare(ukey, f.max.uKey()) <= 0 {
+			return f, fmt.Errorf("myleveldb/ingest %s: %v", path, error2.ErrKeyNotSorted)
+		}
+
+		if n == 0 {
+			f.min = append(internalKey(nil), iterator.Key()...)
+		}
+		f.max = append(f.max[:0], iterator.Key()...)
+	}
+
+	if n == 0 {
+		return f, fmt.Errorf("myleveldb/ingest %s: %v", path, errors.New("no entries"))
+	}
+
+	return f, nil
+}
+
+// 将外部文件以新的文件号硬链接到db目录下, 不支持硬链接时复制文件内容, 文件中的记录使用全局seq
+func (db *DB) linkExternalFile(f ingestFile, seq uint64) (*tFile, error) {
+
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, patch, err := db.globalSeqPatch(f.path, stat.Size(), seq)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := storage.FileDesc{Type: storage.FileTypeSSTable, Num: int(db.s.allocNextNum())}
+
+	linker, ok := db.s.stor.(storage.Linker)
+	if ok && linker.Link(f.path, fd) == nil {
+		err = writeExternalPatch(f.path, offset, patch)
+	} else {
+		err = copyExternalFile(db.s.stor, f.path, fd, offset, patch)
+	}
+	if err != nil {
+		db.s.stor.Remove(fd)
+		return nil, err
+	}
+
+	return &tFile{
+		fd:   fd,
+		size: stat.Size(),
+		min:  withGlobalSeq(f.min, seq),
+		max:  withGlobalSeq(f.max, seq),
+		seq:  seq,
+	}, nil
+}
+
+// 改写文件中全局seq需要写入的内容, 旧版本的文件没有properties block时patch为nil
+func (db *DB) globalSeqPatch(path string, size int64, seq uint64) (int64, []byte, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	offset, patch, err := sstable.GlobalSeqPatch(file, size, seq, db.s.Options.GetPool())
+	if err == sstable.ErrNoProperties {
+		return 0, nil, nil
+	}
+	return offset, patch, err
+}
+
+// 硬链接的文件跟外部文件是同一个文件, 通过外部文件的路径改写
+func writeExternalPatch(path string, offset int64, patch []byte) error {
+
+	if patch == nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.WriteAt(patch, offset); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func copyExternalFile(stor storage.Storage, path string, fd storage.FileDesc, offset int64, patch []byte) error {
+
+	reader, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := stor.Create(fd)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if _, err = io.Copy(writer, reader); err != nil {
+		return err
+	}
+
+	if patch != nil {
+		if _, err = writer.WriteAt(patch, offset); err != nil {
+			return err
+		}
+	}
+
+	return writer.Sync()
+}
+
+// 返回ikey的拷贝, seq替换为全局seq, key type不变
+func withGlobalSeq(ikey internalKey, seq uint64) internalKey {
+	dst := append(internalKey(nil), ikey...)
+	binary.LittleEndian.PutUint64(dst[len(dst)-8:], seq<<8|ikey.num()&0xff)
+	return dst
+}
+
+// 替换导入文件中Find找到的key的seq, ukey相同并且全局seq大于查找的seq时, 该ukey对查找不可见
+func (sstOpt *sstableOperation) withGlobalSeq(t tFile, ikey, rkey internalKey) (internalKey, error) {
+	if t.seq > ikey.num()>>8 && sstOpt.icmp.uCompare(rkey.uKey(), ikey.uKey()) == 0 {
+		return nil, sstable.ErrNotFound
+	}
+	return withGlobalSeq(rkey, t.seq), nil
+}
+
+// 导入文件的iterator, 返回的key的seq替换为全局seq
+type globalSeqIterator struct {
+	iter.Iterator
+	icmp *iComparer
+	seq  uint64
+	key  internalKey
+}
+
+func newGlobalSeqIterator(iterator iter.Iterator, icmp *iComparer, seq uint64) iter.Iterator {
+	return &globalSeqIterator{Iterator: iterator, icmp: icmp, seq: seq}
+}
+
+// Seek 文件中的seq为0, 总是定位到跟key的ukey相同的记录, 全局seq大于key的seq时该记录在key之前, 跳过
+func (i *globalSeqIterator) Seek(key []byte) bool {
+	if !i.Iterator.Seek(key) {
+		return false
+	}
+	ikey := internalKey(key)
+	if i.seq > ikey.num()>>8 && i.icmp.uCompare(internalKey(i.Iterator.Key()).uKey(), ikey.uKey()) == 0 {
+		return i.Iterator.Next()
+	}
+	return true
+}
+
+func (i *globalSeqIterator) Last() bool {
+	return iter.Last(i.Iterator)
+}
+
+func (i *globalSeqIterator) Prev() bool {
+	return iter.Prev(i.Iterator)
+}
+
+// SeekBefore 文件中的seq为0, 跟key的ukey相同的记录总是在key之后, 全局seq大于key的seq时该记录在key之前,
+// 改为查找排在该ukey所有记录之后的key
+func (i *globalSeqIterator) SeekBefore(key []byte) bool {
+	ikey := internalKey(key)
+	if i.seq > ikey.num()>>8 {
+		key = makeInternalKey(ikey.uKey(), 0, 0)
+	}
+	return iter.SeekBefore(i.Iterator, key)
+}
+
+// Key 返回的key在下一次移动之前有效
+func (i *globalSeqIterator) Key() []byte {
+	key := internalKey(i.Iterator.Key())
+	if key == nil {
+		return nil
+	}
+	i.key = append(i.key[:0], key...)
+	binary.LittleEndian.PutUint64(i.key[len(i.key)-8:], i.seq<<8|key.num()&0xff)
+	return i.key
+}
+
+// 在tCompaction goroutine中执行, 为每个文件选择level并一次commit
+func (db *DB) ingestTables(tables tFiles, seq uint64) error {
+
+	v := db.s.defaultCf.version()
+	defer v.unRef()
+
+	rec := &SessionRecord{}
+	for _, t := range tables {
+		rec.addTableFile(defaultColumnFamilyID, v.pickIngestLevel(t.min.uKey(), t.max.uKey()), t)
+	}
+	rec.setSequenceNum(seq)
+
+	return db.s.commit(rec)
+}
+
+// 从level0往下找到第一个跟[umin, umax]重叠的level, 返回它的上一层
+func (v *Version) pickIngestLevel(umin, umax []byte) int {
+
+	level := 0
+	for ; level < defaultNumLevels; level++ {
+		if level < len(v.levels) &&
+			len(v.levels[level].getOverlaps(v.cf.icmp, umin, umax, level == 0)) > 0 {
+			break
+		}
+	}
+
+	if level == 0 {
+		return 0
+	}
+	return level - 1
+}
@@ -0,0 +1,134 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_IngestExternalFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 64 << 10}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, db.CompactRange(nil, nil))
+
+	// 外部文件覆盖[500, 1500), 删除key 10
+	path := filepath.Join(t.TempDir(), "external.sst")
+	w, err := NewSSTableFileWriter(path, opt)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Delete(testKey(10)))
+	for i := 500; i < 1500; i++ {
+		assert.Nil(t, w.Put(testKey(i), testValue(i+1, 100)))
+	}
+	assert.Nil(t, w.Finish())
+
+	before := db.loadSeq()
+	assert.Nil(t, db.IngestExternalFiles([]string{path}))
+
+	// 外部文件硬链接到db目录下, 没有重写
+	ext, err := os.Stat(path)
+	assert.Nil(t, err)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	linked := false
+	for _, e := range entries {
+		if fi, err := os.Stat(filepath.Join(dir, e.Name())); err == nil && os.SameFile(ext, fi) {
+			linked = true
+		}
+	}
+	assert.True(t, linked)
+
+	expect := func(i int) []byte {
+		switch {
+		case i == 10:
+			return nil
+		case i < 500:
+			return testValue(i, 100)
+		case i < 1500:
+			return testValue(i+1, 100)
+		}
+		return nil
+	}
+	check := func(db *DB) {
+		for i := 0; i < 1600; i++ {
+			v, err := db.Get(testKey(i))
+			if want := expect(i); want == nil {
+				assert.Equal(t, error2.ErrNotFound, err, "key %d", i)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, want, v, "key %d", i)
+			}
+		}
+
+		keys := [][]byte{testKey(10), testKey(499), testKey(500), testKey(1499), testKey(1500)}
+		values, errs := db.MultiGet(keys)
+		for i, key := range keys {
+			v, err := db.Get(key)
+			assert.Equal(t, err, errs[i])
+			assert.Equal(t, v, values[i])
+		}
+
+		it := db.NewIterator(nil)
+		n := 0
+		for ok := it.First(); ok; ok = it.Next() {
+			for expect(n) == nil {
+				n++
+			}
+			assert.Equal(t, testKey(n), it.Key())
+			assert.Equal(t, expect(n), it.Value())
+			n++
+		}
+		assert.Equal(t, 1500, n)
+		assert.True(t, it.Seek(testKey(700)))
+		assert.Equal(t, testKey(700), it.Key())
+		assert.Equal(t, testValue(701, 100), it.Value())
+		assert.True(t, it.Last())
+		assert.Equal(t, testKey(1499), it.Key())
+		it.UnRef()
+
+		// Last从上界向前遍历, 导入文件中的key替换为全局seq之后覆盖旧的记录
+		for _, upper := range []int{700, 11, 1600} {
+			it := db.NewIterator(&IterOptions{UpperBound: testKey(upper)})
+			assert.True(t, it.Last())
+			last := upper - 1
+			for expect(last) == nil {
+				last--
+			}
+			assert.Equal(t, testKey(last), it.Key(), "upper %d", upper)
+			assert.Equal(t, expect(last), it.Value(), "upper %d", upper)
+			it.UnRef()
+		}
+	}
+	check(db)
+
+	// 导入之前的seq看不到导入的记录
+	v, err := db.get(db.s.defaultCf, testKey(10), before)
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(10, 100), v)
+	v, err = db.get(db.s.defaultCf, testKey(600), before)
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(600, 100), v)
+	_, err = db.get(db.s.defaultCf, testKey(1200), before)
+	assert.Equal(t, error2.ErrNotFound, err)
+
+	// 全局seq记录在manifest中, 重新打开以及compaction之后不变
+	assert.Nil(t, db.Close())
+	db, err = Open(dir, opt)
+	assert.Nil(t, err)
+	check(db)
+	assert.Nil(t, db.CompactRange(nil, nil))
+	check(db)
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	check(db)
+}
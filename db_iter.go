@@ -0,0 +1,501 @@
+package myleveldb
+
+import (
+	"bytes"
+	error2 "myleveldb/error"
+	"myleveldb/filter"
+	"myleveldb/iter"
+	"myleveldb/memdb"
+	"myleveldb/utils"
+)
+
+/**
+db iterator
+
+底层是一个MergedIterator, 由以下的iterator合并而成
+1. memdb, frozenMemdb的iterator
+2. level0的每一个sstable各自一个iterator(level0的sstable之间key的范围会重叠)
+3. level1以上, 每一层一个IndexedIterator(同一层的sstable之间key的范围不会重叠)
+
+MergedIterator按照internalKey的顺序遍历, ukey相同时seq越大越靠前, 所以对于同一个ukey,
+第一个seq小于等于快照seq的记录就是快照可见的最新版本, 剩下的版本直接跳过,
+如果可见的最新版本是删除, 那么这个ukey对外不可见
+
+	ukey   a       a       a       b       c       c
+	seq    9       5       3       7       6       2
+	kt     val     del     val     del     val     val
+
+快照seq为5时, 遍历的结果为 a(del, 不可见) c(2)
+
+prefix模式
+Seek时通过Options.PrefixExtractor取出key的prefix, 重新合并iterator, 跳过filter中不包含该prefix的sstable,
+遍历到prefix不同的key时结束, 所以只能用于遍历同一个prefix下的key
+
+范围遍历
+IterOptions指定[LowerBound, UpperBound)时, key的范围与之不重叠的sstable不参与合并,
+sstable中index key大于等于UpperBound的data block之后的data block不会被读取, First从LowerBound开始,
+Last停在UpperBound之前最后一个可见的key
+
+Last
+底层的iterator支持反向遍历, Last定位到UpperBound之前(没有UpperBound时为最后)的位置, 然后向前遍历,
+同一个ukey反向遍历时seq从小到大, 快照可见的最新版本是最后遇到的seq小于等于快照seq的记录,
+遇到前一个ukey时如果当前ukey可见的最新版本不是删除, 那么当前ukey就是结果, 否则继续向前直到LowerBound,
+向前遍历时只记录blob index, 只有作为结果的记录才读取blob文件
+
+	ukey   a       a       b       b       c
+	seq    9       5       7       3       6
+	kt     del     val     del     val     del
+	                                          <- 从这里开始, 快照seq为8时结果为a(5)
+**/
+
+// DBIterator db的迭代器, 在Iterator的基础上支持Last
+type DBIterator interface {
+	iter.Iterator
+	Last() bool // 移动到范围内最后一个可见的key, 之后Next返回false
+}
+
+// family已经删除时返回的迭代器
+type emptyDBIter struct {
+	iter.Iterator
+}
+
+func (emptyDBIter) Last() bool {
+	return false
+}
+
+type dbIter struct {
+	utils.BasicReleaser
+	db   *DB
+	cf   *ColumnFamily
+	iter iter.Iterator
+	seq  uint64
+
+	// 当前遍历的ukey, 同时也用于跳过同一个ukey的旧版本
+	key, value []byte
+	hasKey     bool
+	last       bool // Last定位到的key, 底层iterator在它之前的位置, 之后Next返回false
+
+	// soi 代表是否开始遍历
+	// eoi 代表是否结束遍历
+	soi, eoi bool
+
+	version  *Version
+	snapshot *snapshotElement
+
+	err error // 读取blob失败时结束遍历
+
+	mems []*memdb.MemDB // 创建时的memdb以及frozenMemdb
+
+	// 遍历的范围[lower, upper), upperKey是upper对应的最小的internalKey
+	lower, upper []byte
+	upperKey     internalKey
+
+	// 读取sstable, DontFillCache时读取的block不加入block cache
+	tableOpts *sstableOperation
+
+	// prefix模式, extractor为nil时不是prefix模式
+	extractor filter.PrefixExtractor
+	prefix    []byte // 当前Seek的key的prefix, hasPrefix为false时遍历所有的key
+	hasPrefix bool
+}
+
+// NewIterator 新建一个遍历当前快照的迭代器, 遍历的key是ukey, 使用完后需要调用UnRef, opt为nil时不限制范围
+func (db *DB) NewIterator(opt *IterOptions) DBIterator {
+	return db.NewIteratorCF(db.s.defaultCf, opt)
+}
+
+// NewIteratorCF 新建一个遍历指定family当前快照的迭代器
+func (db *DB) NewIteratorCF(cf *ColumnFamily, opt *IterOptions) DBIterator {
+	return db.newIterator(cf, opt, false)
+}
+
+// NewPrefixIterator 新建一个prefix模式的迭代器, 需要设置Options.PrefixExtractor
+// Seek时取key的prefix, 跳过filter中不包含该prefix的sstable, 遍历到prefix不同的key时结束,
+// key不存在prefix或者调用First, Last时遍历所有的key
+func (db *DB) NewPrefixIterator(opt *IterOptions) DBIterator {
+	return db.NewPrefixIteratorCF(db.s.defaultCf, opt)
+}
+
+// NewPrefixIteratorCF 新建一个指定family的prefix模式的迭代器
+func (db *DB) NewPrefixIteratorCF(cf *ColumnFamily, opt *IterOptions) DBIterator {
+	return db.newIterator(cf, opt, true)
+}
+
+func (db *DB) newIterator(cf *ColumnFamily, opt *IterOptions, prefixMode bool) DBIterator {
+
+	v := cf.version()
+	if v == nil {
+		return emptyDBIter{iter.NewEmptyIterator(error2.ErrColumnFamilyDropped)}
+	}
+	snapshot := db.acquireSnapshot()
+
+	i := &dbIter{
+		db:       db,
+		cf:       cf,
+		seq:      snapshot.seq,
+		soi:      true,
+		version:  v,
+		snapshot: snapshot,
+	}
+
+	i.tableOpts = cf.tableOpts
+	if opt.GetDontFillCache() {
+		i.tableOpts = cf.tableOpts.withoutFillCache()
+	}
+
+	if prefixMode {
+		i.extractor = cf.opt.GetPrefixExtractor()
+	}
+
+	if lower := opt.GetLowerBound(); lower != nil {
+		i.lower = append([]byte(nil), lower...)
+	}
+	if upper := opt.GetUpperBound(); upper != nil {
+		i.upper = append([]byte(nil), upper...)
+		i.upperKey = makeInternalKey(upper, maxSeq, keyTypeSeek)
+	}
+
+	// 引用一直持有到UnRef, prefix模式下重建iterator时使用同一组memdb
+	memDb, memFrozenDb := db.getMems(cf)
+	for _, m := range []*memdb.MemDB{memDb, memFrozenDb} {
+		if m != nil {
+			i.mems = append(i.mems, m)
+		}
+	}
+
+	i.iter = i.mergedIterator(nil)
+	return i
+}
+
+// 合并memdb以及version中所有sstable的iterator, prefix不为nil时跳过不可能包含prefix的sstable
+func (i *dbIter) mergedIterator(prefix []byte) iter.Iterator {
+
+	var (
+		iters []iter.Iterator
+		pkey  internalKey
+	)
+
+	for _, m := range i.mems {
+		iters = append(iters, m.NewIterator())
+	}
+
+	if prefix != nil {
+		pkey = makeInternalKey(prefix, maxSeq, keyTypeSeek)
+	}
+
+	for level, tables := range i.version.levels {
+		tables = i.boundedTables(tables)
+		if prefix != nil {
+			tables = i.prefixTables(level, tables, pkey)
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		if level == 0 {
+			for _, t := range tables {
+				iters = append(iters, i.tableOpts.NewBoundedIterator(t, i.upperKey))
+			}
+		} else {
+			iters = append(iters, iter.NewIndexedIterator(tables.NewBoundedIteratorIndexer(i.tableOpts, i.upperKey)))
+		}
+	}
+
+	return iter.NewMergedIterator(iters, i.cf.icmp)
+}
+
+// 跳过key的范围与[lower, upper)不重叠的sstable
+func (i *dbIter) boundedTables(tables tFiles) tFiles {
+
+	if i.lower == nil && i.upper == nil {
+		return tables
+	}
+
+	var dst tFiles
+	for _, t := range tables {
+		if i.lower != nil && t.before(i.cf.icmp, i.lower) {
+			continue
+		}
+		if i.upper != nil && i.cf.icmp.uCompare(t.min.uKey(), i.upper) >= 0 {
+			continue
+		}
+		dst = append(dst, t)
+	}
+	return dst
+}
+
+// 筛选出可能包含prefix的sstable
+// 1. max小于prefix的sstable不包含prefix
+// 2. 第一个可能包含>=prefix的data block的filter中不存在prefix时, 因为prefix相同的key是连续的, 整个sstable都不包含prefix
+// 3. level0以上的sstable之间不重叠, max的prefix不同时, 后面的sstable都在prefix之后
+func (i *dbIter) prefixTables(level int, tables tFiles, pkey internalKey) tFiles {
+
+	var dst tFiles
+	prefix := pkey.uKey()
+
+	for _, t := range tables {
+		if t.before(i.cf.icmp, prefix) {
+			continue
+		}
+
+		// 读取filter失败时保留sstable, 由sstable的iterator返回错误
+		if ok, err := i.cf.tableOpts.MayContainPrefix(t, pkey); ok || err != nil {
+			dst = append(dst, t)
+		}
+
+		if level > 0 && !i.inPrefix(t.max.uKey()) {
+			break
+		}
+	}
+	return dst
+}
+
+// 按照key的prefix重建底层的iterator, key不存在prefix时遍历所有的key
+func (i *dbIter) setPrefix(key []byte) {
+
+	if i.extractor.InDomain(key) {
+		i.prefix = append(i.prefix[:0], i.extractor.Transform(key)...)
+		i.hasPrefix = true
+		i.rebuild()
+	} else {
+		i.clearPrefix()
+	}
+}
+
+func (i *dbIter) clearPrefix() {
+	if i.hasPrefix {
+		i.hasPrefix = false
+		i.rebuild()
+	}
+}
+
+func (i *dbIter) rebuild() {
+	var prefix []byte
+	if i.hasPrefix {
+		prefix = i.prefix
+	}
+	i.iter.UnRef()
+	i.iter = i.mergedIterator(prefix)
+}
+
+func (i *dbIter) inPrefix(ukey []byte) bool {
+	return i.extractor.InDomain(ukey) && bytes.Equal(i.extractor.Transform(ukey), i.prefix)
+}
+
+func (i *dbIter) First() bool {
+
+	if i.Released() {
+		return false
+	}
+
+	i.reset()
+	i.clearPrefix()
+
+	// 有下界时从下界开始遍历
+	var ok bool
+	if i.lower != nil {
+		ok = i.iter.Seek(makeInternalKey(i.lower, i.seq, keyTypeSeek))
+	} else {
+		ok = i.iter.First()
+	}
+	if !ok {
+		return i.end()
+	}
+	return i.walk()
+}
+
+func (i *dbIter) Last() bool {
+
+	if i.Released() {
+		return false
+	}
+
+	i.reset()
+	i.clearPrefix()
+
+	var ok bool
+	if i.upper != nil {
+		ok = iter.SeekBefore(i.iter, i.upperKey)
+	} else {
+		ok = iter.Last(i.iter)
+	}
+	if !ok {
+		return i.end()
+	}
+	return i.walkBackward()
+}
+
+// 从底层iterator的当前位置开始向前遍历, 停在最后一个可见的ukey上, 之后Next返回false
+func (i *dbIter) walkBackward() bool {
+
+	var (
+		kt    = keyTypeDel // i.key可见的最新版本的类型
+		value []byte
+	)
+
+	for {
+
+		ukey, seq, t, err := parseInternalKey(i.iter.Key())
+
+		// 遍历到下界时结束
+		if err == nil && i.lower != nil && i.cf.icmp.uCompare(ukey, i.lower) < 0 {
+			break
+		}
+
+		if err == nil && seq <= i.seq {
+			if i.hasKey && i.cf.icmp.uCompare(ukey, i.key) != 0 {
+				if kt != keyTypeDel {
+					break
+				}
+			}
+			i.key = append(i.key[:0], ukey...)
+			i.hasKey = true
+			kt = t
+			value = append(value[:0], i.iter.Value()...)
+		}
+
+		if !iter.Prev(i.iter) {
+			break
+		}
+	}
+
+	if !i.hasKey || (kt != keyTypeVal && kt != keyTypeBlob) {
+		return i.end()
+	}
+
+	if kt == keyTypeBlob {
+		var err error
+		if value, err = i.cf.resolveValue(kt, value); err != nil {
+			i.err = err
+			return i.end()
+		}
+	}
+
+	i.value = append(i.value[:0], value...)
+	i.last = true
+	return true
+}
+
+func (i *dbIter) Seek(key []byte) bool {
+
+	if i.Released() {
+		return false
+	}
+
+	i.reset()
+	if i.lower != nil && i.cf.icmp.uCompare(key, i.lower) < 0 {
+		key = i.lower
+	}
+	if i.extractor != nil {
+		i.setPrefix(key)
+	}
+	if !i.iter.Seek(makeInternalKey(key, i.seq, keyTypeSeek)) {
+		return i.end()
+	}
+	return i.walk()
+}
+
+func (i *dbIter) Next() bool {
+
+	if i.Released() || i.eoi {
+		return false
+	}
+
+	if i.soi {
+		return i.First()
+	}
+
+	if i.last {
+		return i.end()
+	}
+
+	if !i.iter.Next() {
+		return i.end()
+	}
+	return i.walk()
+}
+
+// 从底层iterator的当前位置开始, 找到下一个可见的ukey
+func (i *dbIter) walk() bool {
+
+	for {
+
+		ukey, seq, kt, err := parseInternalKey(i.iter.Key())
+
+		// 遍历到上界时结束
+		if err == nil && i.upper != nil && i.cf.icmp.uCompare(ukey, i.upper) >= 0 {
+			return i.end()
+		}
+
+		// prefix模式下遍历到prefix不同的key时结束
+		if err == nil && i.hasPrefix && !i.inPrefix(ukey) {
+			return i.end()
+		}
+
+		if err == nil && seq <= i.seq &&
+			(!i.hasKey || i.cf.icmp.uCompare(ukey, i.key) != 0) {
+
+			i.key = append(i.key[:0], ukey...)
+			i.hasKey = true
+
+			if kt == keyTypeVal {
+				i.value = append(i.value[:0], i.iter.Value()...)
+				return true
+			}
+
+			if kt == keyTypeBlob {
+				value, err := i.cf.resolveValue(kt, i.iter.Value())
+				if err != nil {
+					i.err = err
+					return i.end()
+				}
+				i.value = append(i.value[:0], value...)
+				return true
+			}
+		}
+
+		if !i.iter.Next() {
+			return i.end()
+		}
+	}
+
+}
+
+func (i *dbIter) reset() {
+	i.soi, i.eoi = false, false
+	i.hasKey, i.last = false, false
+	i.key = i.key[:0]
+	i.value = i.value[:0]
+}
+
+func (i *dbIter) end() bool {
+	i.eoi = true
+	return false
+}
+
+func (i *dbIter) Key() []byte {
+	if i.soi || i.eoi {
+		return nil
+	}
+	return i.key
+}
+
+func (i *dbIter) Value() []byte {
+	if i.soi || i.eoi {
+		return nil
+	}
+	return i.value
+}
+
+func (i *dbIter) UnRef() {
+
+	if !i.Released() {
+		i.iter.UnRef()
+		for _, m := range i.mems {
+			m.UnRef()
+		}
+		i.version.unRef()
+		i.db.releaseSnapshot(i.snapshot)
+		i.BasicReleaser.UnRef()
+	}
+
+}
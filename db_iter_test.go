@@ -0,0 +1,195 @@
+package myleveldb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 三个key的范围互不重叠的level0 sstable: [0, 1000), [1000, 2000), [2000, 3000)
+func openBoundsTestDB(t *testing.T) *DB {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 1 << 20}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for b := 0; b < 3; b++ {
+		for i := b * 1000; i < (b+1)*1000; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+		}
+		assert.Nil(t, db.flushMemDb())
+	}
+	assert.Nil(t, db.Close())
+
+	// 重新打开, sstable以及block都不在缓存中
+	return openTestDB(t, dir, opt)
+}
+
+func TestDBIter_BoundsPruneTablesAndBlocks(t *testing.T) {
+
+	db := openBoundsTestDB(t)
+	stats := func() *DBStats {
+		s, err := db.Stats()
+		assert.Nil(t, err)
+		return s
+	}
+	assert.Equal(t, 3, stats().Levels[0].FileCount)
+
+	// 范围之外的sstable不会被打开
+	it := db.NewIterator(&IterOptions{LowerBound: testKey(1300), UpperBound: testKey(1320)})
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		assert.Equal(t, testKey(1300+n), it.Key())
+		n++
+	}
+	it.UnRef()
+	assert.Equal(t, 20, n)
+	assert.Equal(t, uint64(1), stats().OpenFilesCache.Misses)
+
+	// 没有范围时level0的sstable都要参与合并
+	it = db.NewIterator(nil)
+	assert.True(t, it.Seek(testKey(1300)))
+	it.UnRef()
+	assert.Equal(t, uint64(3), stats().OpenFilesCache.Misses)
+
+	// sstable的iterator遍历完包含upper的data block之后不再加载后面的data block
+	v := db.s.defaultCf.version()
+	defer v.unRef()
+	table := v.levels[0][0]
+	if v.levels[0][1].fd.Num < table.fd.Num {
+		table = v.levels[0][1]
+	}
+	if v.levels[0][2].fd.Num < table.fd.Num {
+		table = v.levels[0][2]
+	}
+
+	scan := func(upper internalKey) (n int, misses uint64) {
+		before := stats().BlockCache.Misses
+		tit := db.s.defaultCf.tableOpts.withoutFillCache().NewBoundedIterator(table, upper)
+		for tit.Next() {
+			n++
+		}
+		tit.UnRef()
+		return n, stats().BlockCache.Misses - before
+	}
+
+	n, bounded := scan(makeInternalKey(testKey(100), maxSeq, keyTypeSeek))
+	assert.True(t, n >= 100 && n < 120, "read %d keys", n)
+	all, unbounded := scan(nil)
+	assert.Equal(t, 1000, all)
+	assert.True(t, bounded*5 < unbounded, "bounded %d, unbounded %d", bounded, unbounded)
+}
+
+func TestDBIter_Last(t *testing.T) {
+
+	db := openBoundsTestDB(t)
+
+	last := func(opt *IterOptions) []byte {
+		it := db.NewIterator(opt)
+		defer it.UnRef()
+		if !it.Last() {
+			return nil
+		}
+		key := append([]byte(nil), it.Key()...)
+		assert.False(t, it.Next())
+		return key
+	}
+
+	assert.Equal(t, testKey(2999), last(nil))
+	assert.Equal(t, testKey(1319), last(&IterOptions{UpperBound: testKey(1320)}))
+	assert.Equal(t, testKey(999), last(&IterOptions{LowerBound: testKey(10), UpperBound: testKey(1000)}))
+	assert.Nil(t, last(&IterOptions{LowerBound: testKey(5000)}))
+
+	// 删除的key不可见, memdb中的key同样参与
+	assert.Nil(t, db.Delete(testKey(1319)))
+	assert.Nil(t, db.Delete(testKey(1318)))
+	assert.Equal(t, testKey(1317), last(&IterOptions{UpperBound: testKey(1320)}))
+	assert.Nil(t, db.Put(testKey(5000), testValue(5000, 100)))
+	assert.Equal(t, testKey(5000), last(nil))
+
+	// 最后一个sstable中的key都被删除时, 从前一个sstable开始
+	assert.Nil(t, db.Delete(testKey(5000)))
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Equal(t, testKey(1999), last(nil))
+	assert.Nil(t, last(&IterOptions{LowerBound: testKey(2000)}))
+
+	// 快照之后的写入不可见
+	it := db.NewIterator(&IterOptions{LowerBound: testKey(100), UpperBound: testKey(200)})
+	defer it.UnRef()
+	assert.Nil(t, db.Delete(testKey(199)))
+	assert.True(t, it.Last())
+	assert.Equal(t, testKey(199), it.Key())
+	assert.Equal(t, testValue(199, 100), it.Value())
+	assert.True(t, it.First())
+	assert.Equal(t, testKey(100), it.Key())
+}
+
+func TestDBIter_LastReadsOnlyTheLastBlocks(t *testing.T) {
+
+	db := openBoundsTestDB(t)
+	misses := func() uint64 {
+		s, err := db.Stats()
+		assert.Nil(t, err)
+		return s.BlockCache.Misses
+	}
+
+	// Last从UpperBound向前遍历, 只读取包含UpperBound的data block, 读取的block都不加入缓存
+	before := misses()
+	it := db.NewIterator(&IterOptions{UpperBound: testKey(1990), DontFillCache: true})
+	assert.True(t, it.Last())
+	assert.Equal(t, testKey(1989), it.Key())
+	assert.Equal(t, testValue(1989, 100), it.Value())
+	it.UnRef()
+	last := misses() - before
+
+	before = misses()
+	it = db.NewIterator(&IterOptions{LowerBound: testKey(1000), UpperBound: testKey(1990), DontFillCache: true})
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		n++
+	}
+	it.UnRef()
+	assert.Equal(t, 990, n)
+	scan := misses() - before
+	assert.True(t, last*10 < scan, "last %d, scan %d", last, scan)
+}
+
+func TestDBIter_LastResolvesOnlyTheResultBlob(t *testing.T) {
+
+	dir := t.TempDir()
+	db := openTestDB(t, dir, &Options{BlobMinValueSize: 512})
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 1024)))
+	}
+	assert.Nil(t, db.CompactRange(nil, nil))
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	if !assert.Len(t, stats.Blobs, 1) {
+		return
+	}
+
+	// 破坏第一个blob, 读取key 0的value失败
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%06d.blob", stats.Blobs[0].Num)), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("corrupted"), 32)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	it := db.NewIterator(nil)
+	assert.False(t, it.First())
+	it.UnRef()
+
+	// 向前遍历经过的记录不读取blob
+	it = db.NewIterator(&IterOptions{UpperBound: testKey(150)})
+	defer it.UnRef()
+	assert.True(t, it.Last())
+	assert.Equal(t, testKey(149), it.Key())
+	assert.Equal(t, testValue(149, 1024), it.Value())
+}
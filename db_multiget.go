@@ -0,0 +1,257 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"myleveldb/memdb"
+	"myleveldb/sstable"
+	"sort"
+	"sync"
+)
+
+/**
+MultiGet
+
+批量查找时使用同一个快照, 同一组memdb以及同一个version, 查找流程跟Get相同, 只是按照sstable分组
+
+1. 所有key按照ukey排序, 依次在memdb, frozenMemdb中查找, 找到(包括删除)的key不再往下查找
+2. 逐层查找剩下的key
+   level0: 每一个sstable与所有key的范围比较, 重叠的key分到这个sstable, 同一个key取所有sstable中seq最大的记录
+   level1以上: 每个key二分查找所在的sstable, 同一个sstable的key分到一组
+3. 每一组只打开一次sstable, sstable.Reader.MultiFind按照顺序查找这一组的key,
+   落在同一个data block的key只读取一次data block, 每个key只查询一次filter
+4. 同一层不同sstable的分组之间没有依赖, Options.MultiGetParallelism大于1时并发查找
+
+	keys    a   c   f   k   m   x
+	level1  [a   d]  [f    m]  [w   z]
+	        {a, c}   {f, k, m} {x}
+**/
+
+type multiGetReq struct {
+	ikey internalKey
+	ukey []byte
+
+	done  bool
+	value []byte
+	err   error
+
+	// level0中seq最大的记录
+	zfound bool
+	zseq   uint64
+	zkt    keyType
+	zval   []byte
+}
+
+// 一个sstable以及落在这个sstable中的key, key已经按照顺序排列
+type multiGetGroup struct {
+	t       tFile
+	reqs    []*multiGetReq
+	results []sstable.FindResult
+}
+
+// MultiGet 批量获取default family中keys对应的value, values[i], errs[i]对应keys[i],
+// key不存在时errs[i]为ErrNotFound
+func (db *DB) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	return db.MultiGetCF(db.s.defaultCf, keys)
+}
+
+// MultiGetCF 批量获取指定family中keys对应的value
+func (db *DB) MultiGetCF(cf *ColumnFamily, keys [][]byte) (values [][]byte, errs []error) {
+
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+
+	snapshot := db.acquireSnapshot()
+	defer db.releaseSnapshot(snapshot)
+
+	reqs := make([]*multiGetReq, len(keys))
+	sorted := make([]*multiGetReq, len(keys))
+	for i, key := range keys {
+		reqs[i] = &multiGetReq{
+			ikey: makeInternalKey(key, snapshot.seq, keyTypeSeek),
+			ukey: key,
+		}
+		sorted[i] = reqs[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return cf.icmp.uCompare(sorted[i].ukey, sorted[j].ukey) < 0
+	})
+
+	memDb, memFrozenDb := db.getMems(cf)
+	for _, m := range []*memdb.MemDB{memDb, memFrozenDb} {
+		if m == nil {
+			continue
+		}
+		for _, req := range sorted {
+			if req.done {
+				continue
+			}
+			if ok, v, e := memGet(m, req.ikey, cf.icmp); ok {
+				req.done, req.value, req.err = true, append([]byte(nil), v...), e
+			}
+		}
+		m.UnRef()
+	}
+
+	v := cf.version()
+	if v == nil {
+		for _, req := range sorted {
+			if !req.done {
+				req.done, req.err = true, error2.ErrColumnFamilyDropped
+			}
+		}
+	} else {
+		v.multiGet(sorted, cf.opt.GetMultiGetParallelism())
+		v.unRef()
+	}
+
+	for i, req := range reqs {
+		values[i], errs[i] = req.value, req.err
+	}
+	return
+}
+
+// 在version中逐层查找没有完成的请求, reqs已经按照ukey排序
+func (v *Version) multiGet(reqs []*multiGetReq, parallelism int) {
+
+	icmp := v.cf.icmp
+
+	for level, tables := range v.levels {
+
+		var pending []*multiGetReq
+		for _, req := range reqs {
+			if !req.done {
+				pending = append(pending, req)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		var groups []*multiGetGroup
+		if level == 0 {
+			for _, t := range tables {
+				group := &multiGetGroup{t: t}
+				for _, req := range pending {
+					if t.overlapped(icmp, req.ukey, req.ukey) {
+						group.reqs = append(group.reqs, req)
+					}
+				}
+				if len(group.reqs) > 0 {
+					groups = append(groups, group)
+				}
+			}
+		} else {
+			// 请求有序, 所在的sstable也有序, 相邻的请求落在同一个sstable时合并到同一组
+			var last *multiGetGroup
+			for _, req := range pending {
+				idx := sort.Search(len(tables), func(i int) bool {
+					return icmp.Compare(tables[i].max, req.ikey) >= 0
+				})
+				if idx >= len(tables) || icmp.uCompare(req.ukey, tables[idx].min.uKey()) < 0 {
+					continue
+				}
+				if last == nil || last.t.fd.Num != tables[idx].fd.Num {
+					last = &multiGetGroup{t: tables[idx]}
+					groups = append(groups, last)
+				}
+				last.reqs = append(last.reqs, req)
+			}
+		}
+
+		v.multiFind(groups, parallelism)
+
+		for _, group := range groups {
+			for i, req := range group.reqs {
+				v.applyMultiGetResult(level, req, group.results[i])
+			}
+		}
+
+		if level == 0 {
+			for _, req := range pending {
+				if req.zfound && !req.done {
+					req.done = true
+					req.value, req.err = v.multiGetValue(req.zkt, req.zval)
+				}
+			}
+		}
+	}
+
+	for _, req := range reqs {
+		if !req.done {
+			req.done, req.err = true, error2.ErrNotFound
+		}
+	}
+}
+
+// 并发查找每一组, 每一组的结果写入自己的results, 不会互相影响
+func (v *Version) multiFind(groups []*multiGetGroup, parallelism int) {
+
+	find := func(group *multiGetGroup) {
+		ikeys := make([][]byte, len(group.reqs))
+		for i, req := range group.reqs {
+			ikeys[i] = req.ikey
+		}
+		group.results = v.cf.tableOpts.MultiFind(group.t, ikeys)
+	}
+
+	if parallelism <= 1 || len(groups) <= 1 {
+		for _, group := range groups {
+			find(group)
+		}
+		return
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, parallelism)
+	)
+	for _, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(group *multiGetGroup) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			find(group)
+		}(group)
+	}
+	wg.Wait()
+}
+
+// 跟Version.find中的处理相同, level0只记录seq最大的记录, 其他层找到即完成
+func (v *Version) applyMultiGetResult(level int, req *multiGetReq, result sstable.FindResult) {
+
+	if req.done {
+		return
+	}
+
+	if result.Err != nil {
+		if result.Err != sstable.ErrNotFound {
+			req.done, req.err = true, result.Err
+		}
+		return
+	}
+
+	uk, seq, kt, err := parseInternalKey(result.Key)
+	if err != nil || v.cf.icmp.uCompare(uk, req.ukey) != 0 {
+		return
+	}
+
+	if level == 0 {
+		if !req.zfound || seq >= req.zseq {
+			req.zfound, req.zseq, req.zkt, req.zval = true, seq, kt, result.Value
+		}
+		return
+	}
+
+	req.done = true
+	req.value, req.err = v.multiGetValue(kt, result.Value)
+}
+
+func (v *Version) multiGetValue(kt keyType, value []byte) ([]byte, error) {
+	if kt == keyTypeDel {
+		return nil, error2.ErrNotFound
+	}
+	return v.resolveValue(kt, value, false)
+}
@@ -0,0 +1,57 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_MultiGet(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 32 << 10}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, db.CompactRange(nil, nil))
+	// level0中覆盖一部分, memdb中删除一部分
+	for i := 0; i < 2000; i += 7 {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1, 100)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	for i := 0; i < 2000; i += 5 {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	assert.Nil(t, db.Put(testKey(2001), testValue(2001, 100)))
+
+	// 乱序, 重复以及不存在的key
+	var keys [][]byte
+	for i := 2001; i >= 0; i -= 3 {
+		keys = append(keys, testKey(i))
+	}
+	keys = append(keys, testKey(10), testKey(11), testKey(11), testKey(9999))
+
+	values, errs := db.MultiGet(keys)
+	assert.Equal(t, len(keys), len(values))
+	assert.Equal(t, len(keys), len(errs))
+	for i, key := range keys {
+		value, err := db.Get(key)
+		assert.Equal(t, err, errs[i], "key %s", key)
+		assert.Equal(t, value, values[i], "key %s", key)
+	}
+
+	assert.Equal(t, error2.ErrNotFound, errs[len(keys)-1])
+	assert.Equal(t, testValue(11, 100), values[len(keys)-2])
+	assert.Equal(t, testValue(2001, 100), values[0])
+
+	values, errs = db.MultiGet(nil)
+	assert.Empty(t, values)
+	assert.Empty(t, errs)
+}
@@ -0,0 +1,108 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+)
+
+/**
+乐观事务
+
+1. 开始时获取一个快照, 所有的写入先缓存在事务私有的batch中
+2. Get先从batch中从后往前查找自己的写入, 找不到再读取快照, 并记录读取过的key以及读取时的快照seq
+3. Commit时在写锁的临界区内检查每一个读取过的key, 如果key最新的seq大于读取时的seq,
+   说明事务开始后有其他写入修改了这个key, 返回ErrConflict, 否则在同一个临界区内写入batch
+
+		快照seq=10    tx.Get(a)                              tx.Commit()
+		    |------------|-----------------------------------------|
+		                      db.Put(a) seq=12                     a最新的seq=12 > 10, 冲突
+
+冲突后事务作废, 需要调用方重新开始一个事务重试
+**/
+
+type OptimisticTransaction struct {
+	db       *DB
+	snapshot *snapshotElement
+	batch    *Batch
+	reads    map[string]uint64 // 读取过的key -> 读取时的快照seq
+	done     bool
+}
+
+// BeginOptimistic 开始一个乐观事务, 使用完后需要调用Commit或者Rollback
+func (db *DB) BeginOptimistic() *OptimisticTransaction {
+	return &OptimisticTransaction{
+		db:       db,
+		snapshot: db.acquireSnapshot(),
+		batch:    NewBatch(),
+		reads:    make(map[string]uint64),
+	}
+}
+
+// Get 优先读取事务自己的写入, 再读取事务开始时的快照
+func (tx *OptimisticTransaction) Get(key []byte) ([]byte, error) {
+
+	if tx.done {
+		return nil, error2.ErrClosed
+	}
+
+	if value, kt, ok := tx.batch.get(defaultColumnFamilyID, tx.db.s.defaultCf.icmp.ucmp, key); ok {
+		if kt == keyTypeDel {
+			return nil, error2.ErrNotFound
+		}
+		return append([]byte(nil), value...), nil
+	}
+
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = tx.snapshot.seq
+	}
+
+	return tx.db.get(tx.db.s.defaultCf, key, tx.snapshot.seq)
+}
+
+func (tx *OptimisticTransaction) Put(key, value []byte) error {
+	if tx.done {
+		return error2.ErrClosed
+	}
+	tx.batch.Put(key, value)
+	return nil
+}
+
+func (tx *OptimisticTransaction) Delete(key []byte) error {
+	if tx.done {
+		return error2.ErrClosed
+	}
+	tx.batch.Delete(key)
+	return nil
+}
+
+// Commit 检查冲突并写入, 冲突时返回*error2.ErrConflict, 无论成功与否事务都会结束
+func (tx *OptimisticTransaction) Commit() error {
+
+	if tx.done {
+		return error2.ErrClosed
+	}
+	defer tx.Rollback()
+
+	return tx.db.writeBatch(tx.batch, func() error {
+		for key, readSeq := range tx.reads {
+			latest, found, err := tx.db.latestSeq(tx.db.s.defaultCf, []byte(key))
+			if err != nil {
+				return err
+			}
+			if found && latest > readSeq {
+				return error2.NewErrConflict([]byte(key), readSeq, latest)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback 放弃事务中的写入并释放快照
+func (tx *OptimisticTransaction) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.db.releaseSnapshot(tx.snapshot)
+	tx.batch.reset()
+	tx.reads = nil
+}
@@ -0,0 +1,56 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimisticTransaction_Conflict(t *testing.T) {
+
+	db := openTestDB(t, t.TempDir(), nil)
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+
+	// 读取过的key在事务开始后被修改, 提交时冲突
+	tx := db.BeginOptimistic()
+	v, err := tx.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+	assert.Nil(t, db.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, tx.Put([]byte("a"), []byte("3")))
+	err = tx.Commit()
+	assert.True(t, error2.IsErrConflict(err))
+	assert.Equal(t, []byte("a"), err.(*error2.ErrConflict).Key)
+	assert.Equal(t, error2.ErrClosed, tx.Commit())
+
+	v, err = db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), v)
+
+	// 读取自己的写入, 没有被其他写入修改时提交成功
+	tx = db.BeginOptimistic()
+	assert.Nil(t, tx.Put([]byte("b"), []byte("1")))
+	v, err = tx.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+	v, err = tx.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), v)
+	assert.Nil(t, db.Put([]byte("c"), []byte("1")))
+	assert.Nil(t, tx.Commit())
+
+	v, err = db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+
+	// 事务读取的是开始时的快照, Rollback后写入不可见
+	tx = db.BeginOptimistic()
+	assert.Nil(t, db.Put([]byte("d"), []byte("1")))
+	_, err = tx.Get([]byte("d"))
+	assert.Equal(t, error2.ErrNotFound, err)
+	assert.Nil(t, tx.Put([]byte("e"), []byte("1")))
+	tx.Rollback()
+	_, err = db.Get([]byte("e"))
+	assert.Equal(t, error2.ErrNotFound, err)
+}
@@ -0,0 +1,474 @@
+package myleveldb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	error2 "myleveldb/error"
+	"myleveldb/iter"
+	"myleveldb/journal"
+	"myleveldb/memdb"
+	"myleveldb/sstable"
+	"myleveldb/storage"
+	"myleveldb/utils"
+	"sort"
+)
+
+/**
+repair 修复数据库
+
+当MANIFEST或者CURRENT丢失/损坏时, session.recover会失败, 数据无法访问,
+repair通过存活的sstable和journal重新生成一个manifest
+
+分为几个步骤
+1. 列出所有的manifest, journal, sstable文件, 最大的文件号码作为下一个可用文件号码的起点
+2. 读取每个sstable的properties block, 得到sstable所属的family(id, 名称, comparer名称)以及导入文件的全局seq,
+	family的选项跟打开db时一样通过Options.ColumnFamilies按照名称指定, comparer跟properties中记录的不同时
+	不修改任何文件, 直接返回ErrComparerMismatch. 旧版本的sstable没有properties block, 当成default family的数据
+3. 按照文件号码的顺序将journal replay到每个family的memdb中, 再落地到level0的sstable
+	损坏的chunk直接跳过, 无法打开的journal移动到lost目录, 转换完成的journal同样移动到lost目录.
+	journal中存在第2步没有发现的family的entry时(family的sstable都已经丢失或者还没有落地), 无法确定family的名称以及comparer,
+	这些entry保留在lost目录中的journal里, repair在完成其他修复之后返回ErrCorrupted
+4. 遍历所有的sstable(包括第3步新生成的), 通过family的comparer重新计算出min, max和最大的seq,
+	无法读取, block损坏(check sum不一致)或者key乱序的sstable移动到lost目录,
+	再扫描所有的blob文件, 重新统计blob的数量和大小, blob文件加入到引用它的family中
+5. 生成一个新的manifest, 包括第2步发现的所有family, 所有的sstable都放在level0, seq为所有文件中最大的seq,
+	旧的manifest移动到lost目录
+
+注: 所有的sstable都放在level0, 打开db后会由table compaction重新向下合并
+注: 已经删除但是sstable还没有被清理的family会被重新创建
+**/
+
+type repairer struct {
+	s        *Session
+	pool     *utils.BytePool
+	families map[uint32]*ColumnFamily
+	props    map[int]*sstable.Properties // sstable的文件号码 -> properties, 旧版本的sstable没有
+	badProps map[int]bool                // properties block已经损坏的sstable
+	tables   map[uint32]tFiles
+	blobs    map[int64]uint32 // blob文件号码 -> 引用它的family
+	unknown  []storage.FileDesc
+	maxSeq   uint64
+}
+
+// Repair 通过存活的sstable和journal重建manifest
+func Repair(path string, opt *Options) error {
+
+	stor, err := storage.OpenFile(path, false)
+	if err != nil {
+		return err
+	}
+
+	s, err := newSession(stor, opt)
+	if err != nil {
+		stor.Close()
+		return err
+	}
+
+	// 关闭manifest, 停止refLoop并释放文件锁
+	defer s.close()
+
+	r := &repairer{
+		s:        s,
+		pool:     s.Options.GetPool(),
+		families: map[uint32]*ColumnFamily{defaultColumnFamilyID: s.defaultCf},
+		props:    make(map[int]*sstable.Properties),
+		badProps: make(map[int]bool),
+		tables:   make(map[uint32]tFiles),
+		blobs:    make(map[int64]uint32),
+	}
+
+	manifests, err := stor.List(storage.FileTypeManifest)
+	if err != nil {
+		return err
+	}
+
+	journals, err := stor.List(storage.FileTypeJournal)
+	if err != nil {
+		return err
+	}
+
+	tables, err := stor.List(storage.FileTypeSSTable)
+	if err != nil {
+		return err
+	}
+
+	blobs, err := stor.List(storage.FileTypeBlob)
+	if err != nil {
+		return err
+	}
+
+	// 新生成的文件号码不能跟已经存在的文件冲突
+	var maxNum int
+	for _, fds := range [][]storage.FileDesc{manifests, journals, tables, blobs} {
+		for _, fd := range fds {
+			if fd.Num > maxNum {
+				maxNum = fd.Num
+			}
+		}
+	}
+	s.SetNextFileNum(int64(maxNum) + 1)
+
+	// 在修改任何文件之前确定所有的family, comparer不一致时直接返回
+	sortFds(tables)
+	for _, fd := range tables {
+		if err = r.readProperties(fd); err != nil {
+			return err
+		}
+	}
+
+	sortFds(journals)
+	for _, fd := range journals {
+		if err = r.convertJournal(fd); err != nil {
+			return err
+		}
+	}
+
+	// 重新列出, 包括journal转换后的sstable
+	tables, err = stor.List(storage.FileTypeSSTable)
+	if err != nil {
+		return err
+	}
+
+	sortFds(tables)
+	for _, fd := range tables {
+		if err = r.scanTable(fd); err != nil {
+			return err
+		}
+	}
+
+	rec := &SessionRecord{}
+	for _, cf := range r.listFamilies() {
+		if cf.id != defaultColumnFamilyID {
+			r.addFamily(cf)
+		}
+		for _, t := range r.tables[cf.id] {
+			rec.addTableFile(cf.id, 0, t)
+		}
+	}
+	rec.setMaxColumnFamily(s.maxFamilyID)
+
+	sortFds(blobs)
+	for _, fd := range blobs {
+		if err = r.scanBlob(rec, fd); err != nil {
+			return err
+		}
+	}
+	rec.setJournalNum(0)
+	rec.setSequenceNum(r.maxSeq)
+
+	// session中还不存在manifest, commit会新建一个manifest并设置CURRENT
+	if err = s.commit(rec); err != nil {
+		return err
+	}
+
+	for _, fd := range manifests {
+		if err = stor.Lost(fd); err != nil {
+			return err
+		}
+	}
+
+	if len(r.unknown) > 0 {
+		return error2.NewErrCorrupted(r.unknown[0], fmt.Sprintf(
+			"%d journal(s) contain entries of unknown column families, moved to lost", len(r.unknown)))
+	}
+
+	return nil
+}
+
+// 按照id从小到大返回所有的family
+func (r *repairer) listFamilies() []*ColumnFamily {
+	families := make([]*ColumnFamily, 0, len(r.families))
+	for _, cf := range r.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+	return families
+}
+
+// 将family加入到session中, 新的manifest会记录family的创建
+func (r *repairer) addFamily(cf *ColumnFamily) {
+	cf.setVersion(nil, r.s.newFamilyVersion(cf))
+	r.s.cfMu.Lock()
+	r.s.families[cf.id] = cf
+	r.s.cfMu.Unlock()
+	r.s.markFamilyID(cf.id)
+}
+
+// 读取sstable的properties block, 得到sstable所属的family, 无法读取的sstable在scanTable中处理
+func (r *repairer) readProperties(fd storage.FileDesc) error {
+
+	tr, _, err := r.openTable(fd, r.s.defaultCf)
+	if err != nil {
+		return nil
+	}
+	props, err := tr.Properties()
+	tr.UnRef()
+	if err == sstable.ErrNoProperties {
+		return nil
+	}
+	if err != nil {
+		r.badProps[fd.Num] = true
+		return nil
+	}
+
+	cf := r.families[props.ColumnFamilyID]
+	if cf == nil {
+		cf = r.s.newColumnFamily(props.ColumnFamilyID, props.ColumnFamilyName,
+			r.s.Options.GetColumnFamilyOptions(props.ColumnFamilyName))
+		r.families[cf.id] = cf
+	}
+
+	// 同一个family id的名称不同说明properties已经损坏, 在scanTable中移动到lost目录
+	if cf.name != props.ColumnFamilyName {
+		r.badProps[fd.Num] = true
+		return nil
+	}
+	if props.ComparerName != cf.icmp.Name() {
+		return error2.NewErrComparerMismatch(props.ComparerName, cf.icmp.Name())
+	}
+
+	r.props[fd.Num] = props
+	return nil
+}
+
+// 使用family的comparer打开sstable, 返回文件的大小
+func (r *repairer) openTable(fd storage.FileDesc, cf *ColumnFamily) (*sstable.Reader, int64, error) {
+
+	reader, err := r.s.stor.Open(fd)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+
+	tr, err := sstable.NewReader(reader, size, cf.icmp, cf.iFilter, cf.tableOpts.blockCacheOf(fd.Num), r.pool)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+	return tr, size, nil
+}
+
+// 重新统计blob文件中的blob数量以及大小, 之前累计的垃圾无法恢复, 从0开始重新统计
+func (r *repairer) scanBlob(rec *SessionRecord, fd storage.FileDesc) error {
+
+	reader, err := r.s.stor.Open(fd)
+	if err != nil {
+		return r.s.stor.Lost(fd)
+	}
+
+	bf, err := scanBlobFile(reader)
+	reader.Close()
+	if err != nil || bf.count == 0 {
+		return r.s.stor.Lost(fd)
+	}
+
+	bf.num = int64(fd.Num)
+	rec.addBlobFile(r.blobs[bf.num], bf) // 没有被引用的blob文件加入default family
+	return nil
+}
+
+// 将journal转换成每个family的level0的sstable
+func (r *repairer) convertJournal(fd storage.FileDesc) error {
+
+	reader, err := r.s.stor.Open(fd)
+	if err != nil {
+		return r.s.stor.Lost(fd)
+	}
+
+	var (
+		jr      = journal.NewReader(reader)
+		mdbs    = make(map[uint32]*memdb.MemDB)
+		unknown bool
+	)
+
+	newMemDb := func(cf *ColumnFamily) *memdb.MemDB {
+		return memdb.NewMemDB(cf.opt.GetMemDbType(), cf.opt.GetWriteBuffer(), cf.icmp, cf.opt.GetPool())
+	}
+
+	defer func() {
+		for _, mdb := range mdbs {
+			mdb.UnRef()
+		}
+	}()
+
+	for {
+
+		chunkReader, err := jr.SeekNextChunk()
+		if err == io.EOF {
+			break
+		}
+
+		// 剩下的内容无法读取, 保留已经读取的内容
+		if err != nil {
+			break
+		}
+
+		chunk, err := ioutil.ReadAll(chunkReader)
+		if err != nil || len(chunk) < batchHeaderLen {
+			continue // chunk不完整, 跳过
+		}
+
+		batchSeq, batchLen, err := decodeBatchToMem(chunk, 0, func(family uint32) *memdb.MemDB {
+			cf := r.families[family]
+			if cf == nil {
+				unknown = true
+				return nil
+			}
+			if mdbs[family] == nil {
+				mdbs[family] = newMemDb(cf)
+			}
+			return mdbs[family]
+		})
+		if err != nil {
+			continue
+		}
+
+		if batchLen > 0 {
+			if seq := batchSeq + uint64(batchLen) - 1; seq > r.maxSeq {
+				r.maxSeq = seq
+			}
+		}
+
+		for id, mdb := range mdbs {
+			if mdb.Len() < r.families[id].opt.GetWriteBuffer() {
+				continue
+			}
+			if err = r.flushMemDb(r.families[id], mdb); err != nil {
+				reader.Close()
+				return err
+			}
+			mdb.UnRef()
+			mdbs[id] = newMemDb(r.families[id])
+		}
+
+	}
+
+	reader.Close()
+	for id, mdb := range mdbs {
+		if err = r.flushMemDb(r.families[id], mdb); err != nil {
+			return err
+		}
+	}
+
+	// 内容已经转换成sstable, journal不再需要, 存在未知family的entry时journal是这些entry唯一的副本
+	if unknown {
+		r.unknown = append(r.unknown, fd)
+	}
+	return r.s.stor.Lost(fd)
+}
+
+func (r *repairer) flushMemDb(cf *ColumnFamily, mdb *memdb.MemDB) error {
+
+	if mdb.Len() == 0 {
+		return nil
+	}
+
+	iterator := mdb.NewIterator()
+	defer iterator.UnRef()
+
+	t, err := cf.tableOpts.createFrom(iterator, nil)
+	if err != nil {
+		return err
+	}
+	r.props[t.fd.Num] = &sstable.Properties{ColumnFamilyID: cf.id, ColumnFamilyName: cf.name, ComparerName: cf.icmp.Name()}
+	return nil
+}
+
+// 遍历sstable, 重新计算出min, max和最大的seq, 导入的文件按照properties中的全局seq计算
+func (r *repairer) scanTable(fd storage.FileDesc) error {
+
+	if r.badProps[fd.Num] {
+		return r.s.stor.Lost(fd)
+	}
+
+	cf, props := r.s.defaultCf, r.props[fd.Num]
+	if props != nil {
+		cf = r.families[props.ColumnFamilyID]
+	}
+
+	tr, size, err := r.openTable(fd, cf)
+	if err != nil {
+		return r.s.stor.Lost(fd)
+	}
+
+	iterator := tr.NewIterator()
+	if iterator == nil {
+		tr.UnRef()
+		return r.s.stor.Lost(fd)
+	}
+
+	var (
+		tf        = tFile{fd: fd, size: size}
+		maxSeq    uint64
+		corrupted bool
+	)
+
+	for iterator.Next() {
+
+		ikey := internalKey(iterator.Key())
+
+		_, seq, kt, err := parseInternalKey(ikey)
+		if err != nil {
+			corrupted = true
+			break
+		}
+
+		// sstable中的key必须是递增的
+		if tf.max != nil && cf.icmp.Compare(ikey, tf.max) <= 0 {
+			corrupted = true
+			break
+		}
+
+		if kt == keyTypeBlob {
+			bi, err := decodeBlobIndex(iterator.Value())
+			if err != nil {
+				corrupted = true
+				break
+			}
+			r.blobs[bi.num] = cf.id
+		}
+
+		if tf.min == nil {
+			tf.min = append(internalKey(nil), ikey...)
+		}
+		tf.max = append(tf.max[:0], ikey...)
+
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+
+	// block损坏时遍历提前结束, 得到的max不是真正的最大值
+	if iter.Error(iterator) != nil {
+		corrupted = true
+	}
+
+	iterator.UnRef()
+	tr.UnRef()
+
+	if corrupted || tf.min == nil {
+		return r.s.stor.Lost(fd)
+	}
+
+	// 导入的文件中记录的seq为0, 使用全局seq
+	if props != nil && props.GlobalSeq > 0 {
+		tf.seq = props.GlobalSeq
+		tf.min, tf.max = withGlobalSeq(tf.min, tf.seq), withGlobalSeq(tf.max, tf.seq)
+		maxSeq = tf.seq
+	}
+
+	r.tables[cf.id] = append(r.tables[cf.id], tf)
+	if maxSeq > r.maxSeq {
+		r.maxSeq = maxSeq
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package myleveldb
+
+import (
+	"myleveldb/comparer"
+	error2 "myleveldb/error"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_RepairThenOpen(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 64 << 10}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, db.Close())
+
+	// Repair结束后必须释放文件锁, 同一进程内可以再次打开
+	assert.Nil(t, Repair(dir, opt))
+
+	db = openTestDB(t, dir, opt)
+	for i := 0; i < 2000; i++ {
+		v, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 100), v)
+	}
+}
+
+func TestDB_OpenFailureReleasesLock(t *testing.T) {
+
+	dir := t.TempDir()
+
+	db, err := Open(dir, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("k"), []byte("v")))
+	assert.Nil(t, db.Close())
+
+	// manifest替换为目录, 读取失败导致打开失败
+	current, err := os.ReadFile(filepath.Join(dir, "CURRENT"))
+	assert.Nil(t, err)
+	manifest := filepath.Join(dir, strings.TrimSpace(string(current)))
+	content, err := os.ReadFile(manifest)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(manifest))
+	assert.Nil(t, os.Mkdir(manifest, 0755))
+
+	_, err = Open(dir, nil)
+	assert.NotNil(t, err)
+
+	// 失败的Open不能残留文件锁
+	assert.Nil(t, os.Remove(manifest))
+	assert.Nil(t, os.WriteFile(manifest, content, 0644))
+	db = openTestDB(t, dir, nil)
+	v, err := db.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), v)
+}
+
+// 删除MANIFEST以及CURRENT, 模拟manifest丢失
+func removeManifest(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, e := range entries {
+		if e.Name() == "CURRENT" || strings.HasPrefix(e.Name(), "MANIFEST-") {
+			assert.Nil(t, os.Remove(filepath.Join(dir, e.Name())))
+		}
+	}
+}
+
+func TestDB_RepairMissingManifest(t *testing.T) {
+
+	dir := t.TempDir()
+	reverse := &Options{Cmp: comparer.ReverseByteComparer}
+	opt := &Options{WriteBuffer: 64 << 10, ColumnFamilies: map[string]*Options{"users": reverse}}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	users, err := db.CreateColumnFamily("users", reverse)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+		assert.Nil(t, db.PutCF(users, testKey(i), testValue(i, 50)))
+	}
+	assert.Nil(t, db.flushMemDb())
+
+	// 导入的文件覆盖[0, 100), 全局seq大于已经落地的记录
+	path := filepath.Join(t.TempDir(), "external.sst")
+	w, err := NewSSTableFileWriter(path, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, w.Put(testKey(i), testValue(i+1, 100)))
+	}
+	assert.Nil(t, w.Finish())
+	assert.Nil(t, db.IngestExternalFiles([]string{path}))
+
+	// 留在journal中的记录
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+		assert.Nil(t, db.PutCF(users, testKey(i), testValue(i, 50)))
+	}
+	assert.Nil(t, db.Close())
+
+	removeManifest(t, dir)
+
+	// users的comparer跟sstable中记录的不同, 不修改任何文件
+	err = Repair(dir, &Options{WriteBuffer: 64 << 10})
+	assert.True(t, error2.IsErrComparerMismatch(err), "%v", err)
+	_, err = os.Stat(filepath.Join(dir, "lost"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, Repair(dir, opt))
+
+	db = openTestDB(t, dir, opt)
+	users = db.ColumnFamily("users")
+	if !assert.NotNil(t, users) {
+		return
+	}
+	for i := 0; i < 1100; i++ {
+		v, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		if i < 100 {
+			assert.Equal(t, testValue(i+1, 100), v, "key %d", i)
+		} else {
+			assert.Equal(t, testValue(i, 100), v, "key %d", i)
+		}
+		v, err = db.GetCF(users, testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 50), v)
+	}
+
+	// users按照reverse comparer排序
+	it := db.NewIteratorCF(users, nil)
+	defer it.UnRef()
+	assert.True(t, it.First())
+	assert.Equal(t, testKey(1099), it.Key())
+}
+
+func TestDB_RepairCorruptedTable(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 1 << 20}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	for i := 2000; i < 2100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	assert.Nil(t, db.Close())
+
+	tables, err := filepath.Glob(filepath.Join(dir, "*.ldb"))
+	assert.Nil(t, err)
+	if !assert.Len(t, tables, 2) {
+		return
+	}
+
+	// 第一个sstable中间的data block损坏, 遍历在这个block提前结束
+	corrupted := tables[0]
+	content, err := os.ReadFile(corrupted)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(corrupted, content, 0644))
+
+	removeManifest(t, dir)
+	assert.Nil(t, Repair(dir, opt))
+
+	_, err = os.Stat(filepath.Join(dir, "lost", filepath.Base(corrupted)))
+	assert.Nil(t, err)
+	_, err = os.Stat(corrupted)
+	assert.True(t, os.IsNotExist(err))
+
+	db = openTestDB(t, dir, opt)
+	for i := 2000; i < 2100; i++ {
+		v, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 100), v)
+	}
+	_, err = db.Get(testKey(1999))
+	assert.Equal(t, error2.ErrNotFound, err)
+}
+
+// journal中的family没有任何sstable, 无法确定名称以及comparer, journal保留在lost目录并返回错误
+func TestDB_RepairUnknownColumnFamily(t *testing.T) {
+
+	dir := t.TempDir()
+
+	db, err := Open(dir, nil)
+	assert.Nil(t, err)
+	users, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, db.PutCF(users, []byte("b"), []byte("2")))
+	assert.Nil(t, db.Close())
+
+	journals, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.Nil(t, err)
+
+	removeManifest(t, dir)
+	assert.NotNil(t, Repair(dir, nil))
+
+	for _, path := range journals {
+		_, err = os.Stat(filepath.Join(dir, "lost", filepath.Base(path)))
+		assert.Nil(t, err)
+	}
+
+	db = openTestDB(t, dir, nil)
+	v, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
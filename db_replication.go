@@ -0,0 +1,542 @@
+package myleveldb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	error2 "myleveldb/error"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/**
+primary/replica 日志复制
+
+primary把已经提交的batch(journal中的chunk, writeBatchWithHeader的格式)通过stream发送给replica,
+replica按照同样的seq写入自己的journal和memdb, 两边同一个seq对应同一条记录
+
+消息格式
+
+/-----------/---------------------/-------------------------/
+| 1byte typ |  4byte payload len  |         payload         |
+/-----------/---------------------/-------------------------/
+
+	msgHello      replica -> primary  8byte replica已经写入的seq
+	msgBatch      primary -> replica  journal中的一个chunk
+	msgFile       primary -> replica  checkpoint中的一个文件, 2byte文件名长度 + 文件名 + 8byte文件大小,
+	                                  消息之后紧跟着文件大小个字节的文件内容, 分块从文件流式复制, 不会整个读入内存
+	msgBootstrap  primary -> replica  checkpoint的文件发送完毕, 8byte checkpoint的seq
+
+流程
+
+	replica                                   primary
+	   |-------- hello(seq) --------------------->|
+	   |                                          |  GetUpdatesSince(seq+1)
+	   |<------- batch ... batch -----------------|  journal已经被删除(ErrUpdatesPurged)时:
+	   |                                          |    生成checkpoint
+	   |<------- file ... file, bootstrap(cseq) --|    发送所有文件, 再从cseq+1继续发送batch
+	   |<------- batch ... -----------------------|  没有新的batch时每隔pollInterval重新读取journal
+
+连接断开后replica重新连接, 从自己已经写入的seq继续, 所以需要primary保留足够的journal(JournalRetentionTTL/Size),
+否则只能重新bootstrap
+通过IngestExternalFiles导入的数据不经过journal, 不会被复制; replica上不应该直接写入
+**/
+
+const (
+	msgHello byte = iota + 1
+	msgBatch
+	msgFile
+	msgBootstrap
+)
+
+const (
+	replicationMsgHeaderLen = 5
+
+	defaultReplicationPollInterval = 100 * time.Millisecond
+	defaultReplicationRetryBackoff = time.Second
+)
+
+func writeReplicationMsg(w io.Writer, typ byte, payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return fmt.Errorf("myleveldb/replication msg payload too large, len=%d", len(payload))
+	}
+	var header [replicationMsgHeaderLen]byte
+	header[0] = typ
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readReplicationMsg(r io.Reader) (typ byte, payload []byte, err error) {
+	var header [replicationMsgHeaderLen]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	payload = make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	return header[0], payload, nil
+}
+
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, seq)
+	return b
+}
+
+func decodeSeq(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, errors.New("myleveldb/replication invalid seq payload")
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// Primary 向replica发送已经提交的batch
+type Primary struct {
+	db *DB
+
+	// PollInterval 没有新的batch时重新读取journal的间隔
+	PollInterval time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	closeC   chan struct{}
+	closed   bool
+}
+
+func NewPrimary(db *DB) *Primary {
+	return &Primary{
+		db:           db,
+		PollInterval: defaultReplicationPollInterval,
+		closeC:       make(chan struct{}),
+	}
+}
+
+// Serve 在l上接收replica的连接, 直到l或者primary被关闭
+func (p *Primary) Serve(l net.Listener) error {
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return error2.ErrClosed
+	}
+	p.listener = l
+	p.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-p.closeC:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		go func() {
+			defer conn.Close()
+			_ = p.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn 向一个replica连接发送batch, 直到连接断开或者primary被关闭
+func (p *Primary) ServeConn(rw io.ReadWriter) error {
+
+	typ, payload, err := readReplicationMsg(rw)
+	if err != nil {
+		return err
+	}
+	if typ != msgHello {
+		return fmt.Errorf("myleveldb/replication unexpected msg type %d", typ)
+	}
+
+	seq, err := decodeSeq(payload)
+	if err != nil {
+		return err
+	}
+
+	// replica在hello之后不会再发送消息, 读到错误说明连接已经断开
+	connClosedC := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, rw)
+		close(connClosedC)
+	}()
+
+	pollInterval := p.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultReplicationPollInterval
+	}
+
+	for {
+
+		next, err := p.sendUpdates(rw, seq+1)
+		if err == error2.ErrUpdatesPurged {
+			next, err = p.sendCheckpoint(rw)
+		}
+		if err != nil {
+			return err
+		}
+
+		if next > seq {
+			seq = next
+			continue
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-connClosedC:
+			return io.EOF
+		case <-p.closeC:
+			return error2.ErrClosed
+		}
+	}
+}
+
+// 发送从since开始的所有batch, 返回已经发送的最大seq
+func (p *Primary) sendUpdates(w io.Writer, since uint64) (uint64, error) {
+
+	it, err := p.db.GetUpdatesSince(since)
+	if err != nil {
+		return 0, err
+	}
+	defer it.UnRef()
+
+	last := since - 1
+	for it.Next() {
+		if err = writeReplicationMsg(w, msgBatch, it.chunk); err != nil {
+			return 0, err
+		}
+		last = it.Seq() + uint64(len(it.Entries())) - 1
+	}
+
+	return last, it.Err()
+}
+
+// 生成checkpoint并发送所有文件, 返回checkpoint的seq
+func (p *Primary) sendCheckpoint(w io.Writer) (uint64, error) {
+
+	tmp, err := ioutil.TempDir("", "myleveldb-replication-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "checkpoint")
+	seq, err := p.db.checkpoint(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "LOCK" { // 文件锁不需要发送
+			continue
+		}
+
+		if err = sendCheckpointFile(w, dir, f.Name()); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = writeReplicationMsg(w, msgBootstrap, encodeSeq(seq)); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// 发送msgFile之后按照文件大小流式复制文件内容, 文件大小用8个字节, 不受消息长度的限制
+func sendCheckpointFile(w io.Writer, dir, name string) error {
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, 2+len(name)+8)
+	binary.LittleEndian.PutUint16(payload, uint16(len(name)))
+	copy(payload[2:], name)
+	binary.LittleEndian.PutUint64(payload[2+len(name):], uint64(fi.Size()))
+
+	if err = writeReplicationMsg(w, msgFile, payload); err != nil {
+		return err
+	}
+
+	// checkpoint中的文件不会再被修改, 读到的长度跟发送的文件大小不同说明文件出错
+	n, err := io.CopyN(w, f, fi.Size())
+	if err == io.EOF {
+		return fmt.Errorf("myleveldb/replication checkpoint file %s truncated, size=%d, read=%d", name, fi.Size(), n)
+	}
+	return err
+}
+
+// Close 停止接收连接, 正在发送的连接会在下一次读取journal时退出
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.closeC)
+
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	return nil
+}
+
+// Replica 接收primary的batch并按照同样的seq写入本地的db
+type Replica struct {
+	dir string
+	opt *Options
+
+	// RetryBackoff 连接断开后重新连接的间隔
+	RetryBackoff time.Duration
+
+	mu sync.RWMutex
+	db *DB
+}
+
+// OpenReplica 打开dir中的db作为replica
+func OpenReplica(dir string, opt *Options) (*Replica, error) {
+
+	// bootstrap在旧的目录改名之后, 新的目录换入之前崩溃, 恢复旧的目录
+	old := dir + ".old"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err = os.Stat(old); err == nil {
+			if err = os.Rename(old, dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	db, err := Open(dir, opt)
+	if err != nil {
+		return nil, err
+	}
+	os.RemoveAll(old) // 新的目录已经换入, 旧的目录还没有删除时崩溃
+	return &Replica{
+		dir:          dir,
+		opt:          opt,
+		db:           db,
+		RetryBackoff: defaultReplicationRetryBackoff,
+	}, nil
+}
+
+// DB 返回当前的db, bootstrap之后db会被替换, 所以每次读取前都需要重新获取
+func (r *Replica) DB() *DB {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.db
+}
+
+// Seq 返回replica已经写入的seq
+func (r *Replica) Seq() uint64 {
+	return r.DB().loadSeq()
+}
+
+// Sync 在一个连接上接收并写入batch, 直到连接断开或者出错
+func (r *Replica) Sync(rw io.ReadWriter) error {
+
+	if err := writeReplicationMsg(rw, msgHello, encodeSeq(r.Seq())); err != nil {
+		return err
+	}
+
+	var bootstrapDir string
+	defer func() {
+		if bootstrapDir != "" {
+			os.RemoveAll(bootstrapDir)
+		}
+	}()
+
+	for {
+
+		typ, payload, err := readReplicationMsg(rw)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case msgBatch:
+			if err = r.DB().writeChunkWithSeq(payload); err != nil {
+				return err
+			}
+
+		case msgFile:
+			if bootstrapDir == "" {
+				bootstrapDir = r.dir + ".bootstrap"
+				os.RemoveAll(bootstrapDir)
+				if err = os.MkdirAll(bootstrapDir, 0755); err != nil {
+					return err
+				}
+			}
+			if err = receiveBootstrapFile(rw, bootstrapDir, payload); err != nil {
+				return err
+			}
+
+		case msgBootstrap:
+			if bootstrapDir == "" {
+				return errors.New("myleveldb/replication bootstrap without files")
+			}
+			if err = r.bootstrap(bootstrapDir); err != nil {
+				return err
+			}
+			bootstrapDir = ""
+
+		default:
+			return fmt.Errorf("myleveldb/replication unexpected msg type %d", typ)
+		}
+	}
+}
+
+// 解析msgFile的文件名和文件大小, 从r中复制文件内容到dir
+func receiveBootstrapFile(r io.Reader, dir string, payload []byte) error {
+	if len(payload) < 2 {
+		return errors.New("myleveldb/replication invalid file payload")
+	}
+	n := int(binary.LittleEndian.Uint16(payload))
+	if len(payload) != 2+n+8 {
+		return errors.New("myleveldb/replication invalid file payload")
+	}
+	name := filepath.Base(string(payload[2 : 2+n]))
+	size := int64(binary.LittleEndian.Uint64(payload[2+n:]))
+	if size < 0 {
+		return errors.New("myleveldb/replication invalid file size")
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(f, r, size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 用checkpoint替换本地的db
+//
+// 旧的目录先改名为r.dir.old, checkpoint换入r.dir之后打开, 打开成功才删除旧的目录,
+// 任何一步失败都恢复旧的目录并重新打开旧的db, 中途崩溃时由OpenReplica恢复
+func (r *Replica) bootstrap(dir string) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.db.Close(); err != nil && err != error2.ErrClosed {
+		return err
+	}
+
+	old := r.dir + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return r.restore(old, err)
+	}
+	if err := os.Rename(r.dir, old); err != nil {
+		return r.restore(old, err)
+	}
+	if err := os.Rename(dir, r.dir); err != nil {
+		return r.restore(old, err)
+	}
+
+	db, err := Open(r.dir, r.opt)
+	if err != nil {
+		return r.restore(old, err)
+	}
+	r.db = db
+	os.RemoveAll(old)
+	return nil
+}
+
+// bootstrap失败时删除换入的checkpoint, 恢复旧的目录并重新打开旧的db, 返回bootstrap失败的原因
+func (r *Replica) restore(old string, cause error) error {
+
+	if _, err := os.Stat(old); err == nil {
+		if err = os.RemoveAll(r.dir); err != nil {
+			return cause
+		}
+		if err = os.Rename(old, r.dir); err != nil {
+			return cause
+		}
+	}
+
+	if db, err := Open(r.dir, r.opt); err == nil {
+		r.db = db
+	}
+	return cause
+}
+
+// Run 通过dial连接primary并持续同步, 连接断开后等待RetryBackoff重新连接, 直到stop被关闭
+func (r *Replica) Run(dial func() (io.ReadWriteCloser, error), stop <-chan struct{}) error {
+
+	backoff := r.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultReplicationRetryBackoff
+	}
+
+	for {
+
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		conn, err := dial()
+		if err == nil {
+			doneC := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					conn.Close()
+				case <-doneC:
+				}
+			}()
+
+			err = r.Sync(conn)
+			close(doneC)
+			conn.Close()
+		}
+
+		// 不存在的family重新连接之后仍然会出错, 需要先在replica上创建family
+		if err == error2.ErrClosed || error2.IsErrUnknownColumnFamily(err) {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Close 关闭replica的db
+func (r *Replica) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db.Close()
+}
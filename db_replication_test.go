@@ -0,0 +1,143 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplica_Bootstrap(t *testing.T) {
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "replica")
+
+	r, err := OpenReplica(dir, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+	assert.Nil(t, r.DB().Put([]byte("old"), []byte("1")))
+
+	// 无法打开的checkpoint: manifest是一个目录, bootstrap失败后恢复旧的db
+	bad := filepath.Join(root, "bad")
+	assert.Nil(t, os.MkdirAll(filepath.Join(bad, "MANIFEST-000002"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(bad, "CURRENT"), []byte("MANIFEST-000002\n"), 0644))
+	assert.NotNil(t, r.bootstrap(bad))
+
+	v, err := r.DB().Get([]byte("old"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+	_, err = os.Stat(dir + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+	// 正常的checkpoint替换旧的db, 旧的目录被删除
+	primary := openTestDB(t, filepath.Join(root, "primary"), nil)
+	assert.Nil(t, primary.Put([]byte("new"), []byte("2")))
+	good := filepath.Join(root, "good")
+	assert.Nil(t, primary.Checkpoint(good))
+	assert.Nil(t, r.bootstrap(good))
+
+	v, err = r.DB().Get([]byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), v)
+	_, err = r.DB().Get([]byte("old"))
+	assert.Equal(t, error2.ErrNotFound, err)
+	_, err = os.Stat(dir + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+	// 旧的目录改名之后, 新的目录换入之前崩溃, 打开时恢复旧的目录
+	assert.Nil(t, r.Close())
+	assert.Nil(t, os.Rename(dir, dir+".old"))
+	r, err = OpenReplica(dir, nil)
+	assert.Nil(t, err)
+	v, err = r.DB().Get([]byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), v)
+}
+
+// 在pipe的一端模拟primary: 读取hello之后发送checkpoint和之后的batch, 然后关闭连接
+func serveCheckpoint(t *testing.T, p *Primary, conn net.Conn) {
+	t.Helper()
+	go func() {
+		defer conn.Close()
+		if _, _, err := readReplicationMsg(conn); err != nil {
+			return
+		}
+		seq, err := p.sendCheckpoint(conn)
+		if err != nil {
+			return
+		}
+		_, _ = p.sendUpdates(conn, seq+1)
+	}()
+}
+
+func TestReplica_SyncCheckpoint(t *testing.T) {
+
+	root := t.TempDir()
+	primary := openTestDB(t, filepath.Join(root, "primary"), nil)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, primary.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, primary.flushMemDb())
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, primary.Put(testKey(i), testValue(i, 100)))
+	}
+
+	r, err := OpenReplica(filepath.Join(root, "replica"), nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	c1, c2 := net.Pipe()
+	serveCheckpoint(t, NewPrimary(primary), c1)
+	assert.NotNil(t, r.Sync(c2)) // 连接关闭
+	c2.Close()
+
+	assert.Equal(t, primary.loadSeq(), r.Seq())
+	for i := 0; i < 1100; i++ {
+		v, err := r.DB().Get(testKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 100), v)
+	}
+}
+
+// family的创建不会被复制, replica上没有这个family时停止写入, 不能跳过
+func TestReplica_UnknownColumnFamily(t *testing.T) {
+
+	root := t.TempDir()
+	primary := openTestDB(t, filepath.Join(root, "primary"), nil)
+	assert.Nil(t, primary.Put([]byte("a"), []byte("1")))
+	users, err := primary.CreateColumnFamily("users", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, primary.PutCF(users, []byte("b"), []byte("2")))
+	assert.Nil(t, primary.Put([]byte("c"), []byte("3")))
+
+	r, err := OpenReplica(filepath.Join(root, "replica"), nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	c1, c2 := net.Pipe()
+	p := NewPrimary(primary)
+	go func() {
+		_ = p.ServeConn(c1)
+	}()
+	err = r.Sync(c2)
+	assert.True(t, error2.IsErrUnknownColumnFamily(err), "%v", err)
+	c2.Close()
+	assert.Nil(t, p.Close())
+
+	// 出错之前的batch已经写入, 之后的batch都不写入
+	v, err := r.DB().Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+	_, err = r.DB().Get([]byte("c"))
+	assert.Equal(t, error2.ErrNotFound, err)
+	assert.Equal(t, uint64(1), r.Seq())
+}
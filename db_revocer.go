@@ -32,15 +32,56 @@ func (db *DB) recoverJournal() error {
 
 	sortFds(fds)
 
+	// 小于stJournalNum的journal已经落地到sstable中, 不需要replay, 按照保留策略保留或者删除,
+	// 落地的时间没有持久化, 使用文件的修改时间
+	n := 0
+	for _, fd := range fds {
+		if int64(fd.Num) >= db.s.stJournalNum {
+			fds[n] = fd
+			n++
+		} else {
+			db.retainJournal(fd, db.journalModTime(fd))
+		}
+	}
+	fds = fds[:n]
+
 	var (
-		ofd storage.FileDesc
-		rec = &SessionRecord{}
-		mdb = memdb.NewMemDB(db.s.Options.GetWriteBuffer(), db.s.icmp, db.pool)
+		ofd  storage.FileDesc
+		rec  = &SessionRecord{}
+		mdbs = make(map[uint32]*memdb.MemDB) // 每个family replay用的memdb
 	)
 
+	// 已经被删除的family的entry直接跳过
+	getMem := func(family uint32) *memdb.MemDB {
+		if mdb, ok := mdbs[family]; ok {
+			return mdb
+		}
+		cf := db.s.getFamily(family)
+		if cf == nil {
+			return nil
+		}
+		mdb := memdb.NewMemDB(cf.opt.GetMemDbType(), cf.opt.GetWriteBuffer(), cf.icmp, db.pool)
+		mdbs[family] = mdb
+		return mdb
+	}
+
+	// 将所有family非空的memdb落地到level0
+	flushAll := func() error {
+		for family, mdb := range mdbs {
+			if mdb.Len() == 0 {
+				continue
+			}
+			if err := db.s.flushMemDb(rec, db.s.getFamily(family), mdb); err != nil {
+				return err
+			}
+			mdb.Reset()
+		}
+		return nil
+	}
+
 	if len(fds) > 0 {
 
-		db.s.markFileNum(int64(fds[len(fds)-1].Num))
+		db.s.markFileNum(int64(fds[len(fds)-1].Num) + 1)
 
 		var (
 			jr          *journal.Reader
@@ -58,11 +99,9 @@ func (db *DB) recoverJournal() error {
 
 			// 如果上个journal遍历存在, 那么需要把它更新到manifest中
 			if !ofd.Zero() {
-				if mdb.Len() > 0 {
-					err = db.s.flushMemDb(rec, mdb)
-					if err != nil {
-						return err
-					}
+				err = flushAll()
+				if err != nil {
+					return err
 				}
 				rec.setJournalNum(int64(fd.Num))
 				rec.setSequenceNum(db.seq)
@@ -72,12 +111,13 @@ func (db *DB) recoverJournal() error {
 					return err
 				}
 
-				// 把journal文件删除
-				db.s.stor.Remove(ofd)
+				// journal已经落地, 按照保留策略保留或者删除
+				db.releaseJournal(ofd)
 
 				ofd = storage.FileDesc{}
 
 				rec.resetAddRecord()
+				rec.resetBlobRecord()
 			}
 
 			for {
@@ -96,20 +136,23 @@ func (db *DB) recoverJournal() error {
 					return err
 				}
 
-				batchSeq, batchLen, err := decodeBatchToMem(chunk, db.seq, mdb)
+				batchSeq, batchLen, err := decodeBatchToMem(chunk, db.seq, getMem)
 				if err != nil {
 					return err
 				}
 
-				db.seq = batchSeq + uint64(batchLen)
-
-				if mdb.Len() >= db.s.Options.GetWriteBuffer() {
-					// 将内存数据库dump到level0的sstable file中
-					err = db.s.flushMemDb(rec, mdb)
-					if err != nil {
-						return err
+				db.seq = batchSeq + uint64(batchLen) - 1 // batchSeq是batch中第一条记录的seq
+
+				for family, mdb := range mdbs {
+					cf := db.s.getFamily(family)
+					if mdb.Len() >= cf.opt.GetWriteBuffer() {
+						// 将内存数据库dump到level0的sstable file中
+						err = db.s.flushMemDb(rec, cf, mdb)
+						if err != nil {
+							return err
+						}
+						mdb.Reset()
 					}
-					mdb.Reset()
 				}
 
 			}
@@ -121,21 +164,22 @@ func (db *DB) recoverJournal() error {
 		}
 
 		// 对最后一个journal进行刷新到mdb, 再更新到manifest中
-		if mdb.Len() > 0 {
-			err = db.s.flushMemDb(rec, mdb)
-			if err != nil {
-				return err
-			}
+		err = flushAll()
+		if err != nil {
+			return err
 		}
 
 	}
 
+	for _, mdb := range mdbs {
+		mdb.UnRef()
+	}
+
 	// 创建一个新的memdb和journal
-	mdb, err = db.newMem(0)
+	err = db.newMem(nil)
 	if err != nil {
 		return err
 	}
-	defer mdb.UnRef()
 	rec.setSequenceNum(db.seq)
 	rec.setJournalNum(int64(db.journalFd.Num))
 
@@ -145,7 +189,7 @@ func (db *DB) recoverJournal() error {
 	}
 
 	if !ofd.Zero() {
-		db.s.stor.Remove(ofd)
+		db.releaseJournal(ofd)
 	}
 
 	return nil
@@ -157,19 +201,24 @@ func sortFds(fds []storage.FileDesc) {
 	})
 }
 
-func (db *DB) newMem(size int) (*memdb.MemDB, error) {
+// 为所有family创建新的memdb以及journal, 当前的memdb变成frozenMemDb
+// need是每个family要写入的长度, memdb的容量至少是writeBuffer, 当要写入的内容超过writeBuffer时, 以要写入的大小为准
+func (db *DB) newMem(need map[uint32]int) error {
 
 	db.memMu.Lock()
 	defer db.memMu.Unlock()
 
-	if db.frozenMemDb != nil {
-		return nil, error2.ErrHasFrozenMemDb
+	families := db.s.listFamilies()
+	for _, cf := range families {
+		if cf.frozenMemDb != nil {
+			return error2.ErrHasFrozenMemDb
+		}
 	}
 
 	journalFd := storage.FileDesc{Type: storage.FileTypeJournal, Num: int(db.s.allocNextNum())}
 	writer, err := db.s.stor.Create(journalFd)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	journalWriter := journal.NewWriter(writer)
@@ -178,14 +227,20 @@ func (db *DB) newMem(size int) (*memdb.MemDB, error) {
 		db.journalWriter.Close()
 	}
 
-	memDb := memdb.NewMemDB(size, db.s.icmp, db.pool)
+	for _, cf := range families {
+		size := cf.opt.GetWriteBuffer()
+		if n := need[cf.id]; n > size {
+			size = n
+		}
 
-	db.frozenMemDb = db.memDb
-	db.frozenJournalFd = db.journalFd
+		memDb := memdb.NewMemDB(cf.opt.GetMemDbType(), size, cf.icmp, db.pool)
+		memDb.Ref() // 自己
 
-	memDb.Ref() // 自己
-	memDb.Ref() // 调用方
-	db.memDb = memDb
+		cf.frozenMemDb = cf.memDb
+		cf.memDb = memDb
+	}
+
+	db.frozenJournalFd = db.journalFd
 
 	db.journal = journalWriter
 	db.journalFd = journalFd
@@ -193,6 +248,6 @@ func (db *DB) newMem(size int) (*memdb.MemDB, error) {
 
 	db.frozenSeq = db.seq
 
-	return memDb, nil
+	return nil
 
 }
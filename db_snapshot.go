@@ -13,14 +13,15 @@ func (db *DB) acquireSnapshot() *snapshotElement {
 	defer db.snapMu.Unlock()
 	seq := db.loadSeq()
 
+	// 跟最新的快照seq相同时复用, 否则新建一个快照放到队尾
 	if e := db.snapList.Back(); e != nil {
 		ele := e.Value.(*snapshotElement)
 		if ele.seq == seq {
 			ele.ref++
+			return ele
 		} else if ele.seq > seq {
 			panic("myLeveldb/snapshot acquire invalid seq")
 		}
-		return ele
 	}
 
 	se := &snapshotElement{
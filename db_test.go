@@ -0,0 +1,221 @@
+package myleveldb
+
+import (
+	"fmt"
+	"myleveldb/collections"
+	"myleveldb/comparer"
+	error2 "myleveldb/error"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在临时目录中打开db, 测试结束时关闭
+func openTestDB(t *testing.T, dir string, opt *Options) *DB {
+	t.Helper()
+	db, err := Open(dir, opt)
+	if err != nil {
+		t.Fatalf("open %s: %v", dir, err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+func testValue(i, size int) []byte {
+	v := make([]byte, size)
+	copy(v, fmt.Sprintf("value%06d", i))
+	for j := 11; j < size; j++ {
+		v[j] = byte(i + j)
+	}
+	return v
+}
+
+func TestDB_PutGetReopen(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 32 << 10}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	for i := 0; i < 2000; i += 3 {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	for i := 0; i < 2000; i++ {
+		v, err := db.Get(testKey(i))
+		if i%3 == 0 {
+			assert.Equal(t, error2.ErrNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 100), v)
+	}
+}
+
+// 重新打开之后compaction删除恢复的sstable, 文件引用的计数不能变为负数
+func TestDB_CompactAfterReopen(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 64 << 10}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	for i := 500; i < 1500; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1, 100)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	assert.Nil(t, db.CompactRange(nil, nil))
+	for i := 0; i < 1500; i++ {
+		v, err := db.Get(testKey(i))
+		assert.Nil(t, err)
+		if i < 500 {
+			assert.Equal(t, testValue(i, 100), v)
+		} else {
+			assert.Equal(t, testValue(i+1, 100), v)
+		}
+	}
+}
+
+// uint64的comparer写入长度不是8个字节的key不能panic, 前8个字节相同的长key不能互相覆盖
+func TestDB_Uint64ComparerKeyLength(t *testing.T) {
+
+	for _, cmp := range []comparer.BasicComparer{comparer.BigEndianUint64Comparer, comparer.LittleEndianUint64Comparer} {
+		dir := t.TempDir()
+		opt := &Options{Cmp: cmp}
+
+		db, err := Open(dir, opt)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("abc"), []byte("short")))
+		assert.Nil(t, db.Put([]byte("01234567a"), []byte("long-a")))
+		assert.Nil(t, db.Put([]byte("01234567b"), []byte("long-b")))
+		assert.Nil(t, db.Put(make([]byte, 8), []byte("zero")))
+		assert.Nil(t, db.Close())
+
+		// 重新打开时回放journal
+		db = openTestDB(t, dir, opt)
+		for k, v := range map[string]string{"abc": "short", "01234567a": "long-a", "01234567b": "long-b", string(make([]byte, 8)): "zero"} {
+			got, err := db.Get([]byte(k))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(v), got)
+		}
+		assert.Nil(t, db.flushMemDb())
+		got, err := db.Get([]byte("01234567a"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("long-a"), got)
+		_, err = db.Get([]byte("ab"))
+		assert.Equal(t, error2.ErrNotFound, err)
+	}
+}
+
+// block cache很小时, 读取的block很快被驱逐, buffer归还后被其他block复用, 读取返回的value不能指向block的buffer
+func TestDB_GetWithEvictingBlockCache(t *testing.T) {
+	testEvictingBlockCache(t, &Options{WriteBuffer: 1 << 20, BlockCacheCapacity: 64 << 10})
+}
+
+// 2Q策略下probation中的block同样会被驱逐复用
+func TestDB_GetWith2QEvictingBlockCache(t *testing.T) {
+	testEvictingBlockCache(t, &Options{
+		WriteBuffer:        1 << 20,
+		BlockCacheCapacity: 64 << 10,
+		BlockCachePolicy:   collections.CachePolicy2Q,
+	})
+}
+
+// 固定的index block以及filter block占用了大部分容量, data block几乎每次读取都会驱逐其他的data block
+func TestDB_GetWithPinnedIndexAndFilterBlocks(t *testing.T) {
+	db := testEvictingBlockCache(t, &Options{
+		WriteBuffer:             1 << 20,
+		BlockCacheCapacity:      64 << 10,
+		PinIndexAndFilterBlocks: PinningTierAll,
+	})
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.True(t, stats.BlockCache.Pinned > 0)
+}
+
+// 读取完成后返回打开的db, 测试结束时关闭
+func testEvictingBlockCache(t *testing.T, opt *Options) *DB {
+
+	dir := t.TempDir()
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	// 三个key范围重叠的level0 sstable, 查找时先找到的旧版本要一直保留到其他sstable查找完
+	version := func(i int) int {
+		switch {
+		case i%3 == 0:
+			return 2
+		case i%2 == 0:
+			return 1
+		}
+		return 0
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2000; i++ {
+			if version(i) >= round {
+				assert.Nil(t, db.Put(testKey(i), testValue(i*10+round, 200)))
+			}
+		}
+		assert.Nil(t, db.flushMemDb())
+	}
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Levels[0].FileCount)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 2000; i += 4 {
+				v, err := db.Get(testKey(i))
+				if !assert.Nil(t, err) || !assert.Equal(t, testValue(i*10+version(i), 200), v, "key %d", i) {
+					return
+				}
+			}
+		}(g)
+	}
+	// 同时遍历, iterator跟Get互相驱逐对方的block
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		it := db.NewIterator(nil)
+		defer it.UnRef()
+		i := 0
+		for ok := it.First(); ok; ok = it.Next() {
+			if !assert.Equal(t, testKey(i), it.Key()) || !assert.Equal(t, testValue(i*10+version(i), 200), it.Value()) {
+				return
+			}
+			i++
+		}
+		assert.Equal(t, 2000, i)
+	}()
+	wg.Wait()
+
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.True(t, stats.BlockCache.Evictions > 0)
+	return db
+}
@@ -0,0 +1,159 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+)
+
+/**
+悲观事务
+
+1. Get给key加共享锁, GetForUpdate/Put/Delete给key加排它锁, 加锁之后读取的是最新提交的数据,
+   在事务结束之前其他事务无法修改这个key, 所以提交时不需要做冲突检查
+2. 所有的写入先缓存在事务私有的batch中, 读取时优先读取自己的写入
+3. SetSavePoint记录batch当前的位置, RollbackToSavePoint丢弃最近一个savepoint之后的写入,
+   savepoint之后加的锁不会被释放
+4. Commit通过DB.Write写入batch, 无论成功与否都会释放所有的锁
+
+	tx1.GetForUpdate(a)  X(a)
+	                            tx2.Get(a) 等待tx1释放a
+	tx1.Put(a, 2)
+	tx1.Commit()         释放a  tx2.Get(a) = 2
+
+加锁超时返回ErrLockTimeout, 检测到死锁返回ErrDeadlock, 此时事务仍然可用, 通常由调用方Rollback后重试
+**/
+
+type Transaction struct {
+	db         *DB
+	id         uint64
+	batch      *Batch
+	locks      map[string]lockMode // 已经持有的锁
+	savePoints []batchMark
+	done       bool
+}
+
+// BeginTransaction 开始一个悲观事务, 使用完后需要调用Commit或者Rollback
+func (db *DB) BeginTransaction() *Transaction {
+	return &Transaction{
+		db:    db,
+		id:    db.lockMgr.newTxnID(),
+		batch: NewBatch(),
+		locks: make(map[string]lockMode),
+	}
+}
+
+func (tx *Transaction) lock(key []byte, mode lockMode) error {
+
+	if held, ok := tx.locks[string(key)]; ok && held >= mode {
+		return nil
+	}
+
+	err := tx.db.lockMgr.lock(tx.id, string(key), mode, tx.db.s.Options.GetTxnLockTimeout())
+	if err != nil {
+		return err
+	}
+	tx.locks[string(key)] = mode
+	return nil
+}
+
+func (tx *Transaction) get(key []byte) ([]byte, error) {
+	if value, kt, ok := tx.batch.get(defaultColumnFamilyID, tx.db.s.defaultCf.icmp.ucmp, key); ok {
+		if kt == keyTypeDel {
+			return nil, error2.ErrNotFound
+		}
+		return append([]byte(nil), value...), nil
+	}
+	return tx.db.Get(key)
+}
+
+// Get 给key加共享锁后读取
+func (tx *Transaction) Get(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, error2.ErrClosed
+	}
+	if err := tx.lock(key, lockShared); err != nil {
+		return nil, err
+	}
+	return tx.get(key)
+}
+
+// GetForUpdate 给key加排它锁后读取, 用于读取后需要修改的场景, 避免两个事务同时持有共享锁后升级导致死锁
+func (tx *Transaction) GetForUpdate(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, error2.ErrClosed
+	}
+	if err := tx.lock(key, lockExclusive); err != nil {
+		return nil, err
+	}
+	return tx.get(key)
+}
+
+func (tx *Transaction) Put(key, value []byte) error {
+	if tx.done {
+		return error2.ErrClosed
+	}
+	if err := tx.lock(key, lockExclusive); err != nil {
+		return err
+	}
+	tx.batch.Put(key, value)
+	return nil
+}
+
+func (tx *Transaction) Delete(key []byte) error {
+	if tx.done {
+		return error2.ErrClosed
+	}
+	if err := tx.lock(key, lockExclusive); err != nil {
+		return err
+	}
+	tx.batch.Delete(key)
+	return nil
+}
+
+// SetSavePoint 记录当前的写入位置
+func (tx *Transaction) SetSavePoint() {
+	if tx.done {
+		return
+	}
+	tx.savePoints = append(tx.savePoints, tx.batch.mark())
+}
+
+// RollbackToSavePoint 丢弃最近一个savepoint之后的写入, 并移除这个savepoint
+func (tx *Transaction) RollbackToSavePoint() error {
+	if tx.done {
+		return error2.ErrClosed
+	}
+	if len(tx.savePoints) == 0 {
+		return error2.ErrNoSavePoint
+	}
+	n := len(tx.savePoints) - 1
+	tx.batch.rollbackTo(tx.savePoints[n])
+	tx.savePoints = tx.savePoints[:n]
+	return nil
+}
+
+// Commit 写入事务中的所有修改并释放锁
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return error2.ErrClosed
+	}
+	defer tx.Rollback()
+	return tx.db.Write(tx.batch)
+}
+
+// Rollback 放弃事务中的写入并释放锁
+func (tx *Transaction) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+
+	keys := make([]string, 0, len(tx.locks))
+	for key := range tx.locks {
+		keys = append(keys, key)
+	}
+	tx.db.lockMgr.unlock(tx.id, keys)
+
+	tx.batch.reset()
+	tx.locks = nil
+	tx.savePoints = nil
+}
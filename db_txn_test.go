@@ -0,0 +1,95 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransaction_LockWait(t *testing.T) {
+
+	db := openTestDB(t, t.TempDir(), &Options{TxnLockTimeout: 5 * time.Second})
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+
+	tx1 := db.BeginTransaction()
+	_, err := tx1.GetForUpdate([]byte("a"))
+	assert.Nil(t, err)
+
+	// tx2的共享锁等待tx1提交, 读到tx1的写入
+	got := make(chan []byte, 1)
+	go func() {
+		tx2 := db.BeginTransaction()
+		defer tx2.Rollback()
+		v, err := tx2.Get([]byte("a"))
+		assert.Nil(t, err)
+		got <- v
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("shared lock granted while exclusive lock is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Nil(t, tx1.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, tx1.Commit())
+	assert.Equal(t, []byte("2"), <-got)
+}
+
+func TestTransaction_Deadlock(t *testing.T) {
+
+	db := openTestDB(t, t.TempDir(), &Options{TxnLockTimeout: 5 * time.Second})
+
+	tx1, tx2 := db.BeginTransaction(), db.BeginTransaction()
+	assert.Nil(t, tx1.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, tx2.Put([]byte("b"), []byte("2")))
+
+	// tx1等待tx2持有的b
+	waited := make(chan error, 1)
+	go func() {
+		waited <- tx1.Put([]byte("b"), []byte("1"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// tx2再等待tx1持有的a形成环, 检测到死锁
+	assert.Equal(t, error2.ErrDeadlock, tx2.Put([]byte("a"), []byte("2")))
+
+	// tx2放弃后tx1拿到b
+	tx2.Rollback()
+	assert.Nil(t, <-waited)
+	assert.Nil(t, tx1.Commit())
+
+	v, err := db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestTransaction_TimeoutAndSavePoint(t *testing.T) {
+
+	db := openTestDB(t, t.TempDir(), &Options{TxnLockTimeout: 20 * time.Millisecond})
+
+	tx1 := db.BeginTransaction()
+	assert.Nil(t, tx1.Put([]byte("a"), []byte("1")))
+
+	tx2 := db.BeginTransaction()
+	_, err := tx2.Get([]byte("a"))
+	assert.Equal(t, error2.ErrLockTimeout, err)
+	tx2.Rollback()
+
+	// savepoint之后的写入被丢弃
+	tx1.SetSavePoint()
+	assert.Nil(t, tx1.Put([]byte("b"), []byte("1")))
+	assert.Nil(t, tx1.RollbackToSavePoint())
+	assert.Equal(t, error2.ErrNoSavePoint, tx1.RollbackToSavePoint())
+	_, err = tx1.Get([]byte("b"))
+	assert.Equal(t, error2.ErrNotFound, err)
+	assert.Nil(t, tx1.Commit())
+
+	v, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), v)
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, error2.ErrNotFound, err)
+}
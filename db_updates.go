@@ -0,0 +1,334 @@
+package myleveldb
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	error2 "myleveldb/error"
+	"myleveldb/journal"
+	"myleveldb/storage"
+	"os"
+	"time"
+)
+
+/**
+change data capture
+
+1. journal保留
+	journal落地到sstable后默认立即删除, 设置了JournalRetentionTTL或者JournalRetentionSize时, 落地后的journal
+	会被保留下来, 从最旧的journal开始删除超过TTL或者超过总大小的journal, 以下时机检查:
+
+		有journal落地时
+		db打开时, 上次保留的journal重新加入, 超过的直接删除
+		设置了TTL时后台定期检查, 没有新的journal落地也会删除过期的journal
+
+	保留时间从落地开始计算, 不会持久化, db打开时发现的journal使用文件的修改时间, 切换之后journal不会再被写入,
+	修改时间不晚于落地的时间
+
+2. GetUpdatesSince(seq)
+	按照文件号码顺序读取保留的journal以及正在使用的journal, 返回包含seq以及之后的所有batch
+
+		journal   000003.log          000007.log          000010.log(当前)
+		batch     [1,3] [4,4] [5,9]   [10,10] [11,15]     [16,20] ...
+
+	seq=12时从000007.log开始, 返回[11,15], [16,20]...  如果seq落在batch中间, 返回整个batch, 由调用方去重
+	iterator只返回创建时已经提交的batch, 通过IngestExternalFiles导入的数据不经过journal, 不会被返回
+	需要的journal已经被删除时返回ErrUpdatesPurged
+**/
+
+type retainedJournal struct {
+	fd       storage.FileDesc
+	size     int64
+	released time.Time
+}
+
+const (
+	journalRetentionCheckInterval = time.Minute // 后台检查过期journal的最长间隔
+)
+
+// journal已经落地, 根据保留策略删除或者保留
+func (db *DB) releaseJournal(fd storage.FileDesc) {
+	db.retainJournal(fd, time.Now())
+}
+
+// released为journal落地的时间, 加入保留的journal之后删除超过保留策略的journal
+func (db *DB) retainJournal(fd storage.FileDesc, released time.Time) {
+
+	ttl, maxSize := db.s.Options.GetJournalRetentionTTL(), db.s.Options.GetJournalRetentionSize()
+	if ttl <= 0 && maxSize <= 0 {
+		db.s.stor.Remove(fd)
+		return
+	}
+
+	size, err := db.journalSize(fd)
+	if err != nil {
+		db.s.stor.Remove(fd)
+		return
+	}
+
+	db.retainMu.Lock()
+	defer db.retainMu.Unlock()
+
+	db.retainedJournals = append(db.retainedJournals, retainedJournal{fd: fd, size: size, released: released})
+	db.pruneJournalsLocked(ttl, maxSize)
+}
+
+// 删除超过保留策略的journal
+func (db *DB) pruneJournals() {
+	db.retainMu.Lock()
+	defer db.retainMu.Unlock()
+	db.pruneJournalsLocked(db.s.Options.GetJournalRetentionTTL(), db.s.Options.GetJournalRetentionSize())
+}
+
+// 需要持有retainMu
+func (db *DB) pruneJournalsLocked(ttl time.Duration, maxSize int64) {
+
+	var total int64
+	for _, r := range db.retainedJournals {
+		total += r.size
+	}
+
+	// 从最旧的开始删除
+	n := 0
+	for _, r := range db.retainedJournals {
+		expired := ttl > 0 && time.Since(r.released) > ttl
+		oversize := maxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			break
+		}
+		db.s.stor.Remove(r.fd)
+		total -= r.size
+		n++
+	}
+	db.retainedJournals = append(db.retainedJournals[:0], db.retainedJournals[n:]...)
+}
+
+// 设置了JournalRetentionTTL时在后台定期删除过期的journal
+func (db *DB) journalRetention(ttl time.Duration) {
+
+	defer db.closeW.Done()
+
+	interval := ttl / 2
+	if interval > journalRetentionCheckInterval {
+		interval = journalRetentionCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.pruneJournals()
+		case <-db.closeC:
+			return
+		}
+	}
+}
+
+// journal文件的修改时间, 存储不支持时返回当前时间
+func (db *DB) journalModTime(fd storage.FileDesc) time.Time {
+	reader, err := db.s.stor.Open(fd)
+	if err != nil {
+		return time.Now()
+	}
+	defer reader.Close()
+	if f, ok := reader.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			return fi.ModTime()
+		}
+	}
+	return time.Now()
+}
+
+func (db *DB) journalSize(fd storage.FileDesc) (int64, error) {
+	reader, err := db.s.stor.Open(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return reader.Seek(0, io.SeekEnd)
+}
+
+// 读取journal中第一个batch的seq, journal为空时ok为false
+func (db *DB) journalFirstSeq(fd storage.FileDesc) (seq uint64, ok bool, err error) {
+
+	reader, err := db.s.stor.Open(fd)
+	if err != nil {
+		return 0, false, err
+	}
+	defer reader.Close()
+
+	chunkReader, err := journal.NewReader(reader).SeekNextChunk()
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	var header [batchHeaderLen]byte
+	if _, err = io.ReadFull(chunkReader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF { // 还没有写完整的batch
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return binary.LittleEndian.Uint64(header[:8]), true, nil
+}
+
+// UpdatesIterator 按照seq顺序遍历已经提交的batch, 使用完后需要调用UnRef
+type UpdatesIterator struct {
+	db  *DB
+	fds []storage.FileDesc
+
+	reader storage.Reader
+	jr     *journal.Reader
+
+	since, last uint64 // 返回的batch需要包含[since, last]中的seq
+
+	seq     uint64
+	entries []Entry
+	chunk   []byte // batch在journal中的原始chunk, 用于replication
+	err     error
+
+	released bool
+}
+
+// GetUpdatesSince 返回从seq开始(包含seq)的所有已经提交的batch
+func (db *DB) GetUpdatesSince(seq uint64) (*UpdatesIterator, error) {
+
+	if seq == 0 {
+		seq = 1
+	}
+
+	fds, err := db.s.stor.List(storage.FileTypeJournal)
+	if err != nil {
+		return nil, err
+	}
+	sortFds(fds)
+
+	last := db.loadSeq()
+
+	// 从后往前找到第一个起始seq小于等于seq的journal, covered是保留下来的journal能够覆盖的最小seq
+	start, covered := 0, last+1
+	for i := len(fds) - 1; i >= 0; i-- {
+		first, ok, err := db.journalFirstSeq(fds[i])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		covered = first
+		if first <= seq {
+			start = i
+			break
+		}
+	}
+
+	if seq < covered {
+		return nil, error2.ErrUpdatesPurged
+	}
+
+	return &UpdatesIterator{
+		db:    db,
+		fds:   fds[start:],
+		since: seq,
+		last:  last,
+	}, nil
+}
+
+// Next 移动到下一个batch, 遍历结束或者出错时返回false, 出错时通过Err获取
+func (it *UpdatesIterator) Next() bool {
+
+	if it.released || it.err != nil {
+		return false
+	}
+
+	for {
+
+		if it.jr == nil {
+			if len(it.fds) == 0 {
+				return false
+			}
+			reader, err := it.db.s.stor.Open(it.fds[0])
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.fds = it.fds[1:]
+			it.reader = reader
+			it.jr = journal.NewReader(reader)
+		}
+
+		chunkReader, err := it.jr.SeekNextChunk()
+		if err == io.EOF {
+			it.closeJournal()
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		chunk, err := ioutil.ReadAll(chunkReader)
+		if err == io.ErrUnexpectedEOF { // 正在写入的journal末尾的batch还没有写完整
+			it.closeJournal()
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		seq, entries, err := decodeBatchEntries(chunk)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		if seq > it.last {
+			it.closeJournal()
+			it.fds = nil
+			return false
+		}
+
+		if seq+uint64(len(entries)) <= it.since {
+			continue
+		}
+
+		it.seq, it.entries, it.chunk = seq, entries, chunk
+		return true
+	}
+}
+
+func (it *UpdatesIterator) closeJournal() {
+	if it.reader != nil {
+		it.reader.Close()
+	}
+	it.reader, it.jr = nil, nil
+}
+
+// Seq 当前batch中第一条记录的seq
+func (it *UpdatesIterator) Seq() uint64 {
+	return it.seq
+}
+
+// Entries 当前batch中的记录, Key为ukey
+func (it *UpdatesIterator) Entries() []Entry {
+	return it.entries
+}
+
+func (it *UpdatesIterator) Err() error {
+	return it.err
+}
+
+func (it *UpdatesIterator) UnRef() {
+	if !it.released {
+		it.released = true
+		it.closeJournal()
+		it.fds = nil
+		it.entries = nil
+		it.chunk = nil
+	}
+}
@@ -0,0 +1,94 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 读取从seq开始的所有更新, 返回每条entry的seq以及key
+func readUpdates(t *testing.T, db *DB, seq uint64) (seqs []uint64, keys [][]byte) {
+	t.Helper()
+	it, err := db.GetUpdatesSince(seq)
+	assert.Nil(t, err)
+	defer it.UnRef()
+	for it.Next() {
+		for _, e := range it.Entries() {
+			seqs = append(seqs, e.Seq)
+			keys = append(keys, e.Key)
+		}
+	}
+	assert.Nil(t, it.Err())
+	return
+}
+
+func TestDB_GetUpdatesSince(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{JournalRetentionSize: 64 << 20}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+
+	// 第一段写入落地后journal被保留, 第二段在重新打开时replay
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 10)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 10)))
+	}
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	for i := 200; i < 300; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 10)))
+	}
+
+	seqs, keys := readUpdates(t, db, 1)
+	assert.Equal(t, 300, len(keys))
+	for i := range keys {
+		assert.Equal(t, uint64(i+1), seqs[i])
+		assert.Equal(t, testKey(i), keys[i])
+	}
+
+	// 从中间开始, 跨过落地以及重新打开的journal
+	seqs, keys = readUpdates(t, db, 151)
+	assert.Equal(t, 150, len(keys))
+	assert.Equal(t, uint64(151), seqs[0])
+	assert.Equal(t, testKey(299), keys[len(keys)-1])
+}
+
+func TestDB_JournalRetentionTTL(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{JournalRetentionTTL: 200 * time.Millisecond}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 10)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	seqs, _ := readUpdates(t, db, 1)
+	assert.Equal(t, 100, len(seqs))
+
+	// 没有新的journal落地, 后台检查删除过期的journal
+	time.Sleep(500 * time.Millisecond)
+	_, err = db.GetUpdatesSince(1)
+	assert.Equal(t, error2.ErrUpdatesPurged, err)
+
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 10)))
+	}
+	assert.Nil(t, db.flushMemDb())
+	assert.Nil(t, db.Close())
+
+	// 关闭期间过期的journal在打开时删除
+	time.Sleep(300 * time.Millisecond)
+	db = openTestDB(t, dir, &Options{JournalRetentionTTL: 200 * time.Millisecond})
+	_, err = db.GetUpdatesSince(101)
+	assert.Equal(t, error2.ErrUpdatesPurged, err)
+}
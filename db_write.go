@@ -3,71 +3,96 @@ package myleveldb
 import (
 	error2 "myleveldb/error"
 	"myleveldb/memdb"
-	"time"
+	"sync/atomic"
 )
 
 /**
 写入时, 需要有条件的控制下写入速度
 
-1. 当发现level0文件个数大于等于 slowdownTrigger时(通常是8个), 那么首次休眠1毫秒
-2. 当发现memdb足够写入的长度时立即返回
-3. 当发现level0文件个数大于等于 pauseTrigger时(通常是12个), 发起table compaction
+1. 当level0文件个数或者待compaction的字节数达到限速的条件时, 按照write controller计算的速度休眠(见write_controller.go),
+   每次写入只休眠一次
+2. 当达到暂停的条件时, 发起table compaction并等待写入恢复
+3. 当发现memdb足够写入的长度时立即返回
 4. 当发现memdb不够长度时, 那么将当前memdb转化为frozenMemdb, 如果存在了frozenMemdb, 先执行minorCompaction
 
 **/
 
 const ()
 
-// n 是要写入的长度
-func (db *DB) makeRoomForWrite(n int) (memDb *memdb.MemDB, mdbFree int, err error) {
+// need 是每个family要写入的长度, 返回所有要写入的family中memdb最小的剩余容量
+func (db *DB) makeRoomForWrite(need map[uint32]int) (mdbFree int, err error) {
 
-	delay := false
+	var (
+		delay bool
+		total int
+	)
+	for _, n := range need {
+		total += n
+	}
 
 	flush := func() (retry bool) {
 
-		memDb, err = db.getEffectiveMemDb()
-		if err != nil {
-			return false
-		}
+		var (
+			full bool
+		)
 
-		defer func() {
-			if retry {
-				memDb.UnRef()
+		mdbFree = -1
+		for id, n := range need {
+
+			cf := db.s.getFamily(id)
+			if cf == nil {
+				err = error2.ErrColumnFamilyDropped
+				return false
 			}
-		}()
 
-		mdbFree, err := memDb.Free()
-		if err != nil {
-			return false
+			var memDb *memdb.MemDB
+			memDb, err = db.getEffectiveMemDb(cf)
+			if err != nil {
+				return false
+			}
+
+			free, ferr := memDb.Free()
+			memDb.UnRef()
+			if ferr != nil {
+				err = ferr
+				return false
+			}
+
+			if free < n {
+				full = true
+			}
+			if mdbFree < 0 || free < mdbFree {
+				mdbFree = free
+			}
 		}
 
-		if db.s.tLen(0) >= defaultSlowDownTrigger && !delay {
+		ws := db.refreshWriteStall()
+
+		// 没有需要做的compaction时等待不会有进展, 继续写入直到满足compaction的条件
+		if ws.condition == WriteStallStopped && db.needCompaction() {
 			delay = true
-			time.Sleep(time.Millisecond)
-		} else if mdbFree >= n {
-			return false
-		} else if db.s.tLen(0) >= defaultPauseTrigger {
+			err = db.stopWrite(ws)
+			if err != nil {
+				mdbFree = 0
+				return false
+			}
+		} else if ws.condition == WriteStallDelayed && !delay {
 			delay = true
-			err = db.compTriggerWait(db.tcompCmdC)
+			err = db.delayWrite(total, ws)
 			if err != nil {
 				mdbFree = 0
 				return false
 			}
+		} else if !full {
+			return false
 		} else {
 
-			// 说明memdb free不够写入的n
-			if memDb.Len() == 0 { // 还没有数据
-				mdbFree = n
-				return false
-			}
-			memDb.UnRef()
-			memDb, err = db.rotateMem(n, false) // 将当前memdb 转成frozenMemdb
+			// 说明某个family的memdb free不够写入, 将所有family的memdb转成frozenMemdb
+			err = db.rotateMem(need, false)
 			if err != nil {
 				mdbFree = 0
 				return false
 			}
-			mdbFree = memDb.Len()
-			return false
 
 		}
 
@@ -81,20 +106,23 @@ func (db *DB) makeRoomForWrite(n int) (memDb *memdb.MemDB, mdbFree int, err erro
 	return
 }
 
-func (db *DB) getEffectiveMemDb() (*memdb.MemDB, error) {
+func (db *DB) getEffectiveMemDb(cf *ColumnFamily) (*memdb.MemDB, error) {
 
 	db.memMu.Lock()
 	defer db.memMu.Unlock()
-	if db.memDb == nil {
+	if cf.memDb == nil {
+		if cf.isDropped() {
+			return nil, error2.ErrColumnFamilyDropped
+		}
 		return nil, error2.ErrClosed
 	}
-	db.memDb.Ref()
-	return db.memDb, nil
+	cf.memDb.Ref()
+	return cf.memDb, nil
 }
 
 func (db *DB) compTriggerWait(cmd chan<- cCmd) error {
-	c := make(chan error)
-	defer close(c)
+	// ack需要有缓冲, db关闭后compaction goroutine仍然可以ack而不会被阻塞
+	c := make(chan error, 1)
 	select {
 	case cmd <- cAuto{c}:
 	case <-db.closeC:
@@ -109,6 +137,41 @@ func (db *DB) compTriggerWait(cmd chan<- cCmd) error {
 	}
 }
 
+// 发起一次family指定level的range compaction, 并等待完成
+func (db *DB) compTriggerRange(cmd cRange) error {
+	c := make(chan error, 1)
+	cmd.ack = c
+	select {
+	case db.tcompCmdC <- cmd:
+	case <-db.closeC:
+		return error2.ErrClosed
+	}
+
+	select {
+	case e := <-c:
+		return e
+	case <-db.closeC:
+		return error2.ErrClosed
+	}
+}
+
+// 将导入的sstable交给table compaction goroutine放置到level中, 并等待完成
+func (db *DB) compTriggerIngest(tables tFiles, seq uint64) error {
+	c := make(chan error, 1)
+	select {
+	case db.tcompCmdC <- cIngest{ack: c, tables: tables, seq: seq}:
+	case <-db.closeC:
+		return error2.ErrClosed
+	}
+
+	select {
+	case e := <-c:
+		return e
+	case <-db.closeC:
+		return error2.ErrClosed
+	}
+}
+
 func (db *DB) compTrigger(cmd chan<- cCmd) error {
 
 	select {
@@ -119,33 +182,196 @@ func (db *DB) compTrigger(cmd chan<- cCmd) error {
 	return nil
 }
 
+// 拿到写锁后先执行check, check通过后再写入batch, 用于需要在写入的临界区内做校验的场景(例如事务提交)
+func (db *DB) writeBatch(b *Batch, check func() error) error {
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return error2.ErrClosed
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	if b.BatchLen() == 0 {
+		return nil
+	}
+
+	mdbFree, err := db.makeRoomForWrite(b.familyLen())
+	if err != nil {
+		return err
+	}
+
+	return db.writeBatchLocked(b, mdbFree)
+}
+
+// 按照chunk中的seq写入, chunk是writeBatchWithHeader的格式, 用于replica回放primary的batch
+// seq必须大于当前的seq, 已经写入过的batch直接忽略, seq之间允许存在空洞
+// family的创建和删除不会被复制, chunk中有本地不存在的family时整个chunk都不写入, 返回ErrUnknownColumnFamily
+func (db *DB) writeChunkWithSeq(chunk []byte) error {
+
+	seq, entries, err := decodeBatchEntries(chunk)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return error2.ErrClosed
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	lastSeq := seq + uint64(len(entries)) - 1
+	if cur := db.loadSeq(); lastSeq <= cur {
+		return nil
+	} else if seq <= cur {
+		return error2.NewBatchDecodeHeaderErrWithSeq(cur+1, seq)
+	}
+
+	// 跳过不存在的family会让replica跟primary不一致, 直接停止写入
+	need := make(map[uint32]int)
+	for idx, e := range entries {
+		if db.s.getFamily(e.Family) == nil {
+			return error2.NewErrUnknownColumnFamily(e.Family, seq+uint64(idx))
+		}
+		need[e.Family] += len(e.Key) + len(e.Value) + 8
+	}
+
+	mdbFree, err := db.makeRoomForWrite(need)
+	if err != nil {
+		return err
+	}
+
+	// 原样写入journal, 重启后按照同样的seq回放
+	if _, err = db.journal.Write(chunk); err != nil {
+		return err
+	}
+
+	rotate := false
+	for idx, e := range entries {
+		kt := keyTypeVal
+		if e.Deleted {
+			kt = keyTypeDel
+		}
+		mdb := db.getFamilyMemDb(e.Family)
+		if mdb == nil {
+			continue
+		}
+		if err = mdb.Put(makeInternalKey(e.Key, seq+uint64(idx), kt), e.Value); err != nil {
+			return err
+		}
+		if free, _ := mdb.Free(); free <= 0 {
+			rotate = true
+		}
+	}
+
+	atomic.StoreUint64(&db.seq, lastSeq)
+
+	if rotate || mdbFree <= 0 {
+		db.rotateMem(nil, false)
+	}
+	db.reportMemUsage()
+
+	return nil
+}
+
 func (db *DB) putRec(key, value []byte, kt keyType) error {
 	return db.writeMerge.Put(kt, key, value, db.withBatch)
 }
 
-func (db *DB) writeBatchLocked(b *Batch, mdb *memdb.MemDB, mdbFree int) error {
-
-	seq := db.seq + 1
+func (db *DB) writeBatchLocked(b *Batch, mdbFree int) error {
 
-	// 写入到journal 中
-	if err := writeBatchWithHeader(db.journal, seq, b); err != nil {
+	seq, err := db.writeBatchJournal(b)
+	if err != nil {
 		return err
 	}
 
-	for idx, batchIndex := range b.index {
-		ik := makeInternalKey(batchIndex.key(b.data.Bytes()), seq+uint64(idx), batchIndex.KeyType)
-		err := mdb.Put(ik, batchIndex.value(b.data.Bytes()))
-		if err != nil {
+	for idx := range b.index {
+		if err := db.putBatchEntry(b, idx, seq); err != nil {
 			return err
 		}
 	}
 
+	return db.publishBatch(b, mdbFree)
+
+}
+
+// batch涉及的所有family的memdb都支持并发写入时, 合并写的成员才并发写入memdb
+func (db *DB) concurrentWritable(b *Batch) bool {
+	for id := range b.familyLen() {
+		mdb := db.getFamilyMemDb(id)
+		if mdb == nil || !mdb.Concurrent() {
+			return false
+		}
+	}
+	return true
+}
+
+// 写入到journal中, 返回batch第一条entry的seq
+func (db *DB) writeBatchJournal(b *Batch) (uint64, error) {
+	seq := db.seq + 1
+	if err := writeBatchWithHeader(db.journal, seq, b); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// 将batch中第idx条entry写入memdb, 并发写入时每个goroutine写入不同的idx
+func (db *DB) putBatchEntry(b *Batch, idx int, seq uint64) error {
+	batchIndex := b.index[idx]
+	mdb := db.getFamilyMemDb(batchIndex.Family)
+	if mdb == nil {
+		return error2.ErrColumnFamilyDropped
+	}
+	ik := makeInternalKey(batchIndex.key(b.data.Bytes()), seq+uint64(idx), batchIndex.KeyType)
+	return mdb.Put(ik, batchIndex.value(b.data.Bytes()))
+}
+
+// 所有entry写入memdb后才更新seq, 之后读取才能看到这个batch
+func (db *DB) publishBatch(b *Batch, mdbFree int) error {
+
 	db.addSeq(uint64(b.BatchLen()))
 
-	if b.internalLen >= mdbFree {
-		db.rotateMem(0, false)
+	rotate := b.internalLen >= mdbFree
+	for id := range b.familyLen() {
+		if rotate {
+			break
+		}
+		if mdb := db.getFamilyMemDb(id); mdb != nil {
+			if free, _ := mdb.Free(); free <= 0 {
+				rotate = true
+			}
+		}
+	}
+
+	if rotate {
+		db.rotateMem(nil, false)
 	}
+	db.reportMemUsage()
 
 	return nil
+}
 
+// 获取family当前的memdb, 只能在持有写锁时调用, 写锁保证memdb不会被切换
+func (db *DB) getFamilyMemDb(id uint32) *memdb.MemDB {
+	cf := db.s.getFamily(id)
+	if cf == nil {
+		return nil
+	}
+	db.memMu.Lock()
+	defer db.memMu.Unlock()
+	return cf.memDb
 }
@@ -0,0 +1,225 @@
+package myleveldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	error2 "myleveldb/error"
+	"myleveldb/memdb"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ConcurrentMemDbWrite(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 256 << 10, MemDbType: memdb.TypeSkipList}
+
+	const (
+		writers = 16
+		batches = 200
+	)
+	key := func(side string, w, i int) []byte {
+		return []byte(fmt.Sprintf("%s-%02d-%04d", side, w, i))
+	}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+
+	// 每个batch在a, b两边各写入一个key, 快照中两边的数量必须相等
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			it := db.NewIterator(nil)
+			a, b := 0, 0
+			for ok := it.First(); ok; ok = it.Next() {
+				if it.Key()[0] == 'a' {
+					a++
+				} else {
+					b++
+				}
+			}
+			it.UnRef()
+			if a != b {
+				t.Errorf("partial batch visible: a=%d b=%d", a, b)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < batches; i++ {
+				batch := NewBatch()
+				batch.Put(key("a", w, i), testValue(i, 64))
+				batch.Put(key("b", w, i), testValue(i, 64))
+				if err := db.Write(batch); err != nil {
+					t.Errorf("write: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-readerDone
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(writers*batches*2), stats.Seq)
+
+	check := func(db *DB) {
+		for w := 0; w < writers; w++ {
+			for i := 0; i < batches; i++ {
+				for _, side := range []string{"a", "b"} {
+					v, err := db.Get(key(side, w, i))
+					assert.Nil(t, err)
+					assert.Equal(t, testValue(i, 64), v)
+				}
+			}
+		}
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	check(db)
+}
+
+func TestDB_WriteStallNoSlowdown(t *testing.T) {
+
+	var (
+		mu     sync.Mutex
+		stalls []WriteStallInfo
+	)
+	opt := &Options{
+		WriteBuffer:                 1 << 20,
+		Level0SlowdownWritesTrigger: 2,
+		Level0StopWritesTrigger:     10,
+		DelayedWriteRate:            minDelayedWriteRate,
+		NoSlowdown:                  true,
+		OnWriteStall: func(info WriteStallInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			stalls = append(stalls, info)
+		},
+	}
+	db := openTestDB(t, t.TempDir(), opt)
+
+	// level0文件数达到Level0SlowdownWritesTrigger, 还没有达到compaction的条件
+	for b := 0; b < 2; b++ {
+		for i := b * 100; i < (b+1)*100; i++ {
+			assert.Nil(t, db.Put(testKey(i), testValue(i, 100)))
+		}
+		assert.Nil(t, db.flushMemDb())
+	}
+
+	// 限速的令牌不够时不休眠, 直接返回ErrBusy, 写入没有生效
+	err := db.Put(testKey(1000), testValue(1000, 4096))
+	assert.True(t, error2.IsErrBusy(err), "err %v", err)
+	busy := err.(*error2.ErrBusy)
+	assert.False(t, busy.Stopped)
+	assert.True(t, busy.RetryAfter > 0)
+	assert.Equal(t, WriteStallCauseLevel0Files.String(), busy.Cause)
+	_, err = db.Get(testKey(1000))
+	assert.Equal(t, error2.ErrNotFound, err)
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStallDelayed, stats.WriteStall.Condition)
+	assert.Equal(t, WriteStallCauseLevel0Files, stats.WriteStall.Cause)
+	assert.Equal(t, 2, stats.WriteStall.Level0Files)
+	assert.True(t, stats.WriteStall.BusyCount > 0)
+	assert.Equal(t, uint64(0), stats.WriteStall.DelayedCount)
+
+	// compaction之后恢复正常, 写入成功
+	assert.Nil(t, db.CompactRange(nil, nil))
+	assert.Nil(t, db.Put(testKey(1000), testValue(1000, 4096)))
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, WriteStallNormal, stats.WriteStall.Condition)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, len(stalls) >= 2)
+	assert.Equal(t, WriteStallDelayed, stalls[0].Condition)
+	assert.Equal(t, WriteStallCauseLevel0Files, stalls[0].Cause)
+	last := stalls[len(stalls)-1]
+	assert.Equal(t, WriteStallNormal, last.Condition)
+	assert.Equal(t, WriteStallDelayed, last.Prev)
+}
+
+// 多个goroutine并发调用DB.Write, 写入经过write merge, journal以及memdb, 同时有一个goroutine在并发读取,
+// memdb不支持并发写入时合并写由leader统一写入, 支持并发写入时合并写的每个成员各自写入
+func benchmarkConcurrentWrite(b *testing.B, typ memdb.Type) {
+
+	db, err := Open(b.TempDir(), &Options{WriteBuffer: 64 << 20, MemDbType: typ})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	var (
+		seq     uint64
+		stop    = make(chan struct{})
+		readers sync.WaitGroup
+	)
+
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		key := make([]byte, 16)
+		for i := uint64(0); ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			binary.BigEndian.PutUint64(key, i*2654435761)
+			_, _ = db.Get(key)
+		}
+	}()
+
+	value := make([]byte, 100)
+	b.SetBytes(int64(16 + len(value)))
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		key := make([]byte, 16)
+		for pb.Next() {
+			n := atomic.AddUint64(&seq, 1)
+			binary.BigEndian.PutUint64(key, n*2654435761)
+			binary.BigEndian.PutUint64(key[8:], n)
+			batch := NewBatch()
+			batch.Put(key, value)
+			if err := db.Write(batch); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	b.StopTimer()
+	close(stop)
+	readers.Wait()
+}
+
+func BenchmarkDB_ConcurrentWrite_LLRBTree(b *testing.B) {
+	benchmarkConcurrentWrite(b, memdb.TypeLLRBTree)
+}
+
+func BenchmarkDB_ConcurrentWrite_SkipList(b *testing.B) {
+	benchmarkConcurrentWrite(b, memdb.TypeSkipList)
+}
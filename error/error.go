@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"myleveldb/storage"
+	"time"
 )
 
 type ErrCorrupted struct {
@@ -26,6 +27,91 @@ func IsErrCorruptedErr(err error) bool {
 	return ok
 }
 
+// ErrConflict 事务提交时发现读取过的key在事务开始之后被其他写入修改
+type ErrConflict struct {
+	error
+	Key       []byte
+	ReadSeq   uint64 // 读取时的快照seq
+	LatestSeq uint64 // 提交时key最新的seq
+}
+
+func NewErrConflict(key []byte, readSeq, latestSeq uint64) error {
+	return &ErrConflict{
+		error:     fmt.Errorf("myleveldb/transaction conflict, key=%q, readSeq=%d, latestSeq=%d", key, readSeq, latestSeq),
+		Key:       key,
+		ReadSeq:   readSeq,
+		LatestSeq: latestSeq,
+	}
+}
+
+func IsErrConflict(err error) bool {
+	_, ok := err.(*ErrConflict)
+	return ok
+}
+
+// ErrComparerMismatch 打开db时使用的comparer跟manifest中记录的不同
+type ErrComparerMismatch struct {
+	error
+	Expected string // manifest中记录的comparer名称
+	Actual   string // 打开时使用的comparer名称
+}
+
+func NewErrComparerMismatch(expected, actual string) error {
+	return &ErrComparerMismatch{
+		error:    fmt.Errorf("myleveldb/comparer mismatch, expected=%q, actual=%q", expected, actual),
+		Expected: expected,
+		Actual:   actual,
+	}
+}
+
+func IsErrComparerMismatch(err error) bool {
+	_, ok := err.(*ErrComparerMismatch)
+	return ok
+}
+
+// ErrBusy 设置了Options.NoSlowdown时, 写入需要限速等待或者暂停等待compaction时直接返回
+type ErrBusy struct {
+	error
+	Cause      string        // 限速或者暂停的原因
+	Stopped    bool          // 为true时写入已经暂停, 需要等待compaction
+	RetryAfter time.Duration // 限速时大约需要等待的时长, 暂停时为0
+}
+
+func NewErrBusy(cause string, stopped bool, retryAfter time.Duration) error {
+	return &ErrBusy{
+		error:      fmt.Errorf("myleveldb/write stall, cause=%s, stopped=%t, retryAfter=%s", cause, stopped, retryAfter),
+		Cause:      cause,
+		Stopped:    stopped,
+		RetryAfter: retryAfter,
+	}
+}
+
+func IsErrBusy(err error) bool {
+	_, ok := err.(*ErrBusy)
+	return ok
+}
+
+// ErrUnknownColumnFamily replica收到的batch中有本地不存在的family, family的创建和删除不会被复制,
+// 需要先在replica上按照同样的顺序创建family
+type ErrUnknownColumnFamily struct {
+	error
+	Family uint32 // 不存在的family id
+	Seq    uint64 // 写入这个family的entry的seq
+}
+
+func NewErrUnknownColumnFamily(family uint32, seq uint64) error {
+	return &ErrUnknownColumnFamily{
+		error:  fmt.Errorf("myleveldb/replication unknown column family, family=%d, seq=%d", family, seq),
+		Family: family,
+		Seq:    seq,
+	}
+}
+
+func IsErrUnknownColumnFamily(err error) bool {
+	_, ok := err.(*ErrUnknownColumnFamily)
+	return ok
+}
+
 type BatchDecodeHeaderErr struct {
 	error
 	Seq uint64
@@ -44,4 +130,19 @@ var (
 	ErrClosed         = errors.New("myleveldb/closed")
 	ErrHasFrozenMemDb = errors.New("myleveldb/frozen memdb not null")
 	ErrCompactionExit = errors.New("myleveldb/compaction transact exit... ")
+	ErrExists         = errors.New("myleveldb/db already exists")
+	ErrNotFound       = errors.New("myleveldb/not found")
+	ErrKeyNotSorted   = errors.New("myleveldb/keys must be added in strictly increasing order")
+	ErrIngestOverlap  = errors.New("myleveldb/ingested files overlap each other")
+	ErrUpdatesPurged  = errors.New("myleveldb/journals containing the requested seq have been purged")
+	ErrLockTimeout    = errors.New("myleveldb/transaction lock wait timeout")
+	ErrDeadlock       = errors.New("myleveldb/transaction deadlock detected")
+	ErrNoSavePoint    = errors.New("myleveldb/transaction has no save point")
+
+	ErrColumnFamilyExists      = errors.New("myleveldb/column family already exists")
+	ErrColumnFamilyDropped     = errors.New("myleveldb/column family has been dropped")
+	ErrDropDefaultColumnFamily = errors.New("myleveldb/default column family cannot be dropped")
+
+	ErrBlobIndexCorrupted = errors.New("myleveldb/blob index corrupted")
+	ErrBlobCorrupted      = errors.New("myleveldb/blob record checksum mismatch")
 )
@@ -1,25 +1,69 @@
 package myleveldb
 
 import (
+	"bytes"
 	"myleveldb/filter"
 )
 
 type iFilter struct {
 	filter.IFilter
+	prefix filter.PrefixExtractor // 不为nil时prefix也加入filter
+}
+
+func newIFilter(opt *Options) iFilter {
+	return iFilter{opt.GetFilter(), opt.GetPrefixExtractor()}
 }
 
 func (iFilter iFilter) Contains(data []byte, key []byte) bool {
 	return iFilter.IFilter.Contains(data, internalKey(key).uKey())
 }
 
+// Name 跟是否加入prefix无关, prefix的规则由sstable单独记录, 见sstable.WriterOptions.FilterPrefix
+func (iFilter iFilter) Name() string {
+	return iFilter.IFilter.Name()
+}
+
+// 写入sstable的prefix规则名称, 没有加入prefix时为空
+func (iFilter iFilter) prefixName() string {
+	if iFilter.prefix == nil {
+		return ""
+	}
+	return iFilter.prefix.Name()
+}
+
 func (iFilter iFilter) NewFilterGenerator(bitsPerKey uint8) filter.IFilterGenerator {
-	return iFilterGenerator{iFilter.IFilter.NewFilterGenerator(bitsPerKey)}
+	return &iFilterGenerator{
+		IFilterGenerator: iFilter.IFilter.NewFilterGenerator(bitsPerKey),
+		prefix:           iFilter.prefix,
+	}
 }
 
 type iFilterGenerator struct {
 	filter.IFilterGenerator
+	prefix     filter.PrefixExtractor
+	lastPrefix []byte // 连续的key大多prefix相同, 同一段filter中只加入一次
+	hasPrefix  bool
+}
+
+func (iFilterGenerator *iFilterGenerator) Add(key []byte) {
+	ukey := internalKey(key).uKey()
+	iFilterGenerator.IFilterGenerator.Add(ukey)
+
+	if iFilterGenerator.prefix == nil || !iFilterGenerator.prefix.InDomain(ukey) {
+		return
+	}
+
+	prefix := iFilterGenerator.prefix.Transform(ukey)
+	if iFilterGenerator.hasPrefix && bytes.Equal(prefix, iFilterGenerator.lastPrefix) {
+		return
+	}
+	iFilterGenerator.IFilterGenerator.Add(prefix)
+	iFilterGenerator.lastPrefix = append(iFilterGenerator.lastPrefix[:0], prefix...)
+	iFilterGenerator.hasPrefix = true
 }
 
-func (iFilterGenerator iFilterGenerator) Add(key []byte) {
-	iFilterGenerator.IFilterGenerator.Add(internalKey(key).uKey())
+// Generate 生成一段filter之后, 下一段filter需要重新加入prefix
+func (iFilterGenerator *iFilterGenerator) Generate(buf *bytes.Buffer) {
+	iFilterGenerator.IFilterGenerator.Generate(buf)
+	iFilterGenerator.hasPrefix = false
 }
@@ -25,10 +25,6 @@ key 经过k个hash函数散列后(每次hash函数会得出一个值, 然后对m
 
 **/
 
-var (
-	hashFnv32 = fnv.New32()
-)
-
 const (
 	defaultBitsPerKey = 10
 	maxBitsPerKey     = 30
@@ -128,6 +124,9 @@ func (filter *BloomFilterGenerator) Generate(buf *bytes.Buffer) {
 	data[nBytes] = filter.k
 
 	buf.Write(data)
+
+	// 每次生成的filter只包含上一次生成之后加入的key
+	filter.keyHashes = filter.keyHashes[:0]
 }
 
 func calculateNumOfHashFunc(bitsPerKey uint8) uint8 {
@@ -138,8 +137,9 @@ func bloomHash(key []byte) uint32 {
 	return fnv32(key)
 }
 
+// 每次使用新的hash, 并发查找filter时不能共享同一个hash的状态
 func fnv32(key []byte) uint32 {
-	_, _ = hashFnv32.Write(key)
-	defer hashFnv32.Reset()
-	return hashFnv32.Sum32()
+	hash := fnv.New32()
+	_, _ = hash.Write(key)
+	return hash.Sum32()
 }
@@ -0,0 +1,37 @@
+package filter
+
+import "strconv"
+
+/**
+prefix extractor
+
+从ukey中提取prefix, 设置后sstable的filter中除了完整的ukey, 还会加入每个key的prefix,
+prefix模式的Seek可以通过filter判断整个sstable是否包含某个prefix的key, 从而跳过整个sstable
+
+要求: prefix相同的key在comparer的顺序中必须是连续的, 例如bytewise的comparer下取固定长度的前缀
+**/
+
+// PrefixExtractor 从ukey中提取prefix
+type PrefixExtractor interface {
+	// Transform 返回key的prefix, 只会对InDomain的key调用
+	Transform(key []byte) []byte
+	// InDomain key是否存在prefix, 不存在prefix的key不会加入filter
+	InDomain(key []byte) bool
+	// Name 名称, 会记录到sstable中, 修改prefix extractor之后旧的sstable不会被prefix跳过
+	Name() string
+}
+
+// FixedPrefix 取key的前n个字节作为prefix, 长度不足n的key不存在prefix
+type FixedPrefix int
+
+func (p FixedPrefix) Transform(key []byte) []byte {
+	return key[:p]
+}
+
+func (p FixedPrefix) InDomain(key []byte) bool {
+	return len(key) >= int(p)
+}
+
+func (p FixedPrefix) Name() string {
+	return "fixed." + strconv.Itoa(int(p))
+}
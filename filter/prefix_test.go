@@ -0,0 +1,24 @@
+package filter
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFixedPrefix(t *testing.T) {
+	p := FixedPrefix(3)
+	assert.True(t, p.InDomain([]byte("abcd")))
+	assert.True(t, p.InDomain([]byte("abc")))
+	assert.False(t, p.InDomain([]byte("ab")))
+	assert.Equal(t, []byte("abc"), p.Transform([]byte("abcd")))
+	assert.Equal(t, "fixed.3", p.Name())
+
+	bloomFilter := &BloomFilter{}
+	generator := bloomFilter.NewFilterGenerator(defaultBitsPerKey)
+	generator.Add([]byte("abcd"))
+	generator.Add(p.Transform([]byte("abcd")))
+	buf := bytes.NewBuffer(nil)
+	generator.Generate(buf)
+	assert.True(t, bloomFilter.Contains(buf.Bytes(), []byte("abc")))
+}
@@ -0,0 +1,254 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+/**
+ribbon filter简介
+
+跟布隆过滤器一样只会误判存在, 不会误判不存在, 相同误判率下比布隆过滤器少用约20%~30%的空间, 代价是构建以及查询需要更多的cpu
+
+每个key通过hash得到三个值
+	start:       在m行中的起始行
+	coeff:       64位的系数, 表示从start开始的64行中哪些行参与计算, 最低位固定为1
+	fingerprint: r位的指纹
+
+构建时求解一个r列的bit矩阵S, 使得每个key都满足
+	parity(coeff & S[start:start+64]的第j列) == fingerprint的第j位,  j = 0..r-1
+查询时只需要读取S中从start开始的64行, 按照同样的方式计算出r位, 跟key的fingerprint比较,
+不在集合中的key每一位相等的概率为1/2, 所以误判率约为 2^-r
+
+1. banding, 逐个key插入到线性方程组中, 维持每行的最低位为1的上三角形式
+
+	row start: 如果该行为空, 直接放入
+	           否则与该行异或, 消掉最低位, 移到下一个为1的位所在的行继续插入
+	           系数全部消掉时, 指纹也被消掉说明跟已有的key线性相关(例如重复的key), 否则方程无解, 换一个seed重新构建
+
+2. 回代, 从最后一行往前求出每一行的解
+
+m = n * (1 + 1/8) + 63, 每个key约 r * 1.125 个bit, 布隆过滤器达到同样的误判率需要 r * 1.44 个bit,
+固定多出的63行在key很少时占比很大, 所以适合整表filter以及分区filter, 不适合每2k的data block一段filter
+
+数据格式(按列存储, 每一列连续的 (m+63)/64 个uint64)
+	/ column0 / column1 / ... / column r-1 / m uint32 / seed uint8 / r uint8 /
+**/
+
+const (
+	ribbonWidth         = 64 // 系数的位数
+	ribbonOverheadShift = 3  // 多分配 n>>3 行, 行越多构建越容易成功
+	ribbonTrailerLen    = 6
+	maxRibbonResultBits = 32
+	ribbonBitsPerLg2    = 0.69 // 布隆过滤器每个key的bit数换算成误判率的log2
+)
+
+// RibbonFilter ribbon过滤器, 误判率记录在生成的filter中, 修改误判率后旧的filter仍然可以使用
+type RibbonFilter struct {
+	FalsePositiveRate float64 // 误判率, 为0时根据bitsPerKey换算成跟布隆过滤器相同的误判率
+}
+
+// NewFilterGenerator 实例化一个过滤器生成器
+func (f *RibbonFilter) NewFilterGenerator(bitsPerKey uint8) IFilterGenerator {
+	return &RibbonFilterGenerator{resultBits: f.resultBits(bitsPerKey)}
+}
+
+// 每个key的指纹位数, 误判率约为 2^-resultBits
+func (f *RibbonFilter) resultBits(bitsPerKey uint8) uint8 {
+
+	var r float64
+	if f.FalsePositiveRate > 0 && f.FalsePositiveRate < 1 {
+		r = math.Ceil(-math.Log2(f.FalsePositiveRate))
+	} else {
+		if bitsPerKey <= 0 {
+			bitsPerKey = defaultBitsPerKey
+		}
+		r = math.Round(float64(bitsPerKey) * ribbonBitsPerLg2)
+	}
+
+	if r < 1 {
+		r = 1
+	}
+	if r > maxRibbonResultBits {
+		r = maxRibbonResultBits
+	}
+	return uint8(r)
+}
+
+// Contains 当前过滤器是否包含key, 格式不正确时返回true
+func (f *RibbonFilter) Contains(data []byte, key []byte) bool {
+
+	if len(data) < ribbonTrailerLen {
+		return true
+	}
+
+	trailer := data[len(data)-ribbonTrailerLen:]
+	m := int(binary.LittleEndian.Uint32(trailer))
+	seed := trailer[4]
+	r := int(trailer[5])
+	words := (m + 63) / 64
+	if m == 0 {
+		return false
+	}
+	if r == 0 || r > maxRibbonResultBits || len(data) != r*words*8+ribbonTrailerLen {
+		return true
+	}
+
+	start, coeff, fingerprint := ribbonHash(ribbonKeyHash(key), seed, m-ribbonWidth+1, r)
+
+	w, shift := start/64, uint(start%64)
+	for j := 0; j < r; j++ {
+		column := data[j*words*8:]
+		window := binary.LittleEndian.Uint64(column[w*8:]) >> shift
+		if shift > 0 {
+			window |= binary.LittleEndian.Uint64(column[(w+1)*8:]) << (64 - shift)
+		}
+		if uint32(bits.OnesCount64(coeff&window)&1) != (fingerprint>>uint(j))&1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Name 名称
+func (f *RibbonFilter) Name() string {
+	return "ribbonfilter"
+}
+
+// RibbonFilterGenerator ribbon过滤器生成器
+type RibbonFilterGenerator struct {
+	resultBits uint8
+	keyHashes  []uint64
+}
+
+// Add 将key加入过滤器集合
+func (g *RibbonFilterGenerator) Add(key []byte) {
+	g.keyHashes = append(g.keyHashes, ribbonKeyHash(key))
+}
+
+// Generate 求解出bit矩阵, 并写入到buffer中
+func (g *RibbonFilterGenerator) Generate(buf *bytes.Buffer) {
+
+	n := len(g.keyHashes)
+	r := int(g.resultBits)
+
+	var (
+		m        int
+		seed     uint8
+		solution [][]uint64
+	)
+
+	if n > 0 {
+		numStarts := n + n>>ribbonOverheadShift + 1
+		for attempt := 0; ; attempt++ {
+			// 连续失败说明行数不够, 每4次增加 n/16 行
+			if attempt > 0 && attempt%4 == 0 {
+				numStarts += n>>4 + 1
+			}
+			seed = uint8(attempt)
+			m = numStarts + ribbonWidth - 1
+			if coeffs, results, ok := g.band(numStarts, seed); ok {
+				solution = backSubstitute(coeffs, results, r)
+				break
+			}
+		}
+	}
+
+	var scratch [8]byte
+	for _, column := range solution {
+		for _, word := range column {
+			binary.LittleEndian.PutUint64(scratch[:], word)
+			buf.Write(scratch[:])
+		}
+	}
+
+	binary.LittleEndian.PutUint32(scratch[:], uint32(m))
+	scratch[4] = seed
+	scratch[5] = uint8(r)
+	buf.Write(scratch[:ribbonTrailerLen])
+
+	// 每次生成的filter只包含上一次生成之后加入的key
+	g.keyHashes = g.keyHashes[:0]
+}
+
+// 将所有key插入到方程组中, 方程无解时返回false
+func (g *RibbonFilterGenerator) band(numStarts int, seed uint8) (coeffs []uint64, results []uint32, ok bool) {
+
+	m := numStarts + ribbonWidth - 1
+	coeffs = make([]uint64, m)
+	results = make([]uint32, m)
+
+	for _, h := range g.keyHashes {
+		start, coeff, fingerprint := ribbonHash(h, seed, numStarts, int(g.resultBits))
+		for {
+			if coeffs[start] == 0 {
+				coeffs[start], results[start] = coeff, fingerprint
+				break
+			}
+			coeff ^= coeffs[start]
+			fingerprint ^= results[start]
+			if coeff == 0 {
+				if fingerprint != 0 {
+					return nil, nil, false
+				}
+				break // 跟已有的key线性相关
+			}
+			tz := bits.TrailingZeros64(coeff)
+			coeff >>= uint(tz)
+			start += tz
+		}
+	}
+
+	return coeffs, results, true
+}
+
+// 从最后一行往前回代, 返回按列存储的解
+func backSubstitute(coeffs []uint64, results []uint32, r int) [][]uint64 {
+
+	m := len(coeffs)
+	words := (m + 63) / 64
+	solution := make([][]uint64, r)
+	for j := range solution {
+		solution[j] = make([]uint64, words)
+	}
+
+	// state[j]的第k位是第j列中第i+k行的解
+	state := make([]uint64, r)
+	for i := m - 1; i >= 0; i-- {
+		for j := 0; j < r; j++ {
+			state[j] <<= 1
+			bit := uint64(bits.OnesCount64(coeffs[i]&state[j])&1) ^ uint64(results[i]>>uint(j)&1)
+			state[j] |= bit
+			solution[j][i/64] |= bit << uint(i%64)
+		}
+	}
+	return solution
+}
+
+// 根据key的hash以及seed得到起始行, 系数以及指纹
+func ribbonHash(h uint64, seed uint8, numStarts int, r int) (start int, coeff uint64, fingerprint uint32) {
+	h = mix64(h + uint64(seed)*0x9e3779b97f4a7c15)
+	start = int((h >> 32) * uint64(numStarts) >> 32)
+	coeff = mix64(h^0xc2b2ae3d27d4eb4f) | 1
+	fingerprint = uint32(mix64(h^0x165667b19e3779f9)) & (uint32(1<<uint(r)) - 1)
+	return
+}
+
+func ribbonKeyHash(key []byte) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write(key)
+	return hash.Sum64()
+}
+
+// murmur3的finalizer, 让hash的每一位都均匀分布
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRibbonFilterGenerator(t *testing.T) {
+
+	ribbonFilter := &RibbonFilter{FalsePositiveRate: 0.01}
+	generator := ribbonFilter.NewFilterGenerator(defaultBitsPerKey)
+	keys := rand16MbKeys()
+
+	for idx := 0; idx < len(keys)/4; idx++ {
+		generator.Add(keys[idx*4 : (idx+1)*4])
+	}
+	buf := bytes.NewBuffer(nil)
+	generator.Generate(buf)
+
+	data := buf.Bytes()
+
+	for idx := 0; idx < len(keys)/4; idx++ {
+		ok := ribbonFilter.Contains(data, keys[idx*4:(idx+1)*4])
+		assert.True(t, ok)
+	}
+
+	assert.InDelta(t, 0.01, falsePositiveRate(ribbonFilter, data), 0.005)
+}
+
+func TestRibbonFilter_Empty(t *testing.T) {
+
+	ribbonFilter := &RibbonFilter{}
+	generator := ribbonFilter.NewFilterGenerator(defaultBitsPerKey)
+	buf := bytes.NewBuffer(nil)
+	generator.Generate(buf)
+	assert.False(t, ribbonFilter.Contains(buf.Bytes(), []byte("foo")))
+
+	// 重复的key以及每次Generate之后重新开始
+	generator.Add([]byte("foo"))
+	generator.Add([]byte("foo"))
+	buf.Reset()
+	generator.Generate(buf)
+	assert.True(t, ribbonFilter.Contains(buf.Bytes(), []byte("foo")))
+
+	generator.Add([]byte("bar"))
+	buf.Reset()
+	generator.Generate(buf)
+	assert.True(t, ribbonFilter.Contains(buf.Bytes(), []byte("bar")))
+	assert.False(t, ribbonFilter.Contains(buf.Bytes(), []byte("foo")))
+}
+
+// 不在集合中的key被误判的比例
+func falsePositiveRate(f IFilter, data []byte) float64 {
+	const n = 100000
+	fp := 0
+	key := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(key, uint64(i)|1<<40) // 跟4字节的key长度不同, 一定不在集合中
+		if f.Contains(data, key) {
+			fp++
+		}
+	}
+	return float64(fp) / n
+}
+
+var benchmarkFilters = []struct {
+	name   string
+	filter IFilter
+}{
+	{"Bloom", &BloomFilter{}},
+	{"Ribbon", &RibbonFilter{}},
+	{"Ribbon_0.1%", &RibbonFilter{FalsePositiveRate: 0.001}},
+}
+
+func benchmarkKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, 16)
+		binary.LittleEndian.PutUint64(keys[i], uint64(i))
+	}
+	return keys
+}
+
+func generateFilter(f IFilter, keys [][]byte) []byte {
+	generator := f.NewFilterGenerator(defaultBitsPerKey)
+	for _, key := range keys {
+		generator.Add(key)
+	}
+	buf := bytes.NewBuffer(nil)
+	generator.Generate(buf)
+	return buf.Bytes()
+}
+
+// 每个key占用的bit数以及误判率
+func BenchmarkFilter_Generate(b *testing.B) {
+	keys := benchmarkKeys(100000)
+	for _, bf := range benchmarkFilters {
+		b.Run(bf.name, func(b *testing.B) {
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data = generateFilter(bf.filter, keys)
+			}
+			b.ReportMetric(float64(len(data)*8)/float64(len(keys)), "bits/key")
+			b.ReportMetric(falsePositiveRate(bf.filter, data)*100, "fp%")
+		})
+	}
+}
+
+func BenchmarkFilter_Contains(b *testing.B) {
+	keys := benchmarkKeys(100000)
+	for _, bf := range benchmarkFilters {
+		b.Run(bf.name, func(b *testing.B) {
+			data := generateFilter(bf.filter, keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bf.filter.Contains(data, keys[i%len(keys)])
+			}
+		})
+	}
+}
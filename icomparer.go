@@ -11,13 +11,14 @@ type iComparer struct {
 func (ic iComparer) Compare(a, b []byte) int {
 
 	// aaaa1100 aaaa1000
+	// ukey相同的情况下, seq越大的排得越靠前, 这样按照快照的seq去seek时, 第一个命中的就是快照可见的最新版本
 	r := ic.ucmp.Compare(internalKey(a).uKey(), internalKey(b).uKey())
 
 	if r == 0 {
 		if m, n := internalKey(a).num(), internalKey(b).num(); m > n {
-			return 1
-		} else if m < n {
 			return -1
+		} else if m < n {
+			return 1
 		}
 	}
 	return r
@@ -26,3 +27,33 @@ func (ic iComparer) Compare(a, b []byte) int {
 func (ic iComparer) uCompare(a, b []byte) int {
 	return ic.ucmp.Compare(a, b)
 }
+
+// UserKey 实现sstable.UserKeyExtractor, data block的hash index按照ukey计算hash
+func (ic iComparer) UserKey(key []byte) []byte {
+	return internalKey(key).uKey()
+}
+
+// Name 使用ucmp的名称, manifest中记录的是ucmp的名称
+func (ic iComparer) Name() string {
+	return ic.ucmp.Name()
+}
+
+// Separator 使用ucmp缩短ukey, ukey变短时追加最大的seq以及type, 保证在相同ukey的internalKey中排在最前面
+func (ic iComparer) Separator(a, b []byte) []byte {
+	ua, ub := internalKey(a).uKey(), internalKey(b).uKey()
+	x := ic.ucmp.Separator(ua, ub)
+	if len(x) < len(ua) && ic.ucmp.Compare(ua, x) < 0 {
+		return makeInternalKey(x, maxSeq, keyTypeSeek)
+	}
+	return a
+}
+
+// Successor 与Separator相同, ukey变短时追加最大的seq以及type
+func (ic iComparer) Successor(a []byte) []byte {
+	ua := internalKey(a).uKey()
+	x := ic.ucmp.Successor(ua)
+	if len(x) < len(ua) && ic.ucmp.Compare(ua, x) < 0 {
+		return makeInternalKey(x, maxSeq, keyTypeSeek)
+	}
+	return a
+}
@@ -38,7 +38,7 @@ func (b *arrayIteratorIndexer) Next() bool {
 	}
 
 	b.pos++
-	if n := b.array.Len(); n >= b.pos {
+	if n := b.array.Len(); b.pos >= n {
 		b.pos = n
 		return false
 	}
@@ -46,6 +46,31 @@ func (b *arrayIteratorIndexer) Next() bool {
 	return true
 }
 
+func (b *arrayIteratorIndexer) Last() bool {
+
+	if b.Released() {
+		return false
+	}
+
+	b.pos = b.array.Len() - 1
+	return b.pos >= 0
+}
+
+func (b *arrayIteratorIndexer) Prev() bool {
+
+	if b.Released() {
+		return false
+	}
+
+	b.pos--
+	if b.pos < 0 {
+		b.pos = -1
+		return false
+	}
+
+	return true
+}
+
 func (b *arrayIteratorIndexer) Seek(key []byte) bool {
 
 	n := b.array.Len()
@@ -58,7 +83,7 @@ func (b *arrayIteratorIndexer) Seek(key []byte) bool {
 }
 
 func (b *arrayIteratorIndexer) Get() Iterator {
-	if n := b.array.Len(); b.pos < n {
+	if n := b.array.Len(); b.pos >= 0 && b.pos < n {
 		return b.array.Get(b.pos)
 	}
 	return NewEmptyIterator(errors.New("myLevelDb/arrayIteratorIndexer Get() eoi"))
@@ -27,9 +27,25 @@ func (ei *EmptyIterator) Value() []byte {
 	return nil
 }
 
+func (ei *EmptyIterator) Error() error {
+	return ei.err
+}
+
 func NewEmptyIterator(err error) Iterator {
 	ei := &EmptyIterator{
 		err: err,
 	}
 	return ei
 }
+
+func (ei *EmptyIterator) Last() bool {
+	return false
+}
+
+func (ei *EmptyIterator) Prev() bool {
+	return false
+}
+
+func (ei *EmptyIterator) SeekBefore(key []byte) bool {
+	return false
+}
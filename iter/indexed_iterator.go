@@ -1,16 +1,44 @@
 package iter
 
-import "myleveldb/utils"
+import (
+	"myleveldb/comparer"
+	"myleveldb/utils"
+)
 
 type IteratorIndexer interface {
 	CommonIterator
 	Get() Iterator
 }
 
+// IndexKeyer 可以返回当前位置key的IteratorIndexer, 例如sstable的index block,
+// 这个key大于等于当前data中所有的key, 并且小于后面data中所有的key
+type IndexKeyer interface {
+	Key() []byte
+}
+
 type indexedIterator struct {
 	utils.BasicReleaser
 	index IteratorIndexer
 	data  Iterator
+
+	// 当前位置的index key大于等于limit时, 后面的data中所有的key都大于limit, 不再加载
+	cmp   comparer.BasicComparer
+	limit []byte
+
+	err error // index或者data出错之后不再继续遍历
+}
+
+// 后面的data是否都超过了limit
+func (i *indexedIterator) pastLimit() bool {
+	if i.limit == nil {
+		return false
+	}
+	keyer, ok := i.index.(IndexKeyer)
+	if !ok {
+		return false
+	}
+	key := keyer.Key()
+	return key != nil && i.cmp.Compare(key, i.limit) >= 0
 }
 
 func (i *indexedIterator) setData() {
@@ -28,15 +56,27 @@ func (i *indexedIterator) clearData() {
 	i.data = nil
 }
 
+// data或者index因为出错结束时记录错误
+func (i *indexedIterator) setErr(it CommonIterator) bool {
+	if err := Error(it); err != nil {
+		i.err = err
+		i.clearData()
+		return true
+	}
+	return false
+}
+
 func (i *indexedIterator) First() bool {
 
 	if i.Released() {
 		return false
 	}
+	i.err = nil
 	switch {
 	case i.index.First():
 		i.setData()
 	default:
+		i.setErr(i.index)
 		i.clearData()
 		return false
 	}
@@ -45,13 +85,24 @@ func (i *indexedIterator) First() bool {
 
 func (i *indexedIterator) Next() bool {
 
+	if i.err != nil {
+		return false
+	}
+
 	switch {
 
 	case i.data != nil && !i.data.Next():
+		if i.setErr(i.data) {
+			return false
+		}
 		i.clearData()
 		fallthrough
 	case i.data == nil:
+		if i.pastLimit() {
+			return false
+		}
 		if !i.index.Next() {
+			i.setErr(i.index)
 			return false
 		}
 		i.setData()
@@ -63,13 +114,18 @@ func (i *indexedIterator) Next() bool {
 
 func (i *indexedIterator) Seek(key []byte) bool {
 
+	i.err = nil
 	if !i.index.Seek(key) {
+		i.setErr(i.index)
 		i.clearData()
 		return false
 	}
 	i.setData()
 
 	if !i.data.Seek(key) {
+		if i.setErr(i.data) {
+			return false
+		}
 		i.clearData()
 		return i.Next()
 	}
@@ -78,6 +134,81 @@ func (i *indexedIterator) Seek(key []byte) bool {
 
 }
 
+// Last index需要实现ReverseIterator, 从最后一个data开始找到第一个不为空的data
+func (i *indexedIterator) Last() bool {
+
+	if i.Released() {
+		return false
+	}
+	i.err = nil
+	if !Last(i.index) {
+		i.setErr(i.index)
+		i.clearData()
+		return false
+	}
+	i.setData()
+	if Last(i.data) {
+		return true
+	}
+	return i.prevData()
+}
+
+// SeekBefore 第一个index key大于等于key的data中可能存在小于key的记录, 不存在时从前一个data的最后一个位置开始,
+// 不会受到limit的限制
+func (i *indexedIterator) SeekBefore(key []byte) bool {
+
+	if i.Released() {
+		return false
+	}
+	i.err = nil
+	if !i.index.Seek(key) {
+		// 所有的index key都小于key
+		if i.setErr(i.index) {
+			return false
+		}
+		return i.Last()
+	}
+	i.setData()
+	if SeekBefore(i.data, key) {
+		return true
+	}
+	return i.prevData()
+}
+
+func (i *indexedIterator) Prev() bool {
+
+	if i.err != nil || i.data == nil {
+		return false
+	}
+	if Prev(i.data) {
+		return true
+	}
+	return i.prevData()
+}
+
+// 当前data已经没有更前的记录, 移动到前一个不为空的data的最后一个位置
+func (i *indexedIterator) prevData() bool {
+
+	for {
+		if i.setErr(i.data) {
+			return false
+		}
+		if !Prev(i.index) {
+			i.setErr(i.index)
+			i.clearData()
+			return false
+		}
+		i.setData()
+		if Last(i.data) {
+			return true
+		}
+	}
+}
+
+func (i *indexedIterator) Error() error {
+	return i.err
+}
+
 func (i *indexedIterator) UnRef() {
 	i.clearData()
 	i.index.UnRef()
@@ -103,3 +234,13 @@ func NewIndexedIterator(index IteratorIndexer) Iterator {
 		index: index,
 	}
 }
+
+// NewBoundedIndexedIterator index实现了IndexKeyer时, index key大于等于limit之后不再加载后面的data,
+// 所以只保证小于limit的key会被遍历到, limit为nil时与NewIndexedIterator相同
+func NewBoundedIndexedIterator(index IteratorIndexer, cmp comparer.BasicComparer, limit []byte) Iterator {
+	return &indexedIterator{
+		index: index,
+		cmp:   cmp,
+		limit: limit,
+	}
+}
@@ -16,3 +16,52 @@ type Iterator interface {
 	Key() []byte   // 获取当前遍历的key
 	Value() []byte // 获取当前遍历的value
 }
+
+// ErrorIterator 可选的接口, 遍历出错(例如block的check sum不一致)时First/Seek/Next返回false, Error返回出错的原因
+type ErrorIterator interface {
+	Error() error
+}
+
+// Error 返回i遍历过程中的错误, i没有实现ErrorIterator时返回nil
+func Error(i CommonIterator) error {
+	if ei, ok := i.(ErrorIterator); ok {
+		return ei.Error()
+	}
+	return nil
+}
+
+// ReverseIterator 可选的接口, 支持从后向前遍历, Prev之后可以继续调用Next向后遍历,
+// Prev返回false(已经越过第一个位置)之后需要重新定位
+type ReverseIterator interface {
+	Last() bool // 移动到最后一个位置
+	Prev() bool // 移动到前一个位置
+}
+
+// BeforeSeeker 可选的接口, 移动到最后一个小于key的位置, 之后可以调用Prev继续向前遍历
+type BeforeSeeker interface {
+	SeekBefore(key []byte) bool
+}
+
+// Last i没有实现ReverseIterator时返回false
+func Last(i CommonIterator) bool {
+	if ri, ok := i.(ReverseIterator); ok {
+		return ri.Last()
+	}
+	return false
+}
+
+// Prev i没有实现ReverseIterator时返回false
+func Prev(i CommonIterator) bool {
+	if ri, ok := i.(ReverseIterator); ok {
+		return ri.Prev()
+	}
+	return false
+}
+
+// SeekBefore i没有实现BeforeSeeker时返回false
+func SeekBefore(i CommonIterator, key []byte) bool {
+	if bs, ok := i.(BeforeSeeker); ok {
+		return bs.SeekBefore(key)
+	}
+	return false
+}
@@ -1,8 +1,8 @@
 package iter
 
 import (
-	"bytes"
 	"myleveldb/collections"
+	"myleveldb/comparer"
 	"myleveldb/utils"
 )
 
@@ -12,11 +12,12 @@ type MergedIterator struct {
 	iters []Iterator
 	keys  [][]byte
 	heap  *collections.Heap
+	cmp   comparer.BasicComparer
 	utils.BasicReleaser
 	// soi 代表是否开始遍历
 	// eoi 代表是否结束遍历
 	soi, eoi bool
-	reverse  bool // 如果true, heap为最大堆, 反之为最小堆
+	reverse  bool // 如果true, heap为最大堆, 反之为最小堆, Last, SeekBefore以及Prev之后为true
 	released bool
 }
 
@@ -34,6 +35,10 @@ func (mi *MergedIterator) Next() bool {
 		return mi.First()
 	}
 
+	if mi.reverse {
+		return mi.forward()
+	}
+
 	iter := mi.iters[mi.index]
 	switch {
 	case iter.Next():
@@ -54,6 +59,8 @@ func (mi *MergedIterator) Seek(key []byte) bool {
 
 	mi.soi = false
 	mi.eoi = false
+	mi.reverse = false
+	mi.heap.Clear()
 
 	for x, iter := range mi.iters {
 		switch {
@@ -88,6 +95,10 @@ func (mi *MergedIterator) First() bool {
 		return false
 	}
 
+	mi.eoi = false
+	mi.reverse = false
+	mi.heap.Clear()
+
 	for x, iter := range mi.iters {
 		switch {
 		case iter.First():
@@ -103,6 +114,135 @@ func (mi *MergedIterator) First() bool {
 	return mi.next()
 }
 
+// Last 所有的iterator都需要实现ReverseIterator, 之后heap为最大堆
+func (mi *MergedIterator) Last() bool {
+
+	if mi.released {
+		return false
+	}
+
+	mi.soi = false
+	mi.eoi = false
+	mi.reverse = true
+	mi.heap.Clear()
+
+	for x, iter := range mi.iters {
+		switch {
+		case Last(iter):
+			mi.keys[x] = assertKey(iter.Key())
+			mi.heap.Push(x)
+		default:
+			mi.keys[x] = nil
+		}
+	}
+
+	return mi.next()
+}
+
+// SeekBefore 所有的iterator都需要实现BeforeSeeker
+func (mi *MergedIterator) SeekBefore(key []byte) bool {
+
+	if mi.released {
+		return false
+	}
+
+	mi.soi = false
+	mi.eoi = false
+	mi.reverse = true
+	mi.heap.Clear()
+
+	for x, iter := range mi.iters {
+		switch {
+		case SeekBefore(iter, key):
+			mi.keys[x] = assertKey(iter.Key())
+			mi.heap.Push(x)
+		default:
+			mi.keys[x] = nil
+		}
+	}
+
+	return mi.next()
+}
+
+func (mi *MergedIterator) Prev() bool {
+
+	if mi.released || mi.soi {
+		return false
+	}
+
+	if mi.eoi {
+		if mi.reverse {
+			return false
+		}
+		return mi.Last()
+	}
+
+	if !mi.reverse {
+		return mi.backward()
+	}
+
+	iter := mi.iters[mi.index]
+	switch {
+	case Prev(iter):
+		mi.keys[mi.index] = iter.Key()
+		mi.heap.Push(mi.index)
+	default:
+		mi.keys[mi.index] = nil
+	}
+
+	return mi.next()
+}
+
+// 正向遍历时改为反向, 当前iterator之外的iterator都停在大于当前key的位置, 需要重新定位到小于当前key的位置
+func (mi *MergedIterator) backward() bool {
+
+	key := append([]byte(nil), mi.keys[mi.index]...)
+	mi.reverse = true
+	mi.heap.Clear()
+
+	for x, iter := range mi.iters {
+		var ok bool
+		if x == mi.index {
+			ok = Prev(iter)
+		} else {
+			ok = SeekBefore(iter, key)
+		}
+		if ok {
+			mi.keys[x] = assertKey(iter.Key())
+			mi.heap.Push(x)
+		} else {
+			mi.keys[x] = nil
+		}
+	}
+
+	return mi.next()
+}
+
+// 反向遍历时改为正向, 当前iterator之外的iterator都停在小于当前key的位置, 需要重新定位到大于当前key的位置
+func (mi *MergedIterator) forward() bool {
+
+	key := append([]byte(nil), mi.keys[mi.index]...)
+	mi.reverse = false
+	mi.heap.Clear()
+
+	for x, iter := range mi.iters {
+		var ok bool
+		if x == mi.index {
+			ok = iter.Next()
+		} else if ok = iter.Seek(key); ok && mi.cmp.Compare(iter.Key(), key) == 0 {
+			ok = iter.Next()
+		}
+		if ok {
+			mi.keys[x] = assertKey(iter.Key())
+			mi.heap.Push(x)
+		} else {
+			mi.keys[x] = nil
+		}
+	}
+
+	return mi.next()
+}
+
 func (mi *MergedIterator) next() bool {
 
 	if mi.heap.Empty() || mi.eoi {
@@ -132,7 +272,7 @@ func (mi *MergedIterator) heapLess(array *[]interface{}, i, j int) bool {
 		panic("max heap arr item convert int failed")
 	}
 
-	r := bytes.Compare(mi.keys[iIndex], mi.keys[jIndex])
+	r := mi.cmp.Compare(mi.keys[iIndex], mi.keys[jIndex])
 	if mi.reverse { // 最大堆
 		if r > 0 {
 			return true
@@ -163,10 +303,11 @@ func (mi *MergedIterator) UnRef() {
 
 }
 
-func NewMergedIterator(iters []Iterator) Iterator {
+func NewMergedIterator(iters []Iterator, cmp comparer.BasicComparer) Iterator {
 	iter := &MergedIterator{
 		iters: iters,
 		soi:   true,
+		cmp:   cmp,
 		keys:  make([][]byte, len(iters)),
 	}
 	iter.heap = collections.InitHeap(iter.heapLess)
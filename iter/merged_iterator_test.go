@@ -0,0 +1,77 @@
+package iter
+
+import (
+	"fmt"
+	"myleveldb/collections"
+	"myleveldb/comparer"
+	"myleveldb/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mergedTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%04d", i))
+}
+
+// 三个iterator分别包含 i%3 == 0, 1, 2 的key
+func newTestMergedIterator(t *testing.T, n int) *MergedIterator {
+
+	pool := utils.NewBytePool(1 << 20)
+	var iters []Iterator
+	for x := 0; x < 3; x++ {
+		tree := collections.NewLLRBTree(1<<20, comparer.DefaultComparer, pool)
+		for i := x; i < n; i += 3 {
+			assert.Nil(t, tree.Put(mergedTestKey(i), mergedTestKey(i)))
+		}
+		iters = append(iters, collections.NewLLRBTreeIter(tree, nil))
+		tree.UnRef()
+	}
+	return NewMergedIterator(iters, comparer.DefaultComparer).(*MergedIterator)
+}
+
+func TestMergedIterator_Reverse(t *testing.T) {
+
+	const n = 300
+	mi := newTestMergedIterator(t, n)
+	defer mi.UnRef()
+
+	i := n - 1
+	for ok := mi.Last(); ok; ok = mi.Prev() {
+		if !assert.Equal(t, mergedTestKey(i), mi.Key()) || !assert.Equal(t, mergedTestKey(i), mi.Value()) {
+			return
+		}
+		i--
+	}
+	assert.Equal(t, -1, i)
+
+	assert.True(t, mi.SeekBefore(mergedTestKey(100)))
+	assert.Equal(t, mergedTestKey(99), mi.Key())
+	assert.False(t, mi.SeekBefore(mergedTestKey(0)))
+}
+
+func TestMergedIterator_SwitchDirection(t *testing.T) {
+
+	const n = 300
+	mi := newTestMergedIterator(t, n)
+	defer mi.UnRef()
+
+	// 正向遍历中途改为反向, 再改回正向
+	assert.True(t, mi.Seek(mergedTestKey(100)))
+	assert.True(t, mi.Next())
+	assert.Equal(t, mergedTestKey(101), mi.Key())
+	for i := 100; i >= 90; i-- {
+		assert.True(t, mi.Prev())
+		assert.Equal(t, mergedTestKey(i), mi.Key())
+	}
+	for i := 91; i <= 110; i++ {
+		assert.True(t, mi.Next())
+		assert.Equal(t, mergedTestKey(i), mi.Key())
+	}
+
+	// 正向遍历结束之后Prev从最后一个开始
+	for mi.Next() {
+	}
+	assert.True(t, mi.Prev())
+	assert.Equal(t, mergedTestKey(n-1), mi.Key())
+}
@@ -6,12 +6,16 @@ import (
 )
 
 // key的类型
-// 有增加, 删除
+// 有增加, 删除, 以及value存放在blob文件中的增加
 type keyType uint8
 
 const (
-	keyTypeVal = keyType(1) // 增加
-	keyTypeDel = keyType(2) // 删除
+	keyTypeVal  = keyType(1) // 增加
+	keyTypeDel  = keyType(2) // 删除
+	keyTypeBlob = keyType(3) // 增加, value是blob index, 只会出现在sstable中
+
+	// seek时使用的类型, 同一个ukey同一个seq下, 类型越大排序越靠前, 所以取最大的类型
+	keyTypeSeek = keyTypeBlob
 )
 
 const (
@@ -26,7 +30,7 @@ func makeInternalKey(key []byte, seq uint64, kt keyType) internalKey {
 		panic("seq invalid")
 	}
 
-	if kt > keyTypeDel {
+	if kt > keyTypeBlob {
 		panic("key type invalid")
 	}
 
@@ -46,7 +50,7 @@ func parseInternalKey(ik []byte) (uk []byte, seq uint64, kt keyType, err error)
 	x := binary.LittleEndian.Uint64(ik[len(ik)-8:])
 	seq = x >> 8
 	kt = keyType(x & (0xff))
-	if kt > keyTypeDel {
+	if kt > keyTypeBlob {
 		return nil, 0, 0, errors.New("invalid key type")
 	}
 	return
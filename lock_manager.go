@@ -0,0 +1,209 @@
+package myleveldb
+
+import (
+	"hash/fnv"
+	error2 "myleveldb/error"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+悲观事务的key锁
+
+1. 锁表按照key的hash分成多个stripe, 每个stripe有自己的互斥锁, 不同stripe上的加锁互不影响
+
+	stripe 0   a -> {S: tx1, tx3}      c -> {X: tx2}
+	stripe 1   b -> {X: tx1}
+	...
+
+2. 共享锁(S)可以被多个事务同时持有, 排它锁(X)只能被一个事务持有, 唯一持有共享锁的事务可以直接升级为排它锁
+
+3. 加锁失败时记录 等待者 -> 持有者 的边到wait-for图中, 如果从持有者出发能够回到等待者, 说明形成了环,
+   当前的等待者返回ErrDeadlock; 否则等待stripe上的释放通知后重试, 超过timeout返回ErrLockTimeout
+
+	tx1 -> tx2 -> tx3
+	 ^             |
+	 |-------------|   tx3等待tx1时检测到环
+
+锁只在事务Commit或者Rollback时统一释放
+**/
+
+type lockMode uint8
+
+const (
+	lockShared lockMode = iota + 1
+	lockExclusive
+)
+
+type keyLock struct {
+	mode    lockMode
+	holders map[uint64]struct{}
+}
+
+type lockStripe struct {
+	mu        sync.Mutex
+	locks     map[string]*keyLock
+	releasedC chan struct{} // 有锁被释放时close, 并替换成新的chan
+}
+
+type lockManager struct {
+	stripes []*lockStripe
+	nextID  uint64
+
+	waitMu  sync.Mutex
+	waitFor map[uint64][]uint64 // 等待者 -> 持有者
+}
+
+func newLockManager(stripes int) *lockManager {
+	lm := &lockManager{
+		stripes: make([]*lockStripe, stripes),
+		waitFor: make(map[uint64][]uint64),
+	}
+	for i := range lm.stripes {
+		lm.stripes[i] = &lockStripe{
+			locks:     make(map[string]*keyLock),
+			releasedC: make(chan struct{}),
+		}
+	}
+	return lm
+}
+
+func (lm *lockManager) newTxnID() uint64 {
+	return atomic.AddUint64(&lm.nextID, 1)
+}
+
+func (lm *lockManager) stripe(key string) *lockStripe {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return lm.stripes[h.Sum32()%uint32(len(lm.stripes))]
+}
+
+// lock 以mode给key加锁, timeout小于0时不等待
+func (lm *lockManager) lock(txnID uint64, key string, mode lockMode, timeout time.Duration) error {
+
+	stripe := lm.stripe(key)
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		lm.clearWait(txnID)
+	}()
+
+	for {
+
+		stripe.mu.Lock()
+		holders := stripe.tryLock(txnID, key, mode)
+		if holders == nil {
+			stripe.mu.Unlock()
+			return nil
+		}
+		releasedC := stripe.releasedC
+		stripe.mu.Unlock()
+
+		if timeout < 0 {
+			return error2.ErrLockTimeout
+		}
+
+		if lm.setWait(txnID, holders) {
+			return error2.ErrDeadlock
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+		}
+
+		select {
+		case <-releasedC:
+		case <-timer.C:
+			return error2.ErrLockTimeout
+		}
+	}
+}
+
+// 加锁成功时返回nil, 否则返回阻塞当前事务的持有者
+func (stripe *lockStripe) tryLock(txnID uint64, key string, mode lockMode) []uint64 {
+
+	kl, ok := stripe.locks[key]
+	if !ok {
+		stripe.locks[key] = &keyLock{
+			mode:    mode,
+			holders: map[uint64]struct{}{txnID: {}},
+		}
+		return nil
+	}
+
+	_, held := kl.holders[txnID]
+
+	if mode == lockShared {
+		if kl.mode == lockShared || held {
+			kl.holders[txnID] = struct{}{}
+			return nil
+		}
+	} else if held && len(kl.holders) == 1 {
+		kl.mode = lockExclusive // 升级
+		return nil
+	}
+
+	holders := make([]uint64, 0, len(kl.holders))
+	for id := range kl.holders {
+		if id != txnID {
+			holders = append(holders, id)
+		}
+	}
+	return holders
+}
+
+// unlock 释放事务在keys上持有的锁
+func (lm *lockManager) unlock(txnID uint64, keys []string) {
+	for _, key := range keys {
+
+		stripe := lm.stripe(key)
+		stripe.mu.Lock()
+
+		if kl, ok := stripe.locks[key]; ok {
+			delete(kl.holders, txnID)
+			if len(kl.holders) == 0 {
+				delete(stripe.locks, key)
+			}
+			close(stripe.releasedC)
+			stripe.releasedC = make(chan struct{})
+		}
+
+		stripe.mu.Unlock()
+	}
+}
+
+// 记录等待关系, 形成环时返回true并且不记录
+func (lm *lockManager) setWait(txnID uint64, holders []uint64) bool {
+
+	lm.waitMu.Lock()
+	defer lm.waitMu.Unlock()
+
+	visited := make(map[uint64]bool)
+	stack := append([]uint64(nil), holders...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == txnID {
+			delete(lm.waitFor, txnID)
+			return true
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		stack = append(stack, lm.waitFor[id]...)
+	}
+
+	lm.waitFor[txnID] = holders
+	return false
+}
+
+func (lm *lockManager) clearWait(txnID uint64) {
+	lm.waitMu.Lock()
+	delete(lm.waitFor, txnID)
+	lm.waitMu.Unlock()
+}
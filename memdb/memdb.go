@@ -7,19 +7,64 @@ import (
 	"myleveldb/utils"
 )
 
+// Type memdb底层有序表的实现
+type Type int
+
+const (
+	TypeLLRBTree Type = iota // 左倾红黑树, 读写共用一把读写锁
+	TypeSkipList             // 基于arena的无锁skiplist, 支持并发写入, 读取不需要锁
+)
+
+// memdb底层的有序表, key相同时替换value
+type table interface {
+	Put(key, value []byte) error
+	Get(key []byte) ([]byte, error)
+	Find(key []byte) (rkey, value []byte, err error)
+	Len() int
+	Cap() int
+	Allocated() int
+	Free() (int, error)
+	Ref()
+	UnRef()
+	Reset()
+}
+
 // MemDB 内存kv数据库
 type MemDB struct {
-	collections.LLRBTree
+	table
+	newIterator func() iter.Iterator
+	concurrent  bool
 }
 
-// NewMemDB 新建
-func NewMemDB(capacity int, cmp comparer.BasicComparer, pool *utils.BytePool) *MemDB {
+// NewMemDB 新建, capacity为可以写入的大小
+func NewMemDB(typ Type, capacity int, cmp comparer.BasicComparer, pool *utils.BytePool) *MemDB {
+
+	if typ == TypeSkipList {
+		list := collections.NewConcurrentSkipList(capacity, cmp, pool)
+		return &MemDB{
+			table: list,
+			newIterator: func() iter.Iterator {
+				return collections.NewConcurrentSkipListIter(list, nil)
+			},
+			concurrent: true,
+		}
+	}
+
+	tree := collections.NewLLRBTree(capacity, cmp, pool)
 	return &MemDB{
-		LLRBTree: *collections.NewLLRBTree(capacity, cmp, pool),
+		table: tree,
+		newIterator: func() iter.Iterator {
+			return collections.NewLLRBTreeIter(tree, nil)
+		},
 	}
 }
 
 // NewIterator 新建一个迭代器
 func (mdb *MemDB) NewIterator() iter.Iterator {
-	return collections.NewLLRBTreeIter(&mdb.LLRBTree, nil)
+	return mdb.newIterator()
+}
+
+// Concurrent 是否支持多个goroutine同时Put而不需要互相等待
+func (mdb *MemDB) Concurrent() bool {
+	return mdb.concurrent
 }
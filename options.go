@@ -2,8 +2,14 @@ package myleveldb
 
 import (
 	"math"
+	"myleveldb/cache"
+	"myleveldb/collections"
 	"myleveldb/comparer"
+	"myleveldb/filter"
+	"myleveldb/memdb"
+	"myleveldb/sstable"
 	"myleveldb/utils"
+	"time"
 )
 
 const (
@@ -17,21 +23,65 @@ const (
 	// 默认当要扩大输入文件时, 一次性总共不能超过25个文件进行合并
 	defaultCompactionLimitFiles = 25
 
-	// 写入的时候进行检查, 如果level0层的sstable文件数量达到此值, 需要做一次休眠一微秒的操作
+	// 写入的时候进行检查, 如果level0层的sstable文件数量达到此值, 开始限速写入
 	defaultSlowDownTrigger = 8
 
-	// 写入的时候进行检查, 如果level0成的sstable文件数量达到此值, 需要直接做compaction操作
+	// 写入的时候进行检查, 如果level0成的sstable文件数量达到此值, 暂停写入直到compaction完成
 	defaultPauseTrigger = 12
 
+	// 默认待compaction的字节数达到soft时开始限速, 达到hard时暂停写入
+	defaultSoftPendingCompactionBytes = 1 << 30
+	defaultHardPendingCompactionBytes = 4 << 30
+
+	// 默认开始限速时每秒可以写入的字节数, 越接近暂停的条件限速越低, 最低不小于minDelayedWriteRate
+	defaultDelayedWriteRate = 16 * mb
+	minDelayedWriteRate     = 16 << 10
+
 	// 默认当level[0]跟level[1]无重复, 并且level[0]跟gp层重复的文件数量不超过该值, 则可以直接将
 	// level[0]直接放置到level[1]
 	defaultTrivialGpLimitFiles = 10
 
+	// 默认compaction生成的sstable跟level+2层重叠的大小不能超过sstable文件大小的倍数
+	defaultGpOverlappedMulter = 10
+
 	// 默认下一层是上一层size的10倍
 	defaultCompactionTotalSizeMulter = 10
 
 	// 默认基础层的总大小
 	defaultLevelTotalSize = 10 * mb
+
+	// 默认最多缓存打开的sstable文件数量
+	defaultOpenFilesCacheCapacity = 500
+
+	// 默认block cache的容量
+	defaultBlockCacheCapacity = 8 * mb
+
+	// 默认cache的分片数量为 1<<defaultCacheShardBits
+	defaultCacheShardBits = 4
+
+	// 默认的最大层数, 导入外部sstable时最多放到该层的最后一层
+	defaultNumLevels = 7
+
+	// 默认悲观事务等待key锁的超时时间
+	defaultTxnLockTimeout = time.Second
+
+	// 默认key锁表的分片数量
+	defaultTxnLockStripes = 16
+
+	// 默认blob文件的大小, 超过后切换到新的blob文件
+	defaultBlobFileSize = 256 * mb
+
+	// 默认blob文件垃圾比例达到该值时, compaction会迁移其中的live value
+	defaultBlobGCRatio = 0.5
+)
+
+// PinningTier 哪些sstable的index block以及filter block固定在block cache中
+type PinningTier int
+
+const (
+	PinningTierNone   PinningTier = iota // 默认, 跟data block一样按照lru驱逐
+	PinningTierLevel0                    // 只固定level0的sstable, level0的每个sstable查询时都需要检查
+	PinningTierAll                       // 固定所有的sstable
 )
 
 // Options db相关的选项
@@ -40,15 +90,89 @@ type Options struct {
 
 	WriteBuffer int // memdb的容量
 
+	MemDbType memdb.Type // memdb的实现, 默认为左倾红黑树
+
 	Cmp comparer.BasicComparer // 比较大小
 
 	SSTableDataBlockSize int64 // sstable的datablock的大小
 
+	// sstable的过滤器, 默认为布隆过滤器, filter.RibbonFilter用更多的cpu换取更少的内存, 需要搭配整表filter或者分区filter,
+	// 切换过滤器后旧的sstable因为filter名称不同不再经过filter, compaction之后使用新的过滤器
+	Filter filter.IFilter
+
+	// filter block的格式, 默认每2k的data block一段filter, 整表filter在读取index block之前就可以判断,
+	// 分区filter适合很大的sstable, 查询时只读取一个分区. 读取时根据sstable中记录的格式自动识别
+	FilterFormat sstable.FilterFormat
+
+	// data block中追加user key的hash index, 点查时不需要二分查找restart point, 每个key大约多占用1.3个字节,
+	// 要求Cmp中相等的key的字节也相等
+	DataBlockHashIndex bool
+
+	// sstable的index block超过该大小(字节)时切分成多个分区, 只有顶层index常驻block cache,
+	// 分区跟data block一样按需读取, 适合很大的sstable, 小于等于0时不分区
+	IndexPartitionThreshold int
+
+	// 从ukey中提取prefix, 设置后filter中同时加入prefix, 可以使用prefix模式的iterator,
+	// 规则的名称单独记录在sstable中, 没有加入prefix或者规则不同的sstable不会被prefix跳过, 但是点查仍然可以使用filter
+	PrefixExtractor filter.PrefixExtractor
+
+	// journal落地到sstable后的保留策略, 两者都为0时落地后立即删除
+	// 保留的journal可以通过DB.GetUpdatesSince读取
+	JournalRetentionTTL  time.Duration // 保留的时长, 超过的journal会被删除
+	JournalRetentionSize int64         // 保留的总大小, 超过时从最旧的journal开始删除
+
+	// 悲观事务的key锁
+	TxnLockTimeout time.Duration // 等待key锁的超时时间, 小于0时不等待
+	TxnLockStripes int           // key锁表的分片数量
+
+	// kv分离, 长度大于等于BlobMinValueSize的value写入blob文件, 为0时不分离
+	BlobMinValueSize int
+	BlobFileSize     int64   // blob文件的大小
+	BlobGCRatio      float64 // blob文件的垃圾比例达到该值时, compaction迁移其中的live value
+
+	// MultiGet时同一层不同sstable的查找并发执行的数量, 小于等于1时串行
+	MultiGetParallelism int
+
+	// 缓存, 每个缓存按照key的hash分成 1<<CacheShardBits 个分片, 小于0时不分片
+	BlockCacheCapacity     int64                   // block cache的容量(字节)
+	BlockCachePolicy       collections.CachePolicy // block cache的淘汰策略, 默认为LRU, 2Q可以防止扫描把热点block挤出缓存
+	OpenFilesCacheCapacity int                     // 最多缓存打开的sstable以及blob文件数量
+	CacheShardBits         int
+
+	// sstable打开期间(在file cache中)将index block以及filter block固定在block cache中, 不会被data block挤出缓存,
+	// 占用的内存计入block cache的容量, 默认不固定
+	PinIndexAndFilterBlocks PinningTier
+
+	// 设置后使用外部的缓存, 对应的容量选项不再生效, 多个db可以共享同一个缓存, 每个db使用各自的namespace,
+	// db关闭时只删掉自己namespace中的节点, 不会关闭缓存
+	BlockCache     cache.Cache
+	OpenFilesCache cache.Cache
+
+	// 多个db共享的memdb内存预算, 总用量超过预算时切换memdb最大的db, 为nil时每个db只受WriteBuffer限制
+	WriteBufferManager *WriteBufferManager
+
+	// 写入限速, level0文件数达到Level0SlowdownWritesTrigger或者待compaction的字节数达到SoftPendingCompactionBytesLimit时
+	// 按照DelayedWriteRate限速, 越接近Level0StopWritesTrigger以及HardPendingCompactionBytesLimit限速越低, 达到时暂停写入直到compaction完成.
+	// level0的阈值以及字节数的阈值每个family可以单独设置, 字节数的阈值小于0时不限制
+	Level0SlowdownWritesTrigger     int
+	Level0StopWritesTrigger         int
+	SoftPendingCompactionBytesLimit int64
+	HardPendingCompactionBytesLimit int64
+	DelayedWriteRate                int64 // 开始限速时每秒可以写入的字节数
+
+	// 写入需要限速等待或者暂停时不等待, 直接返回error2.ErrBusy
+	NoSlowdown bool
+
+	// 写入的限速状态或者原因变化时回调, 在写入, compaction或者调用Stats的goroutine中执行, 不能阻塞也不能写入db
+	OnWriteStall func(info WriteStallInfo)
+
+	// 打开db时已存在的family的选项, key为family名称, 没有指定的family使用默认选项
+	ColumnFamilies map[string]*Options
 }
 
 func (opt *Options) GetPool() *utils.BytePool {
 	dataBlockSize := defaultSStableDataBlockSize
-	if opt != nil {
+	if opt != nil && opt.SSTableDataBlockSize > 0 {
 		dataBlockSize = opt.SSTableDataBlockSize
 	}
 	return utils.NewBytePool(dataBlockSize) //todo
@@ -68,6 +192,13 @@ func (opt *Options) GetWriteBuffer() int {
 	return opt.WriteBuffer
 }
 
+func (opt *Options) GetMemDbType() memdb.Type {
+	if opt == nil {
+		return memdb.TypeLLRBTree
+	}
+	return opt.MemDbType
+}
+
 func (opt *Options) GetCompare() comparer.BasicComparer {
 	if opt == nil || opt.Cmp == nil {
 		return comparer.DefaultComparer
@@ -76,6 +207,179 @@ func (opt *Options) GetCompare() comparer.BasicComparer {
 	return opt.Cmp
 }
 
+func (opt *Options) GetFilter() filter.IFilter {
+	if opt == nil || opt.Filter == nil {
+		return &filter.BloomFilter{}
+	}
+	return opt.Filter
+}
+
+func (opt *Options) GetFilterFormat() sstable.FilterFormat {
+	if opt == nil {
+		return sstable.FilterFormatBlock
+	}
+	return opt.FilterFormat
+}
+
+func (opt *Options) GetDataBlockHashIndex() bool {
+	if opt == nil {
+		return false
+	}
+	return opt.DataBlockHashIndex
+}
+
+func (opt *Options) GetIndexPartitionThreshold() int {
+	if opt == nil {
+		return 0
+	}
+	return opt.IndexPartitionThreshold
+}
+
+// 写入sstable时使用的选项, family记录在sstable的properties block中
+func (opt *Options) sstableWriterOptions(icmp *iComparer, cfID uint32, cfName string) *sstable.WriterOptions {
+	return &sstable.WriterOptions{
+		FilterFormat:            opt.GetFilterFormat(),
+		DataBlockHashIndex:      opt.GetDataBlockHashIndex(),
+		Comparer:                icmp,
+		IndexPartitionThreshold: opt.GetIndexPartitionThreshold(),
+		ColumnFamilyID:          cfID,
+		ColumnFamilyName:        cfName,
+		FilterPrefix:            newIFilter(opt).prefixName(),
+	}
+}
+
+// GetPrefixExtractor 没有设置时返回nil, 不加入prefix
+func (opt *Options) GetPrefixExtractor() filter.PrefixExtractor {
+	if opt == nil {
+		return nil
+	}
+	return opt.PrefixExtractor
+}
+
+func (opt *Options) GetJournalRetentionTTL() time.Duration {
+	if opt == nil {
+		return 0
+	}
+	return opt.JournalRetentionTTL
+}
+
+func (opt *Options) GetJournalRetentionSize() int64 {
+	if opt == nil {
+		return 0
+	}
+	return opt.JournalRetentionSize
+}
+
+func (opt *Options) GetTxnLockTimeout() time.Duration {
+	if opt == nil || opt.TxnLockTimeout == 0 {
+		return defaultTxnLockTimeout
+	}
+	return opt.TxnLockTimeout
+}
+
+func (opt *Options) GetTxnLockStripes() int {
+	if opt == nil || opt.TxnLockStripes <= 0 {
+		return defaultTxnLockStripes
+	}
+	return opt.TxnLockStripes
+}
+
+func (opt *Options) GetBlobMinValueSize() int {
+	if opt == nil || opt.BlobMinValueSize <= 0 {
+		return 0
+	}
+	return opt.BlobMinValueSize
+}
+
+func (opt *Options) GetBlobFileSize() int64 {
+	if opt == nil || opt.BlobFileSize <= 0 {
+		return defaultBlobFileSize
+	}
+	return opt.BlobFileSize
+}
+
+func (opt *Options) GetBlobGCRatio() float64 {
+	if opt == nil || opt.BlobGCRatio <= 0 {
+		return defaultBlobGCRatio
+	}
+	return opt.BlobGCRatio
+}
+
+func (opt *Options) GetMultiGetParallelism() int {
+	if opt == nil || opt.MultiGetParallelism < 1 {
+		return 1
+	}
+	return opt.MultiGetParallelism
+}
+
+func (opt *Options) GetBlockCacheCapacity() int64 {
+	if opt == nil || opt.BlockCacheCapacity <= 0 {
+		return defaultBlockCacheCapacity
+	}
+	return opt.BlockCacheCapacity
+}
+
+func (opt *Options) GetBlockCachePolicy() collections.CachePolicy {
+	if opt == nil {
+		return collections.CachePolicyLRU
+	}
+	return opt.BlockCachePolicy
+}
+
+func (opt *Options) GetWriteBufferManager() *WriteBufferManager {
+	if opt == nil {
+		return nil
+	}
+	return opt.WriteBufferManager
+}
+
+func (opt *Options) GetPinIndexAndFilterBlocks() PinningTier {
+	if opt == nil {
+		return PinningTierNone
+	}
+	return opt.PinIndexAndFilterBlocks
+}
+
+func (opt *Options) GetOpenFilesCacheCapacity() int {
+	if opt == nil || opt.OpenFilesCacheCapacity <= 0 {
+		return defaultOpenFilesCacheCapacity
+	}
+	return opt.OpenFilesCacheCapacity
+}
+
+func (opt *Options) GetCacheShardBits() int {
+	if opt == nil || opt.CacheShardBits == 0 {
+		return defaultCacheShardBits
+	}
+	if opt.CacheShardBits < 0 {
+		return 0
+	}
+	return opt.CacheShardBits
+}
+
+// GetBlockCache 没有设置时返回nil, 使用db自己的block cache
+func (opt *Options) GetBlockCache() cache.Cache {
+	if opt == nil {
+		return nil
+	}
+	return opt.BlockCache
+}
+
+// GetOpenFilesCache 没有设置时返回nil, 使用db自己的文件缓存
+func (opt *Options) GetOpenFilesCache() cache.Cache {
+	if opt == nil {
+		return nil
+	}
+	return opt.OpenFilesCache
+}
+
+func (opt *Options) GetColumnFamilyOptions(name string) *Options {
+	if opt == nil || opt.ColumnFamilies == nil {
+		return nil
+	}
+	return opt.ColumnFamilies[name]
+}
+
 func (opt *Options) GetCompactionLimit() int64 {
 	return defaultCompactionLimitFiles * defaultSStableFileSize
 }
@@ -88,11 +392,114 @@ func (opt *Options) GetTableFileSize() int {
 	return defaultSStableFileSize
 }
 
+// GetLevel0TriggerLen level0文件数超过该值时需要compaction, 小于暂停写入的阈值, 暂停写入时compaction总是可以开始
 func (opt *Options) GetLevel0TriggerLen() int {
-	return defaultPauseTrigger
+	trigger := opt.GetLevel0StopWritesTrigger() - 1
+	if trigger > defaultPauseTrigger {
+		trigger = defaultPauseTrigger
+	}
+	if trigger < 1 {
+		return 1
+	}
+	return trigger
+}
+
+func (opt *Options) GetLevel0SlowdownWritesTrigger() int {
+	if opt == nil || opt.Level0SlowdownWritesTrigger <= 0 {
+		return defaultSlowDownTrigger
+	}
+	return opt.Level0SlowdownWritesTrigger
+}
+
+// GetLevel0StopWritesTrigger 不小于开始限速的阈值
+func (opt *Options) GetLevel0StopWritesTrigger() int {
+	stop := defaultPauseTrigger
+	if opt != nil && opt.Level0StopWritesTrigger > 0 {
+		stop = opt.Level0StopWritesTrigger
+	}
+	if slow := opt.GetLevel0SlowdownWritesTrigger(); stop < slow {
+		return slow
+	}
+	return stop
+}
+
+// GetSoftPendingCompactionBytesLimit 返回0时不限制
+func (opt *Options) GetSoftPendingCompactionBytesLimit() int64 {
+	if opt == nil || opt.SoftPendingCompactionBytesLimit == 0 {
+		return defaultSoftPendingCompactionBytes
+	}
+	if opt.SoftPendingCompactionBytesLimit < 0 {
+		return 0
+	}
+	return opt.SoftPendingCompactionBytesLimit
+}
+
+// GetHardPendingCompactionBytesLimit 返回0时不限制
+func (opt *Options) GetHardPendingCompactionBytesLimit() int64 {
+	if opt == nil || opt.HardPendingCompactionBytesLimit == 0 {
+		return defaultHardPendingCompactionBytes
+	}
+	if opt.HardPendingCompactionBytesLimit < 0 {
+		return 0
+	}
+	return opt.HardPendingCompactionBytesLimit
+}
+
+func (opt *Options) GetDelayedWriteRate() int64 {
+	if opt == nil || opt.DelayedWriteRate <= 0 {
+		return defaultDelayedWriteRate
+	}
+	if opt.DelayedWriteRate < minDelayedWriteRate {
+		return minDelayedWriteRate
+	}
+	return opt.DelayedWriteRate
+}
+
+func (opt *Options) GetNoSlowdown() bool {
+	if opt == nil {
+		return false
+	}
+	return opt.NoSlowdown
+}
+
+func (opt *Options) GetOnWriteStall() func(info WriteStallInfo) {
+	if opt == nil {
+		return nil
+	}
+	return opt.OnWriteStall
 }
 
 func (opt *Options) GetCompactionSizeLevel(level int) int64 {
 	multer := math.Pow(defaultCompactionTotalSizeMulter, float64(level))
 	return int64(multer) * defaultLevelTotalSize
 }
+
+// IterOptions iterator相关的选项
+type IterOptions struct {
+	LowerBound []byte // 遍历的下界(包含), 为nil时不限制
+	UpperBound []byte // 遍历的上界(不包含), 为nil时不限制
+
+	// 读取的block不加入block cache, 只使用已经在缓存中的block, 用于大范围扫描, 避免把热点block挤出缓存
+	DontFillCache bool
+}
+
+func (opt *IterOptions) GetLowerBound() []byte {
+	if opt == nil {
+		return nil
+	}
+	return opt.LowerBound
+}
+
+func (opt *IterOptions) GetUpperBound() []byte {
+	if opt == nil {
+		return nil
+	}
+	return opt.UpperBound
+}
+
+func (opt *IterOptions) GetDontFillCache() bool {
+	if opt == nil {
+		return false
+	}
+	return opt.DontFillCache
+}
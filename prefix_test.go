@@ -0,0 +1,86 @@
+package myleveldb
+
+import (
+	"fmt"
+	"myleveldb/filter"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_PrefixIterator(t *testing.T) {
+
+	dir := t.TempDir()
+	opt := &Options{WriteBuffer: 16 << 10, PrefixExtractor: filter.FixedPrefix(4)}
+	pkey := func(p, i int) []byte {
+		return []byte(fmt.Sprintf("p%03d-%04d", p, i))
+	}
+
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	// 偶数prefix, 每个prefix下100个key, 分散在多个sstable中
+	for p := 0; p < 20; p += 2 {
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(pkey(p, i), testValue(i, 64)))
+		}
+	}
+	assert.Nil(t, db.Put([]byte("p"), []byte("short")))
+	assert.Nil(t, db.CompactRange(nil, nil))
+	// memdb中的key同样按照prefix遍历
+	assert.Nil(t, db.Put(pkey(6, 100), testValue(100, 64)))
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, opt)
+	it := db.NewPrefixIterator(nil)
+	defer it.UnRef()
+
+	n := 0
+	for ok := it.Seek([]byte("p006")); ok; ok = it.Next() {
+		assert.Equal(t, pkey(6, n), it.Key())
+		assert.Equal(t, testValue(n, 64), it.Value())
+		n++
+	}
+	assert.Equal(t, 101, n)
+
+	// 从prefix中间开始
+	n = 50
+	for ok := it.Seek(pkey(10, 50)); ok; ok = it.Next() {
+		assert.Equal(t, pkey(10, n), it.Key())
+		n++
+	}
+	assert.Equal(t, 100, n)
+
+	// 不存在的prefix
+	assert.False(t, it.Seek([]byte("p007")))
+	assert.False(t, it.Seek([]byte("p099")))
+
+	// 不存在prefix的key以及First遍历所有的key
+	assert.True(t, it.Seek([]byte("p")))
+	assert.Equal(t, []byte("p"), it.Key())
+	n = 0
+	for ok := it.First(); ok; ok = it.Next() {
+		n++
+	}
+	assert.Equal(t, 10*100+2, n)
+}
+
+func TestDB_PrefixExtractorFilterCompatibility(t *testing.T) {
+
+	const n = 10000
+	plain := &Options{WriteBuffer: 1 << 20}
+	prefixed := &Options{WriteBuffer: 1 << 20, PrefixExtractor: filter.FixedPrefix(7)}
+
+	// 没有加入prefix的sstable, 设置PrefixExtractor之后点查仍然使用filter, prefix模式不会跳过这些sstable
+	db := testTableReads(t, t.TempDir(), plain, prefixed, n)
+	it := db.NewPrefixIterator(nil)
+	count := 0
+	for ok := it.Seek([]byte("key0001")); ok; ok = it.Next() {
+		assert.Equal(t, testKey(100+count*2), it.Key())
+		count++
+	}
+	it.UnRef()
+	assert.Equal(t, 50, count)
+
+	// 加入了prefix的sstable, 去掉PrefixExtractor之后点查仍然使用filter
+	testTableReads(t, t.TempDir(), prefixed, plain, n)
+}
@@ -29,18 +29,25 @@ type Session struct {
 	stor storage.Storage // 存储
 	vmu  sync.Mutex
 
-	icmp *iComparer
+	icmp *iComparer // default family的comparer
+
+	// column family相关, 每个family有自己当前正在使用的版本
+	cfMu        sync.RWMutex
+	families    map[uint32]*ColumnFamily
+	defaultCf   *ColumnFamily
+	maxFamilyID uint32 // 已经分配过的最大family id, 被删除的id不会被重新使用
 
 	// version 相关(mvcc)
-	stVersion   *Version // 当前正在使用的版本
-	ntVersionId int64    // 下一个版本号码
+	ntVersionId int64 // 下一个版本号码
 
 	// version引用相关
 	versionRefCh   chan *VersionRef
 	versionDeltaCh chan *VersionDelta
 	versionRelCh   chan *VersionRelease
+	closeC         chan struct{} // 关闭后refLoop退出, 之后version的引用变化不再发送
 
 	// manifest相关
+	commitMu       sync.Mutex // 串行化sessionRecord的提交
 	manifestFd     storage.FileDesc
 	manifestWriter storage.Writer
 	manifest       *journal.Writer
@@ -54,8 +61,6 @@ type Session struct {
 
 	// 选项
 	*Options
-
-	compactPtrs []internalKey // 每一个level被compact的最大值
 }
 
 // 打开存储, 获得session
@@ -70,63 +75,58 @@ func newSession(stor storage.Storage, opt *Options) (*Session, error) {
 		versionRefCh:   make(chan *VersionRef),
 		versionDeltaCh: make(chan *VersionDelta),
 		versionRelCh:   make(chan *VersionRelease),
+		closeC:         make(chan struct{}),
+		stNextFileNum:  1, // 文件号码从1开始, 0代表无效的文件
 	}
 
 	s.dupOptions(opt)
+	s.tableOpts = newTableOperation(s)
+	s.defaultCf = s.newColumnFamily(defaultColumnFamilyID, defaultColumnFamilyName, opt)
+	s.families = map[uint32]*ColumnFamily{defaultColumnFamilyID: s.defaultCf}
 	go s.refLoop()
-	s.setVersion(nil, s.newVersion())
+	s.defaultCf.setVersion(nil, s.newFamilyVersion(s.defaultCf))
 	return s, nil
 }
 
-func (s *Session) setVersion(sessionRecord *SessionRecord, newVer *Version) {
-	s.vmu.Lock()
-	defer s.vmu.Unlock()
-	newVer.incRef()
-
-	if s.stVersion != nil {
-		if sessionRecord != nil {
-			s.stVersion.delta(sessionRecord)
-		}
-		s.stVersion.unRef()
-	}
-	s.stVersion = newVer
-
-}
-
-// note 使用前需要上锁
+// note 使用前需要上锁, 保证获取到的version还没有被替换释放
 func (v *Version) incRef() {
 
 	if v.released {
 		panic(fmt.Errorf("version, id=%d, has been released", v.id))
 	}
-	v.ref++
-	if v.ref == 1 {
-		v.session.versionRefCh <- &VersionRef{
+	if atomic.AddInt64(&v.ref, 1) == 1 {
+		select {
+		case v.session.versionRefCh <- &VersionRef{
 			vid:        v.id,
 			files:      v.levels,
 			createTime: time.Now(),
+		}:
+		case <-v.session.closeC:
 		}
 	}
 
 }
 
-// note 使用前需要上锁
+// 引用计数是原子的, 读取, 写入以及compaction可以不上锁各自释放持有的version
 func (v *Version) unRef() {
 
 	if v.released {
 		panic(fmt.Errorf("version, id=%d, has been released", v.id))
 	}
 
-	v.ref--
+	ref := atomic.AddInt64(&v.ref, -1)
 
-	if v.ref < 0 {
+	if ref < 0 {
 		panic(fmt.Errorf("version, id=%d, ref negative ", v.id))
 	}
 
-	if v.ref == 0 {
-		v.session.versionRelCh <- &VersionRelease{
+	if ref == 0 {
+		select {
+		case v.session.versionRelCh <- &VersionRelease{
 			vid:   v.id,
 			files: v.levels,
+		}:
+		case <-v.session.closeC:
 		}
 	}
 
@@ -137,30 +137,34 @@ func (v *Version) delta(sessionRecord *SessionRecord) {
 	added := make([]int64, 0, len(sessionRecord.atRecords))
 	del := make([]int64, 0, len(sessionRecord.dlRecords))
 
-	for _, v := range sessionRecord.atRecords {
-		added = append(added, int64(v.num))
+	for _, r := range sessionRecord.atRecords {
+		if r.cf == v.cf.id {
+			added = append(added, int64(r.num))
+		}
 	}
 
-	for _, v := range sessionRecord.dlRecords {
-		del = append(del, int64(v.num))
+	for _, r := range sessionRecord.dlRecords {
+		if r.cf == v.cf.id {
+			del = append(del, int64(r.num))
+		}
 	}
 
-	v.session.versionDeltaCh <- &VersionDelta{
+	select {
+	case v.session.versionDeltaCh <- &VersionDelta{
 		vid:     v.id,
 		added:   added,
 		deleted: del,
+	}:
+	case <-v.session.closeC:
 	}
 }
 
-func (s *Session) newVersion() *Version {
-
-	s.vmu.Lock()
-	defer s.vmu.Unlock()
-	versionId := s.ntVersionId
-	s.ntVersionId = versionId + 1
+func (s *Session) newFamilyVersion(cf *ColumnFamily) *Version {
+	versionId := atomic.AddInt64(&s.ntVersionId, 1)
 	return &Version{
-		id:      versionId,
+		id:      versionId - 1,
 		session: s,
+		cf:      cf,
 	}
 }
 
@@ -175,11 +179,14 @@ func (s *Session) recover() (err error) {
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
 	var (
-		sessionRecord  = &SessionRecord{}
-		journalReader  = journal.NewReader(reader)
-		versionStaging = s.stVersion.newVersionStaging()
+		sessionRecord = &SessionRecord{}
+		journalReader = journal.NewReader(reader)
+		families      = map[uint32]*ColumnFamily{defaultColumnFamilyID: s.defaultCf}
+		stagings      = map[uint32]*VersionStaging{defaultColumnFamilyID: s.defaultCf.emptyVersion().newVersionStaging()}
+		comparers     = map[uint32]string{} // 创建family时记录的comparer名称
 	)
 
 	for {
@@ -189,16 +196,38 @@ func (s *Session) recover() (err error) {
 			break
 		}
 
+		if err != nil {
+			return err
+		}
+
 		err = sessionRecord.decode(bufio.NewReader(chunkReader))
 		if err != nil {
-			return
+			return err
 		}
 
-		versionStaging.commit(sessionRecord)
+		// 同一个record中先创建family, 再应用sstable的增删, 最后删除family
+		for _, f := range sessionRecord.addedFamilies {
+			cf := s.newColumnFamily(f.id, f.name, s.Options.GetColumnFamilyOptions(f.name))
+			families[f.id] = cf
+			comparers[f.id] = f.comparer
+			stagings[f.id] = cf.emptyVersion().newVersionStaging()
+			s.markFamilyID(f.id)
+		}
+
+		for _, staging := range stagings {
+			staging.commit(sessionRecord)
+		}
+
+		for _, id := range sessionRecord.droppedFamilies {
+			delete(families, id)
+			delete(stagings, id)
+		}
 
 		sessionRecord.resetAddRecord()
 		sessionRecord.resetDelRecord()
 		sessionRecord.resetCompatPtr()
+		sessionRecord.resetFamilyRecord()
+		sessionRecord.resetBlobRecord()
 
 	}
 
@@ -213,8 +242,45 @@ func (s *Session) recover() (err error) {
 		return error2.NewErrCorrupted(fd, "manifest lack recJournalNum")
 	}
 
-	s.setVersion(sessionRecord, versionStaging.finish())
+	// 旧版本的manifest中comparer的名称为空, 不做检查
+	if name := string(sessionRecord.comparer); name != "" && name != s.icmp.Name() {
+		return error2.NewErrComparerMismatch(name, s.icmp.Name())
+	}
+
+	// 其他family的comparer由Options.ColumnFamilies指定, 已经删除的family不检查
+	for id, cf := range families {
+		if name := comparers[id]; name != "" && name != cf.icmp.Name() {
+			return error2.NewErrComparerMismatch(name, cf.icmp.Name())
+		}
+	}
+
+	if sessionRecord.hasField(recMaxColumnFamily) {
+		s.markFamilyID(sessionRecord.maxColumnFamily)
+	}
+
+	// refLoop沿着version的delta链计算文件引用, 每个family的链从空的version开始,
+	// 恢复的sstable作为空version的delta加入, 之后删除这些文件时引用才不会变为负数
+	for id, staging := range stagings {
+		cf := families[id]
+		if cf.stVersion == nil {
+			cf.setVersion(nil, s.newFamilyVersion(cf))
+		}
+		nv := staging.finish()
+		rec := &SessionRecord{}
+		for level, tables := range nv.levels {
+			for _, t := range tables {
+				rec.addTableFile(id, level, t)
+			}
+		}
+		cf.setVersion(rec, nv)
+	}
+
+	s.cfMu.Lock()
+	s.families = families
+	s.cfMu.Unlock()
+
 	s.SetNextFileNum(sessionRecord.nextFileNum)
+	s.manifestFd = fd // 新的manifest创建成功后删除旧的
 	s.commitRecord(sessionRecord)
 	return
 }
@@ -226,11 +292,11 @@ func (s *Session) SetNextFileNum(nextFileNum int64) {
 func (s *Session) commitRecord(sessionRecord *SessionRecord) {
 
 	if sessionRecord.hasField(recSequenceNum) {
-		s.stSeqNum = recSequenceNum
+		s.stSeqNum = sessionRecord.sequenceNum
 	}
 
 	if sessionRecord.hasField(recJournalNum) {
-		s.stJournalNum = recJournalNum
+		s.stJournalNum = sessionRecord.journalNum
 	}
 
 	// todo 将compatkey记录到Session
@@ -247,26 +313,22 @@ func (s *Session) create() error {
 		return err
 	}
 
-	v := s.version()
 	sr := &SessionRecord{}
 
 	s.fillRecord(sr, true)
-	v.fillRecord(sr)
+	s.fillFamilies(sr, nil)
 
 	jw := journal.NewWriter(writer)
 
-	writerBuffer := utils.GetPoolNamespace(defaultManifestNamespace)
-	defer func() {
-		utils.PutPoolNamespace(defaultManifestNamespace, writerBuffer)
-	}()
-
-	err = sr.encode(writerBuffer)
-	if err != nil {
-		return err
+	err = writeManifestRecord(jw, sr)
+	if err == nil {
+		err = writer.Sync()
+	}
+	if err == nil {
+		err = s.stor.SetMeta(fd)
 	}
-
-	_, err = jw.Write(writerBuffer.Bytes())
 	if err != nil {
+		writer.Close()
 		return err
 	}
 
@@ -281,14 +343,7 @@ func (s *Session) loadNextNum() int64 {
 }
 
 func (s *Session) allocNextNum() int64 {
-	return atomic.AddInt64(&s.stNextFileNum, 1)
-}
-
-func (s *Session) version() *Version {
-	s.vmu.Lock()
-	defer s.vmu.Unlock()
-	s.stVersion.incRef()
-	return s.stVersion
+	return atomic.AddInt64(&s.stNextFileNum, 1) - 1
 }
 
 // 填充sessionRecord, 如果snapShot为true, 会有条件的填充sessionRecord的其他字段
@@ -303,16 +358,38 @@ func (s *Session) fillRecord(sr *SessionRecord, snapShot bool) {
 		}
 
 		if !sr.hasField(recComparer) {
-			sr.setComparer([]byte("")) //todo 填充cmpr的名称
+			sr.setComparer([]byte(s.icmp.Name()))
 		}
 
 	}
 }
 
+// 填充所有family以及它们的sstable, 用于manifest的snapshot, nvs中的version优先于family当前的version
+func (s *Session) fillFamilies(sr *SessionRecord, nvs map[uint32]*Version) {
+	sr.resetAddRecord()
+	sr.resetBlobRecord() // blob垃圾是增量, 已经包含在version中, 不能重复记录
+	for _, cf := range s.listFamilies() {
+		if cf.id != defaultColumnFamilyID {
+			sr.addColumnFamily(cf.id, cf.name, cf.icmp.Name())
+		}
+
+		if nv, ok := nvs[cf.id]; ok {
+			nv.fillRecord(sr)
+			continue
+		}
+
+		if v := cf.version(); v != nil {
+			v.fillRecord(sr)
+			v.unRef()
+		}
+	}
+	sr.setMaxColumnFamily(atomic.LoadUint32(&s.maxFamilyID))
+}
+
 func (s *Session) markFileNum(f int64) {
 
 	for {
-		old, x := atomic.LoadInt64(&s.stJournalNum), f
+		old, x := atomic.LoadInt64(&s.stNextFileNum), f
 		if old > x {
 			x = old
 		}
@@ -323,18 +400,23 @@ func (s *Session) markFileNum(f int64) {
 
 }
 
-// 将memdb的内容持久化到sstable中, 并更新sessionrecord
-func (s *Session) flushMemDb(rec *SessionRecord, memDB *memdb.MemDB) error {
+// 将family的memdb的内容持久化到sstable中, 并更新sessionrecord
+func (s *Session) flushMemDb(rec *SessionRecord, cf *ColumnFamily, memDB *memdb.MemDB) error {
 	iter := memDB.NewIterator()
 	defer iter.UnRef()
 
-	// 生成sstable文件
-	tFile, err := s.tableOpts.createFrom(iter)
+	// 生成sstable文件, 开启kv分离时较大的value写入blob文件
+	bw := newBlobWriter(cf)
+	tFile, err := cf.tableOpts.createFrom(iter, bw)
+	if err == nil {
+		err = bw.finish(rec)
+	}
 	if err != nil {
+		bw.abort()
 		return err
 	}
 
-	rec.addTableFile(0, *tFile)
+	rec.addTableFile(cf.id, 0, *tFile)
 
 	return nil
 }
@@ -342,17 +424,30 @@ func (s *Session) flushMemDb(rec *SessionRecord, memDB *memdb.MemDB) error {
 // 将rec更新到manifest文件, 并更新session相应的version
 func (s *Session) commit(rec *SessionRecord) error {
 
-	v := s.version()
-	defer v.unRef()
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
 
-	staging := v.newVersionStaging()
-	staging.commit(rec)
-	nv := staging.finish() // 产生新的version
+	// 为rec中有sstable变化的family产生新的version
+	nvs := make(map[uint32]*Version)
+	for _, id := range rec.touchedFamilies() {
+		cf := s.getFamily(id)
+		if cf == nil { // family已经被删除
+			continue
+		}
+		v := cf.version()
+		if v == nil {
+			continue
+		}
+		staging := v.newVersionStaging()
+		staging.commit(rec)
+		nvs[id] = staging.finish()
+		v.unRef()
+	}
 
 	var err error
 
 	if s.manifest == nil { // todo 判断manifest文件的大小超过一定限制就启用新的文件
-		err = s.newManifest(rec, nv)
+		err = s.newManifest(rec, nvs)
 	} else {
 		err = s.flushManifest(rec)
 	}
@@ -362,21 +457,22 @@ func (s *Session) commit(rec *SessionRecord) error {
 	}
 
 	// 更新或者写进去manifest成功后, 更新session
-	s.setVersion(rec, nv)
+	for _, nv := range nvs {
+		nv.cf.setVersion(rec, nv)
+	}
 	return nil
 }
 
 func (s *Session) flushManifest(rec *SessionRecord) error {
 
-	writer := s.manifestWriter
 	s.fillRecord(rec, false)
 
-	err := rec.encode(writer)
+	err := writeManifestRecord(s.manifest, rec)
 	if err != nil {
 		return err
 	}
 
-	err = writer.Sync()
+	err = s.manifestWriter.Sync()
 	if err != nil {
 		return err
 	}
@@ -386,7 +482,7 @@ func (s *Session) flushManifest(rec *SessionRecord) error {
 	return nil
 }
 
-func (s *Session) newManifest(rec *SessionRecord, nv *Version) (err error) {
+func (s *Session) newManifest(rec *SessionRecord, nvs map[uint32]*Version) (err error) {
 
 	fd := storage.FileDesc{Type: storage.FileTypeManifest, Num: int(s.allocNextNum())}
 
@@ -396,7 +492,7 @@ func (s *Session) newManifest(rec *SessionRecord, nv *Version) (err error) {
 	}
 
 	s.fillRecord(rec, true)
-	nv.fillRecord(rec)
+	s.fillFamilies(rec, nvs)
 	manifest := journal.NewWriter(writer)
 
 	defer func() {
@@ -415,7 +511,7 @@ func (s *Session) newManifest(rec *SessionRecord, nv *Version) (err error) {
 		}
 	}()
 
-	err = rec.encode(manifest)
+	err = writeManifestRecord(manifest, rec)
 	if err != nil {
 		return err
 	}
@@ -436,18 +532,44 @@ func (s *Session) newManifest(rec *SessionRecord, nv *Version) (err error) {
 
 }
 
+// 一条sessionRecord需要作为一个完整的chunk写入manifest, 否则recover时无法按chunk解析
+func writeManifestRecord(manifest *journal.Writer, rec *SessionRecord) error {
+
+	writerBuffer := utils.GetPoolNamespace(defaultManifestNamespace)
+	defer func() {
+		utils.PutPoolNamespace(defaultManifestNamespace, writerBuffer)
+	}()
+
+	err := rec.encode(writerBuffer)
+	if err != nil {
+		return err
+	}
+
+	_, err = manifest.Write(writerBuffer.Bytes())
+	return err
+}
+
 func (s *Session) dupOptions(opt *Options) {
 	s.Options = opt
 
 	s.icmp = &iComparer{s.Options.GetCompare()}
+	s.iFilter = newIFilter(s.Options)
 
 }
 
-func (s *Session) tLen(n int) int {
-	s.vmu.Lock()
-	defer s.vmu.Unlock()
-	v := s.stVersion
-	v.incRef()
-	defer v.unRef()
-	return s.stVersion.tLen(n)
+// 关闭manifest和存储, 调用前需要保证没有正在进行的compaction
+// 关闭manifest, 停止refLoop, 释放存储的文件锁, 只能调用一次
+func (s *Session) close() error {
+
+	close(s.closeC)
+
+	if s.manifestWriter != nil {
+		s.manifestWriter.Close()
+		s.manifestWriter = nil
+		s.manifest = nil
+	}
+
+	s.tableOpts.close()
+
+	return s.stor.Close()
 }
@@ -25,42 +25,89 @@ pickCompaction
 
 */
 
+// 从所有family中选出cScore最高并且大于等于1的version做compaction
 func (s *Session) pickCompaction() *Compaction {
 
-	v := s.version()
-
-	var sourceLevel int
-
-	if v.cScore >= 1 {
-		sourceLevel = v.cLevel
-		vtf0 := v.levels[sourceLevel]
-		var tf0 tFiles
-		if sourceLevel >= 1 {
-			ptr := s.getCompactPtr(sourceLevel)
-			if ptr != nil {
-				if idx := sort.Search(len(vtf0), func(i int) bool {
-					if s.icmp.Compare(vtf0[i].max, ptr) > 0 {
-						return true
-					}
-					return false
-				}); idx < len(vtf0) {
-					tf0 = append(tf0, vtf0[idx])
-				}
+	var v *Version
+	for _, cf := range s.listFamilies() {
+		cv := cf.version()
+		if cv == nil {
+			continue
+		}
+		if cv.cScore >= 1 && (v == nil || cv.cScore > v.cScore) {
+			if v != nil {
+				v.unRef()
 			}
+			v = cv
+			continue
 		}
+		cv.unRef()
+	}
+
+	if v == nil {
+		return nil
+	}
 
-		if len(tf0) == 0 {
-			tf0 = append(tf0, vtf0[0])
+	cf := v.cf
+	sourceLevel := v.cLevel
+	vtf0 := v.levels[sourceLevel]
+	var tf0 tFiles
+	if sourceLevel >= 1 {
+		ptr := cf.getCompactPtr(sourceLevel)
+		if ptr != nil {
+			if idx := sort.Search(len(vtf0), func(i int) bool {
+				if cf.icmp.Compare(vtf0[i].max, ptr) > 0 {
+					return true
+				}
+				return false
+			}); idx < len(vtf0) {
+				tf0 = append(tf0, vtf0[idx])
+			}
 		}
-		return newCompaction(s, v, sourceLevel, tf0)
 	}
 
-	return nil
+	if len(tf0) == 0 {
+		tf0 = append(tf0, vtf0[0])
+	}
+	return newCompaction(s, v, sourceLevel, tf0)
 
 }
 
+// getCompactionRange 获取family的level中跟[umin, umax]重叠的sstable, umin或者umax为nil时代表不限制
+func (s *Session) getCompactionRange(cf *ColumnFamily, level int, umin, umax []byte) *Compaction {
+
+	v := cf.version()
+	if v == nil {
+		return nil
+	}
+
+	if level >= len(v.levels) || len(v.levels[level]) == 0 {
+		v.unRef()
+		return nil
+	}
+
+	tables := v.levels[level]
+
+	imin, imax := tables.getRange(cf.icmp)
+	if umin == nil {
+		umin = imin.uKey()
+	}
+	if umax == nil {
+		umax = imax.uKey()
+	}
+
+	tf0 := tables.getOverlaps(cf.icmp, umin, umax, level == 0)
+	if len(tf0) == 0 {
+		v.unRef()
+		return nil
+	}
+
+	return newCompaction(s, v, level, tf0)
+}
+
 type Compaction struct {
 	s                 *Session
+	cf                *ColumnFamily
 	v                 *Version
 	sourceLevel       int
 	levels            [2]tFiles
@@ -71,30 +118,32 @@ type Compaction struct {
 	gpOverlappedBytes int64 // 当前compaction新文件跟gp存在重叠的总大小
 	maxGpOverlapped   int64 // 当前compaction新文件跟gp存在重叠的最大限制
 	levelPtrs         []int //
+
+	// blob相关, 指向relocate中blob文件的blob index, 需要把value迁移到新的blob文件中
+	relocate     map[int64]struct{}
+	forceRewrite bool // 不允许直接移动sstable, 保证所有的blob index都被检查
 }
 
 func newCompaction(s *Session, v *Version, sourceLevel int, vtf0 tFiles) *Compaction {
 	c := &Compaction{
 		s:           s,
+		cf:          v.cf,
 		v:           v,
 		sourceLevel: sourceLevel,
 		levels:      [2]tFiles{vtf0, nil},
 		levelPtrs:   make([]int, len(v.levels)),
+
+		maxGpOverlapped: int64(v.cf.opt.GetTableFileSize()) * defaultGpOverlappedMulter,
+
+		relocate: v.blobs.selectGC(v.cf.opt.GetBlobGCRatio()),
 	}
 	c.expand()
 	return c
 }
 
-func (s *Session) getCompactPtr(level int) internalKey {
-	if level >= len(s.compactPtrs) {
-		return nil
-	}
-	return s.compactPtrs[level]
-}
-
 func (c *Compaction) expand() {
 
-	compactionLimit := c.s.Options.GetCompactionLimit()
+	compactionLimit := c.cf.opt.GetCompactionLimit()
 
 	sourceLevel := c.sourceLevel
 
@@ -107,39 +156,39 @@ func (c *Compaction) expand() {
 	tf0, tf1 := c.levels[0], c.levels[1]
 
 	// 先获取t0的min和max区间
-	imin, imax := tf0.getRange(c.s.icmp)
+	imin, imax := tf0.getRange(c.cf.icmp)
 
 	// 如果input是level0的话, 需要扩大input文件, 因为leveldb规定了level0层所有文件key可以重叠
 	if sourceLevel == 0 {
 		// 重新推算level0的input
-		tf0 = vt0.getOverlaps(c.s.icmp, imin.uKey(), imax.uKey(), sourceLevel == 0)
+		tf0 = vt0.getOverlaps(c.cf.icmp, imin.uKey(), imax.uKey(), sourceLevel == 0)
 		// 重新计算出imin和imax
-		imin, imax = tf0.getRange(c.s.icmp)
+		imin, imax = tf0.getRange(c.cf.icmp)
 	}
 
 	// 根据imin和imax计算出
-	tf1 = vt1.getOverlaps(c.s.icmp, imin.uKey(), imax.uKey(), false)
+	tf1 = vt1.getOverlaps(c.cf.icmp, imin.uKey(), imax.uKey(), false)
 
-	amin, amax := append(tf0, tf1...).getRange(c.s.icmp)
+	amin, amax := append(tf0, tf1...).getRange(c.cf.icmp)
 
 	// 扩大input
 	if len(tf1) > 0 {
-		exp0 := vt0.getOverlaps(c.s.icmp, amin.uKey(), amax.uKey(), true)
+		exp0 := vt0.getOverlaps(c.cf.icmp, amin.uKey(), amax.uKey(), true)
 		if len(exp0) > len(tf0) && exp0.size()+tf1.size() < compactionLimit { // 确认可以扩大输入
-			xmin, xmax := exp0.getRange(c.s.icmp)
+			xmin, xmax := exp0.getRange(c.cf.icmp)
 			// 重新确认下tf1会不会发生改变
-			exp1 := vt1.getOverlaps(c.s.icmp, imin.uKey(), imax.uKey(), true)
+			exp1 := vt1.getOverlaps(c.cf.icmp, imin.uKey(), imax.uKey(), false)
 			if len(exp1) == len(tf1) {
 				imin, imax = xmin, xmax
-				amin, amax = append(exp0, exp1...).getRange(c.s.icmp)
+				amin, amax = append(exp0, exp1...).getRange(c.cf.icmp)
 				tf0 = exp0
 			}
 		}
 	}
 
 	// 记录合并后跟level+2重叠的sstable文件
-	if level := sourceLevel + 2; level < len(c.levels) {
-		c.gp = c.levels[level].getOverlaps(c.s.icmp, amin.uKey(), amax.uKey(), false)
+	if level := sourceLevel + 2; level < len(c.v.levels) {
+		c.gp = c.v.levels[level].getOverlaps(c.cf.icmp, amin.uKey(), amax.uKey(), false)
 	}
 
 	c.imin, c.imax = imin, imax
@@ -163,18 +212,18 @@ func (c *Compaction) newIterator(so *sstableOperation) iter.Iterator {
 			icap = append(icap, iter.NewIndexedIterator(iter.NewArrayIndexer(tFileArrayIndexer{
 				tfs:  level,
 				top:  so,
-				icmp: so.s.icmp,
+				icmp: so.icmp,
 			})))
 		}
 	}
 
-	return iter.NewMergedIterator(icap)
+	return iter.NewMergedIterator(icap, so.icmp)
 
 }
 
 func (c *Compaction) trivial() bool {
 
-	if len(c.levels[0]) == 1 && len(c.levels[1]) == 0 && len(c.gp) < c.s.Options.GetCompactionTrivialGpFiles() {
+	if !c.forceRewrite && len(c.levels[0]) == 1 && len(c.levels[1]) == 0 && len(c.gp) < c.cf.opt.GetCompactionTrivialGpFiles() {
 		return true
 	}
 
@@ -194,7 +243,7 @@ func (c *Compaction) shouldStopBefore(ikey internalKey) bool {
 	for ; c.gpi < len(c.gp); c.gpi++ {
 		gp := c.gp[c.gpi]
 		// 说明当前key正好跟下一层的重叠又产生一个
-		if c.s.icmp.Compare(ikey, gp.max) > 0 {
+		if c.cf.icmp.Compare(ikey, gp.max) > 0 {
 			if c.seenKey {
 				c.gpOverlappedBytes += c.gp[c.gpi].size
 			}
@@ -222,11 +271,10 @@ func (c *Compaction) restore() {
 func (c *Compaction) isBaseLevelForKey(ukey []byte) bool {
 
 	for level := c.sourceLevel + 2; level < len(c.v.levels); level++ {
-		ptr := c.levelPtrs[level]
 		l := c.v.levels[level]
-		for ptr < len(l) {
-			if c.s.icmp.uCompare(l[ptr].max.uKey(), ukey) >= 0 {
-				if c.s.icmp.uCompare(l[ptr].min.uKey(), ukey) <= 0 { // 存在重叠, 不能自增, 因为下一个key可能也重叠
+		for ptr := c.levelPtrs[level]; ptr < len(l); ptr = c.levelPtrs[level] {
+			if c.cf.icmp.uCompare(l[ptr].max.uKey(), ukey) >= 0 {
+				if c.cf.icmp.uCompare(l[ptr].min.uKey(), ukey) <= 0 { // 存在重叠, 不能自增, 因为下一个key可能也重叠
 					return false
 				}
 				break
@@ -237,6 +285,17 @@ func (c *Compaction) isBaseLevelForKey(ukey []byte) bool {
 	return true
 }
 
+// 强制迁移垃圾比例大于等于ratio的blob文件中的live value
+func (c *Compaction) collectBlobGarbage(ratio float64) {
+	c.relocate = c.v.blobs.selectGC(ratio)
+	c.forceRewrite = len(c.relocate) > 0
+}
+
+func (c *Compaction) shouldRelocate(num int64) bool {
+	_, ok := c.relocate[num]
+	return ok
+}
+
 func (c *Compaction) UnRef() {
 	c.v.unRef()
 }
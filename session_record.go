@@ -102,6 +102,57 @@ key类型: varint
 value: int
 value类型: varint
 
+10-14, column family相关, default family(id为0)的sstable仍然使用6和7, 其他family使用12和13
+
+*新增column family
+key: 10
+key类型: varint
+value: varint family id + []byte family名称
+
+*删除column family
+key: 11
+key类型: varint
+value: family id
+value类型: varint
+
+*family对应的ldb删除文件的编号
+key: 12
+key类型: varint
+value: varint family id + dlRecord
+
+*family对应的ldb新增文件
+key: 13
+key类型: varint
+value: varint family id + atRecord
+
+*已经分配过的最大family id
+key: 14
+key类型: varint
+value: family id
+value类型: varint
+
+15-16, kv分离的blob文件
+
+*family新增的blob文件
+key: 15
+key类型: varint
+value: varint family id + varint num + varint blob数量 + varint value总大小
+
+*family的blob文件新增的垃圾, 多条记录累加
+key: 16
+key类型: varint
+value: varint family id + varint num + varint 垃圾blob数量 + varint 垃圾value大小
+
+*family的comparer名称, 紧跟在新增column family之后, 旧版本的manifest中没有该记录
+key: 17
+key类型: varint
+value: varint family id + []byte comparer名称
+
+*导入的外部sstable的全局seq, 紧跟在新增文件(7或者13)之后, 只有导入的文件有该记录
+key: 18
+key类型: varint
+value: varint family id + varint num + varint seq
+
 **/
 
 // 以下常量不能被变更, 会写入到文件系统中
@@ -114,6 +165,18 @@ const (
 	recDelRecord      = 6
 	recAddRecord      = 7
 	recPrevJournalNum = 9 // 已废弃
+
+	recAddColumnFamily  = 10
+	recDropColumnFamily = 11
+	recFamilyDelRecord  = 12
+	recFamilyAddRecord  = 13
+	recMaxColumnFamily  = 14
+
+	recAddBlobFile = 15
+	recBlobGarbage = 16
+
+	recFamilyComparer = 17
+	recTableGlobalSeq = 18
 )
 
 var (
@@ -131,15 +194,32 @@ type compactPtr struct {
 }
 
 type dlRecord struct {
+	cf    uint32
 	level int
 	num   int
 }
 
 type atRecord struct {
+	cf       uint32
 	level    int
 	num      int
 	size     int
 	min, max internalKey
+	seq      uint64 // 导入文件的全局seq, 为0时没有
+}
+
+type cfRecord struct {
+	id       uint32
+	name     string
+	comparer string // 为空时不检查
+}
+
+// blob文件新增或者垃圾的记录
+type blobRecord struct {
+	cf    uint32
+	num   int64
+	count uint64
+	size  uint64
 }
 
 // SessionRecord version edit
@@ -153,8 +233,16 @@ type SessionRecord struct {
 	dlRecords      []dlRecord
 	atRecords      []atRecord
 	prevJournalNum int64
-	scratch        [binary.MaxVarintLen64]byte
-	err            error
+
+	addedFamilies   []cfRecord
+	droppedFamilies []uint32
+	maxColumnFamily uint32
+
+	addedBlobs  []blobRecord
+	blobGarbage []blobRecord
+
+	scratch [binary.MaxVarintLen64]byte
+	err     error
 }
 
 func (p *SessionRecord) putUVarInt(writer io.Writer, u uint64) {
@@ -223,29 +311,90 @@ func (p *SessionRecord) addCompactPtr(cptr compactPtr) {
 }
 
 func (p *SessionRecord) delRecord(record dlRecord) {
-	p.hasRec |= 1 << recDelRecord
+	if record.cf == defaultColumnFamilyID {
+		p.hasRec |= 1 << recDelRecord
+	} else {
+		p.hasRec |= 1 << recFamilyDelRecord
+	}
 	p.dlRecords = append(p.dlRecords, record)
 }
 
 func (p *SessionRecord) addRecord(record atRecord) {
-	p.hasRec |= 1 << recAddRecord
+	if record.cf == defaultColumnFamilyID {
+		p.hasRec |= 1 << recAddRecord
+	} else {
+		p.hasRec |= 1 << recFamilyAddRecord
+	}
 	p.atRecords = append(p.atRecords, record)
 }
 
-func (p *SessionRecord) addTableFile(level int, file tFile) {
+func (p *SessionRecord) addColumnFamily(id uint32, name, comparer string) {
+	p.hasRec |= 1 << recAddColumnFamily
+	p.addedFamilies = append(p.addedFamilies, cfRecord{id: id, name: name, comparer: comparer})
+}
+
+func (p *SessionRecord) dropColumnFamily(id uint32) {
+	p.hasRec |= 1 << recDropColumnFamily
+	p.droppedFamilies = append(p.droppedFamilies, id)
+}
+
+func (p *SessionRecord) setMaxColumnFamily(id uint32) {
+	p.hasRec |= 1 << recMaxColumnFamily
+	p.maxColumnFamily = id
+}
+
+func (p *SessionRecord) addBlobFile(cf uint32, bf blobFile) {
+	p.hasRec |= 1 << recAddBlobFile
+	p.addedBlobs = append(p.addedBlobs, blobRecord{cf: cf, num: bf.num, count: bf.count, size: bf.size})
+}
+
+func (p *SessionRecord) addBlobGarbage(cf uint32, num int64, count, size uint64) {
+	p.hasRec |= 1 << recBlobGarbage
+	p.blobGarbage = append(p.blobGarbage, blobRecord{cf: cf, num: num, count: count, size: size})
+}
+
+// 返回有sstable或者blob文件变化的family
+func (p *SessionRecord) touchedFamilies() []uint32 {
+	var ids []uint32
+	seen := make(map[uint32]bool)
+	add := func(id uint32) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, r := range p.atRecords {
+		add(r.cf)
+	}
+	for _, r := range p.dlRecords {
+		add(r.cf)
+	}
+	for _, r := range p.addedBlobs {
+		add(r.cf)
+	}
+	for _, r := range p.blobGarbage {
+		add(r.cf)
+	}
+	return ids
+}
+
+func (p *SessionRecord) addTableFile(cf uint32, level int, file tFile) {
 
 	at := atRecord{
+		cf:    cf,
 		level: level,
 		num:   file.fd.Num,
 		size:  int(file.size),
 		min:   file.min,
 		max:   file.max,
+		seq:   file.seq,
 	}
 	p.addRecord(at)
 }
 
-func (p *SessionRecord) delTableFile(level int, file tFile) {
+func (p *SessionRecord) delTableFile(cf uint32, level int, file tFile) {
 	dl := dlRecord{
+		cf:    cf,
 		level: level,
 		num:   file.fd.Num,
 	}
@@ -253,7 +402,7 @@ func (p *SessionRecord) delTableFile(level int, file tFile) {
 }
 
 func (p *SessionRecord) hasField(rec int) bool {
-	return (p.hasRec & 1 << rec) != 0
+	return p.hasRec&(1<<rec) != 0
 }
 
 func (p *SessionRecord) encode(writer io.Writer) (err error) {
@@ -286,31 +435,91 @@ func (p *SessionRecord) encode(writer io.Writer) (err error) {
 		}
 	}
 
-	if p.hasField(recDelRecord) {
-		for _, v := range p.dlRecords {
+	if p.hasField(recMaxColumnFamily) {
+		p.putUVarInt(writer, recMaxColumnFamily)
+		p.putUVarInt(writer, uint64(p.maxColumnFamily))
+	}
+
+	// family需要在它的sstable之前创建
+	for _, v := range p.addedFamilies {
+		p.putUVarInt(writer, recAddColumnFamily)
+		p.putUVarInt(writer, uint64(v.id))
+		p.putBytes(writer, []byte(v.name))
+		if v.comparer != "" {
+			p.putUVarInt(writer, recFamilyComparer)
+			p.putUVarInt(writer, uint64(v.id))
+			p.putBytes(writer, []byte(v.comparer))
+		}
+	}
+
+	for _, v := range p.dlRecords {
+		if v.cf == defaultColumnFamilyID {
 			p.putUVarInt(writer, recDelRecord)
-			p.putVarInt(writer, int64(v.level))
-			p.putVarInt(writer, int64(v.num))
+		} else {
+			p.putUVarInt(writer, recFamilyDelRecord)
+			p.putUVarInt(writer, uint64(v.cf))
 		}
+		p.putVarInt(writer, int64(v.level))
+		p.putVarInt(writer, int64(v.num))
 	}
 
-	if p.hasField(recAddRecord) {
-		for _, v := range p.atRecords {
+	for _, v := range p.atRecords {
+		if v.cf == defaultColumnFamilyID {
 			p.putUVarInt(writer, recAddRecord)
-			p.putVarInt(writer, int64(v.level))
+		} else {
+			p.putUVarInt(writer, recFamilyAddRecord)
+			p.putUVarInt(writer, uint64(v.cf))
+		}
+		p.putVarInt(writer, int64(v.level))
+		p.putVarInt(writer, int64(v.num))
+		p.putVarInt(writer, int64(v.size))
+		p.putBytes(writer, v.min)
+		p.putBytes(writer, v.max)
+		if v.seq > 0 {
+			p.putUVarInt(writer, recTableGlobalSeq)
+			p.putUVarInt(writer, uint64(v.cf))
 			p.putVarInt(writer, int64(v.num))
-			p.putVarInt(writer, int64(v.size))
-			p.putBytes(writer, v.min)
-			p.putBytes(writer, v.max)
+			p.putUVarInt(writer, v.seq)
 		}
 	}
 
+	for _, v := range p.addedBlobs {
+		p.putUVarInt(writer, recAddBlobFile)
+		p.putBlobRecord(writer, v)
+	}
+
+	for _, v := range p.blobGarbage {
+		p.putUVarInt(writer, recBlobGarbage)
+		p.putBlobRecord(writer, v)
+	}
+
+	for _, id := range p.droppedFamilies {
+		p.putUVarInt(writer, recDropColumnFamily)
+		p.putUVarInt(writer, uint64(id))
+	}
+
 	if p.err != nil {
 		return p.err
 	}
 	return nil
 }
 
+func (p *SessionRecord) putBlobRecord(writer io.Writer, v blobRecord) {
+	p.putUVarInt(writer, uint64(v.cf))
+	p.putVarInt(writer, v.num)
+	p.putUVarInt(writer, v.count)
+	p.putUVarInt(writer, v.size)
+}
+
+func (p *SessionRecord) readBlobRecord(r Reader) blobRecord {
+	return blobRecord{
+		cf:    uint32(p.readUVarInt(r)),
+		num:   p.readVarInt(r),
+		count: p.readUVarInt(r),
+		size:  p.readUVarInt(r),
+	}
+}
+
 func (p *SessionRecord) readUVarInt(r Reader) uint64 {
 	return p.readUVarIntMayEOF(r, false)
 }
@@ -368,10 +577,14 @@ func (p *SessionRecord) readUVarIntMayEOF(r Reader, mayEOF bool) uint64 {
 
 func (p *SessionRecord) decode(r Reader) (err error) {
 
+	// recover时同一个record会被用来解析多个chunk, 上一个chunk结尾的EOF不能带到下一个chunk
+	p.err = nil
+
 	for {
 		rec := p.readUVarIntMayEOF(r, true)
 		if p.err != nil {
 			if p.err == io.EOF {
+				p.err = nil
 				return
 			}
 			return p.err
@@ -397,16 +610,25 @@ func (p *SessionRecord) decode(r Reader) (err error) {
 				cKey:   cKey,
 			})
 
-		case recDelRecord:
+		case recDelRecord, recFamilyDelRecord:
 
+			var cf uint32
+			if rec == recFamilyDelRecord {
+				cf = uint32(p.readUVarInt(r))
+			}
 			level := p.readVarInt(r)
 			num := p.readVarInt(r)
 			p.dlRecords = append(p.dlRecords, dlRecord{
+				cf:    cf,
 				level: int(level),
 				num:   int(num),
 			})
-		case recAddRecord:
+		case recAddRecord, recFamilyAddRecord:
 
+			var cf uint32
+			if rec == recFamilyAddRecord {
+				cf = uint32(p.readUVarInt(r))
+			}
 			level := p.readVarInt(r)
 			num := p.readVarInt(r)
 			size := p.readVarInt(r)
@@ -414,12 +636,47 @@ func (p *SessionRecord) decode(r Reader) (err error) {
 			max := p.readBytes(r)
 
 			p.atRecords = append(p.atRecords, atRecord{
+				cf:    cf,
 				level: int(level),
 				num:   int(num),
 				size:  int(size),
 				min:   min,
 				max:   max,
 			})
+		case recAddColumnFamily:
+			id := p.readUVarInt(r)
+			name := p.readBytes(r)
+			p.addedFamilies = append(p.addedFamilies, cfRecord{
+				id:   uint32(id),
+				name: string(name),
+			})
+		case recFamilyComparer:
+			id := uint32(p.readUVarInt(r))
+			name := p.readBytes(r)
+			for i := len(p.addedFamilies) - 1; i >= 0; i-- {
+				if p.addedFamilies[i].id == id {
+					p.addedFamilies[i].comparer = string(name)
+					break
+				}
+			}
+		case recTableGlobalSeq:
+			cf := uint32(p.readUVarInt(r))
+			num := int(p.readVarInt(r))
+			seq := p.readUVarInt(r)
+			for i := len(p.atRecords) - 1; i >= 0; i-- {
+				if p.atRecords[i].cf == cf && p.atRecords[i].num == num {
+					p.atRecords[i].seq = seq
+					break
+				}
+			}
+		case recDropColumnFamily:
+			p.droppedFamilies = append(p.droppedFamilies, uint32(p.readUVarInt(r)))
+		case recMaxColumnFamily:
+			p.maxColumnFamily = uint32(p.readUVarInt(r))
+		case recAddBlobFile:
+			p.addedBlobs = append(p.addedBlobs, p.readBlobRecord(r))
+		case recBlobGarbage:
+			p.blobGarbage = append(p.blobGarbage, p.readBlobRecord(r))
 		}
 
 		if p.err != nil {
@@ -440,3 +697,13 @@ func (p *SessionRecord) resetDelRecord() {
 func (p *SessionRecord) resetCompatPtr() {
 	p.compactPtrs = p.compactPtrs[:0]
 }
+
+func (p *SessionRecord) resetBlobRecord() {
+	p.addedBlobs = p.addedBlobs[:0]
+	p.blobGarbage = p.blobGarbage[:0]
+}
+
+func (p *SessionRecord) resetFamilyRecord() {
+	p.addedFamilies = p.addedFamilies[:0]
+	p.droppedFamilies = p.droppedFamilies[:0]
+}
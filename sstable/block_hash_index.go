@@ -0,0 +1,183 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"myleveldb/comparer"
+)
+
+/**
+data block hash index
+
+点查时data block需要先二分查找restart point, 然后在restart point之后顺序查找,
+hash index记录每个user key所在的restart point, 点查时直接定位到restart point
+
+	/ entries / restart0 / restart1 / ... / bucket0 / bucket1 / ... / bucketsNum uint16 / restartsNum | flag uint32 /
+
+1. 每个bucket一个字节, 记录落在该bucket的user key所在的restart point下标
+	hashIndexEmpty     没有user key落在该bucket, 说明block中不存在该user key
+	hashIndexCollision 多个restart point中的user key落在同一个bucket, 退化成二分查找
+2. 同一个user key的多条记录(不同的seq)只记录第一条所在的restart point, 从该restart point开始顺序查找
+3. restart point的个数写入block尾部的最高位作为标记, 没有标记的block按照原来的格式读取,
+   restart point个数超过maxHashIndexRestarts时不生成hash index
+
+要求comparer中相等的user key的字节也相等
+**/
+
+const (
+	hashIndexEmpty       = 0xff
+	hashIndexCollision   = 0xfe
+	maxHashIndexRestarts = hashIndexCollision // restart point的下标需要用一个字节表示
+	hashIndexFlag        = 1 << 31
+	hashIndexUtilRatio   = 0.75 // user key个数与bucket个数的比例
+	maxHashIndexBuckets  = 1<<16 - 1
+)
+
+// UserKeyExtractor sstable中的key由user key以及其他信息(例如seq)组成时由comparer实现,
+// data block hash index按照user key计算hash
+type UserKeyExtractor interface {
+	UserKey(key []byte) []byte
+}
+
+// 取出key中的user key, comparer没有实现UserKeyExtractor时为key本身
+func userKeyOf(cmp comparer.BasicComparer, key []byte) []byte {
+	if extractor, ok := cmp.(UserKeyExtractor); ok {
+		return extractor.UserKey(key)
+	}
+	return key
+}
+
+// fnv-1a
+func hashIndexHash(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// 构建一个data block的hash index
+type hashIndexWriter struct {
+	cmp         comparer.BasicComparer
+	hashes      []uint32
+	restarts    []uint8
+	lastUserKey []byte
+	buckets     []byte
+}
+
+// restartIndex为key所在的restart point的下标
+func (hw *hashIndexWriter) add(key []byte, restartIndex int) {
+	ukey := userKeyOf(hw.cmp, key)
+	if len(hw.hashes) > 0 && bytes.Equal(ukey, hw.lastUserKey) {
+		return
+	}
+	hw.lastUserKey = append(hw.lastUserKey[:0], ukey...)
+	if restartIndex >= maxHashIndexRestarts {
+		restartIndex = maxHashIndexRestarts // 超过时整个block不生成hash index
+	}
+	hw.hashes = append(hw.hashes, hashIndexHash(ukey))
+	hw.restarts = append(hw.restarts, uint8(restartIndex))
+}
+
+func (hw *hashIndexWriter) bucketsNum() int {
+	n := int(float64(len(hw.hashes))/hashIndexUtilRatio) + 1
+	if n > maxHashIndexBuckets {
+		n = maxHashIndexBuckets
+	}
+	return n
+}
+
+// hash index的长度, 不包括尾部的restart point个数
+func (hw *hashIndexWriter) size() int {
+	return hw.bucketsNum() + 2
+}
+
+// 是否可以生成hash index
+func (hw *hashIndexWriter) usable(restarts int) bool {
+	return len(hw.hashes) > 0 && restarts < maxHashIndexRestarts
+}
+
+// 写入buckets以及bucket个数
+func (hw *hashIndexWriter) finish(buf *bytes.Buffer) {
+
+	n := hw.bucketsNum()
+	if cap(hw.buckets) < n {
+		hw.buckets = make([]byte, n)
+	}
+	buckets := hw.buckets[:n]
+	for i := range buckets {
+		buckets[i] = hashIndexEmpty
+	}
+
+	for i, h := range hw.hashes {
+		b := h % uint32(n)
+		switch buckets[b] {
+		case hashIndexEmpty:
+			buckets[b] = hw.restarts[i]
+		case hw.restarts[i], hashIndexCollision:
+		default:
+			buckets[b] = hashIndexCollision
+		}
+	}
+
+	buf.Write(buckets)
+	var scratch [2]byte
+	binary.LittleEndian.PutUint16(scratch[:], uint16(n))
+	buf.Write(scratch[:])
+}
+
+func (hw *hashIndexWriter) reset() {
+	hw.hashes = hw.hashes[:0]
+	hw.restarts = hw.restarts[:0]
+	hw.lastUserKey = hw.lastUserKey[:0]
+}
+
+// 通过hash index查找ukey所在的restart point,
+// ok为false时没有hash index或者hash冲突, 需要二分查找, found为false时block中不存在ukey
+func (block *dataBlock) lookupHashIndex(ukey []byte) (index int, found, ok bool) {
+	if block.bucketsLen == 0 {
+		return 0, false, false
+	}
+	b := hashIndexHash(ukey) % uint32(block.bucketsLen)
+	switch v := block.data[block.bucketsOffset+int(b)]; v {
+	case hashIndexEmpty:
+		return 0, false, true
+	case hashIndexCollision:
+		return 0, false, false
+	default:
+		return int(v), true, true
+	}
+}
+
+// 点查, 寻找大于等于key的记录, 有hash index时直接从user key所在的restart point开始查找,
+// absent为true说明block中不存在key的user key
+func (bi *BlockIter) seekPoint(key []byte) (ok, absent bool) {
+
+	index, found, hashed := bi.dataBlock.lookupHashIndex(userKeyOf(bi.dataBlock.cmp, key))
+	if !hashed {
+		return bi.Seek(key), false
+	}
+	if !found {
+		return false, true
+	}
+
+	bi.soi, bi.eoi = false, false
+	bi.restartIndex = index
+	bi.offset = int(binary.LittleEndian.Uint32(bi.dataBlock.data[bi.dataBlock.restartsOffset+index*4:]))
+
+	for bi.Next() {
+		if bi.dataBlock.cmp.Compare(bi.key, key) >= 0 {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// 在data block中点查, 不是BlockIter时使用Seek
+func seekPoint(it interface{ Seek(key []byte) bool }, key []byte) (ok, absent bool) {
+	if bi, isBlockIter := it.(*BlockIter); isBlockIter {
+		return bi.seekPoint(key)
+	}
+	return it.Seek(key), false
+}
@@ -0,0 +1,69 @@
+package sstable
+
+import (
+	"myleveldb/collections"
+)
+
+/**
+固定index block以及filter block
+
+每次查询都需要读取index block以及filter block, 它们跟data block一起在block cache中按照lru驱逐,
+扫描大量data block时会被挤出缓存, 下一次查询需要重新从文件读取
+
+PinIndexAndFilter之后直到reader关闭(从file cache中剔除时调用UnRef), 这些block固定在block cache中不会被驱逐,
+占用的内存仍然计入block cache的容量, 查询仍然通过block cache读取, 只是一定命中
+
+	FilterFormatBlock        filter block
+	FilterFormatFull         整表filter
+	FilterFormatPartitioned  顶层index, 分区按需读取
+	分区index                 顶层index, 分区按需读取
+**/
+
+// PinIndexAndFilter 将index block以及filter block固定在block cache中, reader关闭时释放
+func (r *Reader) PinIndexAndFilter() error {
+
+	if len(r.pinned) > 0 {
+		return nil
+	}
+
+	if err := r.pin(r.indexBH, r.blockLoader(r.indexBH)); err != nil {
+		r.unpin()
+		return err
+	}
+
+	if r.filter == nil || r.metaBH.length == 0 {
+		return nil
+	}
+
+	var loader collections.SetFunc
+	switch r.filterFormat {
+	case FilterFormatFull:
+		loader = r.fullFilterLoader(r.metaBH)
+	case FilterFormatPartitioned:
+		loader = r.blockLoader(r.metaBH)
+	default:
+		loader = r.filterBlockLoader(r.metaBH)
+	}
+	if err := r.pin(r.metaBH, loader); err != nil {
+		r.unpin()
+		return err
+	}
+	return nil
+}
+
+func (r *Reader) pin(bh blockHandle, loader collections.SetFunc) error {
+	ch, err := r.cache.Pin(blockCacheKey(bh), loader)
+	if err != nil {
+		return err
+	}
+	r.pinned = append(r.pinned, ch)
+	return nil
+}
+
+// 释放所有固定的block, 重新可以被驱逐
+func (r *Reader) unpin() {
+	for _, rel := range r.pinned {
+		rel.UnRef()
+	}
+	r.pinned = nil
+}
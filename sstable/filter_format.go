@@ -0,0 +1,328 @@
+package sstable
+
+import (
+	"bytes"
+	"myleveldb/collections"
+	"myleveldb/filter"
+	"myleveldb/iter"
+	"myleveldb/utils"
+)
+
+/**
+filter block的格式
+
+1. FilterFormatBlock(默认), 每2k的data block offset生成一段filter, 查询时需要先通过index block找到data block的offset
+
+	/ filter0 / filter1 / ... / offset0 / offset1 / ... / offset's offset / baseLg /
+
+2. FilterFormatFull, 整个sstable只有一个filter, 查询时不需要读取index block
+
+	/ filter /
+
+3. FilterFormatPartitioned, 按照data block的边界把filter切分成多个分区, 每个分区大约defaultFilterPartitionSize字节,
+   顶层index记录每个分区最后一个key以及分区的block handle, 查询时只需要读取顶层index以及一个分区, 适合很大的sstable
+
+	/ partition0 / partition1 / ... / top-level index /
+
+	top-level index:  last key of partition0 => partition0 bh
+	                  last key of partition1 => partition1 bh
+
+meta index block中key的前缀记录了格式, reader根据前缀选择查询方式
+	filter.<name>            => filter block bh
+	fullfilter.<name>        => filter bh
+	partitionedfilter.<name> => top-level index bh
+
+filter中还加入了prefix时, meta index block中另外记录提取prefix的规则名称, value为空
+	filterprefix.<name>
+**/
+
+// FilterFormat filter block的格式
+type FilterFormat uint8
+
+const (
+	FilterFormatBlock       FilterFormat = iota // 每2k的data block一段filter
+	FilterFormatFull                            // 整个sstable一个filter
+	FilterFormatPartitioned                     // 分区filter, 顶层index指向各个分区
+)
+
+const defaultFilterPartitionSize = 4 << 10 // 每个分区filter的大小
+
+const metaFilterPrefix = "filterprefix."
+
+var filterFormatPrefixes = [...]string{
+	FilterFormatBlock:       "filter.",
+	FilterFormatFull:        "fullfilter.",
+	FilterFormatPartitioned: "partitionedfilter.",
+}
+
+func (format FilterFormat) String() string {
+	switch format {
+	case FilterFormatBlock:
+		return "block"
+	case FilterFormatFull:
+		return "full"
+	case FilterFormatPartitioned:
+		return "partitioned"
+	}
+	return "unknown"
+}
+
+// meta index block中key的前缀
+func (format FilterFormat) metaPrefix() string {
+	if int(format) >= len(filterFormatPrefixes) {
+		return filterFormatPrefixes[FilterFormatBlock]
+	}
+	return filterFormatPrefixes[format]
+}
+
+// 根据meta index block中的key解析出filter的格式以及名称
+func parseFilterMetaKey(key []byte) (format FilterFormat, name string, ok bool) {
+	for i, prefix := range filterFormatPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return FilterFormat(i), string(key[len(prefix):]), true
+		}
+	}
+	return 0, "", false
+}
+
+// 根据meta index block中的key解析出filter中prefix的规则名称
+func parseFilterPrefixMetaKey(key []byte) (name string, ok bool) {
+	if !bytes.HasPrefix(key, []byte(metaFilterPrefix)) {
+		return "", false
+	}
+	return string(key[len(metaFilterPrefix):]), true
+}
+
+// filterBlockWriter 不同格式的filter的写入
+type filterBlockWriter interface {
+	add(key []byte)
+	generate(offset uint64)                // 一个data block写入后调用, offset为下一个data block的起始位置
+	write(w *Writer) (*blockHandle, error) // 写入filter相关的block, 返回meta index block中记录的block handle
+	Close() error
+}
+
+func newFilterBlockWriter(format FilterFormat, w *Writer, bPool *utils.BytePool) filterBlockWriter {
+	generator := w.filter.NewFilterGenerator(defaultFilterBitsPerKey)
+	switch format {
+	case FilterFormatFull:
+		return &fullFilterWriter{
+			buf:             utils.GetPoolNamespace(defaultFilterBytePoolNamespace),
+			filterGenerator: generator,
+		}
+	case FilterFormatPartitioned:
+		return &partitionedFilterWriter{
+			buf:             utils.GetPoolNamespace(defaultFilterBytePoolNamespace),
+			filterGenerator: generator,
+			bPool:           bPool,
+		}
+	}
+	return newFilterWriter(w.Writer, generator)
+}
+
+// 整个sstable只生成一个filter
+type fullFilterWriter struct {
+	buf             *bytes.Buffer
+	filterGenerator filter.IFilterGenerator
+}
+
+func (fw *fullFilterWriter) add(key []byte) {
+	fw.filterGenerator.Add(key)
+}
+
+func (fw *fullFilterWriter) generate(offset uint64) {}
+
+func (fw *fullFilterWriter) write(w *Writer) (*blockHandle, error) {
+	fw.filterGenerator.Generate(fw.buf)
+	return w.writeBlock(fw.buf, noCompress)
+}
+
+func (fw *fullFilterWriter) Close() error {
+	utils.PutPoolNamespace(defaultFilterBytePoolNamespace, fw.buf)
+	return nil
+}
+
+// 按照data block的边界切分filter, 所有分区依次生成到buf中, sstable写完时再写入各个分区以及顶层index
+type partitionedFilterWriter struct {
+	buf             *bytes.Buffer
+	filterGenerator filter.IFilterGenerator
+	bPool           *utils.BytePool
+	keys            int
+	lastKey         []byte
+
+	partitionKeys [][]byte // 每个分区的最后一个key, 小于等于该分区最后一个data block在index block中的key
+	partitionEnds []int    // 每个分区在buf中的结束位置
+}
+
+func (pw *partitionedFilterWriter) add(key []byte) {
+	pw.filterGenerator.Add(key)
+	pw.keys++
+	pw.lastKey = append(pw.lastKey[:0], key...)
+}
+
+// 只在data block写完时切分, 保证同一个data block的key落在同一个分区
+func (pw *partitionedFilterWriter) generate(offset uint64) {
+	if pw.keys*defaultFilterBitsPerKey/8 >= defaultFilterPartitionSize {
+		pw.cut()
+	}
+}
+
+func (pw *partitionedFilterWriter) cut() {
+	pw.filterGenerator.Generate(pw.buf)
+	pw.partitionKeys = append(pw.partitionKeys, append([]byte(nil), pw.lastKey...))
+	pw.partitionEnds = append(pw.partitionEnds, pw.buf.Len())
+	pw.keys = 0
+}
+
+func (pw *partitionedFilterWriter) write(w *Writer) (*blockHandle, error) {
+
+	if pw.keys > 0 {
+		pw.cut()
+	}
+
+	indexWriter := newBlockWriter(defaultIndexBlockRestartInterval, pw.bPool, 0)
+	defer indexWriter.Close()
+
+	var (
+		partition = bytes.NewBuffer(nil)
+		data      = pw.buf.Bytes()
+		start     int
+		scratch   [20]byte
+	)
+	for i, end := range pw.partitionEnds {
+		partition.Reset()
+		partition.Write(data[start:end])
+		bh, err := w.writeBlock(partition, noCompress)
+		if err != nil {
+			return nil, err
+		}
+		n := encodeBlockHandle(scratch[:], *bh)
+		indexWriter.append(pw.partitionKeys[i], scratch[:n])
+		start = end
+	}
+
+	indexWriter.finish()
+	return w.writeBlock(indexWriter.buffer, w.compressionType)
+}
+
+func (pw *partitionedFilterWriter) Close() error {
+	utils.PutPoolNamespace(defaultFilterBytePoolNamespace, pw.buf)
+	return nil
+}
+
+// fullFilterBlock 一个完整的filter, 用于FilterFormatFull以及FilterFormatPartitioned的一个分区
+type fullFilterBlock struct {
+	filter filter.IFilter
+	pool   *utils.BytePool
+	data   []byte
+}
+
+func (block *fullFilterBlock) contains(key []byte) bool {
+	return block.filter.Contains(block.data, key)
+}
+
+func (block *fullFilterBlock) UnRef() {
+	block.pool.Put(block.data)
+}
+
+func (r *Reader) readFullFilterCached(bh blockHandle) (*fullFilterBlock, utils.Releaser, error) {
+	ch, err := r.cache.Get(blockCacheKey(bh), r.fullFilterLoader(bh))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ch.Value().(*fullFilterBlock), ch, nil
+}
+
+func (r *Reader) fullFilterLoader(bh blockHandle) collections.SetFunc {
+	return func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
+		data, err := r.readRawBlock(bh, true)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		block := &fullFilterBlock{filter: r.filter, pool: r.bytePool, data: data}
+		return int64(cap(data)), block, nil, nil
+	}
+}
+
+// 是否可以在读取index block之前通过filter判断key是否存在
+func (r *Reader) hasTableFilter() bool {
+	return r.filter != nil && r.metaBH.length > 0 && r.filterFormat != FilterFormatBlock
+}
+
+// tableFilter 通过整表filter或者分区filter判断key是否存在于sstable中,
+// 多个key按照从小到大的顺序查询时, 相邻的key通常落在同一个分区, 分区只读取一次
+type tableFilter struct {
+	r         *Reader
+	indexIter iter.Iterator // 分区filter的顶层index
+	block     *fullFilterBlock
+	blockBH   blockHandle
+	rel       utils.Releaser
+}
+
+func (r *Reader) newTableFilter() *tableFilter {
+	return &tableFilter{r: r}
+}
+
+func (tf *tableFilter) contains(key []byte) (bool, error) {
+
+	bh := tf.r.metaBH
+	if tf.r.filterFormat == FilterFormatPartitioned {
+		if tf.indexIter == nil {
+			indexIter, err := tf.r.getDataIter(tf.r.metaBH)
+			if err != nil {
+				return false, err
+			}
+			tf.indexIter = indexIter
+		}
+		// 所有分区的key都小于key
+		if !tf.indexIter.Seek(key) {
+			return false, nil
+		}
+		var n int
+		bh, n = decodeBlockHandle(tf.indexIter.Value())
+		if n == 0 {
+			return false, ErrBlockHandle
+		}
+	}
+
+	if tf.block == nil || tf.blockBH != bh {
+		tf.release()
+		block, rel, err := tf.r.readFullFilterCached(bh)
+		if err != nil {
+			return false, err
+		}
+		tf.block, tf.blockBH, tf.rel = block, bh, rel
+	}
+
+	return tf.block.contains(key), nil
+}
+
+func (tf *tableFilter) release() {
+	if tf.rel != nil {
+		tf.rel.UnRef()
+		tf.block, tf.rel = nil, nil
+	}
+}
+
+func (tf *tableFilter) UnRef() {
+	tf.release()
+	if tf.indexIter != nil {
+		tf.indexIter.UnRef()
+		tf.indexIter = nil
+	}
+}
+
+// 分区filter的分区数量
+func (r *Reader) filterPartitions() (int, error) {
+	indexIter, err := r.getDataIter(r.metaBH)
+	if err != nil {
+		return 0, err
+	}
+	defer indexIter.UnRef()
+
+	n := 0
+	for indexIter.Next() {
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package sstable
+
+import (
+	"bytes"
+	"myleveldb/iter"
+)
+
+/**
+分区index
+
+index block超过WriterOptions.IndexPartitionThreshold时, 把index block切分成多个大约defaultIndexPartitionSize的分区,
+footer中的index block handle指向顶层index, 顶层index记录每个分区最后一个key以及分区的block handle
+
+	/ data blocks / filter / meta index / partition0 / partition1 / ... / top-level index / footer /
+
+	top-level index:  last key of partition0 => partition0 bh
+	                  last key of partition1 => partition1 bh
+
+meta index block中存在metaIndexPartitioned时说明index是分区的,
+读取时只有顶层index常驻在block cache中, 分区跟data block一样按需通过block cache读取
+**/
+
+const (
+	defaultIndexPartitionSize = 4 << 10
+	metaIndexPartitioned      = "index.partitioned"
+)
+
+// 将已经写完的index block切分成多个分区写入, 返回顶层index的block handle
+func (w *Writer) writePartitionedIndex() (*blockHandle, error) {
+
+	// index block中的key按照写入的顺序遍历, 不需要comparer
+	w.dataIndexBlockWriter.finish()
+	indexIter := newBlockIter(newDataBlock(w.dataIndexBlockWriter.buffer.Bytes(), nil, nil), nil)
+	defer indexIter.UnRef()
+
+	bPool := w.dataIndexBlockWriter.bPool
+	partition := newBlockWriter(defaultIndexBlockRestartInterval, bPool, 0)
+	defer partition.Close()
+	topIndex := newBlockWriter(defaultIndexBlockRestartInterval, bPool, 0)
+	defer topIndex.Close()
+
+	var scratch [20]byte
+	flush := func() error {
+		lastKey := append([]byte(nil), partition.prevKey...)
+		partition.finish()
+		bh, err := w.writeBlock(partition.buffer, w.compressionType)
+		if err != nil {
+			return err
+		}
+		partition.reset()
+		n := encodeBlockHandle(scratch[:], *bh)
+		topIndex.append(lastKey, scratch[:n])
+		return nil
+	}
+
+	for indexIter.Next() {
+		partition.append(indexIter.Key(), indexIter.Value())
+		if partition.BlockSize() >= defaultIndexPartitionSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if indexIter.err != nil {
+		return nil, indexIter.err
+	}
+	if partition.entries > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	topIndex.finish()
+	return w.writeBlock(topIndex.buffer, w.compressionType)
+}
+
+// 是否需要分区写入index
+func (w *Writer) indexPartitioned() bool {
+	return w.indexPartitionThreshold > 0 && w.dataIndexBlockWriter.BlockSize() > w.indexPartitionThreshold
+}
+
+// 遍历index的iterator, 分区index时为顶层index与分区组成的两层iterator, 跟一个完整的index block遍历的结果相同
+func (r *Reader) newIndexIter(fillCache bool) (iter.Iterator, error) {
+	if !r.indexPartitioned {
+		return r.getDataIterFill(r.indexBH, fillCache)
+	}
+	topIter, err := r.getDataIterFill(r.indexBH, fillCache)
+	if err != nil {
+		return nil, err
+	}
+	return iter.NewIndexedIterator(&indexedIter{Iterator: topIter, r: r, fillCache: fillCache}), nil
+}
+
+// 分区index的分区个数, 不是分区index时为0
+func (r *Reader) indexPartitions() (int, error) {
+	if !r.indexPartitioned {
+		return 0, nil
+	}
+	topIter, err := r.getDataIter(r.indexBH)
+	if err != nil {
+		return 0, err
+	}
+	defer topIter.UnRef()
+
+	n := 0
+	for topIter.Next() {
+		n++
+	}
+	return n, nil
+}
+
+func isIndexPartitionedKey(key []byte) bool {
+	return bytes.Equal(key, []byte(metaIndexPartitioned))
+}
@@ -0,0 +1,134 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"myleveldb/comparer"
+	"myleveldb/utils"
+)
+
+/**
+properties block
+
+记录sstable所属的column family以及导入文件的全局seq, manifest丢失时repair通过它重建family以及全局seq,
+meta index block中key为metaTableProperties, value为properties block的block handle, 旧版本的sstable中没有该block
+
+	+--------------+------------------+-------------------------------+-------------------------------+
+	| 8byte全局seq | varint family id | varint len + family name      | varint len + comparer name    |
+	+--------------+------------------+-------------------------------+-------------------------------+
+
+properties block不压缩, 全局seq固定在block的开头, 导入外部文件时原地改写这8个字节并重新计算block的check sum,
+文件的大小以及其他block的位置都不会改变
+**/
+
+const metaTableProperties = "table.properties"
+
+var (
+	ErrNoProperties      = errors.New("sstable has no properties block")
+	ErrPropertiesCorrupt = errors.New("sstable properties block corrupted")
+)
+
+// Properties sstable的属性
+type Properties struct {
+	GlobalSeq        uint64 // 导入的文件中记录的seq为0, 读取时替换为全局seq, 不是导入的文件为0
+	ColumnFamilyID   uint32
+	ColumnFamilyName string
+	ComparerName     string // family的comparer名称, 跟manifest中记录的相同
+}
+
+func (p *Properties) encode() []byte {
+	dst := make([]byte, 8, 8+3*binary.MaxVarintLen32+len(p.ColumnFamilyName)+len(p.ComparerName))
+	binary.LittleEndian.PutUint64(dst, p.GlobalSeq)
+	dst = appendUvarint(dst, uint64(p.ColumnFamilyID))
+	dst = appendUvarint(dst, uint64(len(p.ColumnFamilyName)))
+	dst = append(dst, p.ColumnFamilyName...)
+	dst = appendUvarint(dst, uint64(len(p.ComparerName)))
+	return append(dst, p.ComparerName...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func decodeProperties(data []byte) (*Properties, error) {
+
+	if len(data) < 8 {
+		return nil, ErrPropertiesCorrupt
+	}
+	p := &Properties{GlobalSeq: binary.LittleEndian.Uint64(data)}
+	data = data[8:]
+
+	id, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrPropertiesCorrupt
+	}
+	p.ColumnFamilyID = uint32(id)
+	data = data[n:]
+
+	for _, dst := range []*string{&p.ColumnFamilyName, &p.ComparerName} {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, ErrPropertiesCorrupt
+		}
+		*dst = string(data[n : n+int(l)])
+		data = data[n+int(l):]
+	}
+
+	return p, nil
+}
+
+// 写入properties block, 返回meta index block中记录的block handle
+func (w *Writer) writeProperties() (*blockHandle, error) {
+	return w.writeBlock(bytes.NewBuffer(w.properties.encode()), noCompress)
+}
+
+// Properties 返回sstable的属性, 旧版本的sstable没有properties block时返回ErrNoProperties
+func (r *Reader) Properties() (*Properties, error) {
+
+	if !r.hasProperties {
+		return nil, ErrNoProperties
+	}
+
+	data, err := r.readRawBlock(r.propertiesBH, true)
+	if err != nil {
+		return nil, err
+	}
+	defer r.bytePool.Put(data)
+
+	return decodeProperties(data)
+}
+
+// GlobalSeqPatch 返回把properties block中的全局seq改写为seq需要写入的内容以及位置, 包括重新计算的check sum,
+// 用于导入外部的sstable, 旧版本的sstable没有properties block时返回ErrNoProperties
+func GlobalSeqPatch(f io.ReaderAt, size int64, seq uint64, bytePool *utils.BytePool) (offset int64, patch []byte, err error) {
+
+	// 只需要解析meta index block, 不需要读取index以及filter
+	r, err := NewReader(f, size, comparer.DefaultComparer, nil, nil, bytePool)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !r.hasProperties {
+		return 0, nil, ErrNoProperties
+	}
+
+	raw := make([]byte, r.propertiesBH.length+blockTrialLen)
+	if _, err = f.ReadAt(raw, int64(r.propertiesBH.offset)); err != nil {
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(raw[len(raw)-4:]) != crc32.ChecksumIEEE(raw[:len(raw)-4]) {
+		return 0, nil, ErrDataBlockCheckSum
+	}
+	if len(raw) < 8+blockTrialLen {
+		return 0, nil, ErrPropertiesCorrupt
+	}
+
+	binary.LittleEndian.PutUint64(raw, seq)
+	binary.LittleEndian.PutUint32(raw[len(raw)-4:], crc32.ChecksumIEEE(raw[:len(raw)-4]))
+
+	return int64(r.propertiesBH.offset), raw, nil
+}
@@ -1,7 +1,6 @@
 package sstable
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"hash/crc32"
@@ -29,21 +28,29 @@ var (
 type dataBlock struct {
 	restartsOffset int
 	restartsLen    int
+	bucketsOffset  int // hash index的位置
+	bucketsLen     int // hash index的bucket个数, 为0时没有hash index
 	data           []byte
 	bytePool       *utils.BytePool
 	cmp            comparer.BasicComparer
 }
 
 func newDataBlock(data []byte, bytePool *utils.BytePool, cmp comparer.BasicComparer) *dataBlock {
-	restartsNum := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
-	restartsOffset := len(data) - (restartsNum+1)*4
-	return &dataBlock{
-		restartsOffset: restartsOffset,
-		restartsLen:    restartsNum,
-		data:           data,
-		bytePool:       bytePool,
-		cmp:            cmp,
+	restartsNum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	block := &dataBlock{
+		restartsLen: int(restartsNum &^ hashIndexFlag),
+		data:        data,
+		bytePool:    bytePool,
+		cmp:         cmp,
+	}
+	end := len(data) - 4
+	if restartsNum&hashIndexFlag != 0 {
+		block.bucketsLen = int(binary.LittleEndian.Uint16(data[end-2:]))
+		block.bucketsOffset = end - 2 - block.bucketsLen
+		end = block.bucketsOffset
 	}
+	block.restartsOffset = end - block.restartsLen*4
+	return block
 }
 
 // 根据给定的key, 找出第一个 restart point对应下标的key 大于给定的key的值
@@ -125,6 +132,7 @@ type BlockIter struct {
 
 	// 遍历相关
 	offset       int // 当前下标所处的位置
+	entryOffset  int // 当前entry的起始位置, 用于Prev
 	restartIndex int // 当前正在哪个restart point
 
 	// 当前遍历的key, value
@@ -152,7 +160,11 @@ func newBlockIter(dataBlock *dataBlock, blockReleaser utils.Releaser) *BlockIter
 }
 
 func (r *Reader) getDataIter(bh blockHandle) (iter.Iterator, error) {
-	block, rel, err := r.readBlockCached(bh)
+	return r.getDataIterFill(bh, true)
+}
+
+func (r *Reader) getDataIterFill(bh blockHandle, fillCache bool) (iter.Iterator, error) {
+	block, rel, err := r.readBlockCachedFill(bh, fillCache)
 	if err != nil {
 		return nil, err
 	}
@@ -189,18 +201,24 @@ func (bi *BlockIter) First() bool {
 		return false
 	}
 
-	if bi.eoi {
-		bi.eoi = false
-	}
-
-	if !bi.soi {
-		bi.soi = true
-	}
+	bi.soi, bi.eoi = true, false
+	bi.offset, bi.restartIndex = 0, 0
+	bi.key = bi.key[:0]
 
 	return bi.Next()
 
 }
 
+// UnRef 释放data block的引用
+func (bi *BlockIter) UnRef() {
+	if !bi.Released() {
+		if bi.blockReleaser != nil {
+			bi.blockReleaser.UnRef()
+		}
+		bi.BasicReleaser.UnRef()
+	}
+}
+
 func (bi *BlockIter) Next() bool {
 
 	if bi.Released() {
@@ -226,10 +244,82 @@ func (bi *BlockIter) Next() bool {
 	}
 	bi.key = append(bi.key[:nShared], unShareKey...)
 	bi.value = value
+	bi.entryOffset = bi.offset
 	bi.offset += n
 	return true
 }
 
+// Last 移动到最后一个entry
+func (bi *BlockIter) Last() bool {
+
+	if bi.Released() {
+		return false
+	}
+
+	return bi.seekEntryBefore(bi.dataBlock.restartsOffset)
+}
+
+// Prev entry之间共享前缀, 只能从前一个restart point开始向后找到当前entry的前一个entry
+func (bi *BlockIter) Prev() bool {
+
+	if bi.Released() || bi.soi {
+		return false
+	}
+
+	if bi.eoi {
+		return bi.Last()
+	}
+
+	return bi.seekEntryBefore(bi.entryOffset)
+}
+
+// SeekBefore 寻找小于key的最后一个下标
+func (bi *BlockIter) SeekBefore(key []byte) bool {
+
+	if bi.Released() {
+		return false
+	}
+
+	if bi.Seek(key) {
+		return bi.Prev()
+	}
+	if bi.err != nil {
+		return false
+	}
+	return bi.Last()
+}
+
+// 移动到结束位置为end的entry, end之前没有entry时回到开始的位置
+func (bi *BlockIter) seekEntryBefore(end int) bool {
+
+	block := bi.dataBlock
+	index := sort.Search(block.restartsLen, func(i int) bool {
+		return int(binary.LittleEndian.Uint32(block.data[block.restartsOffset+i*4:])) >= end
+	}) - 1
+
+	bi.soi, bi.eoi = false, false
+	bi.key = bi.key[:0]
+
+	if index < 0 {
+		bi.soi = true
+		bi.offset, bi.restartIndex = 0, 0
+		return false
+	}
+
+	bi.restartIndex = index
+	bi.offset = int(binary.LittleEndian.Uint32(block.data[block.restartsOffset+index*4:]))
+	for bi.Next() {
+		if bi.offset >= end {
+			return true
+		}
+	}
+	return false
+}
+
+func (bi *BlockIter) Error() error {
+	return bi.err
+}
+
 func (bi *BlockIter) Key() []byte {
 	if bi.soi || bi.eoi {
 		return nil
@@ -262,19 +352,38 @@ type Reader struct {
 	// 字节数组池对象
 	bytePool *utils.BytePool
 	cache    *cache.NamespaceCache
+
+	filterName   string       // meta index block中记录的filter名称
+	filterFormat FilterFormat // meta index block中key的前缀记录的filter格式
+	filterPrefix string       // filter中加入的prefix的规则名称, 没有加入prefix时为空
+
+	indexPartitioned bool // indexBH指向分区index的顶层index
+
+	propertiesBH  blockHandle
+	hasProperties bool // 旧版本的sstable没有properties block
+
+	pinned []utils.Releaser // 固定在block cache中的index block以及filter block
 }
 
 func (r *Reader) readBlockCached(bh blockHandle) (*dataBlock, utils.Releaser, error) {
+	return r.readBlockCachedFill(bh, true)
+}
 
-	key := make([]byte, 8)
-	binary.LittleEndian.PutUint64(key, bh.offset)
-	ch, err := r.cache.Get(key, func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
-		dataBlock, err := r.readBlock(bh, true)
+// fillCache为false时只使用已经在缓存中的block, 不在缓存中时直接读取, 使用完后归还到pool中
+func (r *Reader) readBlockCachedFill(bh blockHandle, fillCache bool) (*dataBlock, utils.Releaser, error) {
+
+	if !fillCache {
+		if ch, err := r.cache.Get(blockCacheKey(bh), nil); err == nil {
+			return ch.Value().(*dataBlock), ch, nil
+		}
+		block, err := r.readBlock(bh, true)
 		if err != nil {
-			return 0, nil, nil, err
+			return nil, nil, err
 		}
-		return int64(cap(dataBlock.data)), dataBlock, nil, nil
-	})
+		return block, block, nil
+	}
+
+	ch, err := r.cache.Get(blockCacheKey(bh), r.blockLoader(bh))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -283,6 +392,24 @@ func (r *Reader) readBlockCached(bh blockHandle) (*dataBlock, utils.Releaser, er
 	return block, ch, nil
 }
 
+// block cache中的key为block的offset
+func blockCacheKey(bh blockHandle) []byte {
+	key := make([]byte, 8)
+	binary.LittleEndian.PutUint64(key, bh.offset)
+	return key
+}
+
+// 不在block cache中时读取data block
+func (r *Reader) blockLoader(bh blockHandle) collections.SetFunc {
+	return func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
+		dataBlock, err := r.readBlock(bh, true)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return int64(cap(dataBlock.data)), dataBlock, nil, nil
+	}
+}
+
 func (r *Reader) readBlock(bh blockHandle, verifyCheckSum bool) (*dataBlock, error) {
 	data, err := r.readRawBlock(bh, verifyCheckSum)
 	if err != nil {
@@ -323,9 +450,10 @@ func (r *Reader) readRawBlock(bh blockHandle, verifyCheckSum bool) (data []byte,
 
 	switch compressionType(ct) {
 	case noCompress:
-		return data[:len(data)-4], nil
+		return data[:len(data)-blockTrialLen], nil
 	default:
-		return nil, ErrCompressTypeUnsupport
+		err = ErrCompressTypeUnsupport
+		return nil, err
 	}
 
 }
@@ -333,7 +461,6 @@ func (r *Reader) readRawBlock(bh blockHandle, verifyCheckSum bool) (data []byte,
 func (r *Reader) readFilterBlock(bh blockHandle) (*FilterBlock, error) {
 	data, err := r.readRawBlock(bh, true)
 	if err != nil {
-		r.bytePool.Put(data)
 		return nil, err
 	}
 
@@ -353,22 +480,22 @@ func (r *Reader) readFilterBlock(bh blockHandle) (*FilterBlock, error) {
 }
 
 func (r *Reader) readFilterBlockCached(bh blockHandle) (block *FilterBlock, releaser utils.Releaser, err error) {
-	key := r.bytePool.Get(8)
-	binary.LittleEndian.PutUint64(key, bh.offset)
-	defer func() {
-		if err != nil {
-			r.bytePool.Put(key)
-		}
-	}()
+	ch, err := r.cache.Get(blockCacheKey(bh), r.filterBlockLoader(bh))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ch.Value().(*FilterBlock), ch, nil
+}
 
-	ch, err := r.cache.Get(key, func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
-		block, err = r.readFilterBlock(bh)
+func (r *Reader) filterBlockLoader(bh blockHandle) collections.SetFunc {
+	return func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
+		block, err := r.readFilterBlock(bh)
 		if err != nil {
 			return 0, nil, nil, err
 		}
 		return int64(cap(block.data)), block, nil, nil
-	})
-	return block, ch, nil
+	}
 }
 
 // 寻找第一个大于或者等于key的值
@@ -407,8 +534,21 @@ func (r *Reader) find(key []byte, filtered, noValue bool) (rkey []byte, rvalue [
 
 	*/
 
+	// 整表filter以及分区filter不需要data block的offset, 在读取index block之前判断
+	if filtered && r.hasTableFilter() {
+		tf := r.newTableFilter()
+		ok, err := tf.contains(key)
+		tf.UnRef()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, ErrNotFound
+		}
+	}
+
 	// 获取index block
-	indexIter, err := r.getDataIter(r.indexBH)
+	indexIter, err := r.newIndexIter(true)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -425,7 +565,7 @@ func (r *Reader) find(key []byte, filtered, noValue bool) (rkey []byte, rvalue [
 		return nil, nil, ErrBlockHandle
 	}
 
-	if filtered {
+	if filtered && r.filter != nil && r.metaBH.length > 0 && r.filterFormat == FilterFormatBlock {
 		// 获取bloom filter
 		filterBlock, rel, err := r.readFilterBlockCached(r.metaBH)
 		if err != nil {
@@ -439,14 +579,20 @@ func (r *Reader) find(key []byte, filtered, noValue bool) (rkey []byte, rvalue [
 		}
 	}
 
-	// 获取数据所在的data block
+	// 获取数据所在的data block, 下面可能切换到下一个data block, 释放的是最后使用的那个
 	dataIter, err := r.getDataIter(blockHandle)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer dataIter.UnRef()
+	defer func() {
+		dataIter.UnRef()
+	}()
 
-	if !dataIter.Seek(key) {
+	found, absent := seekPoint(dataIter, key)
+	if absent {
+		return nil, nil, ErrNotFound
+	}
+	if !found {
 		// 如果已经是最后一个data block了,
 		if !indexIter.Next() {
 			return nil, nil, ErrNotFound
@@ -457,12 +603,12 @@ func (r *Reader) find(key []byte, filtered, noValue bool) (rkey []byte, rvalue [
 			return nil, nil, ErrBlockHandle
 		}
 
-		dataIter.UnRef()
-
-		dataIter, err = r.getDataIter(blockHandle)
+		next, err := r.getDataIter(blockHandle)
 		if err != nil {
 			return nil, nil, err
 		}
+		dataIter.UnRef()
+		dataIter = next
 
 		if !dataIter.Next() {
 			return nil, nil, ErrNotFound
@@ -470,9 +616,10 @@ func (r *Reader) find(key []byte, filtered, noValue bool) (rkey []byte, rvalue [
 
 	}
 
-	rkey = dataIter.Key()
+	// data block释放后buffer会被复用, 返回的key, value需要拷贝
+	rkey = append([]byte(nil), dataIter.Key()...)
 	if !noValue {
-		rvalue = dataIter.Value()
+		rvalue = append([]byte(nil), dataIter.Value()...)
 	}
 	return
 }
@@ -489,6 +636,183 @@ func (r *Reader) Find(key []byte) (rkey []byte, value []byte, err error) {
 	return
 }
 
+// FindResult MultiFind中一个key的查找结果, 跟Find一样是sstable中>=key的最小key value pair
+type FindResult struct {
+	Key, Value []byte
+	Err        error
+}
+
+// MultiFind 查找多个key, keys需要从小到大排序,
+// index block和filter block只读取一次, 每个key只查询一次filter, 落在同一个data block的key只读取一次data block
+func (r *Reader) MultiFind(keys [][]byte) []FindResult {
+
+	results := make([]FindResult, len(keys))
+	fail := func(err error) []FindResult {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	indexIter, err := r.newIndexIter(true)
+	if err != nil {
+		return fail(err)
+	}
+	defer indexIter.UnRef()
+
+	var (
+		filterBlock *FilterBlock
+		tf          *tableFilter
+	)
+	if r.hasTableFilter() {
+		tf = r.newTableFilter()
+		defer tf.UnRef()
+	} else if r.filter != nil && r.metaBH.length > 0 {
+		block, rel, err := r.readFilterBlockCached(r.metaBH)
+		if err != nil {
+			return fail(err)
+		}
+		defer rel.UnRef()
+		filterBlock = block
+	}
+
+	var (
+		dataIter iter.Iterator
+		dataBH   blockHandle
+	)
+	defer func() {
+		if dataIter != nil {
+			dataIter.UnRef()
+		}
+	}()
+
+	// 切换到bh对应的data block, 跟上一个key在同一个data block时不需要重新读取
+	load := func(bh blockHandle) error {
+		if dataIter != nil && dataBH == bh {
+			return nil
+		}
+		if dataIter != nil {
+			dataIter.UnRef()
+			dataIter = nil
+		}
+		it, err := r.getDataIter(bh)
+		if err != nil {
+			return err
+		}
+		dataIter, dataBH = it, bh
+		return nil
+	}
+
+	for i, key := range keys {
+
+		result := &results[i]
+
+		if tf != nil {
+			ok, err := tf.contains(key)
+			if err != nil || !ok {
+				result.Err = err
+				if err == nil {
+					result.Err = ErrNotFound
+				}
+				continue
+			}
+		}
+
+		if !indexIter.Seek(key) {
+			result.Err = ErrNotFound
+			continue
+		}
+
+		bh, n := decodeBlockHandle(indexIter.Value())
+		if n == 0 {
+			result.Err = ErrBlockHandle
+			continue
+		}
+
+		if filterBlock != nil && !filterBlock.contains(int(bh.offset), key) {
+			result.Err = ErrNotFound
+			continue
+		}
+
+		if result.Err = load(bh); result.Err != nil {
+			continue
+		}
+
+		// 跟find一样, 当前data block中不存在时取下一个data block的第一个key
+		found, absent := seekPoint(dataIter, key)
+		if absent {
+			result.Err = ErrNotFound
+			continue
+		}
+		if !found && indexIter.Next() {
+			bh, n = decodeBlockHandle(indexIter.Value())
+			if n == 0 {
+				result.Err = ErrBlockHandle
+				continue
+			}
+			if result.Err = load(bh); result.Err != nil {
+				continue
+			}
+			found = dataIter.First()
+		}
+
+		if !found {
+			result.Err = ErrNotFound
+			continue
+		}
+
+		result.Key = append([]byte(nil), dataIter.Key()...)
+		result.Value = append([]byte(nil), dataIter.Value()...)
+	}
+
+	return results
+}
+
+// MayContain 通过filter判断第一个可能包含>=key的data block是否包含key, 返回false时该data block中一定不存在key,
+// 整表filter以及分区filter判断的是整个sstable, 没有filter或者filter名称跟写入时不同时无法判断, 返回true
+func (r *Reader) MayContain(key []byte) (bool, error) {
+
+	if r.filter == nil || r.metaBH.length == 0 || r.filterName != r.filter.Name() {
+		return true, nil
+	}
+
+	if r.hasTableFilter() {
+		tf := r.newTableFilter()
+		defer tf.UnRef()
+		return tf.contains(key)
+	}
+
+	indexIter, err := r.newIndexIter(true)
+	if err != nil {
+		return false, err
+	}
+	defer indexIter.UnRef()
+
+	// 所有的key都小于key
+	if !indexIter.Seek(key) {
+		return false, nil
+	}
+
+	blockHandle, n := decodeBlockHandle(indexIter.Value())
+	if n == 0 {
+		return false, ErrBlockHandle
+	}
+
+	filterBlock, rel, err := r.readFilterBlockCached(r.metaBH)
+	if err != nil {
+		return false, err
+	}
+	defer rel.UnRef()
+
+	return filterBlock.contains(int(blockHandle.offset), key), nil
+}
+
+// FilterPrefix 写入时filter中加入的prefix的规则名称, 没有加入prefix时为空,
+// 跟当前的规则相同时才能通过MayContain判断sstable是否包含某个prefix
+func (r *Reader) FilterPrefix() string {
+	return r.filterPrefix
+}
+
 // Get 通过key获取value
 func (r *Reader) Get(key []byte) (value []byte, err error) {
 
@@ -504,18 +828,20 @@ func (r *Reader) Get(key []byte) (value []byte, err error) {
 	return
 }
 
-// NewReader 新建一个sstable 的reader对象
-func NewReader(readFd io.ReaderAt, size int64, cmp comparer.BasicComparer,
-	nsCache *cache.NamespaceCache) (*Reader, error) {
+// NewReader 新建一个sstable 的reader对象, filter为nil时查找不经过filter block
+func NewReader(readFd io.ReaderAt, size int64, cmp comparer.BasicComparer, filter filter.IFilter,
+	nsCache *cache.NamespaceCache, bytePool *utils.BytePool) (*Reader, error) {
 
 	if size < footerLength {
 		return nil, ErrDataBlockDecode
 	}
 
 	r := &Reader{
-		reader: readFd,
-		cache:  nsCache,
-		cmp:    cmp,
+		reader:   readFd,
+		cache:    nsCache,
+		cmp:      cmp,
+		filter:   filter,
+		bytePool: bytePool,
 	}
 
 	// 读取尾部
@@ -546,64 +872,184 @@ func NewReader(readFd io.ReaderAt, size int64, cmp comparer.BasicComparer,
 	metaIndexIter := newBlockIter(metaIndexBlock, nil)
 
 	for metaIndexIter.Next() {
-		key := metaIndexIter.Key()
-		if !bytes.HasPrefix(key, []byte("filter.")) {
+		if isIndexPartitionedKey(metaIndexIter.Key()) {
+			r.indexPartitioned = true
+			continue
+		}
+		if string(metaIndexIter.Key()) == metaTableProperties {
+			r.propertiesBH, _ = decodeBlockHandle(metaIndexIter.Value())
+			r.hasProperties = true
+			continue
+		}
+		if name, ok := parseFilterPrefixMetaKey(metaIndexIter.Key()); ok {
+			r.filterPrefix = name
+			continue
+		}
+		format, name, ok := parseFilterMetaKey(metaIndexIter.Key())
+		if !ok {
 			continue
 		}
-		bh := metaIndexIter.Value()
-		r.metaBH, n = decodeBlockHandle(bh)
+		r.metaBH, n = decodeBlockHandle(metaIndexIter.Value())
+		r.filterName = name
+		r.filterFormat = format
 	}
 
 	metaIndexBlock.UnRef()
 	metaIndexIter.UnRef()
 
+	// filter通过名称识别, 写入时使用的filter跟当前不同时(例如从bloom filter切换到ribbon filter)不能通过filter判断
+	if r.filter != nil && r.filterName != r.filter.Name() {
+		r.filter = nil
+	}
+
 	return r, nil
 
 }
 
+// 遍历index, 每个位置返回对应的data block(分区index的顶层index时为index分区)的iterator
 type indexedIter struct {
-	utils.BasicReleaser
-	*BlockIter
-	r *Reader
+	iter.Iterator
+	r         *Reader
+	fillCache bool
 }
 
 func (i *indexedIter) Get() iter.Iterator {
 
-	value := i.value
+	value := i.Value()
 	if value == nil {
-		return nil
+		return iter.NewEmptyIterator(ErrBlockHandle)
 	}
 
 	bh, n := decodeBlockHandle(value)
 	if n == 0 {
-		return nil
+		return iter.NewEmptyIterator(ErrBlockHandle)
 	}
 
-	iter, err := i.r.getDataIter(bh)
+	dataIter, err := i.r.getDataIterFill(bh, i.fillCache)
 	if err != nil {
-		return nil
+		return iter.NewEmptyIterator(err)
 	}
-	return iter
+	return dataIter
+}
+
+func (i *indexedIter) Last() bool {
+	return iter.Last(i.Iterator)
+}
+
+func (i *indexedIter) Prev() bool {
+	return iter.Prev(i.Iterator)
 }
 
 func (r *Reader) NewIterator() iter.Iterator {
+	return r.NewBoundedIterator(nil, true)
+}
+
+// NewBoundedIterator 遍历到index key大于等于upper的data block之后不再读取后面的data block,
+// 只保证小于upper的key会被遍历到, upper为nil时与NewIterator相同
+// fillCache为false时读取的block不加入缓存
+func (r *Reader) NewBoundedIterator(upper []byte, fillCache bool) iter.Iterator {
 
-	indexBlock, releaser, err := r.readBlockCached(r.indexBH)
+	indexIter, err := r.newIndexIter(fillCache)
 	if err != nil {
-		return nil
+		return iter.NewEmptyIterator(err)
 	}
 	index := &indexedIter{
-		BlockIter: newBlockIter(indexBlock, releaser),
+		Iterator:  indexIter,
 		r:         r,
+		fillCache: fillCache,
 	}
-	return iter.NewIndexedIterator(index)
+	return iter.NewBoundedIndexedIterator(index, r.cmp, upper)
 }
 
 func (r *Reader) UnRef() {
 	//todo release the resources
 
+	r.unpin()
+
 	if closer, ok := r.reader.(io.Closer); ok {
 		closer.Close()
 	}
 
 }
+
+// BlockInfo block在sstable中的位置
+type BlockInfo struct {
+	Offset uint64
+	Length uint64
+}
+
+// IndexInfo index block中的一条记录, Key是data block的分隔key
+type IndexInfo struct {
+	Key   []byte
+	Block BlockInfo
+}
+
+// TableInfo sstable的结构信息, 包括footer, index block和filter block
+type TableInfo struct {
+	MetaIndex BlockInfo
+	Index     BlockInfo
+	Filter    BlockInfo
+
+	Indexes         []IndexInfo
+	IndexPartitions int // 分区index的分区数, 不分区时为0
+
+	FilterName   string
+	FilterFormat FilterFormat
+	FilterPrefix string
+	FilterBaseLg int
+	FilterNums   int // 分段filter的段数, 分区filter的分区数
+}
+
+// Info 解析sstable的结构信息, 用于排查问题
+func (r *Reader) Info() (*TableInfo, error) {
+
+	info := &TableInfo{
+		MetaIndex:    BlockInfo{Offset: r.metaIndexBH.offset, Length: r.metaIndexBH.length},
+		Index:        BlockInfo{Offset: r.indexBH.offset, Length: r.indexBH.length},
+		Filter:       BlockInfo{Offset: r.metaBH.offset, Length: r.metaBH.length},
+		FilterName:   r.filterName,
+		FilterFormat: r.filterFormat,
+		FilterPrefix: r.filterPrefix,
+	}
+
+	indexIter, err := r.newIndexIter(true)
+	if err != nil {
+		return nil, err
+	}
+	defer indexIter.UnRef()
+
+	for indexIter.Next() {
+		bh, n := decodeBlockHandle(indexIter.Value())
+		if n == 0 {
+			return nil, ErrBlockHandle
+		}
+		info.Indexes = append(info.Indexes, IndexInfo{
+			Key:   append([]byte(nil), indexIter.Key()...),
+			Block: BlockInfo{Offset: bh.offset, Length: bh.length},
+		})
+	}
+
+	if info.IndexPartitions, err = r.indexPartitions(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case r.metaBH.length == 0:
+	case r.filterFormat == FilterFormatFull:
+		info.FilterNums = 1
+	case r.filterFormat == FilterFormatPartitioned:
+		if info.FilterNums, err = r.filterPartitions(); err != nil {
+			return nil, err
+		}
+	default:
+		filterBlock, err := r.readFilterBlock(r.metaBH)
+		if err != nil {
+			return nil, err
+		}
+		info.FilterBaseLg = int(filterBlock.baseLg)
+		info.FilterNums = filterBlock.filterNums
+		filterBlock.UnRef()
+	}
+
+	return info, nil
+}
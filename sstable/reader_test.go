@@ -0,0 +1,243 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"myleveldb/cache"
+	"myleveldb/collections"
+	"myleveldb/comparer"
+	"myleveldb/filter"
+	"myleveldb/iter"
+	"myleveldb/utils"
+	"testing"
+)
+
+func readerTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+func readerTestValue(i int) []byte {
+	return []byte(fmt.Sprintf("value%08d", i))
+}
+
+// 写入n个偶数key, 奇数key用来检查不存在的key
+func buildTestTable(t *testing.T, f filter.IFilter, opt *WriterOptions, n int) []byte {
+
+	buf := bytes.NewBuffer(nil)
+	w := NewWriterWithOptions(buf, f, utils.NewBytePool(defaultBlockSize), 0, opt)
+	for i := 0; i < n; i++ {
+		w.Append(readerTestKey(i*2), readerTestValue(i*2))
+	}
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func openTestReader(t *testing.T, data []byte, f filter.IFilter) *Reader {
+
+	nsCache := &cache.NamespaceCache{Cache: collections.NewShardedLRUCache(1<<20, 0), Ns: cache.NewNamespace()}
+	r, err := NewReader(bytes.NewReader(data), int64(len(data)), comparer.DefaultComparer, f, nsCache, utils.NewBytePool(defaultBlockSize))
+	assert.Nil(t, err)
+	return r
+}
+
+// 点查存在以及不存在的key, 遍历以及Seek
+func assertTableReads(t *testing.T, r *Reader, n int) {
+
+	for i := 0; i < n; i++ {
+		v, err := r.Get(readerTestKey(i * 2))
+		if !assert.Nil(t, err, "key %d", i*2) || !assert.Equal(t, readerTestValue(i*2), v) {
+			return
+		}
+		_, err = r.Get(readerTestKey(i*2 + 1))
+		if !assert.Equal(t, ErrNotFound, err, "key %d", i*2+1) {
+			return
+		}
+	}
+
+	it := r.NewIterator()
+	defer it.UnRef()
+	i := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !assert.Equal(t, readerTestKey(i*2), it.Key()) || !assert.Equal(t, readerTestValue(i*2), it.Value()) {
+			return
+		}
+		i++
+	}
+	assert.Equal(t, n, i)
+
+	for _, k := range []int{0, 1, n - 1, n, 2*n - 2} {
+		it := r.NewIterator()
+		assert.True(t, it.Seek(readerTestKey(k)), "seek %d", k)
+		assert.Equal(t, readerTestKey((k+1)/2*2), it.Key(), "seek %d", k)
+		it.UnRef()
+	}
+	it = r.NewIterator()
+	assert.False(t, it.Seek(readerTestKey(2*n)))
+	it.UnRef()
+}
+
+func TestReader_DataBlockHashIndex(t *testing.T) {
+
+	const n = 2000
+	data := buildTestTable(t, &filter.BloomFilter{}, &WriterOptions{DataBlockHashIndex: true}, n)
+	r := openTestReader(t, data, nil)
+	defer r.UnRef()
+
+	info, err := r.Info()
+	assert.Nil(t, err)
+	assert.Greater(t, len(info.Indexes), 1)
+
+	// 每个data block都有hash index, 存在的key一定能定位到restart point, 不存在的key不会定位到错误的key
+	for _, index := range info.Indexes {
+		block, err := r.readBlock(blockHandle{offset: index.Block.Offset, length: index.Block.Length}, true)
+		assert.Nil(t, err)
+		assert.Greater(t, block.bucketsLen, 0)
+		block.UnRef()
+	}
+	for i := 0; i < n; i++ {
+		it, err := r.getDataIter(dataBlockHandle(t, r, readerTestKey(i*2)))
+		assert.Nil(t, err)
+		ok, absent := seekPoint(it, readerTestKey(i*2))
+		if !assert.True(t, ok, "key %d", i*2) || !assert.False(t, absent) || !assert.Equal(t, readerTestKey(i*2), it.Key()) {
+			it.UnRef()
+			return
+		}
+		ok, absent = seekPoint(it, readerTestKey(i*2+1))
+		if !assert.True(t, absent || !ok || !bytes.Equal(readerTestKey(i*2+1), it.Key()), "key %d", i*2+1) {
+			it.UnRef()
+			return
+		}
+		it.UnRef()
+	}
+
+	assertTableReads(t, r, n)
+}
+
+func TestReader_PartitionedIndex(t *testing.T) {
+
+	const n = 30000 // index block需要超过多个defaultIndexPartitionSize
+	data := buildTestTable(t, &filter.BloomFilter{}, &WriterOptions{IndexPartitionThreshold: 256}, n)
+	r := openTestReader(t, data, nil)
+	defer r.UnRef()
+
+	info, err := r.Info()
+	assert.Nil(t, err)
+	assert.Greater(t, info.IndexPartitions, 1)
+
+	// 分区index展开后的分隔key有序, data block首尾相接
+	for i := 1; i < len(info.Indexes); i++ {
+		assert.Less(t, bytes.Compare(info.Indexes[i-1].Key, info.Indexes[i].Key), 0)
+		assert.Less(t, info.Indexes[i-1].Block.Offset, info.Indexes[i].Block.Offset)
+	}
+
+	assertTableReads(t, r, n)
+
+	// 不分区时结果相同
+	r2 := openTestReader(t, buildTestTable(t, &filter.BloomFilter{}, nil, n), nil)
+	defer r2.UnRef()
+	info2, err := r2.Info()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, info2.IndexPartitions)
+	assert.Equal(t, len(info2.Indexes), len(info.Indexes))
+}
+
+func TestReader_RibbonFilter(t *testing.T) {
+
+	const n = 2000
+	for _, format := range []FilterFormat{FilterFormatFull, FilterFormatPartitioned} {
+		t.Run(format.String(), func(t *testing.T) {
+
+			ribbon := &filter.RibbonFilter{FalsePositiveRate: 0.01}
+			data := buildTestTable(t, ribbon, &WriterOptions{FilterFormat: format, FilterPrefix: "fixed.3"}, n)
+			r := openTestReader(t, data, ribbon)
+			defer r.UnRef()
+
+			info, err := r.Info()
+			assert.Nil(t, err)
+			assert.Equal(t, ribbon.Name(), info.FilterName)
+			assert.Equal(t, "fixed.3", info.FilterPrefix)
+			assert.Equal(t, format, info.FilterFormat)
+			assert.GreaterOrEqual(t, info.FilterNums, 1)
+
+			falsePositive := 0
+			for i := 0; i < n; i++ {
+				ok, err := r.MayContain(readerTestKey(i * 2))
+				assert.Nil(t, err)
+				if !assert.True(t, ok, "key %d", i*2) {
+					return
+				}
+				ok, err = r.MayContain(readerTestKey(i*2 + 1))
+				assert.Nil(t, err)
+				if ok {
+					falsePositive++
+				}
+			}
+			assert.Less(t, float64(falsePositive)/n, 0.05)
+
+			assertTableReads(t, r, n)
+
+			// 读取时使用不同的filter, 不能通过filter判断
+			bloom := openTestReader(t, data, &filter.BloomFilter{})
+			defer bloom.UnRef()
+			for i := 0; i < n; i++ {
+				ok, err := bloom.MayContain(readerTestKey(i*2 + 1))
+				assert.Nil(t, err)
+				if !assert.True(t, ok) {
+					return
+				}
+			}
+			assertTableReads(t, bloom, n)
+		})
+	}
+}
+
+// key所在的data block
+func dataBlockHandle(t *testing.T, r *Reader, key []byte) blockHandle {
+
+	indexIter, err := r.newIndexIter(true)
+	assert.Nil(t, err)
+	defer indexIter.UnRef()
+	assert.True(t, indexIter.Seek(key))
+	bh, n := decodeBlockHandle(indexIter.Value())
+	assert.NotZero(t, n)
+	return bh
+}
+
+func TestReader_Reverse(t *testing.T) {
+
+	const n = 30000
+	for _, opt := range []*WriterOptions{nil, {IndexPartitionThreshold: 256}} {
+
+		r := openTestReader(t, buildTestTable(t, &filter.BloomFilter{}, opt, n), nil)
+		it := r.NewIterator()
+
+		i := n - 1
+		for ok := iter.Last(it); ok; ok = iter.Prev(it) {
+			if !assert.Equal(t, readerTestKey(i*2), it.Key()) || !assert.Equal(t, readerTestValue(i*2), it.Value()) {
+				break
+			}
+			i--
+		}
+		assert.Equal(t, -1, i)
+		assert.Nil(t, iter.Error(it))
+
+		// 反向之后继续正向遍历
+		for _, k := range []int{1, n - 1, n, 2*n - 1, 4 * n} {
+			expect := (k+1)/2*2 - 2
+			if expect > 2*n-2 {
+				expect = 2*n - 2
+			}
+			assert.True(t, iter.SeekBefore(it, readerTestKey(k)), "seek before %d", k)
+			assert.Equal(t, readerTestKey(expect), it.Key(), "seek before %d", k)
+			if expect < 2*n-2 {
+				assert.True(t, it.Next())
+				assert.Equal(t, readerTestKey(expect+2), it.Key())
+			}
+		}
+		assert.False(t, iter.SeekBefore(it, readerTestKey(0)))
+
+		it.UnRef()
+		r.UnRef()
+	}
+}
@@ -58,7 +58,8 @@ filter block
 
 
 meta index block
-仅包含一个block entry, key是 filter.{filtername}, value是filter block对应的block handle {offset, length}
+key是 filter.{filtername}, value是filter block对应的block handle {offset, length},
+另外key为table.properties的entry指向properties block(见properties.go)
 
 	/					block entry					 \							/      block tail			\
 	+-----------+--------------+-------+-----+-------+--------------+-----------+-----------+------------+
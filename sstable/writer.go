@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"io"
+	"myleveldb/comparer"
 	"myleveldb/filter"
 	"myleveldb/utils"
+	"sort"
 )
 
 type compressionType uint
@@ -20,7 +22,7 @@ const (
 	defaultBlockSize                 = 2 << 10
 	defaultCompressionType           = noCompress
 	defaultDataBlockRestartInterval  = 16
-	defaultFilterWriterBaseLg        = 2 << 10
+	defaultFilterWriterBaseLg        = 11 // 每2k的data block生成一个filter
 	defaultFilterBitsPerKey          = 10
 	defaultMetaBlockRestartInterval  = 1
 	defaultIndexBlockRestartInterval = 1
@@ -35,13 +37,14 @@ type blockWriter struct {
 	entries         int
 	restartInterval int
 	restartIndexes  []int
+	hashIndex       *hashIndexWriter // 不为nil时在block尾部追加user key的hash index
 	scratch         [30]byte
 }
 
 func newBlockWriter(restartInterval int, bPool *utils.BytePool, size int64) *blockWriter {
 	return &blockWriter{
 		bPool:           bPool,
-		buffer:          bytes.NewBuffer(bPool.Get(size)),
+		buffer:          bytes.NewBuffer(bPool.Get(size)[:0]),
 		restartInterval: restartInterval,
 	}
 }
@@ -84,6 +87,10 @@ func (bw *blockWriter) append(key, value []byte) {
 	bw.prevKey = append(bw.prevKey[:0], key...)
 	bw.entries++
 
+	if bw.hashIndex != nil {
+		bw.hashIndex.add(key, len(bw.restartIndexes)-1)
+	}
+
 }
 
 // 结束一个block, 主要是把restartIndex填入buffer中
@@ -92,24 +99,38 @@ func (bw *blockWriter) finish() {
 		bw.restartIndexes = append(bw.restartIndexes, 0)
 	}
 	length := len(bw.restartIndexes)
-	bw.restartIndexes = append(bw.restartIndexes, length)
 	scratch := make([]byte, 4)
-	bw.buffer.Grow(len(bw.restartIndexes) * 4)
+	bw.buffer.Grow((length + 1) * 4)
 	for _, v := range bw.restartIndexes {
 		binary.LittleEndian.PutUint32(scratch, uint32(v))
 		bw.buffer.Write(scratch)
 	}
+
+	// 有hash index时restart point的个数带上标记
+	if bw.hashIndex != nil && bw.hashIndex.usable(length) {
+		bw.hashIndex.finish(bw.buffer)
+		length |= hashIndexFlag
+	}
+	binary.LittleEndian.PutUint32(scratch, uint32(length))
+	bw.buffer.Write(scratch)
 }
 
 func (bw *blockWriter) reset() {
 	bw.buffer.Reset()
 	bw.entries = 0
 	bw.restartIndexes = bw.restartIndexes[:0]
+	if bw.hashIndex != nil {
+		bw.hashIndex.reset()
+	}
 }
 
 // BlockSize 获取当前block块的大小
 func (bw *blockWriter) BlockSize() int {
-	return bw.buffer.Len() + len(bw.restartIndexes)*4 + 4
+	size := bw.buffer.Len() + len(bw.restartIndexes)*4 + 4
+	if bw.hashIndex != nil && bw.hashIndex.usable(len(bw.restartIndexes)) {
+		size += bw.hashIndex.size()
+	}
+	return size
 }
 
 func (bw *blockWriter) Close() error {
@@ -176,6 +197,11 @@ func (fb *filterWriter) finish() {
 
 }
 
+func (fb *filterWriter) write(w *Writer) (*blockHandle, error) {
+	fb.finish()
+	return w.writeBlock(fb.buf, noCompress)
+}
+
 func (fb *filterWriter) Close() error {
 	utils.PutPoolNamespace(defaultFilterBytePoolNamespace, fb.buf)
 	return nil
@@ -190,6 +216,11 @@ func newFilterWriter(writer io.Writer, filterGenerator filter.IFilterGenerator)
 	}
 }
 
+// meta index block中的一条记录
+type metaEntry struct {
+	key, value []byte
+}
+
 // Writer 将内容写入sstable的writer
 type Writer struct {
 	io.Writer
@@ -200,21 +231,108 @@ type Writer struct {
 	pendingBlockHandle                         *blockHandle
 	offset                                     uint64
 	dataBlockWriter                            *blockWriter
-	filterBlockWriter                          *filterWriter
+	cmp                                        comparer.BasicComparer // 缩短index block中的key
+	filterFormat                               FilterFormat
+	filterPrefix                               string
+	indexPartitionThreshold                    int
+	filterBlockWriter                          filterBlockWriter
+	properties                                 Properties
 	metaIndexBlockWriter, dataIndexBlockWriter *blockWriter
 	scratch                                    [50]byte
 }
 
+// WriterOptions sstable的写入选项
+type WriterOptions struct {
+	FilterFormat FilterFormat // filter block的格式, 默认为FilterFormatBlock
+
+	// data block尾部追加user key的hash index, 点查时直接定位到restart point,
+	// Comparer实现了UserKeyExtractor时按照user key计算hash, 读取时需要使用同样的comparer
+	DataBlockHashIndex bool
+
+	// key的顺序, 用于缩短index block中的key, 默认按照字节比较
+	Comparer comparer.BasicComparer
+
+	// index block超过该大小(字节)时切分成多个分区, 读取时只有顶层index常驻缓存, 小于等于0时不分区
+	IndexPartitionThreshold int
+
+	// filter中除了完整的key还加入了prefix时为提取prefix的规则名称, 单独记录在meta index block中,
+	// filter的名称不变, 所以没有加入prefix的sstable仍然可以用filter点查
+	FilterPrefix string
+
+	// sstable所属的family, 连同Comparer的名称一起写入properties block
+	ColumnFamilyID   uint32
+	ColumnFamilyName string
+}
+
+func (opt *WriterOptions) GetFilterFormat() FilterFormat {
+	if opt == nil {
+		return FilterFormatBlock
+	}
+	return opt.FilterFormat
+}
+
+func (opt *WriterOptions) GetDataBlockHashIndex() bool {
+	if opt == nil {
+		return false
+	}
+	return opt.DataBlockHashIndex
+}
+
+func (opt *WriterOptions) GetFilterPrefix() string {
+	if opt == nil {
+		return ""
+	}
+	return opt.FilterPrefix
+}
+
+func (opt *WriterOptions) GetIndexPartitionThreshold() int {
+	if opt == nil {
+		return 0
+	}
+	return opt.IndexPartitionThreshold
+}
+
+func (opt *WriterOptions) properties() Properties {
+	if opt == nil {
+		return Properties{ComparerName: comparer.DefaultComparer.Name()}
+	}
+	return Properties{
+		ColumnFamilyID:   opt.ColumnFamilyID,
+		ColumnFamilyName: opt.ColumnFamilyName,
+		ComparerName:     opt.GetComparer().Name(),
+	}
+}
+
+func (opt *WriterOptions) GetComparer() comparer.BasicComparer {
+	if opt == nil || opt.Comparer == nil {
+		return comparer.DefaultComparer
+	}
+	return opt.Comparer
+}
+
 func NewWriter(w io.Writer, filter filter.IFilter, bPool *utils.BytePool, size int64) *Writer {
+	return NewWriterWithOptions(w, filter, bPool, size, nil)
+}
+
+// NewWriterWithOptions opt为nil时使用默认选项
+func NewWriterWithOptions(w io.Writer, filter filter.IFilter, bPool *utils.BytePool, size int64, opt *WriterOptions) *Writer {
 	writer := &Writer{
-		Writer:               w,
-		filter:               filter,
-		blockSize:            defaultBlockSize,
-		compressionType:      defaultCompressionType,
-		dataBlockWriter:      newBlockWriter(defaultDataBlockRestartInterval, bPool, size),
-		filterBlockWriter:    newFilterWriter(w, filter.NewFilterGenerator(defaultFilterBitsPerKey)),
-		metaIndexBlockWriter: newBlockWriter(defaultMetaBlockRestartInterval, bPool, size),
-		dataIndexBlockWriter: newBlockWriter(defaultIndexBlockRestartInterval, bPool, size),
+		Writer:                  w,
+		filter:                  filter,
+		blockSize:               defaultBlockSize,
+		compressionType:         defaultCompressionType,
+		cmp:                     opt.GetComparer(),
+		filterFormat:            opt.GetFilterFormat(),
+		filterPrefix:            opt.GetFilterPrefix(),
+		indexPartitionThreshold: opt.GetIndexPartitionThreshold(),
+		properties:              opt.properties(),
+		dataBlockWriter:         newBlockWriter(defaultDataBlockRestartInterval, bPool, size),
+		metaIndexBlockWriter:    newBlockWriter(defaultMetaBlockRestartInterval, bPool, size),
+		dataIndexBlockWriter:    newBlockWriter(defaultIndexBlockRestartInterval, bPool, size),
+	}
+	writer.filterBlockWriter = newFilterBlockWriter(writer.filterFormat, writer, bPool)
+	if opt.GetDataBlockHashIndex() {
+		writer.dataBlockWriter.hashIndex = &hashIndexWriter{cmp: opt.GetComparer()}
 	}
 	return writer
 }
@@ -249,31 +367,58 @@ func (w *Writer) Close() (err error) {
 		}
 	}()
 
+	if w.err != nil {
+		return w.err
+	}
+
 	// 如果data block还有没写入到设备块的, 那么写入到设备块
-	if w.dataBlockWriter.buffer.Len() > 0 {
-		// 先把block handle 刷到 index block中
-		w.flushPendingBH(nil)
-		// 写入一个block
+	if w.dataBlockWriter.entries > 0 {
 		err = w.finishBlock(w.dataBlockWriter)
 		if err != nil {
 			return err
 		}
 	}
 
+	// 把最后一个data block的block handle刷到index block中
+	w.flushPendingBH(nil)
+
 	var filterBh *blockHandle
 
 	// 将bloom filter的内容写入到设备块中
-	w.filterBlockWriter.finish()
-	filterBh, err = w.writeBlock(w.filterBlockWriter.buf, noCompress)
+	filterBh, err = w.filterBlockWriter.write(w)
+	if err != nil {
+		return err
+	}
+
+	propertiesBh, err := w.writeProperties()
 	if err != nil {
 		return err
 	}
 
 	var metaBlockHandle *blockHandle
-	// 写入metablock handle
-	key := []byte("filter." + w.filter.Name())
-	n := encodeBlockHandle(w.scratch[:20], *filterBh)
-	w.metaIndexBlockWriter.append(key, w.scratch[:n])
+	// 写入metablock handle, key的前缀记录了filter的格式, meta index block中的key需要有序
+	partitioned := w.indexPartitioned()
+	metas := []metaEntry{{
+		key:   []byte(w.filterFormat.metaPrefix() + w.filter.Name()),
+		value: w.scratch[:encodeBlockHandle(w.scratch[:20], *filterBh)],
+	}}
+	metas = append(metas, metaEntry{
+		key:   []byte(metaTableProperties),
+		value: w.scratch[20:][:encodeBlockHandle(w.scratch[20:40], *propertiesBh)],
+	})
+	if partitioned {
+		metas = append(metas, metaEntry{key: []byte(metaIndexPartitioned)})
+	}
+	if w.filterPrefix != "" {
+		metas = append(metas, metaEntry{key: []byte(metaFilterPrefix + w.filterPrefix)})
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return bytes.Compare(metas[i].key, metas[j].key) < 0
+	})
+	for _, meta := range metas {
+		w.metaIndexBlockWriter.append(meta.key, meta.value)
+	}
+	w.metaIndexBlockWriter.finish()
 	metaBlockHandle, err = w.writeBlock(w.metaIndexBlockWriter.buffer, w.compressionType)
 	if err != nil {
 		return err
@@ -281,15 +426,19 @@ func (w *Writer) Close() (err error) {
 
 	// 写入indexblock
 	var indexBlockHandle *blockHandle
-	w.dataIndexBlockWriter.finish()
-	indexBlockHandle, err = w.writeBlock(w.dataIndexBlockWriter.buffer, w.compressionType)
+	if partitioned {
+		indexBlockHandle, err = w.writePartitionedIndex()
+	} else {
+		w.dataIndexBlockWriter.finish()
+		indexBlockHandle, err = w.writeBlock(w.dataIndexBlockWriter.buffer, w.compressionType)
+	}
 	if err != nil {
 		return err
 	}
 
 	footer := make([]byte, footerLength)
 
-	n = encodeBlockHandle(footer, *metaBlockHandle)
+	n := encodeBlockHandle(footer, *metaBlockHandle)
 	_ = encodeBlockHandle(footer[n:], *indexBlockHandle)
 
 	copy(footer[footerLength-len(magic):], magic)
@@ -298,6 +447,7 @@ func (w *Writer) Close() (err error) {
 	if err != nil {
 		return err
 	}
+	w.offset += footerLength
 	return nil
 
 }
@@ -326,18 +476,19 @@ func (w *Writer) finishBlock(block *blockWriter) error {
 
 func (w *Writer) writeBlock(buffer *bytes.Buffer, compressionType compressionType) (*blockHandle, error) {
 
-	var buf []byte
+	if compressionType != noCompress {
+		return nil, ErrCompressTypeUnsupport
+	}
 
-	if compressionType == compress {
+	length := buffer.Len()
 
-	} else {
-		buffer.Grow(5)
-		buffer.WriteByte(blockTypeNoCompression)
-		buf = buffer.Bytes()
-	}
+	// 尾部追加压缩类型和check sum, check sum包括data和压缩类型
+	buffer.WriteByte(blockTypeNoCompression)
+	var trail [4]byte
+	binary.LittleEndian.PutUint32(trail[:], crc32.ChecksumIEEE(buffer.Bytes()))
+	buffer.Write(trail[:])
 
-	checkSum := crc32.ChecksumIEEE(buf)
-	binary.LittleEndian.PutUint32(buf[len(buf):], checkSum)
+	buf := buffer.Bytes()
 	_, err := w.Writer.Write(buf)
 	if err != nil {
 		return nil, err
@@ -345,7 +496,7 @@ func (w *Writer) writeBlock(buffer *bytes.Buffer, compressionType compressionTyp
 
 	bh := &blockHandle{
 		offset: w.offset,
-		length: uint64(len(buf) - blockTrialLen),
+		length: uint64(length),
 	}
 
 	w.offset += uint64(len(buf))
@@ -365,15 +516,13 @@ func (w *Writer) flushPendingBH(key []byte) {
 	w.dataBlockWriter.prevKey = w.dataBlockWriter.prevKey[:0]
 }
 
-// 获取index block的key
+// 获取index block的key, a为data block的最后一个key, b为下一个data block的第一个key, 最后一个data block时b为nil
+// 通过comparer缩短key, 写入的key是internalKey时由iComparer保证缩短后仍然是合法的internalKey
 func (w *Writer) getIndexKey(a, b []byte) []byte {
-	var separator []byte
 	if b == nil {
-		separator = getSuccessor(a)
-	} else {
-		separator = getSeparator(a, b)
+		return append([]byte(nil), w.cmp.Successor(a)...)
 	}
-	return separator
+	return append([]byte(nil), w.cmp.Separator(a, b)...)
 }
 
 // BytesLen 获取writer写的字节大小
@@ -381,62 +530,6 @@ func (w *Writer) BytesLen() uint64 {
 	return w.offset
 }
 
-/**
-*	遍历字节数组a, 从左往右遍历, 找到第一个ascii+1并且+1后的字节表示不超过255 即可返回
-*	特殊情况下, 如果a从左往右每一位都是 0xff, 则直接返回 a
-*	e.g.
-*	0xff 0xff 0xfe -> 0xff 0xff 0xff
-*	0xfe -> 0xff
-*   0xf1 0xff -> 0xf2
-**/
-func getSuccessor(a []byte) []byte {
-
-	for i, c := range a {
-		if c+1 < 0xff {
-			dst := make([]byte, i+1)
-			copy(dst, a[:i])
-			dst[i] = c + 1
-			return dst
-		}
-	}
-	return a
-}
-
-/**
-*   要求是a<=b
-*	获取a, b 之间的separator, 返回的x是 a<=x, x<b
-*	存在一种特殊情况, 如果a是b的子集, 那么直接返回a本身
-*	从左往右, 遍历a, b, 相同的跳过, 直到找到第一个a[i] < b[i] 并且 a[i]+1 < 一个字节的最大值(0xff)
-*   以此类推, 找不到的时候回返回a 本身
-*	e.g.
-*	ae   b     -> ae
-*	abcd abcde -> abcd
-*	abcd abcf  -> abce
-*	abcd abcd  -> abcd
-*	0xff 0xfe | 0xff 0xff -> 0xff 0xfe
-*
-**/
-func getSeparator(a, b []byte) []byte {
-
-	// 找出两个之间最短的
-	i, n := 0, len(a)
-	if n > len(b) {
-		n = len(b)
-	}
-	for ; a[i] == b[i] && i < n; i++ {
-
-	}
-
-	if i >= n {
-		// 说明a是b的子集
-	} else if c := a[i] + 1; c < b[i] && c < 0xff {
-		dst := append(a[:i], c)
-		return dst
-	}
-
-	return a
-}
-
 func powerOfTwo(givenMum int) int {
 	givenMum--
 	givenMum |= givenMum >> 1
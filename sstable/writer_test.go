@@ -2,6 +2,7 @@ package sstable
 
 import (
 	"github.com/stretchr/testify/assert"
+	"myleveldb/utils"
 	"testing"
 )
 
@@ -16,7 +17,7 @@ const (
 
 func Test_datablock(t *testing.T) {
 
-	bw := newBlockWriter(datablockRI)
+	bw := newBlockWriter(datablockRI, utils.NewBytePool(defaultBlockSize), 0)
 
 	chars := generateKeyValues()
 
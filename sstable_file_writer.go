@@ -0,0 +1,146 @@
+package myleveldb
+
+import (
+	"errors"
+	"myleveldb/cache"
+	"myleveldb/collections"
+	"myleveldb/comparer"
+	error2 "myleveldb/error"
+	"myleveldb/sstable"
+	"os"
+)
+
+/**
+SSTableFileWriter 在db之外生成sstable文件, 生成的文件可以通过DB.IngestExternalFiles导入到db中
+
+写入的是ukey, 文件中实际保存的是seq为0的internalKey, 导入时会统一替换成db分配的全局seq
+key必须按照Options中的comparer严格递增的顺序写入, 否则返回ErrKeyNotSorted
+
+	w, _ := NewSSTableFileWriter("/data/bulk.ldb", nil)
+	w.Put(a, 1) w.Put(b, 2) w.Delete(c)
+	w.Finish()
+	db.IngestExternalFiles([]string{"/data/bulk.ldb"})
+**/
+
+type SSTableFileWriter struct {
+	path   string
+	file   *os.File
+	writer *sstable.Writer
+	cmp    comparer.BasicComparer
+	last   []byte
+	n      int
+	closed bool
+}
+
+// NewSSTableFileWriter 在path创建一个新的sstable文件, path已经存在时返回错误
+func NewSSTableFileWriter(path string, opt *Options) (*SSTableFileWriter, error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSTableFileWriter{
+		path:   path,
+		file:   file,
+		writer: sstable.NewWriterWithOptions(file, newIFilter(opt), opt.GetPool(), 0, opt.sstableWriterOptions(&iComparer{opt.GetCompare()}, defaultColumnFamilyID, defaultColumnFamilyName)),
+		cmp:    opt.GetCompare(),
+	}, nil
+}
+
+// Put 写入一条记录, key需要大于上一次写入的key
+func (w *SSTableFileWriter) Put(key, value []byte) error {
+	return w.append(key, value, keyTypeVal)
+}
+
+// Delete 写入一条删除记录, key需要大于上一次写入的key
+func (w *SSTableFileWriter) Delete(key []byte) error {
+	return w.append(key, nil, keyTypeDel)
+}
+
+func (w *SSTableFileWriter) append(key, value []byte, kt keyType) error {
+
+	if w.closed {
+		return error2.ErrClosed
+	}
+
+	if w.n > 0 && w.cmp.Compare(key, w.last) <= 0 {
+		return error2.ErrKeyNotSorted
+	}
+
+	w.writer.Append(makeInternalKey(key, 0, kt), value)
+	w.last = append(w.last[:0], key...)
+	w.n++
+	return nil
+}
+
+// Len 返回已经写入的记录数量
+func (w *SSTableFileWriter) Len() int {
+	return w.n
+}
+
+// Finish 写入index, filter以及footer并关闭文件, 没有写入任何记录时删除文件并返回错误
+func (w *SSTableFileWriter) Finish() error {
+
+	if w.closed {
+		return error2.ErrClosed
+	}
+
+	if w.n == 0 {
+		w.Abort()
+		return errors.New("myleveldb/sstable file writer has no entries")
+	}
+
+	w.closed = true
+
+	err := w.writer.Close()
+	if err == nil {
+		err = w.file.Sync()
+	}
+
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(w.path)
+	}
+	return err
+}
+
+// 打开db之外的sstable文件, 使用完后需要调用reader.UnRef关闭文件
+func openSSTableFile(path string, opt *Options) (*sstable.Reader, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader, err := sstable.NewReader(file, stat.Size(), &iComparer{opt.GetCompare()}, newIFilter(opt),
+		&cache.NamespaceCache{
+			Cache: collections.NewLRUCache(defaultBlockCacheCapacity),
+		}, opt.GetPool())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Abort 放弃写入, 关闭并删除文件
+func (w *SSTableFileWriter) Abort() {
+
+	if w.closed {
+		return
+	}
+
+	w.closed = true
+	w.file.Close()
+	os.Remove(w.path)
+}
@@ -22,6 +22,10 @@ var (
 	ErrCorupted   = errors.New("corupted content err")
 )
 
+const (
+	lostDirName = "lost" // repair时被隔离的文件所在的目录
+)
+
 // FileStorage 文件存储
 type FileStorage struct {
 	dir      string   // 文件目录
@@ -94,8 +98,8 @@ func (fs *FileStorage) Open(fd FileDesc) (Reader, error) {
 		return nil, ErrFileDesc
 	}
 
-	fs.mutex.RLock()
-	defer fs.mutex.RUnlock()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
 
 	if fs.open < 0 {
 		return nil, ErrStorClosed
@@ -233,6 +237,54 @@ func (fs *FileStorage) Rename(oldFd, newFd FileDesc) error {
 		filepath.Join(fs.dir, fsGenFileName(newFd)))
 }
 
+// Link 将path硬链接为fd, 用于导入外部的sstable
+func (fs *FileStorage) Link(path string, fd FileDesc) error {
+
+	if !fd.FileDescOK() {
+		return ErrFileDesc
+	}
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.open < 0 {
+		return ErrStorClosed
+	}
+
+	return os.Link(path, filepath.Join(fs.dir, fsGenFileName(fd)))
+}
+
+// Lost 将文件移动到lost目录中隔离, 用于repair时无法读取的文件
+func (fs *FileStorage) Lost(fd FileDesc) error {
+
+	if !fd.FileDescOK() {
+		return ErrFileDesc
+	}
+
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.open < 0 {
+		return ErrStorClosed
+	}
+
+	lostDir := filepath.Join(fs.dir, lostDirName)
+	if err := os.MkdirAll(lostDir, 0755); err != nil {
+		return err
+	}
+
+	name := fsGenFileName(fd)
+	return os.Rename(filepath.Join(fs.dir, name), filepath.Join(lostDir, name))
+}
+
 // SetMeta 设置元信息保存在哪个文件
 func (fs *FileStorage) SetMeta(fd FileDesc) error {
 
@@ -300,7 +352,7 @@ func (fs *FileStorage) setMeta(fd FileDesc) error {
 	}
 
 	// rename 名字
-	if err = os.Rename(fullCurrentPath, fullCurrentTmpPath); err != nil {
+	if err = os.Rename(fullCurrentTmpPath, fullCurrentPath); err != nil {
 		return err
 	}
 
@@ -478,6 +530,7 @@ func (fs *FileStorage) Close() error {
 
 	runtime.SetFinalizer(fs, nil)
 
+	fs.open = -1
 	return fs.flock.Release()
 
 }
@@ -516,7 +569,7 @@ func (fw *fileWriter) Close() (err error) {
 
 func fsParseName(fdName string, fd *FileDesc) bool {
 	var tail string
-	_, err := fmt.Sscanf(fdName, "%06d.%s", fd.Num, &tail)
+	_, err := fmt.Sscanf(fdName, "%06d.%s", &fd.Num, &tail)
 	if err == nil {
 
 		switch tail {
@@ -526,6 +579,8 @@ func fsParseName(fdName string, fd *FileDesc) bool {
 			fd.Type = FileTypeSSTable
 		case "temp":
 			fd.Type = FileTypeTemp
+		case "blob":
+			fd.Type = FileTypeBlob
 		default:
 			return false
 		}
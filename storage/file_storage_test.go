@@ -171,3 +171,38 @@ func TestFileStorage_GetMeta(t *testing.T) {
 	assert.EqualValues(t, maxFd.Type, fdG.Type)
 
 }
+
+func TestFileStorage_Lost(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenFile(dir, false)
+	assert.Nil(t, err)
+	defer fs.Close()
+
+	fd := FileDesc{
+		Type: FileTypeSSTable,
+		Num:  3,
+	}
+
+	writer, err := fs.Create(fd)
+	assert.Nil(t, err)
+	_, _ = writer.Write([]byte("broken table"))
+	writer.Close()
+
+	fds, err := fs.List(FileTypeSSTable)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []FileDesc{fd}, fds)
+
+	err = fs.Lost(fd)
+	assert.Nil(t, err)
+
+	fds, err = fs.List(FileTypeSSTable)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, len(fds))
+
+	_, err = os.Stat(filepath.Join(dir, lostDirName, fsGenFileName(fd)))
+	assert.Nil(t, err)
+}
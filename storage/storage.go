@@ -13,7 +13,8 @@ const (
 	FileTypeJournal
 	FileTypeSSTable
 	FileTypeTemp
-	FileAll = FileTypeManifest | FileTypeJournal | FileTypeSSTable | FileTypeTemp
+	FileTypeBlob // kv分离后存放大value的blob文件
+	FileAll      = FileTypeManifest | FileTypeJournal | FileTypeSSTable | FileTypeTemp | FileTypeBlob
 )
 
 // FileDesc stor描述符
@@ -33,6 +34,8 @@ func fsGenFileName(fd FileDesc) string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case FileTypeTemp:
 		return fmt.Sprintf("%06d.temp", fd.Num)
+	case FileTypeBlob:
+		return fmt.Sprintf("%06d.blob", fd.Num)
 	default:
 		return fmt.Sprintf("%06d.%x", fd.Num, fd.Type)
 	}
@@ -41,7 +44,7 @@ func fsGenFileName(fd FileDesc) string {
 
 func (fd *FileDesc) FileDescOK() bool {
 	switch fd.Type {
-	case FileTypeManifest, FileTypeJournal, FileTypeSSTable, FileTypeTemp:
+	case FileTypeManifest, FileTypeJournal, FileTypeSSTable, FileTypeTemp, FileTypeBlob:
 	default:
 		return false
 	}
@@ -85,6 +88,12 @@ type Locker interface {
 	UnLock() error
 }
 
+// Linker 可选的接口, 将存储之外的文件以硬链接的方式加入到存储中, 不需要复制文件内容
+type Linker interface {
+	// Link 将path硬链接为fd, 不支持硬链接(例如不在同一个文件系统)时返回error
+	Link(path string, fd FileDesc) error
+}
+
 // Storage 存储层导出接口
 type Storage interface {
 	// Lock 上锁
@@ -108,6 +117,9 @@ type Storage interface {
 	// Rename 重命名
 	Rename(oldFd, newFd FileDesc) error
 
+	// Lost 将文件隔离到lost目录中, 不再被List列出
+	Lost(fd FileDesc) error
+
 	// Create 创建文件, 如果文件存在, 内容会被truncate
 	Create(fd FileDesc) (Writer, error)
 
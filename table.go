@@ -18,6 +18,8 @@ type tFile struct {
 	fd       storage.FileDesc
 	size     int64
 	min, max internalKey
+	level    int    // 所在的层, 由版本设置, 还没有加入版本的文件为0
+	seq      uint64 // 导入的外部文件的全局seq, 文件中记录的seq都为0, 读取时替换为该seq, 其他文件为0
 }
 
 func (t tFile) overlapped(icmp *iComparer, umin, umax []byte) bool {
@@ -49,12 +51,11 @@ func (tf tFiles) sortByKey(icmp comparer.BasicComparer) {
 }
 
 func (tf tFiles) getRange(icmp comparer.BasicComparer) (imin, imax internalKey) {
-	i := 0
-	for i < len(tf) {
-		if icmp.Compare(tf[i].min, imin) < 0 {
+	for i := range tf {
+		if i == 0 || icmp.Compare(tf[i].min, imin) < 0 {
 			imin = tf[i].min
 		}
-		if icmp.Compare(tf[i].max, imax) > 0 {
+		if i == 0 || icmp.Compare(tf[i].max, imax) > 0 {
 			imax = tf[i].max
 		}
 	}
@@ -77,12 +78,12 @@ func (tf tFiles) getOverlaps(icmp *iComparer, umin, umax []byte, overlapped bool
 				reLoop := false
 				if icmp.uCompare(t.min.uKey(), umin) < 0 {
 					umin = t.min.uKey()
-					i = 0
+					i = -1
 					reLoop = true
 				}
 				if icmp.uCompare(t.max.uKey(), umax) > 0 {
 					umax = t.max.uKey()
-					i = 0
+					i = -1
 					reLoop = true
 				}
 				if reLoop {
@@ -123,34 +124,16 @@ func (tf tFiles) getOverlaps(icmp *iComparer, umin, umax []byte, overlapped bool
 		var begin, end int
 		n := len(tf)
 		// 所有sstable文件的key范围不会重叠, 所以可以使用二分查找
-		// 首先定位sstable第一个min在umin之后的, 如果它的上一个sstable的max仍在umin之后, 那也要算进来
-		idx := sort.Search(n, func(i int) bool {
-			return icmp.uCompare(tf[i].min, umin) > 0
+		// 首先定位第一个max大于等于umin的sstable, 它之前的sstable都在umin之前
+		begin = sort.Search(n, func(i int) bool {
+			return icmp.uCompare(tf[i].max.uKey(), umin) >= 0
 		})
 
-		if idx == 0 || idx == n {
-			begin = idx
-		} else if icmp.uCompare(tf[idx-1].min.uKey(), umin) >= 0 {
-			begin = idx - 1
-		} else {
-			begin = idx
-		}
-
-		// 再定位sstable第一个max在umax之后的
-
-		idx = sort.Search(n, func(i int) bool {
-			return icmp.uCompare(tf[i].max, umax) > 0
+		// 再定位第一个min大于umax的sstable, 它以及它之后的sstable都在umax之后
+		end = sort.Search(n, func(i int) bool {
+			return icmp.uCompare(tf[i].min.uKey(), umax) > 0
 		})
 
-		// 说明所有的sstable文件中不存在max大于umax的文件
-		if idx == n {
-			end = idx
-		} else if icmp.uCompare(tf[idx].min, umin) <= 0 {
-			end = idx + 1 // 因为golang的切片不包括index, 所以需要做+1操作
-		} else {
-			end = idx
-		}
-
 		if end-begin <= 0 {
 			return dst
 		}
@@ -171,16 +154,24 @@ func (tf tFiles) size() (s int64) {
 }
 
 func (tf tFiles) NewIteratorIndexer(top *sstableOperation) iter.IteratorIndexer {
+	return tf.NewBoundedIteratorIndexer(top, nil)
+}
+
+// NewBoundedIteratorIndexer 每一个sstable的iterator都不加载upper之后的data block
+func (tf tFiles) NewBoundedIteratorIndexer(top *sstableOperation, upper internalKey) iter.IteratorIndexer {
 	return iter.NewArrayIndexer(&tFileArrayIndexer{
-		tfs: tf,
-		top: top,
+		tfs:   tf,
+		top:   top,
+		icmp:  top.icmp,
+		upper: upper,
 	})
 }
 
 type tFileArrayIndexer struct {
-	tfs  tFiles
-	top  *sstableOperation
-	icmp comparer.BasicComparer
+	tfs   tFiles
+	top   *sstableOperation
+	icmp  comparer.BasicComparer
+	upper internalKey
 }
 
 func (ti tFileArrayIndexer) Len() int {
@@ -192,7 +183,7 @@ func (ti tFileArrayIndexer) Get(i int) iter.Iterator {
 		return iter.NewEmptyIterator(errors.New("out of range bound"))
 	}
 	tf := ti.tfs[i]
-	return ti.top.NewIterator(tf)
+	return ti.top.NewBoundedIterator(tf, ti.upper)
 }
 
 func (ti tFileArrayIndexer) Search(key []byte) int {
@@ -205,9 +196,100 @@ func (ti tFileArrayIndexer) Search(key []byte) int {
 // sstableOperation sstable 相关操作封装
 type sstableOperation struct {
 	s          *Session
+	icmp       *iComparer
+	iFilter    iFilter
+	writerOpts *sstable.WriterOptions
 	bPool      *utils.BytePool
 	FileCache  *cache.NamespaceCache
 	BlockCache *cache.NamespaceCache
+
+	// 缓存是否由db自己创建, 外部传入的共享缓存关闭时只删掉自己namespace中的节点
+	ownFileCache  bool
+	ownBlockCache bool
+
+	// 读取的block不加入block cache
+	dontFillCache bool
+
+	// 打开sstable时固定index block以及filter block
+	pinTier PinningTier
+}
+
+func newTableOperation(s *Session) *sstableOperation {
+
+	sstOpt := &sstableOperation{
+		s:          s,
+		icmp:       s.icmp,
+		iFilter:    s.iFilter,
+		writerOpts: s.Options.sstableWriterOptions(s.icmp, defaultColumnFamilyID, defaultColumnFamilyName),
+		bPool:      s.Options.GetPool(),
+		pinTier:    s.Options.GetPinIndexAndFilterBlocks(),
+	}
+
+	// 文件号只在db内唯一, 每个db使用不同的namespace, 共享缓存时key不会冲突
+	ns := cache.NewNamespace()
+
+	fileCache := s.Options.GetOpenFilesCache()
+	if fileCache == nil {
+		fileCache = collections.NewShardedLRUCache(int64(s.Options.GetOpenFilesCacheCapacity()), s.Options.GetCacheShardBits())
+		sstOpt.ownFileCache = true
+	}
+	blockCache := s.Options.GetBlockCache()
+	if blockCache == nil {
+		blockCache = collections.NewShardedCache(s.Options.GetBlockCacheCapacity(), s.Options.GetCacheShardBits(),
+			s.Options.GetBlockCachePolicy())
+		sstOpt.ownBlockCache = true
+	}
+
+	sstOpt.FileCache = &cache.NamespaceCache{Cache: fileCache, Ns: ns}
+	sstOpt.BlockCache = &cache.NamespaceCache{Cache: blockCache, Ns: ns}
+	return sstOpt
+}
+
+// sstable读取block时使用的缓存, key为 文件号 + block offset
+func (sstOpt *sstableOperation) blockCacheOf(num int) *cache.NamespaceCache {
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint64(prefix, uint64(num))
+	return &cache.NamespaceCache{
+		Cache:  sstOpt.BlockCache.Cache,
+		Ns:     sstOpt.BlockCache.Ns,
+		Prefix: prefix,
+	}
+}
+
+// 使用family的comparer, filter读写sstable, 所有family共享同一个file cache以及block cache
+// 文件号码在所有family中唯一, 所以缓存的key不会冲突
+func (sstOpt *sstableOperation) withFamily(cf *ColumnFamily) *sstableOperation {
+	return &sstableOperation{
+		s:          sstOpt.s,
+		icmp:       cf.icmp,
+		iFilter:    cf.iFilter,
+		writerOpts: cf.opt.sstableWriterOptions(cf.icmp, cf.id, cf.name),
+		bPool:      cf.opt.GetPool(),
+		FileCache:  sstOpt.FileCache,
+		BlockCache: sstOpt.BlockCache,
+		pinTier:    cf.opt.GetPinIndexAndFilterBlocks(),
+	}
+}
+
+// 读取的block不加入block cache, 其他与sstOpt相同
+func (sstOpt *sstableOperation) withoutFillCache() *sstableOperation {
+	dup := *sstOpt
+	dup.dontFillCache = true
+	return &dup
+}
+
+// 关闭缓存, 释放所有打开的sstable
+func (sstOpt *sstableOperation) close() {
+	closeCache(sstOpt.FileCache, sstOpt.ownFileCache)
+	closeCache(sstOpt.BlockCache, sstOpt.ownBlockCache)
+}
+
+func closeCache(nsCache *cache.NamespaceCache, own bool) {
+	if own {
+		nsCache.Cache.Close()
+	} else {
+		nsCache.Cache.EvictNamespace(nsCache.Ns)
+	}
 }
 
 func (sstOpt *sstableOperation) create(size int64) (*tWriter, error) {
@@ -219,7 +301,7 @@ func (sstOpt *sstableOperation) create(size int64) (*tWriter, error) {
 	return &tWriter{
 		fd:          fd,
 		writer:      w,
-		tableWriter: sstable.NewWriter(w, sstOpt.s.iFilter, sstOpt.bPool, size),
+		tableWriter: sstable.NewWriterWithOptions(w, sstOpt.iFilter, sstOpt.bPool, size, sstOpt.writerOpts),
 	}, nil
 }
 
@@ -232,10 +314,10 @@ type tWriter struct {
 
 func (t *tWriter) append(key, value []byte) {
 	if t.first == nil {
-		t.first = key
+		t.first = append([]byte(nil), key...)
 	}
 	t.tableWriter.Append(key, value)
-	t.last = key
+	t.last = append(t.last[:0], key...)
 }
 
 func (t *tWriter) finish() (*tFile, error) {
@@ -258,7 +340,8 @@ func (t *tWriter) finish() (*tFile, error) {
 
 }
 
-func (sstOpt *sstableOperation) createFrom(iterator iter.Iterator) (*tFile, error) {
+// bw不为nil时, 较大的value写入到blob文件中
+func (sstOpt *sstableOperation) createFrom(iterator iter.Iterator, bw *blobWriter) (*tFile, error) {
 
 	tWriter, err := sstOpt.create(0)
 	if err != nil {
@@ -266,7 +349,13 @@ func (sstOpt *sstableOperation) createFrom(iterator iter.Iterator) (*tFile, erro
 	}
 
 	for iterator.Next() {
-		tWriter.append(iterator.Key(), iterator.Value())
+		key, value, err := bw.separate(iterator.Key(), iterator.Value())
+		if err != nil {
+			tWriter.writer.Close()
+			sstOpt.s.stor.Remove(tWriter.fd)
+			return nil, err
+		}
+		tWriter.append(key, value)
 	}
 
 	tf, err := tWriter.finish()
@@ -289,12 +378,20 @@ func (sstOpt *sstableOperation) open(t tFile) (*collections.LRUHandle, error) {
 			return 0, nil, nil, err
 		}
 
-		reader, err := sstable.NewReader(fd, t.size, sstOpt.s.icmp, sstOpt.FileCache)
+		reader, err := sstable.NewReader(fd, t.size, sstOpt.icmp, sstOpt.iFilter, sstOpt.blockCacheOf(t.fd.Num), sstOpt.bPool)
 		if err != nil {
 			fd.Close()
 			return 0, nil, nil, err
 		}
 
+		if sstOpt.pinned(t) {
+			if err := reader.PinIndexAndFilter(); err != nil {
+				reader.UnRef()
+				return 0, nil, nil, err
+			}
+		}
+
+		// reader实现了Releaser, 从缓存中剔除时会调用UnRef释放固定的block并关闭sstable文件
 		return 1, reader, nil, nil
 	})
 
@@ -302,13 +399,32 @@ func (sstOpt *sstableOperation) open(t tFile) (*collections.LRUHandle, error) {
 
 }
 
+// sstable打开时是否固定index block以及filter block, 文件留在file cache期间层数变化不会重新判断
+func (sstOpt *sstableOperation) pinned(t tFile) bool {
+	switch sstOpt.pinTier {
+	case PinningTierLevel0:
+		return t.level == 0
+	case PinningTierAll:
+		return true
+	}
+	return false
+}
+
 func (sstOpt *sstableOperation) NewIterator(t tFile) iter.Iterator {
+	return sstOpt.NewBoundedIterator(t, nil)
+}
+
+// NewBoundedIterator 只保证遍历到小于upper的key, upper为nil时遍历整个sstable
+func (sstOpt *sstableOperation) NewBoundedIterator(t tFile, upper internalKey) iter.Iterator {
 	ch, err := sstOpt.open(t)
 	if err != nil {
 		return iter.NewEmptyIterator(err)
 	}
-	iterator := ch.Value().(*sstable.Reader).NewIterator()
+	iterator := ch.Value().(*sstable.Reader).NewBoundedIterator(upper, !sstOpt.dontFillCache)
 	iterator.SetReleaser(ch)
+	if t.seq > 0 {
+		return newGlobalSeqIterator(iterator, sstOpt.icmp, t.seq)
+	}
 	return iterator
 }
 
@@ -319,7 +435,11 @@ func (sstOpt *sstableOperation) Find(t tFile, ikey internalKey) (rkey internalKe
 	}
 	defer ch.UnRef()
 	reader := ch.Value().(*sstable.Reader)
-	return reader.Find(ikey)
+	rkey, value, err = reader.Find(ikey)
+	if err == nil && t.seq > 0 {
+		rkey, err = sstOpt.withGlobalSeq(t, ikey, rkey)
+	}
+	return rkey, value, err
 }
 
 func (sstOpt *sstableOperation) FindKey(t tFile, ikey internalKey) (rkey internalKey, err error) {
@@ -329,5 +449,47 @@ func (sstOpt *sstableOperation) FindKey(t tFile, ikey internalKey) (rkey interna
 	}
 	defer ch.UnRef()
 	reader := ch.Value().(*sstable.Reader)
-	return reader.FindKey(ikey)
+	rkey, err = reader.FindKey(ikey)
+	if err == nil && t.seq > 0 {
+		rkey, err = sstOpt.withGlobalSeq(t, ikey, rkey)
+	}
+	return rkey, err
+}
+
+// MayContainPrefix 通过filter判断sstable中第一个可能包含>=pkey的data block是否包含pkey的prefix,
+// 写入时没有加入prefix或者prefix的规则不同时无法判断, 返回true
+func (sstOpt *sstableOperation) MayContainPrefix(t tFile, pkey internalKey) (bool, error) {
+	ch, err := sstOpt.open(t)
+	if err != nil {
+		return false, err
+	}
+	defer ch.UnRef()
+	reader := ch.Value().(*sstable.Reader)
+	if name := sstOpt.iFilter.prefixName(); name == "" || reader.FilterPrefix() != name {
+		return true, nil
+	}
+	return reader.MayContain(pkey)
+}
+
+// MultiFind 在同一个sstable中查找多个从小到大排序的ikey
+func (sstOpt *sstableOperation) MultiFind(t tFile, ikeys [][]byte) []sstable.FindResult {
+	ch, err := sstOpt.open(t)
+	if err != nil {
+		results := make([]sstable.FindResult, len(ikeys))
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+	defer ch.UnRef()
+	reader := ch.Value().(*sstable.Reader)
+	results := reader.MultiFind(ikeys)
+	if t.seq > 0 {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Key, results[i].Err = sstOpt.withGlobalSeq(t, ikeys[i], results[i].Key)
+			}
+		}
+	}
+	return results
 }
@@ -0,0 +1,193 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"myleveldb/filter"
+	"myleveldb/sstable"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 写入n个偶数key并compaction到sstable, 用readOpt重新打开后检查filter, 点查, 不存在的key, 遍历以及Seek
+func testTableReads(t *testing.T, dir string, writeOpt, readOpt *Options, n int) *DB {
+
+	db, err := Open(dir, writeOpt)
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Put(testKey(i*2), testValue(i, 20)))
+	}
+	assert.Nil(t, db.CompactRange(nil, nil))
+	assert.Nil(t, db.Close())
+
+	db = openTestDB(t, dir, readOpt)
+	assertFiltered(t, db, n)
+	for i := 0; i < n; i++ {
+		v, err := db.Get(testKey(i * 2))
+		if !assert.Nil(t, err, "key %d", i*2) || !assert.Equal(t, testValue(i, 20), v) {
+			break
+		}
+		_, err = db.Get(testKey(i*2 + 1))
+		if !assert.Equal(t, error2.ErrNotFound, err, "key %d", i*2+1) {
+			break
+		}
+	}
+
+	it := db.NewIterator(nil)
+	defer it.UnRef()
+	i := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if !assert.Equal(t, testKey(i*2), it.Key()) {
+			break
+		}
+		i++
+	}
+	assert.Equal(t, n, i)
+	for i := 0; i < n-1; i += 97 {
+		assert.True(t, it.Seek(testKey(i*2+1)))
+		assert.Equal(t, testKey(i*2+2), it.Key())
+	}
+	assert.False(t, it.Seek(testKey(n*2)))
+
+	return db
+}
+
+// 刚打开的db中查询范围内不存在的key, 通过filter排除, 几乎不读取data block
+func assertFiltered(t *testing.T, db *DB, n int) {
+	for i := 0; i < n; i += 10 {
+		_, err := db.Get(testKey(i*2 + 1))
+		assert.Equal(t, error2.ErrNotFound, err)
+	}
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.True(t, stats.BlockCache.Misses < uint64(n/100), "misses %d", stats.BlockCache.Misses)
+}
+
+func TestTable_FilterFormats(t *testing.T) {
+
+	const n = 10000
+
+	for _, c := range []struct {
+		name   string
+		format sstable.FilterFormat
+		filter filter.IFilter
+	}{
+		{"block", sstable.FilterFormatBlock, nil},
+		{"full", sstable.FilterFormatFull, nil},
+		{"partitioned", sstable.FilterFormatPartitioned, nil},
+		{"full-ribbon", sstable.FilterFormatFull, &filter.RibbonFilter{}},
+		{"partitioned-ribbon", sstable.FilterFormatPartitioned, &filter.RibbonFilter{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := &Options{WriteBuffer: 1 << 20, FilterFormat: c.format, Filter: c.filter}
+			testTableReads(t, t.TempDir(), opt, opt, n)
+		})
+	}
+
+	// 读取时根据sstable中记录的格式识别, 跟当前的Options无关
+	t.Run("detect", func(t *testing.T) {
+		writeOpt := &Options{WriteBuffer: 1 << 20, FilterFormat: sstable.FilterFormatPartitioned}
+		readOpt := &Options{WriteBuffer: 1 << 20, FilterFormat: sstable.FilterFormatBlock}
+		testTableReads(t, t.TempDir(), writeOpt, readOpt, n)
+	})
+}
+
+func TestTable_DataBlockHashIndex(t *testing.T) {
+
+	const n = 10000
+
+	opt := &Options{WriteBuffer: 1 << 20, DataBlockHashIndex: true}
+	testTableReads(t, t.TempDir(), opt, opt, n)
+
+	// 没有hash index的sstable打开时按照footer中的标记识别
+	testTableReads(t, t.TempDir(), &Options{WriteBuffer: 1 << 20}, opt, n)
+
+	// 同一个sstable中同一个key的多个版本, 按照seq找到对应的版本
+	dir := t.TempDir()
+	db, err := Open(dir, opt)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(testKey(i), testValue(i, 20)))
+	}
+	seq := db.loadSeq()
+	for i := 0; i < 1000; i += 2 {
+		assert.Nil(t, db.Put(testKey(i), testValue(i+1, 20)))
+	}
+	for i := 0; i < 1000; i += 3 {
+		assert.Nil(t, db.Delete(testKey(i)))
+	}
+	assert.Nil(t, db.flushMemDb())
+
+	v := db.s.defaultCf.version()
+	assert.Equal(t, 1, len(v.levels[0]))
+	for i := 0; i < 1000; i++ {
+		value, err := db.Get(testKey(i))
+		switch {
+		case i%3 == 0:
+			assert.Equal(t, error2.ErrNotFound, err)
+		case i%2 == 0:
+			assert.Equal(t, testValue(i+1, 20), value)
+		default:
+			assert.Equal(t, testValue(i, 20), value)
+		}
+
+		value, err = v.get(makeInternalKey(testKey(i), seq, keyTypeSeek), false)
+		assert.Nil(t, err)
+		assert.Equal(t, testValue(i, 20), value)
+	}
+	v.unRef()
+	assert.Nil(t, db.Close())
+}
+
+func TestTable_PartitionedIndex(t *testing.T) {
+
+	const n = 10000
+
+	for _, c := range []struct {
+		name string
+		opt  *Options
+	}{
+		{"partitioned", &Options{WriteBuffer: 1 << 20, IndexPartitionThreshold: 1 << 10}},
+		{"partitioned-filter-hash", &Options{
+			WriteBuffer:             1 << 20,
+			IndexPartitionThreshold: 1 << 10,
+			FilterFormat:            sstable.FilterFormatPartitioned,
+			DataBlockHashIndex:      true,
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := testTableReads(t, t.TempDir(), c.opt, c.opt, n)
+
+			v := db.s.defaultCf.version()
+			defer v.unRef()
+			tables := 0
+			for _, level := range v.levels {
+				for _, tf := range level {
+					ch, err := db.s.defaultCf.tableOpts.open(tf)
+					if !assert.Nil(t, err) {
+						return
+					}
+					info, err := ch.Value().(*sstable.Reader).Info()
+					ch.UnRef()
+					assert.Nil(t, err)
+					assert.True(t, info.IndexPartitions > 1, "table %d has %d index partitions", tf.fd.Num, info.IndexPartitions)
+					tables++
+				}
+			}
+			assert.True(t, tables > 0)
+		})
+	}
+
+	// 分区按需读取, 刚打开时一次点查只读取顶层index, 一个分区以及data block
+	opt := &Options{WriteBuffer: 1 << 20, IndexPartitionThreshold: 1 << 10, FilterFormat: sstable.FilterFormatFull}
+	dir := t.TempDir()
+	assert.Nil(t, testTableReads(t, dir, opt, opt, n).Close())
+
+	db := openTestDB(t, dir, opt)
+	v, err := db.Get(testKey(n))
+	assert.Nil(t, err)
+	assert.Equal(t, testValue(n/2, 20), v)
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.True(t, stats.BlockCache.Misses <= 4, "misses %d", stats.BlockCache.Misses)
+}
@@ -0,0 +1,35 @@
+package tuple
+
+import "strconv"
+
+// PrefixExtractor 取tuple编码的key的前n个字段作为prefix, 实现filter.PrefixExtractor,
+// 字段不足n个或者编码不正确的key不存在prefix
+type PrefixExtractor int
+
+func (p PrefixExtractor) Transform(key []byte) []byte {
+	return key[:p.prefixLen(key)]
+}
+
+func (p PrefixExtractor) InDomain(key []byte) bool {
+	return p.prefixLen(key) >= 0
+}
+
+func (p PrefixExtractor) Name() string {
+	return "tuple." + strconv.Itoa(int(p))
+}
+
+// 前n个字段的编码长度, 不足n个字段时返回-1
+func (p PrefixExtractor) prefixLen(key []byte) int {
+	offset := 0
+	for i := 0; i < int(p); i++ {
+		if offset >= len(key) {
+			return -1
+		}
+		_, n, err := decodeElement(key[offset:])
+		if err != nil {
+			return -1
+		}
+		offset += n
+	}
+	return offset
+}
@@ -0,0 +1,270 @@
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/**
+保持顺序的tuple编码
+
+多个字段组成的key编码后, 按照字节比较(comparer.ByteComparer)的顺序跟按照字段依次比较的顺序相同,
+并且一个tuple的编码是它所有更长的tuple(前面的字段相同)的编码的前缀, 所以可以用prefix iterator遍历
+
+每个字段以一个字节的类型开头, 不同类型之间按照类型的顺序比较, 例如所有的整数都排在所有的字符串之前
+
+	nil      0x00
+	[]byte   0x01 + 转义的字节 + 0x00
+	string   0x02 + 转义的utf8字节 + 0x00
+	整数      0x14 - n ... 0x14 + n, n为去掉前导0之后的字节数
+	float    0x21 + 8个字节
+	false    0x26
+	true     0x27
+
+1. 转义: 字节中的0x00写成 0x00 0xff, 结束符0x00之后不会是0xff, 所以 "a" < "a\x00" < "ab"
+2. 整数: 0写成0x14, 正数写成 0x14+n 以及n个字节的大端编码, 字节数越多越大;
+   负数写成 0x14-n 以及绝对值的n个字节的大端编码取反, 绝对值字节数越多越小, 相同字节数时取反后绝对值越大越小.
+   int以及uint统一编码, 解码时能放进int64的返回int64, 否则返回uint64
+3. float: 正数把符号位置为1, 负数所有位取反, 按照字节比较就是按照数值比较, float32按照float64编码
+**/
+
+const (
+	nilCode    = 0x00
+	bytesCode  = 0x01
+	stringCode = 0x02
+	intZero    = 0x14
+	floatCode  = 0x21
+	falseCode  = 0x26
+	trueCode   = 0x27
+
+	escapeByte = 0xff
+)
+
+var (
+	ErrUnsupportedType = errors.New("tuple: unsupported element type")
+	ErrCorrupted       = errors.New("tuple: corrupted encoding")
+)
+
+// Tuple 多个字段组成的key, 字段支持nil, []byte, string, 整数, float32, float64, bool
+type Tuple []interface{}
+
+// Pack 编码tuple, 字段的类型不支持时panic
+func (t Tuple) Pack() []byte {
+	return t.Append(nil)
+}
+
+// Append 将tuple的编码追加到dst之后, 字段的类型不支持时panic
+func (t Tuple) Append(dst []byte) []byte {
+	for _, e := range t {
+		var err error
+		if dst, err = appendElement(dst, e); err != nil {
+			panic(fmt.Sprintf("%v: %T", err, e))
+		}
+	}
+	return dst
+}
+
+// Pack 编码多个字段, 与Tuple(elems).Pack()相同
+func Pack(elems ...interface{}) []byte {
+	return Tuple(elems).Pack()
+}
+
+func appendElement(dst []byte, e interface{}) ([]byte, error) {
+	switch v := e.(type) {
+	case nil:
+		return append(dst, nilCode), nil
+	case []byte:
+		return appendEscaped(append(dst, bytesCode), v), nil
+	case string:
+		return appendEscaped(append(dst, stringCode), []byte(v)), nil
+	case int:
+		return appendInt(dst, int64(v)), nil
+	case int8:
+		return appendInt(dst, int64(v)), nil
+	case int16:
+		return appendInt(dst, int64(v)), nil
+	case int32:
+		return appendInt(dst, int64(v)), nil
+	case int64:
+		return appendInt(dst, v), nil
+	case uint:
+		return appendUint(dst, uint64(v)), nil
+	case uint8:
+		return appendUint(dst, uint64(v)), nil
+	case uint16:
+		return appendUint(dst, uint64(v)), nil
+	case uint32:
+		return appendUint(dst, uint64(v)), nil
+	case uint64:
+		return appendUint(dst, v), nil
+	case float32:
+		return appendFloat(dst, float64(v)), nil
+	case float64:
+		return appendFloat(dst, v), nil
+	case bool:
+		if v {
+			return append(dst, trueCode), nil
+		}
+		return append(dst, falseCode), nil
+	}
+	return dst, ErrUnsupportedType
+}
+
+// 0x00转义成0x00 0xff, 并追加结束符0x00
+func appendEscaped(dst, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, c)
+		if c == 0x00 {
+			dst = append(dst, escapeByte)
+		}
+	}
+	return append(dst, 0x00)
+}
+
+// 去掉前导0之后的字节数
+func byteLen(u uint64) int {
+	n := 0
+	for ; u > 0; u >>= 8 {
+		n++
+	}
+	return n
+}
+
+func appendUint(dst []byte, u uint64) []byte {
+	n := byteLen(u)
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], u)
+	return append(append(dst, byte(intZero+n)), scratch[8-n:]...)
+}
+
+func appendInt(dst []byte, i int64) []byte {
+	if i >= 0 {
+		return appendUint(dst, uint64(i))
+	}
+	// math.MinInt64的绝对值也可以放进uint64
+	abs := uint64(-(i + 1)) + 1
+	n := byteLen(abs)
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], ^abs)
+	return append(append(dst, byte(intZero-n)), scratch[8-n:]...)
+}
+
+func appendFloat(dst []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], bits)
+	return append(append(dst, floatCode), scratch[:]...)
+}
+
+// Unpack 解码tuple, 整数解码为int64或者uint64, float解码为float64
+func Unpack(b []byte) (Tuple, error) {
+	var t Tuple
+	for len(b) > 0 {
+		e, n, err := decodeElement(b)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, e)
+		b = b[n:]
+	}
+	return t, nil
+}
+
+// 解码第一个字段, 返回字段以及编码的长度
+func decodeElement(b []byte) (e interface{}, n int, err error) {
+
+	code := b[0]
+	switch {
+	case code == nilCode:
+		return nil, 1, nil
+	case code == bytesCode, code == stringCode:
+		v, n, err := decodeEscaped(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if code == stringCode {
+			return string(v), n + 1, nil
+		}
+		return v, n + 1, nil
+	case code >= intZero-8 && code <= intZero+8:
+		return decodeInt(b)
+	case code == floatCode:
+		if len(b) < 9 {
+			return nil, 0, ErrCorrupted
+		}
+		bits := binary.BigEndian.Uint64(b[1:9])
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), 9, nil
+	case code == falseCode:
+		return false, 1, nil
+	case code == trueCode:
+		return true, 1, nil
+	}
+	return nil, 0, ErrCorrupted
+}
+
+// 解码转义的字节直到结束符, 返回的长度包括结束符
+func decodeEscaped(b []byte) ([]byte, int, error) {
+	var v []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			v = append(v, b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == escapeByte {
+			v = append(v, 0x00)
+			i++
+			continue
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		return v, i + 1, nil
+	}
+	return nil, 0, ErrCorrupted
+}
+
+func decodeInt(b []byte) (interface{}, int, error) {
+
+	code := int(b[0])
+	neg := code < intZero
+	n := code - intZero
+	if neg {
+		n = -n
+	}
+	if len(b) < n+1 {
+		return nil, 0, ErrCorrupted
+	}
+
+	var scratch [8]byte
+	if neg {
+		for i := range scratch {
+			scratch[i] = 0xff
+		}
+	}
+	copy(scratch[8-n:], b[1:n+1])
+	u := binary.BigEndian.Uint64(scratch[:])
+
+	if !neg {
+		if u > math.MaxInt64 {
+			return u, n + 1, nil
+		}
+		return int64(u), n + 1, nil
+	}
+	abs := ^u
+	if abs > 1<<63 {
+		return nil, 0, ErrCorrupted
+	}
+	return -int64(abs-1) - 1, n + 1, nil
+}
@@ -0,0 +1,94 @@
+package tuple
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestPack_RoundTrip(t *testing.T) {
+
+	tuples := []Tuple{
+		{},
+		{nil},
+		{[]byte{}, ""},
+		{[]byte("a\x00b\xff"), "c\x00\x00"},
+		{int64(0), int64(1), int64(-1), int64(255), int64(256), int64(-256), int64(-257)},
+		{int64(math.MaxInt64), int64(math.MinInt64), uint64(math.MaxUint64)},
+		{1.5, -2.25, math.Inf(1), math.Inf(-1), 0.0},
+		{true, false, "user", int64(42)},
+	}
+
+	for _, tp := range tuples {
+		decoded, err := Unpack(tp.Pack())
+		assert.Nil(t, err)
+		assert.Equal(t, len(tp), len(decoded))
+		for i := range tp {
+			assert.Equal(t, tp[i], decoded[i])
+		}
+	}
+
+	// 不同宽度的整数以及float32统一解码
+	decoded, err := Unpack(Pack(int8(-3), uint16(7), float32(0.5)))
+	assert.Nil(t, err)
+	assert.Equal(t, Tuple{int64(-3), int64(7), 0.5}, decoded)
+
+	_, err = Unpack([]byte{stringCode, 'a'})
+	assert.Equal(t, ErrCorrupted, err)
+	_, err = Unpack([]byte{intZero + 2, 1})
+	assert.Equal(t, ErrCorrupted, err)
+	assert.Panics(t, func() { Pack(struct{}{}) })
+}
+
+func TestPack_Order(t *testing.T) {
+
+	// 按照从小到大的顺序排列
+	sorted := []Tuple{
+		{nil},
+		{[]byte("a")},
+		{"a"},
+		{"a", int64(math.MinInt64)},
+		{"a", int64(-257)},
+		{"a", int64(-256)},
+		{"a", int64(-1)},
+		{"a", int64(0)},
+		{"a", int64(1)},
+		{"a", int64(255)},
+		{"a", int64(256)},
+		{"a", uint64(math.MaxUint64)},
+		{"a", math.Inf(-1)},
+		{"a", -1.5},
+		{"a", 0.0},
+		{"a", 1.5},
+		{"a", false},
+		{"a", true},
+		{"a\x00"},
+		{"a\x00", "b"},
+		{"a\x01"},
+		{"ab"},
+		{"b"},
+		{int64(0)},
+		{true},
+	}
+
+	for i := 1; i < len(sorted); i++ {
+		assert.True(t, bytes.Compare(sorted[i-1].Pack(), sorted[i].Pack()) < 0, "%v < %v", sorted[i-1], sorted[i])
+	}
+
+	// 较短的tuple的编码是较长的tuple的编码的前缀
+	assert.True(t, bytes.HasPrefix(Pack("user", int64(1), "name"), Pack("user", int64(1))))
+	assert.False(t, bytes.HasPrefix(Pack("user1"), Pack("user")))
+}
+
+func TestPrefixExtractor(t *testing.T) {
+
+	p := PrefixExtractor(2)
+	key := Pack("user", int64(7), "email")
+	assert.True(t, p.InDomain(key))
+	assert.Equal(t, Pack("user", int64(7)), p.Transform(key))
+	assert.True(t, p.InDomain(Pack("user", int64(7))))
+	assert.False(t, p.InDomain(Pack("user")))
+	assert.False(t, p.InDomain([]byte{stringCode, 'a'}))
+	assert.Equal(t, "tuple.2", p.Name())
+}
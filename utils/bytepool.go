@@ -26,7 +26,7 @@ func (pool *BytePool) Get(n int64) []byte {
 			b := make([]byte, n)
 			return b
 		}
-		return make([]byte, pool.baseline[idx])
+		return make([]byte, n, pool.baseline[idx])
 	}
 
 	// 取出来的不需要初始化了
@@ -40,7 +40,7 @@ func (pool *BytePool) Get(n int64) []byte {
 		return *v
 	}
 
-	*v = make([]byte, pool.baseline[idx])
+	*v = make([]byte, n, pool.baseline[idx])
 	return *v
 }
 
@@ -67,12 +67,13 @@ func TestGroup_DoChan(t *testing.T) {
 
 	for i := int64(0); i < 100; i++ {
 
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 		go func(idx int64) {
+			defer cancel()
 			ch := group.DoChan(key, func() (value interface{}, err error) {
 
-				select {}
+				<-ctx.Done()
 
 				return getById(idx), nil
 			})
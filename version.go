@@ -1,25 +1,29 @@
 package myleveldb
 
 import (
+	error2 "myleveldb/error"
 	"myleveldb/sstable"
 	"myleveldb/storage"
 	"sort"
-	"sync/atomic"
 	"unsafe"
 )
 
 // Version 数据库某一时刻的状态
 type Version struct {
 	ref      int64
-	id       int64    // vid
-	levels   []tFiles // 每一层的sstable文件描述符
+	id       int64     // vid
+	levels   []tFiles  // 每一层的sstable文件描述符
+	blobs    blobFiles // 引用的blob文件, 不会被修改, 有变化时产生新的map
 	session  *Session
+	cf       *ColumnFamily // version所属的family
 	released bool
 
 	// compaction 相关
 	cScore float64 // compaction计算分数, 分数大于等于1即可开始compaction
 	cLevel int     // compaction level
 	cSeek  *unsafe.Pointer
+
+	pendingBytes int64 // 估算的待compaction的字节数, 用于写入限速
 }
 
 func (ver *Version) newVersionStaging() *VersionStaging {
@@ -35,6 +39,9 @@ type tableScratch struct {
 type VersionStaging struct {
 	base    *Version
 	scratch []tableScratch // 对应每层level的增删
+
+	blobAdded   map[int64]blobFile // 新增的blob文件
+	blobGarbage map[int64]blobFile // blob文件累加的垃圾
 }
 
 // 将version_edit的变更更新到VersionStaging中
@@ -68,8 +75,11 @@ func (vs *VersionStaging) commit(r *SessionRecord) {
 
 	**/
 
-	// 执行添加操作
+	// 执行添加操作, 只处理version所属family的记录
 	for _, added := range r.atRecords {
+		if added.cf != vs.base.cf.id {
+			continue
+		}
 		scratch := vs.getScratch(added.level)
 		if scratch.added == nil {
 			scratch.added = make(map[int64]atRecord)
@@ -79,6 +89,9 @@ func (vs *VersionStaging) commit(r *SessionRecord) {
 
 	// 执行删除操作
 	for _, deleted := range r.dlRecords {
+		if deleted.cf != vs.base.cf.id {
+			continue
+		}
 		scratch := vs.getScratch(deleted.level)
 		if scratch.deleted == nil {
 			scratch.deleted = make(map[int64]struct{})
@@ -86,6 +99,29 @@ func (vs *VersionStaging) commit(r *SessionRecord) {
 		scratch.deleted[int64(deleted.num)] = struct{}{}
 	}
 
+	for _, added := range r.addedBlobs {
+		if added.cf != vs.base.cf.id {
+			continue
+		}
+		if vs.blobAdded == nil {
+			vs.blobAdded = make(map[int64]blobFile)
+		}
+		vs.blobAdded[added.num] = blobFile{num: added.num, count: added.count, size: added.size}
+	}
+
+	for _, garbage := range r.blobGarbage {
+		if garbage.cf != vs.base.cf.id {
+			continue
+		}
+		if vs.blobGarbage == nil {
+			vs.blobGarbage = make(map[int64]blobFile)
+		}
+		g := vs.blobGarbage[garbage.num]
+		g.garbageCount += garbage.count
+		g.garbageSize += garbage.size
+		vs.blobGarbage[garbage.num] = g
+	}
+
 	for idx, scratch := range vs.scratch {
 
 		// 当前level只有添加或者只有删除, 不需要重新合并添加或者删除的
@@ -132,7 +168,10 @@ func (vs *VersionStaging) finish() *Version {
 
 	for level := 0; level < levelNum; level++ {
 
-		var scratch = vs.scratch[level]
+		var scratch tableScratch
+		if level < len(vs.scratch) {
+			scratch = vs.scratch[level]
+		}
 
 		var baseLevels tFiles
 
@@ -142,6 +181,7 @@ func (vs *VersionStaging) finish() *Version {
 
 		if len(scratch.added) == 0 && len(scratch.deleted) == 0 {
 			newLevels[level] = baseLevels
+			continue
 		}
 
 		newTables := make(tFiles, 0, len(baseLevels)+len(scratch.added)-len(scratch.deleted))
@@ -170,9 +210,11 @@ func (vs *VersionStaging) finish() *Version {
 					Type: storage.FileTypeSSTable,
 					Num:  int(fdNum),
 				},
-				size: int64(atRecord.size),
-				min:  atRecord.min,
-				max:  atRecord.max,
+				size:  int64(atRecord.size),
+				min:   atRecord.min,
+				max:   atRecord.max,
+				level: level,
+				seq:   atRecord.seq,
 			})
 		}
 
@@ -180,7 +222,7 @@ func (vs *VersionStaging) finish() *Version {
 			if level == 0 {
 				newTables.sortByNum()
 			} else {
-				newTables.sortByKey(vs.base.session.icmp)
+				newTables.sortByKey(vs.base.cf.icmp)
 			}
 		}
 
@@ -196,12 +238,46 @@ func (vs *VersionStaging) finish() *Version {
 	nv.levels = newLevels[:n]
 	vs.scratch = vs.scratch[:0]
 
+	nv.blobs = vs.finishBlobs()
+
 	// 推算下次compaction的最佳层
 	nv.computeCompaction()
 
 	return nv
 }
 
+// 在base的blob文件上应用新增的文件以及垃圾, 所有blob都是垃圾的文件被移除
+func (vs *VersionStaging) finishBlobs() blobFiles {
+
+	if len(vs.blobAdded) == 0 && len(vs.blobGarbage) == 0 {
+		return vs.base.blobs
+	}
+
+	blobs := make(blobFiles, len(vs.base.blobs)+len(vs.blobAdded))
+	for num, bf := range vs.base.blobs {
+		blobs[num] = bf
+	}
+	for num, bf := range vs.blobAdded {
+		blobs[num] = bf
+	}
+	for num, g := range vs.blobGarbage {
+		bf, ok := blobs[num]
+		if !ok {
+			continue
+		}
+		bf.garbageCount += g.garbageCount
+		bf.garbageSize += g.garbageSize
+		if bf.obsolete() {
+			delete(blobs, num)
+			continue
+		}
+		blobs[num] = bf
+	}
+
+	vs.blobAdded, vs.blobGarbage = nil, nil
+	return blobs
+}
+
 func (vs *VersionStaging) getScratch(level int) *tableScratch {
 
 	// 如果当前scratch的不够level的长度, 那么扩容到level的长度
@@ -214,19 +290,20 @@ func (vs *VersionStaging) getScratch(level int) *tableScratch {
 }
 
 func (vs *VersionStaging) newVersion() *Version {
-	ntVersionId := atomic.AddInt64(&vs.base.session.ntVersionId, 1)
-	nv := &Version{
-		id:      ntVersionId - 1,
-		session: vs.base.session,
-	}
-	return nv
+	return vs.base.session.newFamilyVersion(vs.base.cf)
 }
 
+// 将version的所有sstable以及blob文件追加到s中
 func (v *Version) fillRecord(s *SessionRecord) {
-	s.resetAddRecord()
 	for idx, level := range v.levels {
 		for j := range level {
-			s.addTableFile(idx, level[j])
+			s.addTableFile(v.cf.id, idx, level[j])
+		}
+	}
+	for _, bf := range v.blobs.sorted() {
+		s.addBlobFile(v.cf.id, bf)
+		if bf.garbageCount > 0 {
+			s.addBlobGarbage(v.cf.id, bf.num, bf.garbageCount, bf.garbageSize)
 		}
 	}
 }
@@ -239,40 +316,52 @@ func (v *Version) tLen(level int) int {
 }
 
 func (v *Version) get(ikey internalKey, noValue bool) (value []byte, err error) {
+	value, _, _, err = v.find(ikey, noValue)
+	return
+}
+
+// find 跟get一样, 同时返回找到的记录(包括删除)的seq, found代表是否存在ikey.uKey()的记录
+func (v *Version) find(ikey internalKey, noValue bool) (value []byte, rseq uint64, found bool, err error) {
 
 	var (
 		// for level 0, since level 0 key can hop cross
-		zfound     = false
-		zkt        keyType
-		zkey, zval []byte
-		zseq       uint64
+		// Find返回的是拷贝, zval在后面的level0 sstable查找时读取的block被驱逐复用后仍然有效
+		zfound = false
+		zkt    keyType
+		zval   []byte
+		zseq   uint64
 	)
 
+	// 所有层都找不到的话, 返回ErrNotFound
+	err = error2.ErrNotFound
+
 	v.walkOverlapping(ikey, func(level int, tf tFile) bool {
 
 		var (
 			fkey internalKey
 			fval []byte
+			ferr error
 		)
 
 		if noValue {
-			fkey, err = v.session.tableOpts.FindKey(tf, ikey)
+			fkey, ferr = v.cf.tableOpts.FindKey(tf, ikey)
 		} else {
-			fkey, fval, err = v.session.tableOpts.Find(tf, ikey)
+			fkey, fval, ferr = v.cf.tableOpts.Find(tf, ikey)
 		}
 
-		if err != nil {
-			if err == sstable.ErrNotFound {
+		if ferr != nil {
+			if ferr == sstable.ErrNotFound {
 				return true
 			}
+			err = ferr
 			return false
 		}
 
-		uk, seq, kt, err := parseInternalKey(fkey)
+		uk, seq, kt, ferr := parseInternalKey(fkey)
 
-		if err == nil {
+		if ferr == nil {
 
-			if v.session.icmp.uCompare(uk, ikey.uKey()) != 0 {
+			if v.cf.icmp.uCompare(uk, ikey.uKey()) != 0 {
 				return true
 			}
 
@@ -280,16 +369,15 @@ func (v *Version) get(ikey internalKey, noValue bool) (value []byte, err error)
 				zfound = true
 				if seq >= zseq {
 					zseq = seq
-					zkey = uk
 					zval = fval
 					zkt = kt
 				}
 			} else {
-				if kt == keyTypeVal {
-					value = append([]byte(nil), fval...)
-					err = nil
+				rseq, found = seq, true
+				if kt == keyTypeVal || kt == keyTypeBlob {
+					value, err = v.resolveValue(kt, fval, noValue)
 				} else if kt == keyTypeDel {
-					err = sstable.ErrNotFound
+					err = error2.ErrNotFound
 				} else {
 					panic("myLeveldb/version get keytype invalid")
 				}
@@ -303,11 +391,11 @@ func (v *Version) get(ikey internalKey, noValue bool) (value []byte, err error)
 
 		if zfound {
 
-			if zkt == keyTypeVal {
-				value = append([]byte(nil), zval...)
-				err = nil
+			rseq, found = zseq, true
+			if zkt == keyTypeVal || zkt == keyTypeBlob {
+				value, err = v.resolveValue(zkt, zval, noValue)
 			} else if zkt == keyTypeDel {
-				err = sstable.ErrNotFound
+				err = error2.ErrNotFound
 			} else {
 				panic("myLeveldb/version get keytype invalid")
 			}
@@ -322,10 +410,17 @@ func (v *Version) get(ikey internalKey, noValue bool) (value []byte, err error)
 	return
 }
 
+func (v *Version) resolveValue(kt keyType, value []byte, noValue bool) ([]byte, error) {
+	if noValue {
+		return nil, nil
+	}
+	return v.cf.resolveValue(kt, value)
+}
+
 func (v *Version) walkOverlapping(ikey internalKey, f func(level int, tf tFile) bool,
 	lf func() bool) {
 	ukey := ikey.uKey()
-	icmp := v.session.icmp
+	icmp := v.cf.icmp
 	for level, tables := range v.levels {
 		if level == 0 {
 			for idx := range tables {
@@ -369,20 +464,58 @@ func (v *Version) computeCompaction() {
 	for level, tables := range v.levels {
 		var (
 			cScore float64
-			cLevel int
 		)
 		size := tables.size()
 		if level == 0 {
-			cScore = float64(len(tables)) / float64(v.session.Options.GetLevel0TriggerLen())
+			cScore = float64(len(tables)) / float64(v.cf.opt.GetLevel0TriggerLen())
 		} else {
-			cScore = float64(size) / float64(v.session.Options.GetCompactionSizeLevel(level))
+			cScore = float64(size) / float64(v.cf.opt.GetCompactionSizeLevel(level))
 		}
 		if cScore > bestScore {
 			bestScore = cScore
-			bestLevel = cLevel
+			bestLevel = level
 		}
 	}
 
 	v.cScore = bestScore
 	v.cLevel = bestLevel
+	v.pendingBytes = v.estimatePendingCompactionBytes()
+}
+
+// 估算把每一层合并到目标大小以内需要重写的字节数:
+// level0需要compaction时level0以及level1都需要重写; 其他层超出目标大小的部分合并到下一层时,
+// 下一层按照两层大小的比例被重写, 超出的部分累加到下一层继续估算. 最后一层不再向下合并
+func (v *Version) estimatePendingCompactionBytes() int64 {
+
+	if len(v.levels) == 0 {
+		return 0
+	}
+
+	var (
+		debt  float64
+		carry float64
+	)
+
+	if len(v.levels[0]) > v.cf.opt.GetLevel0TriggerLen() {
+		carry = float64(v.levels[0].size())
+		debt += carry
+		if len(v.levels) > 1 {
+			debt += float64(v.levels[1].size())
+		}
+	}
+
+	for level := 1; level < len(v.levels)-1; level++ {
+		size := float64(v.levels[level].size()) + carry
+		target := float64(v.cf.opt.GetCompactionSizeLevel(level))
+		carry = 0
+		if size <= target {
+			continue
+		}
+		excess := size - target
+		next := float64(v.levels[level+1].size())
+		debt += excess * (next/size + 1)
+		carry = excess
+	}
+
+	return int64(debt)
 }
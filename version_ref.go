@@ -245,6 +245,8 @@ func (s *Session) refLoop() {
 
 		case <-timer.C:
 
+		case <-s.closeC:
+			return
 		}
 
 	}
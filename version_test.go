@@ -1,23 +1,25 @@
 package myleveldb
 
 import (
-	"bytes"
+	"myleveldb/comparer"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestVersionStaging(t *testing.T) {
+
+	ik := func(ukey string) internalKey {
+		return makeInternalKey([]byte(ukey), 0, keyTypeVal)
+	}
+
+	cf := &ColumnFamily{icmp: &iComparer{comparer.DefaultComparer}}
 	vs := &VersionStaging{
 		base: &Version{
-			id:     1,
-			levels: nil,
-			session: &Session{
-				ntVersionId: 0,
-				icmp: func(a, b interface{}) int {
-					return bytes.Compare(a.(internalKey), b.(internalKey))
-				},
-			},
+			id:      1,
+			levels:  nil,
+			session: &Session{},
+			cf:      cf,
 		},
 		scratch: nil,
 	}
@@ -28,36 +30,36 @@ func TestVersionStaging(t *testing.T) {
 				level: 0,
 				num:   0,
 				size:  100,
-				min:   []byte("aaaaaa"),
-				max:   []byte("bbbbbb"),
+				min:   ik("aaaaaa"),
+				max:   ik("bbbbbb"),
 			},
 			{
 				level: 0,
 				num:   1,
 				size:  100,
-				min:   []byte("cccccc"),
-				max:   []byte("dddddd"),
+				min:   ik("cccccc"),
+				max:   ik("dddddd"),
 			},
 			{
 				level: 0,
 				num:   2,
 				size:  100,
-				min:   []byte("eeeeee"),
-				max:   []byte("ffffff"),
+				min:   ik("eeeeee"),
+				max:   ik("ffffff"),
 			},
 			{
 				level: 0,
 				num:   3,
 				size:  100,
-				min:   []byte("aaaaaa"),
-				max:   []byte("ffffff"),
+				min:   ik("aaaaaa"),
+				max:   ik("ffffff"),
 			},
 			{
 				level: 1,
 				num:   4,
 				size:  100,
-				min:   []byte("iiiiii"),
-				max:   []byte("jjjjjj"),
+				min:   ik("iiiiii"),
+				max:   ik("jjjjjj"),
 			},
 		},
 	}
@@ -91,15 +93,15 @@ func TestVersionStaging(t *testing.T) {
 				level: 1,
 				num:   5,
 				size:  100,
-				min:   []byte("kkkkkk"),
-				max:   []byte("llllll"),
+				min:   ik("kkkkkk"),
+				max:   ik("llllll"),
 			},
 			{
 				level: 1,
 				num:   6,
 				size:  100,
-				min:   []byte("mmmmmm"),
-				max:   []byte("nnnnnn"),
+				min:   ik("mmmmmm"),
+				max:   ik("nnnnnn"),
 			},
 		},
 		dlRecords: []dlRecord{
@@ -0,0 +1,209 @@
+package myleveldb
+
+import (
+	"encoding/binary"
+	"myleveldb/cache"
+	"myleveldb/collections"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+多个db共享的memdb内存预算
+
+同一个进程中打开多个db时, 每个db的memdb各自按照WriteBuffer切换, 总的内存跟db的个数成正比,
+多个db设置同一个WriteBufferManager后, 所有db的memdb(包括正在落地的frozenMemDb)共享一个预算:
+
+1. 每个db写入之后以及frozenMemDb落地之后上报自己memdb实际分配的内存, 以及memdb中已经写入的kv大小,
+   LLRBTree在创建时按照容量一次分配buffer, skiplist的arena按chunk增长, 包括node的header以及tower,
+   实际分配的内存远大于写入的kv大小, 预算以及block cache的占用都按照实际分配的内存计算
+2. 总用量超过预算时, 选择memdb(不包括frozenMemDb)写入最多的db, 在后台拿到它的写锁执行rotateMem,
+   frozenMemDb落地之后内存被释放
+
+	mutable > bufferSize * 7/8                      memdb增长过快, 提前切换
+	used >= bufferSize && mutable >= bufferSize/2   总用量超过预算, 并且切换memdb可以释放足够的内存
+
+   used为实际分配的内存, mutable为memdb中写入的kv大小, 新的memdb同样需要分配内存,
+   切换几乎为空的memdb不能释放内存, 所以是否切换按照写入的大小判断, 避免不断切换出很小的memdb
+3. 设置了block cache时, memdb的用量以固定大小的占位节点固定在block cache中,
+   memdb越大, block cache中可以缓存的block越少, memdb和block cache的总内存不超过block cache的容量
+**/
+
+const (
+	writeBufferChargeSize = 256 << 10 // block cache中每个占位节点的大小
+)
+
+// WriteBufferManager 多个db共享的memdb内存预算, 通过Options.WriteBufferManager设置
+type WriteBufferManager struct {
+	bufferSize int64
+	cache      cache.Cache
+	ns         uint32
+
+	mu      sync.Mutex
+	usages  map[*DB]memUsage
+	used    int64 // 所有db的memdb以及frozenMemDb实际分配的内存
+	mutable int64 // 所有db的memdb中写入的kv大小
+	charged []*collections.PinnedHandle
+}
+
+// 一个db中所有family的memdb的用量
+type memUsage struct {
+	mutable int64 // memdb中写入的kv大小
+	total   int64 // memdb以及frozenMemDb实际分配的内存
+}
+
+// NewWriteBufferManager bufferSize为所有db的memdb总共可以使用的内存,
+// blockCache不为nil时memdb的用量计入blockCache的容量, 通常与Options.BlockCache为同一个缓存
+func NewWriteBufferManager(bufferSize int64, blockCache cache.Cache) *WriteBufferManager {
+	m := &WriteBufferManager{
+		bufferSize: bufferSize,
+		cache:      blockCache,
+		usages:     make(map[*DB]memUsage),
+	}
+	if blockCache != nil {
+		m.ns = cache.NewNamespace()
+	}
+	return m
+}
+
+// BufferSize 所有db的memdb总共可以使用的内存
+func (m *WriteBufferManager) BufferSize() int64 {
+	return m.bufferSize
+}
+
+// MemoryUsage 所有db的memdb以及frozenMemDb实际分配的内存
+func (m *WriteBufferManager) MemoryUsage() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used
+}
+
+// 更新db的用量, 超过预算时在后台切换memdb最大的db
+func (m *WriteBufferManager) update(db *DB, usage memUsage) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.usages[db]
+	m.usages[db] = usage
+	m.used += usage.total - old.total
+	m.mutable += usage.mutable - old.mutable
+	m.charge()
+
+	if !m.shouldFlush() {
+		return
+	}
+
+	var (
+		target  *DB
+		largest int64
+	)
+	for d, u := range m.usages {
+		if u.mutable > largest && atomic.LoadUint32(&d.wbmFlushing) == 0 {
+			target, largest = d, u.mutable
+		}
+	}
+	if target != nil && atomic.CompareAndSwapUint32(&target.wbmFlushing, 0, 1) {
+		go target.flushForWriteBuffer()
+	}
+}
+
+func (m *WriteBufferManager) shouldFlush() bool {
+	if m.bufferSize <= 0 {
+		return false
+	}
+	if m.mutable > m.bufferSize-m.bufferSize/8 {
+		return true
+	}
+	return m.used >= m.bufferSize && m.mutable >= m.bufferSize/2
+}
+
+// db关闭时删掉它的用量
+func (m *WriteBufferManager) remove(db *DB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage := m.usages[db]
+	delete(m.usages, db)
+	m.used -= usage.total
+	m.mutable -= usage.mutable
+	m.charge()
+}
+
+// 调整block cache中占位节点的个数, 使占位节点的总大小不小于used, 需要持有mu
+func (m *WriteBufferManager) charge() {
+
+	if m.cache == nil {
+		return
+	}
+
+	for int64(len(m.charged))*writeBufferChargeSize < m.used {
+		key := make([]byte, 8)
+		binary.LittleEndian.PutUint64(key, uint64(len(m.charged)))
+		h, err := m.cache.Pin(m.ns, key, func() (int64, collections.Value, collections.BucketNodeDeleterCallback, error) {
+			return writeBufferChargeSize, &writeBufferCharge{}, nil, nil
+		})
+		if err != nil {
+			return
+		}
+		m.charged = append(m.charged, h)
+	}
+
+	for n := len(m.charged); n > 0 && int64(n-1)*writeBufferChargeSize >= m.used; n-- {
+		m.charged[n-1].UnRef()
+		m.charged = m.charged[:n-1]
+		key := make([]byte, 8)
+		binary.LittleEndian.PutUint64(key, uint64(n-1))
+		_, _ = m.cache.Delete(m.ns, key)
+	}
+}
+
+// block cache中的占位节点
+type writeBufferCharge struct{}
+
+// 所有family的memdb写入的kv大小, 以及memdb和frozenMemDb实际分配的内存
+func (db *DB) memUsage() memUsage {
+	db.memMu.Lock()
+	defer db.memMu.Unlock()
+
+	var usage memUsage
+	for _, cf := range db.s.listFamilies() {
+		if cf.memDb != nil {
+			usage.mutable += int64(cf.memDb.Len())
+			usage.total += int64(cf.memDb.Allocated())
+		}
+		if cf.frozenMemDb != nil {
+			usage.total += int64(cf.frozenMemDb.Allocated())
+		}
+	}
+	return usage
+}
+
+// 向WriteBufferManager上报memdb的用量
+func (db *DB) reportMemUsage() {
+	if db.wbm != nil {
+		db.wbm.update(db, db.memUsage())
+	}
+}
+
+// WriteBufferManager超过预算时在后台执行, 拿到写锁后切换memdb
+func (db *DB) flushForWriteBuffer() {
+
+	defer atomic.StoreUint32(&db.wbmFlushing, 0)
+
+	select {
+	case db.writeMerge.writeLock <- struct{}{}:
+	case <-db.writeMerge.closedC:
+		return
+	}
+	defer func() {
+		<-db.writeMerge.writeLock
+	}()
+
+	if db.memUsage().mutable == 0 {
+		return
+	}
+	if err := db.rotateMem(nil, false); err == nil {
+		db.reportMemUsage()
+	}
+}
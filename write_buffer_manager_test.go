@@ -0,0 +1,38 @@
+package myleveldb
+
+import (
+	"testing"
+
+	"myleveldb/collections"
+	"myleveldb/memdb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBufferManager_ChargeAllocatedMemory(t *testing.T) {
+
+	blockCache := collections.NewShardedLRUCache(64<<20, 2)
+	defer blockCache.Close()
+	wbm := NewWriteBufferManager(32<<20, blockCache)
+
+	// LLRBTree在创建时按照容量分配buffer, 只写入一条记录也按照整个buffer计算
+	tree := openTestDB(t, t.TempDir(), &Options{WriteBuffer: 1 << 20, WriteBufferManager: wbm})
+	assert.Nil(t, tree.Put([]byte("k"), []byte("v")))
+	assert.True(t, wbm.MemoryUsage() >= 1<<20, "usage %d", wbm.MemoryUsage())
+
+	// skiplist的arena按chunk分配, 第一个chunk就可以放下整个buffer
+	list := openTestDB(t, t.TempDir(), &Options{WriteBuffer: 1 << 20, MemDbType: memdb.TypeSkipList, WriteBufferManager: wbm})
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, list.Put(testKey(i), testValue(i, 16)))
+	}
+	assert.True(t, wbm.MemoryUsage() >= 2<<20, "usage %d", wbm.MemoryUsage())
+
+	// block cache中固定的占位节点不小于实际分配的内存
+	stats := blockCache.Stats()
+	assert.True(t, stats.Pinned >= wbm.MemoryUsage(), "pinned %d, usage %d", stats.Pinned, wbm.MemoryUsage())
+
+	assert.Nil(t, tree.Close())
+	assert.Nil(t, list.Close())
+	assert.Equal(t, int64(0), wbm.MemoryUsage())
+	assert.Equal(t, int64(0), blockCache.Stats().Pinned)
+}
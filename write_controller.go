@@ -0,0 +1,323 @@
+package myleveldb
+
+import (
+	error2 "myleveldb/error"
+	"sync"
+	"time"
+)
+
+/**
+写入限速
+
+每次写入之前根据每个family当前的version计算限速状态, 取所有family中最严重的:
+
+	level0 >= Level0StopWritesTrigger 或者 pending >= HardPendingCompactionBytesLimit   暂停(stopped)
+	level0 >= Level0SlowdownWritesTrigger 或者 pending >= SoftPendingCompactionBytesLimit 限速(delayed)
+
+pending为version估算的待compaction的字节数. 限速时每秒可以写入的字节数:
+
+	rate = DelayedWriteRate * min((stop-level0)/(stop-slowdown), (hard-pending)/(hard-soft))
+
+刚开始限速时为DelayedWriteRate, 越接近暂停的条件越低, 最低为minDelayedWriteRate.
+
+1. 限速使用令牌桶, 令牌按照rate持续增加, 最多累积delayBurstInterval的量, 写入n个字节消耗n个令牌,
+   令牌不足时在写锁中休眠补足令牌需要的时长, 写入是串行的, 所以所有写入的总速度不超过rate
+2. 暂停时通知compaction并等待它使写入恢复, 如果当前没有需要做的compaction(例如level0刚好达到阈值),
+   等待不会有进展, 继续写入直到满足compaction的条件
+3. 设置了NoSlowdown时, 需要休眠或者暂停的写入直接返回error2.ErrBusy
+4. 状态或者原因变化时调用OnWriteStall, 当前状态以及累计的等待通过DBStats.WriteStall获取
+**/
+
+const (
+	delayBurstInterval = time.Millisecond // 令牌桶最多累积的时长
+)
+
+// WriteStallCondition 写入的限速状态
+type WriteStallCondition int
+
+const (
+	WriteStallNormal  WriteStallCondition = iota // 不限速
+	WriteStallDelayed                            // 限速
+	WriteStallStopped                            // 暂停, 等待compaction
+)
+
+func (c WriteStallCondition) String() string {
+	switch c {
+	case WriteStallDelayed:
+		return "delayed"
+	case WriteStallStopped:
+		return "stopped"
+	}
+	return "normal"
+}
+
+// WriteStallCause 限速或者暂停的原因
+type WriteStallCause int
+
+const (
+	WriteStallCauseNone                   WriteStallCause = iota
+	WriteStallCauseLevel0Files                            // level0文件数达到阈值
+	WriteStallCausePendingCompactionBytes                 // 待compaction的字节数达到阈值
+)
+
+func (c WriteStallCause) String() string {
+	switch c {
+	case WriteStallCauseLevel0Files:
+		return "level0 files"
+	case WriteStallCausePendingCompactionBytes:
+		return "pending compaction bytes"
+	}
+	return "none"
+}
+
+// WriteStallInfo 限速状态变化时传给Options.OnWriteStall
+type WriteStallInfo struct {
+	Family           string // 状态最严重的family
+	Condition        WriteStallCondition
+	Prev             WriteStallCondition // 变化之前的状态
+	Cause            WriteStallCause
+	DelayedWriteRate int64 // 限速时每秒可以写入的字节数
+}
+
+// WriteStallStats 写入限速的统计
+type WriteStallStats struct {
+	Condition              WriteStallCondition
+	Cause                  WriteStallCause
+	DelayedWriteRate       int64 // 限速时每秒可以写入的字节数
+	Level0Files            int   // 状态最严重的family的level0文件数
+	PendingCompactionBytes int64 // 状态最严重的family估算的待compaction的字节数
+
+	DelayedCount uint64        // 限速休眠的次数
+	DelayedTime  time.Duration // 限速休眠的总时长
+	StoppedCount uint64        // 暂停等待compaction的次数
+	StoppedTime  time.Duration // 暂停等待compaction的总时长
+	BusyCount    uint64        // 设置了NoSlowdown时返回ErrBusy的次数
+}
+
+// 某个时刻的限速状态
+type writeStall struct {
+	family    string
+	condition WriteStallCondition
+	cause     WriteStallCause
+	rate      int64
+	level0    int
+	pending   int64
+}
+
+// 比other更严重: 状态更严重, 或者都是限速时速度更低
+func (ws writeStall) worse(other writeStall) bool {
+	if ws.condition != other.condition {
+		return ws.condition > other.condition
+	}
+	return ws.condition == WriteStallDelayed && ws.rate < other.rate
+}
+
+// 根据family的version计算限速状态, maxRate为开始限速时的速度
+func (v *Version) writeStall(maxRate int64) writeStall {
+
+	opt := v.cf.opt
+	ws := writeStall{family: v.cf.name, pending: v.pendingBytes}
+	if len(v.levels) > 0 {
+		ws.level0 = len(v.levels[0])
+	}
+
+	slow, stop := opt.GetLevel0SlowdownWritesTrigger(), opt.GetLevel0StopWritesTrigger()
+	soft, hard := opt.GetSoftPendingCompactionBytesLimit(), opt.GetHardPendingCompactionBytesLimit()
+
+	switch {
+	case ws.level0 >= stop:
+		ws.condition, ws.cause = WriteStallStopped, WriteStallCauseLevel0Files
+		return ws
+	case hard > 0 && ws.pending >= hard:
+		ws.condition, ws.cause = WriteStallStopped, WriteStallCausePendingCompactionBytes
+		return ws
+	}
+
+	factor := 1.0
+	if ws.level0 >= slow {
+		ws.condition, ws.cause = WriteStallDelayed, WriteStallCauseLevel0Files
+		factor = float64(stop-ws.level0) / float64(stop-slow)
+	}
+	if soft > 0 && ws.pending >= soft {
+		f := 1.0
+		if hard > soft {
+			f = float64(hard-ws.pending) / float64(hard-soft)
+		}
+		if ws.condition == WriteStallNormal || f < factor {
+			ws.condition, ws.cause, factor = WriteStallDelayed, WriteStallCausePendingCompactionBytes, f
+		}
+	}
+
+	if ws.condition == WriteStallDelayed {
+		ws.rate = int64(float64(maxRate) * factor)
+		if ws.rate < minDelayedWriteRate {
+			ws.rate = minDelayedWriteRate
+		}
+	}
+	return ws
+}
+
+// 写入限速的状态以及令牌桶
+type writeController struct {
+	maxRate    int64
+	noSlowdown bool
+	onStall    func(info WriteStallInfo)
+
+	mu     sync.Mutex
+	state  writeStall
+	tokens float64   // 可以写入的字节数, 休眠中的写入预先消耗时为负数
+	last   time.Time // 上次补充令牌的时间
+	stats  WriteStallStats
+}
+
+func newWriteController(opt *Options) *writeController {
+	return &writeController{
+		maxRate:    opt.GetDelayedWriteRate(),
+		noSlowdown: opt.GetNoSlowdown(),
+		onStall:    opt.GetOnWriteStall(),
+	}
+}
+
+// 更新限速状态, 状态或者原因变化时回调OnWriteStall
+func (wc *writeController) update(ws writeStall) {
+
+	wc.mu.Lock()
+	prev := wc.state
+	wc.state = ws
+	if ws.condition != WriteStallDelayed {
+		wc.tokens, wc.last = 0, time.Time{}
+	} else if prev.condition != WriteStallDelayed {
+		wc.tokens, wc.last = 0, time.Now()
+	}
+	wc.mu.Unlock()
+
+	if wc.onStall != nil && (prev.condition != ws.condition || prev.cause != ws.cause) {
+		wc.onStall(WriteStallInfo{
+			Family:           ws.family,
+			Condition:        ws.condition,
+			Prev:             prev.condition,
+			Cause:            ws.cause,
+			DelayedWriteRate: ws.rate,
+		})
+	}
+}
+
+// 申请写入n个字节, 返回需要休眠的时长. noWait时令牌不足不消耗令牌, 由调用者返回ErrBusy
+func (wc *writeController) acquire(n int, noWait bool) time.Duration {
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	rate := float64(wc.state.rate)
+	if wc.state.condition != WriteStallDelayed || rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	wc.tokens += now.Sub(wc.last).Seconds() * rate
+	if burst := delayBurstInterval.Seconds() * rate; wc.tokens > burst {
+		wc.tokens = burst
+	}
+	wc.last = now
+
+	if wc.tokens >= float64(n) {
+		wc.tokens -= float64(n)
+		return 0
+	}
+
+	wait := time.Duration((float64(n) - wc.tokens) / rate * float64(time.Second))
+	if !noWait {
+		wc.tokens -= float64(n)
+	}
+	return wait
+}
+
+func (wc *writeController) addDelayed(d time.Duration) {
+	wc.mu.Lock()
+	wc.stats.DelayedCount++
+	wc.stats.DelayedTime += d
+	wc.mu.Unlock()
+}
+
+func (wc *writeController) addStopped(d time.Duration) {
+	wc.mu.Lock()
+	wc.stats.StoppedCount++
+	wc.stats.StoppedTime += d
+	wc.mu.Unlock()
+}
+
+func (wc *writeController) addBusy() {
+	wc.mu.Lock()
+	wc.stats.BusyCount++
+	wc.mu.Unlock()
+}
+
+func (wc *writeController) getStats() WriteStallStats {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	stats := wc.stats
+	stats.Condition = wc.state.condition
+	stats.Cause = wc.state.cause
+	stats.DelayedWriteRate = wc.state.rate
+	stats.Level0Files = wc.state.level0
+	stats.PendingCompactionBytes = wc.state.pending
+	return stats
+}
+
+// 根据所有family当前的version重新计算限速状态
+func (db *DB) refreshWriteStall() writeStall {
+
+	var ws writeStall
+	for _, cf := range db.s.listFamilies() {
+		v := cf.version()
+		if v == nil {
+			continue
+		}
+		s := v.writeStall(db.wc.maxRate)
+		v.unRef()
+		if s.worse(ws) || ws.family == "" {
+			ws = s
+		}
+	}
+
+	db.wc.update(ws)
+	return ws
+}
+
+// 限速状态下写入n个字节之前休眠
+func (db *DB) delayWrite(n int, ws writeStall) error {
+
+	wait := db.wc.acquire(n, db.wc.noSlowdown)
+	if wait <= 0 {
+		return nil
+	}
+	if db.wc.noSlowdown {
+		db.wc.addBusy()
+		return error2.NewErrBusy(ws.cause.String(), false, wait)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-db.closeC:
+		return error2.ErrClosed
+	}
+	db.wc.addDelayed(wait)
+	return nil
+}
+
+// 暂停状态下等待compaction使写入恢复
+func (db *DB) stopWrite(ws writeStall) error {
+
+	if db.wc.noSlowdown {
+		db.wc.addBusy()
+		return error2.NewErrBusy(ws.cause.String(), true, 0)
+	}
+
+	start := time.Now()
+	err := db.compTriggerWait(db.tcompCmdC)
+	db.wc.addStopped(time.Since(start))
+	return err
+}
@@ -3,7 +3,6 @@ package myleveldb
 import (
 	"bytes"
 	error2 "myleveldb/error"
-	"myleveldb/memdb"
 	"sync"
 )
 
@@ -18,8 +17,14 @@ var (
 )
 
 type WithBatch struct {
-	makeRoomForWrite func(n int) (*memdb.MemDB, int, error)
-	writeBatch       func(b *Batch, memDb *memdb.MemDB, mdbFree int) error
+	makeRoomForWrite func(need map[uint32]int) (int, error)
+	writeBatch       func(b *Batch, mdbFree int) error
+
+	// 以下用于memdb支持并发写入的场景, concurrent为nil或者返回false时由leader通过writeBatch写入整个batch
+	concurrent   func(b *Batch) bool
+	writeJournal func(b *Batch) (seq uint64, err error)    // 写入journal, 返回batch第一条entry的seq
+	putEntry     func(b *Batch, idx int, seq uint64) error // 将batch中第idx条entry写入memdb
+	publish      func(b *Batch, mdbFree int) error         // 所有entry写入memdb后, 更新可见的seq
 }
 
 func getWriteBatch() *Batch {
@@ -31,12 +36,28 @@ func putWriteBatch(batch *Batch) {
 	writeBatchPool.Put(batch)
 }
 
+/**
+合并写
+
+拿到写锁的writer成为leader, 其他writer把自己的entry交给leader合并到同一个batch中
+
+1. memdb不支持并发写入时, leader写入journal以及memdb, 然后通知所有成员写入结果
+2. memdb支持并发写入时, leader写入journal并分配seq后, 通知所有成员并发写入memdb,
+   所有成员(包括leader)写完后, leader才更新可见的seq, 然后成员返回
+
+	leader   journal ─┬─ put entry0 ─┐
+	member1           ├─ put entry1 ─┼─ wait ─ publish seq ─ done
+	member2           └─ put entry2 ─┘
+
+成员拿到的不一定是自己的entry, 只需要保证每条entry恰好被写入一次
+**/
+
 // WriteMerge 合并写
 type WriteMerge struct {
 	writeMergeC  chan writeMerge
 	writeMergedC chan bool
 	writeLock    chan struct{}
-	writeAck     chan error
+	writeAck     chan writeAck
 	closedC      chan struct{}
 }
 
@@ -45,7 +66,7 @@ func NewWriteMerge() *WriteMerge {
 		writeMergeC:  make(chan writeMerge),
 		writeMergedC: make(chan bool),
 		writeLock:    make(chan struct{}, 1),
-		writeAck:     make(chan error),
+		writeAck:     make(chan writeAck),
 		closedC:      make(chan struct{}),
 	}
 	return wm
@@ -56,6 +77,54 @@ type writeMerge struct {
 	key, value []byte
 }
 
+// leader发给成员的结果, group不为nil时成员需要写入group.batch中第idx条entry
+type writeAck struct {
+	err   error
+	group *writeGroup
+	idx   int
+}
+
+// 一次并发写入memdb的合并写
+type writeGroup struct {
+	batch    *Batch
+	seq      uint64
+	putEntry func(b *Batch, idx int, seq uint64) error
+
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+	done chan struct{} // leader更新seq后关闭
+}
+
+func newWriteGroup(batch *Batch, seq uint64, withBatch *WithBatch) *writeGroup {
+	g := &writeGroup{
+		batch:    batch,
+		seq:      seq,
+		putEntry: withBatch.putEntry,
+		done:     make(chan struct{}),
+	}
+	g.wg.Add(int(batch.BatchLen()))
+	return g
+}
+
+func (g *writeGroup) put(idx int) {
+	defer g.wg.Done()
+	if err := g.putEntry(g.batch, idx, g.seq); err != nil {
+		g.mu.Lock()
+		if g.err == nil {
+			g.err = err
+		}
+		g.mu.Unlock()
+	}
+}
+
+// 成员写入entry后等待leader更新seq, 保证返回后可以读到自己的写入
+func (g *writeGroup) putAndWait(idx int) error {
+	g.put(idx)
+	<-g.done
+	return g.err
+}
+
 // Put 写入单条记录, 支持并发合并写
 func (wb *WriteMerge) Put(kt keyType, key, value []byte, withBatch *WithBatch) error {
 
@@ -63,7 +132,11 @@ func (wb *WriteMerge) Put(kt keyType, key, value []byte, withBatch *WithBatch) e
 
 	case wb.writeMergeC <- writeMerge{kt, key, value}:
 		if <-wb.writeMergedC {
-			return <-wb.writeAck
+			ack := <-wb.writeAck
+			if ack.group != nil {
+				return ack.group.putAndWait(ack.idx)
+			}
+			return ack.err
 		}
 
 	case <-wb.closedC:
@@ -74,7 +147,7 @@ func (wb *WriteMerge) Put(kt keyType, key, value []byte, withBatch *WithBatch) e
 	}
 
 	batch := getWriteBatch()
-	batch.appendEntry(kt, key, value)
+	batch.appendEntry(defaultColumnFamilyID, kt, key, value)
 	return wb.writeLocked(batch, withBatch)
 }
 
@@ -84,11 +157,10 @@ func (wm *WriteMerge) writeLocked(batch *Batch, withBatch *WithBatch) error {
 		panic("withBatch cb 不能为空")
 	}
 
-	mdb, mdbFree, err := withBatch.makeRoomForWrite(batch.internalLen)
+	mdbFree, err := withBatch.makeRoomForWrite(batch.familyLen())
 	if err != nil {
-		return err
+		return wm.unLockWrite(false, 0, err)
 	}
-	defer mdb.UnRef()
 
 	var (
 		mergeLimit int
@@ -123,7 +195,7 @@ merge:
 				break merge
 			}
 
-			batch.appendEntry(kt, k, v)
+			batch.appendEntry(defaultColumnFamilyID, kt, k, v)
 
 			wm.writeMergedC <- true
 			merged++
@@ -135,17 +207,45 @@ merge:
 
 	defer putWriteBatch(batch)
 
-	if err := withBatch.writeBatch(batch, mdb, mdbFree); err != nil {
+	if merged > 0 && withBatch.concurrent != nil && withBatch.concurrent(batch) {
+		return wm.writeConcurrent(batch, mdbFree, overflow, merged, withBatch)
+	}
+
+	if err := withBatch.writeBatch(batch, mdbFree); err != nil {
 		return wm.unLockWrite(overflow, merged, err)
 	}
 
 	return wm.unLockWrite(overflow, merged, nil)
 }
 
+// leader写入journal后, 所有成员并发写入memdb, 全部完成后再更新seq
+func (wm *WriteMerge) writeConcurrent(batch *Batch, mdbFree int, overflow bool, merged int, withBatch *WithBatch) error {
+
+	seq, err := withBatch.writeJournal(batch)
+	if err != nil {
+		return wm.unLockWrite(overflow, merged, err)
+	}
+
+	// batch中第0条是leader自己的entry, 其余的分给成员
+	g := newWriteGroup(batch, seq, withBatch)
+	for i := 1; i <= merged; i++ {
+		wm.writeAck <- writeAck{group: g, idx: i}
+	}
+	g.put(0)
+	g.wg.Wait()
+
+	if g.err == nil {
+		g.err = withBatch.publish(batch, mdbFree)
+	}
+	close(g.done)
+
+	return wm.unLockWrite(overflow, 0, g.err)
+}
+
 func (wm *WriteMerge) unLockWrite(overflow bool, merged int, err error) error {
 
 	for i := 0; i < merged; i++ {
-		wm.writeAck <- err
+		wm.writeAck <- writeAck{err: err}
 	}
 
 	if overflow {
@@ -3,6 +3,8 @@ package myleveldb
 import (
 	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestWriteMerge_Put(t *testing.T) {
@@ -11,10 +13,17 @@ func TestWriteMerge_Put(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(200)
 
-	withBatch := func(batch *Batch) error {
-		t.Logf("batchs %#v", batch.index)
-		t.Logf("batchs len %d", len(batch.index))
-		return nil
+	var written, batches int
+	withBatch := &WithBatch{
+		makeRoomForWrite: func(need map[uint32]int) (int, error) {
+			return 1 << 20, nil
+		},
+		writeBatch: func(batch *Batch, mdbFree int) error {
+			// leader持有写锁时调用, 不需要加锁
+			written += int(batch.BatchLen())
+			batches++
+			return nil
+		},
 	}
 
 	for i := 0; i < 200; i++ {
@@ -23,11 +32,14 @@ func TestWriteMerge_Put(t *testing.T) {
 			defer wg.Done()
 
 			for i := 0; i < 10; i++ {
-				wm.Put(keyTypeVal, []byte("hello"), []byte("world"), withBatch)
+				assert.Nil(t, wm.Put(keyTypeVal, []byte("hello"), []byte("world"), withBatch))
 			}
 		}()
 	}
 
 	wg.Wait()
 
+	assert.Equal(t, 2000, written)
+	assert.True(t, batches <= written)
+	t.Logf("batches %d", batches)
 }